@@ -0,0 +1,114 @@
+// Command homebar-monitor shows the state of a running cluster in the
+// terminal. It polls every node's coordinator for its Raft status and log,
+// and its API for the election counter, and redraws the screen each time:
+//
+//	go run ./cmd/homebar-monitor
+//	go run ./cmd/homebar-monitor -coordinators http://10.0.0.1:8091,http://10.0.0.2:8092
+//	go run ./cmd/homebar-monitor -topology topology.json
+//
+// With -topology, or RAFT_TOPOLOGY_FILE set, the coordinators of the nodes
+// in the cluster topology are polled. Members that join later are found
+// through the coordinators' /cluster/status.
+// With -json the monitor prints one JSON snapshot per line instead, and with
+// -once it prints a single snapshot and exits, for use in scripts:
+//
+//	go run ./cmd/homebar-monitor -once | jq .leader
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kexincchen/homebar/internal/raft"
+)
+
+func main() {
+	coordinators := flag.String("coordinators", "http://localhost:8091,http://localhost:8092,http://localhost:8093",
+		"comma-separated coordinator addresses to poll")
+	topologyFile := flag.String("topology", os.Getenv("RAFT_TOPOLOGY_FILE"),
+		"cluster topology file whose coordinators to poll, instead of -coordinators")
+	interval := flag.Duration("interval", time.Second, "time between polls")
+	timeout := flag.Duration("timeout", 800*time.Millisecond, "time a node has to answer one request")
+	entries := flag.Int("entries", 10, "number of recent log entries to show")
+	history := flag.Int("history", 10, "number of leader changes and election events to keep")
+	asJSON := flag.Bool("json", false, "print a JSON snapshot per poll instead of drawing the screen")
+	once := flag.Bool("once", false, "print a single JSON snapshot and exit")
+	flag.Parse()
+
+	var addrs []string
+	if *topologyFile != "" {
+		data, err := os.ReadFile(*topologyFile)
+		if err != nil {
+			log.Fatalf("Failed to read topology: %v", err)
+		}
+		topology, err := raft.ParseTopology(data)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		for _, id := range topology.IDs() {
+			if addr := topology.Addresses(id, "").Coordinator; addr != "" {
+				addrs = append(addrs, strings.TrimSuffix(addr, "/"))
+			}
+		}
+	} else {
+		for _, addr := range strings.Split(*coordinators, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addrs = append(addrs, strings.TrimSuffix(addr, "/"))
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		log.Fatalf("no coordinator addresses given")
+	}
+	if *interval <= 0 || *entries < 0 || *history <= 0 {
+		log.Fatalf("-interval and -history must be positive, -entries must not be negative")
+	}
+
+	m := newMonitor(addrs, *timeout, *entries, *history)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *once {
+		if err := json.NewEncoder(os.Stdout).Encode(m.poll(ctx)); err != nil {
+			log.Fatalf("Failed to write snapshot: %v", err)
+		}
+		return
+	}
+
+	screen := newScreen(os.Stdout)
+	if !*asJSON {
+		screen.start()
+		defer screen.stop()
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		snapshot := m.poll(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if *asJSON {
+			if err := enc.Encode(snapshot); err != nil {
+				log.Fatalf("Failed to write snapshot: %v", err)
+			}
+		} else {
+			screen.draw(snapshot)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
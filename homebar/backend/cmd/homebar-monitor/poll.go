@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kexincchen/homebar/internal/raft"
+)
+
+// snapshot is the cluster as seen in one poll, printed as is in headless mode
+type snapshot struct {
+	Time        time.Time      `json:"time"`
+	Leader      string         `json:"leader"`       // Empty when no reachable node leads
+	Term        uint64         `json:"term"`         // Highest term of any reachable node
+	CommitIndex uint64         `json:"commit_index"` // Leader's commit index
+	Nodes       []nodeView     `json:"nodes"`
+	Entries     []entryView    `json:"entries"`                // Most recent entries in the log of EntriesFrom
+	EntriesFrom string         `json:"entries_from,omitempty"` // The leader, or the node with the longest log without one
+	Timeline    []leaderChange `json:"timeline"`               // Leader and term changes seen, oldest first
+	Events      []event        `json:"events"`                 // Elections and nodes going down or up, oldest first
+}
+
+// nodeView is one node in a snapshot
+type nodeView struct {
+	ID             string         `json:"id,omitempty"` // Empty until the node has answered once
+	Coordinator    string         `json:"coordinator"`
+	API            string         `json:"api,omitempty"`
+	Reachable      bool           `json:"reachable"`
+	Error          string         `json:"error,omitempty"`
+	State          raft.NodeState `json:"state,omitempty"`
+	Role           string         `json:"role,omitempty"`
+	LeaderID       string         `json:"leader,omitempty"` // Leader as known to this node
+	Term           uint64         `json:"term"`
+	CommitIndex    uint64         `json:"commit_index"`
+	AppliedIndex   uint64         `json:"applied_index"`
+	LastLogIndex   uint64         `json:"last_log_index"`
+	CommitLag      uint64         `json:"commit_lag"`                // Entries committed on the leader but not known committed here
+	ApplyLag       uint64         `json:"apply_lag"`                 // Entries committed on the leader but not applied here
+	ReplicationLag *uint64        `json:"replication_lag,omitempty"` // Leader's entries not replicated here, as the leader sees it
+	Elections      *uint64        `json:"elections,omitempty"`       // Elections the node started, from raft_elections_total
+}
+
+// entryView is a log entry as listed by /cluster/logs
+type entryView struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Type  string `json:"type"` // noop, configuration or the command type
+}
+
+// leaderChange records the leader and term from one poll on
+type leaderChange struct {
+	Time   time.Time `json:"time"`
+	Term   uint64    `json:"term"`
+	Leader string    `json:"leader"` // Empty while no leader was reachable
+}
+
+// Kinds of events
+const (
+	eventElection = "election"
+	eventLeader   = "leader"
+	eventDown     = "down"
+	eventUp       = "up"
+)
+
+// event is something that happened to one node between two polls
+type event struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Node    string    `json:"node"`
+	Term    uint64    `json:"term"`
+	Message string    `json:"message"`
+}
+
+// monitor polls the cluster and remembers what it saw, to derive the
+// timeline and events from the difference between two polls
+type monitor struct {
+	client       *http.Client
+	coordinators []string // Coordinator addresses, given ones first, then discovered ones
+	known        map[string]bool
+	entries      int
+	history      int
+
+	prev     map[string]nodeView // Previous view of every coordinator, by address
+	timeline []leaderChange
+	events   []event
+}
+
+func newMonitor(coordinators []string, timeout time.Duration, entries, history int) *monitor {
+	m := &monitor{
+		client:  &http.Client{Timeout: timeout},
+		known:   make(map[string]bool),
+		entries: entries,
+		history: history,
+		prev:    make(map[string]nodeView),
+	}
+	for _, addr := range coordinators {
+		m.addCoordinator(addr)
+	}
+	return m
+}
+
+func (m *monitor) addCoordinator(addr string) {
+	if addr == "" || m.known[addr] {
+		return
+	}
+	m.known[addr] = true
+	m.coordinators = append(m.coordinators, addr)
+}
+
+// nodePoll is what one coordinator answered
+type nodePoll struct {
+	view    nodeView
+	status  raft.Status
+	cluster raft.ClusterStatus
+}
+
+// poll asks every coordinator for its node's state and returns the cluster
+// as seen now
+func (m *monitor) poll(ctx context.Context) snapshot {
+	polls := make([]nodePoll, len(m.coordinators))
+	var wg sync.WaitGroup
+	for i, addr := range m.coordinators {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			polls[i] = m.pollNode(ctx, addr)
+		}(i, addr)
+	}
+	wg.Wait()
+
+	polls = m.dropDuplicates(polls)
+
+	s := snapshot{Time: time.Now()}
+	var leader *nodePoll
+	for i := range polls {
+		p := &polls[i]
+		if !p.view.Reachable {
+			continue
+		}
+		s.Term = max(s.Term, p.status.Term)
+		if p.status.State == raft.Leader && (leader == nil || p.status.Term > leader.status.Term) {
+			leader = p
+		}
+	}
+	// Members added since the monitor started are polled from the next round
+	for _, p := range polls {
+		for _, member := range p.cluster.Members {
+			if !m.polled(polls, member.ID) {
+				m.addCoordinator(strings.TrimSuffix(member.CoordinatorAddress, "/"))
+			}
+		}
+	}
+
+	if leader != nil {
+		s.Leader = leader.status.ID
+		s.CommitIndex = leader.status.CommitIndex
+	}
+	for i := range polls {
+		view := &polls[i].view
+		if leader != nil && view.Reachable {
+			view.CommitLag = leader.status.CommitIndex - min(view.CommitIndex, leader.status.CommitIndex)
+			view.ApplyLag = leader.status.CommitIndex - min(view.AppliedIndex, leader.status.CommitIndex)
+			if view.ID == leader.status.ID {
+				lag := uint64(0)
+				view.ReplicationLag = &lag
+			} else if progress, ok := leader.status.Peers[view.ID]; ok {
+				lag := leader.status.LastLogIndex - min(progress.MatchIndex, leader.status.LastLogIndex)
+				view.ReplicationLag = &lag
+			}
+		}
+		s.Nodes = append(s.Nodes, *view)
+	}
+	sort.SliceStable(s.Nodes, func(i, j int) bool {
+		a, b := s.Nodes[i], s.Nodes[j]
+		if a.ID == "" || b.ID == "" {
+			return a.ID != "" && b.ID == ""
+		}
+		return a.ID < b.ID
+	})
+
+	// Recent entries come from the leader's log, or without one from the
+	// node that got furthest
+	source := leader
+	if source == nil {
+		for i := range polls {
+			if polls[i].view.Reachable && (source == nil || polls[i].status.LastLogIndex > source.status.LastLogIndex) {
+				source = &polls[i]
+			}
+		}
+	}
+	s.Entries = []entryView{}
+	if source != nil && m.entries > 0 {
+		s.EntriesFrom = source.status.ID
+		if entries, err := m.fetchEntries(ctx, source.view.Coordinator, source.status.ID); err == nil {
+			s.Entries = entries
+		}
+	}
+
+	m.record(s, polls)
+	s.Timeline = append([]leaderChange(nil), m.timeline...)
+	s.Events = append([]event(nil), m.events...)
+	return s
+}
+
+// dropDuplicates stops polling a coordinator found to serve the same node
+// as one polled before it, as happens when a member's coordinator address
+// differs from the one given on the command line, such as 127.0.0.1 for
+// localhost
+func (m *monitor) dropDuplicates(polls []nodePoll) []nodePoll {
+	seen := make(map[string]bool)
+	kept := polls[:0]
+	for _, p := range polls {
+		if p.view.ID != "" && seen[p.view.ID] {
+			m.removeCoordinator(p.view.Coordinator)
+			continue
+		}
+		if p.view.ID != "" {
+			seen[p.view.ID] = true
+		}
+		kept = append(kept, p)
+	}
+	return kept
+}
+
+// polled reports whether a coordinator of the node is polled already
+func (m *monitor) polled(polls []nodePoll, nodeID string) bool {
+	for _, p := range polls {
+		if p.view.ID == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *monitor) removeCoordinator(addr string) {
+	for i, known := range m.coordinators {
+		if known == addr {
+			m.coordinators = append(m.coordinators[:i], m.coordinators[i+1:]...)
+			break
+		}
+	}
+	delete(m.prev, addr)
+	// Stays in known, so that it is not discovered again
+}
+
+// pollNode asks one coordinator for its node's state, and the node's API
+// for its election counter
+func (m *monitor) pollNode(ctx context.Context, addr string) nodePoll {
+	p := nodePoll{view: nodeView{Coordinator: addr, ID: m.prev[addr].ID}}
+
+	if err := m.getJSON(ctx, addr+"/cluster/self", &p.status); err != nil {
+		p.view.Error = err.Error()
+		return p
+	}
+	if err := m.getJSON(ctx, addr+"/cluster/status", &p.cluster); err != nil {
+		p.view.Error = err.Error()
+		return p
+	}
+
+	p.view.Reachable = true
+	p.view.ID = p.status.ID
+	p.view.State = p.status.State
+	p.view.Role = p.status.Role
+	p.view.LeaderID = p.status.LeaderID
+	p.view.Term = p.status.Term
+	p.view.CommitIndex = p.status.CommitIndex
+	p.view.AppliedIndex = p.status.AppliedIndex
+	p.view.LastLogIndex = p.status.LastLogIndex
+	for _, member := range p.cluster.Members {
+		if member.ID == p.status.ID {
+			p.view.API = member.Address
+		}
+	}
+
+	if p.view.API != "" {
+		if elections, err := m.fetchElections(ctx, p.view.API); err == nil {
+			p.view.Elections = &elections
+		}
+	}
+	return p
+}
+
+// fetchEntries returns the most recent entries in a node's log
+func (m *monitor) fetchEntries(ctx context.Context, coordinator, nodeID string) ([]entryView, error) {
+	query := url.Values{"node": {nodeID}, "limit": {strconv.Itoa(m.entries)}}
+	var entries []entryView
+	if err := m.getJSON(ctx, coordinator+"/cluster/logs?"+query.Encode(), &entries); err != nil {
+		return nil, err
+	}
+	// Newest first
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Index > entries[j].Index })
+	return entries, nil
+}
+
+// fetchElections reads raft_elections_total from a node's metrics
+func (m *monitor) fetchElections(ctx context.Context, api string) (uint64, error) {
+	resp, err := m.get(ctx, api+"/metrics")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "raft_elections_total") {
+			continue
+		}
+		fields := strings.Fields(line)
+		v, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse raft_elections_total: %w", err)
+		}
+		return uint64(v), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("raft_elections_total not found")
+}
+
+func (m *monitor) get(ctx context.Context, target string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s returned %s", target, resp.Status)
+	}
+	return resp, nil
+}
+
+func (m *monitor) getJSON(ctx context.Context, target string, v interface{}) error {
+	resp, err := m.get(ctx, target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", target, err)
+	}
+	return nil
+}
+
+// record adds the leader changes and events between the previous poll and
+// this one to the history
+func (m *monitor) record(s snapshot, polls []nodePoll) {
+	if n := len(m.timeline); n == 0 || m.timeline[n-1].Leader != s.Leader || m.timeline[n-1].Term != s.Term {
+		m.timeline = append(m.timeline, leaderChange{Time: s.Time, Term: s.Term, Leader: s.Leader})
+	}
+
+	for _, p := range polls {
+		view := p.view
+		prev, seen := m.prev[view.Coordinator]
+		m.prev[view.Coordinator] = view
+		name := view.ID
+		if name == "" {
+			name = view.Coordinator
+		}
+
+		switch {
+		case !view.Reachable:
+			if !seen || prev.Reachable {
+				m.addEvent(event{Time: s.Time, Kind: eventDown, Node: name, Term: prev.Term,
+					Message: fmt.Sprintf("node %s is not responding", name)})
+			}
+			continue
+		case seen && !prev.Reachable:
+			m.addEvent(event{Time: s.Time, Kind: eventUp, Node: name, Term: view.Term,
+				Message: fmt.Sprintf("node %s is back in term %d", name, view.Term)})
+		}
+
+		// The counter catches elections that started and ended between two
+		// polls; without it only a node still campaigning is noticed
+		if view.Elections != nil && prev.Elections != nil {
+			if started := *view.Elections - min(*prev.Elections, *view.Elections); started > 0 {
+				m.addEvent(event{Time: s.Time, Kind: eventElection, Node: name, Term: view.Term,
+					Message: fmt.Sprintf("node %s started %s, now %s in term %d", name, plural(started, "election"), view.State, view.Term)})
+			}
+		} else if view.State == raft.Candidate && (prev.State != raft.Candidate || prev.Term != view.Term) {
+			m.addEvent(event{Time: s.Time, Kind: eventElection, Node: name, Term: view.Term,
+				Message: fmt.Sprintf("node %s is campaigning in term %d", name, view.Term)})
+		}
+
+		if view.State == raft.Leader && (prev.State != raft.Leader || prev.Term != view.Term) {
+			m.addEvent(event{Time: s.Time, Kind: eventLeader, Node: name, Term: view.Term,
+				Message: fmt.Sprintf("node %s became leader in term %d", name, view.Term)})
+		}
+	}
+
+	if over := len(m.timeline) - m.history; over > 0 {
+		m.timeline = append([]leaderChange(nil), m.timeline[over:]...)
+	}
+	if over := len(m.events) - m.history; over > 0 {
+		m.events = append([]event(nil), m.events[over:]...)
+	}
+}
+
+func (m *monitor) addEvent(e event) {
+	m.events = append(m.events, e)
+}
+
+func plural(n uint64, word string) string {
+	if n == 1 {
+		return "an " + word
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
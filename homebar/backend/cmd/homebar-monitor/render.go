@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/kexincchen/homebar/internal/raft"
+)
+
+// ANSI escape sequences
+const (
+	altScreenOn  = "\033[?1049h\033[?25l" // Switch to the alternate screen and hide the cursor
+	altScreenOff = "\033[?25h\033[?1049l"
+	clearScreen  = "\033[H\033[2J"
+
+	red    = "\033[0;31m"
+	green  = "\033[0;32m"
+	yellow = "\033[0;33m"
+	blue   = "\033[0;34m"
+	cyan   = "\033[0;36m"
+	bold   = "\033[1m"
+	reset  = "\033[0m"
+)
+
+// screen draws snapshots on the terminal, replacing the previous one
+type screen struct {
+	out io.Writer
+}
+
+func newScreen(out io.Writer) *screen {
+	return &screen{out: out}
+}
+
+// start switches to the alternate screen, so the shell's screen comes back on exit
+func (s *screen) start() {
+	io.WriteString(s.out, altScreenOn)
+}
+
+func (s *screen) stop() {
+	io.WriteString(s.out, altScreenOff)
+}
+
+// draw renders a snapshot in one write, so the screen does not flicker
+func (s *screen) draw(snap snapshot) {
+	var b bytes.Buffer
+	b.WriteString(clearScreen)
+
+	fmt.Fprintf(&b, "%s%s===== Homebar Raft Cluster =====%s  %s\n\n", bold, blue, reset, snap.Time.Format("15:04:05"))
+	if snap.Leader != "" {
+		fmt.Fprintf(&b, "Leader: %snode %s%s   Term: %d   Commit index: %d\n\n", green+bold, snap.Leader, reset, snap.Term, snap.CommitIndex)
+	} else {
+		fmt.Fprintf(&b, "Leader: %snone reachable%s   Term: %d\n\n", red+bold, reset, snap.Term)
+	}
+
+	fmt.Fprintf(&b, "%s%-6s %-11s %-8s %6s %8s %8s %8s %9s %9s %9s  %s%s\n", bold,
+		"NODE", "STATE", "ROLE", "TERM", "COMMIT", "APPLIED", "LAST", "REPL LAG", "APPLY LAG", "ELECTIONS", "COORDINATOR", reset)
+	for _, n := range snap.Nodes {
+		id := n.ID
+		if id == "" {
+			id = "?"
+		}
+		if !n.Reachable {
+			fmt.Fprintf(&b, "%-6s %s  %s\n", id, paint(red, fmt.Sprintf("%-11s", "down")), n.Coordinator)
+			continue
+		}
+		fmt.Fprintf(&b, "%-6s %s %-8s %6d %8d %8d %8d %9s %s %9s  %s\n",
+			id, paint(stateColor(n.State), fmt.Sprintf("%-11s", n.State)), n.Role, n.Term,
+			n.CommitIndex, n.AppliedIndex, n.LastLogIndex, optional(n.ReplicationLag),
+			paint(lagColor(n.ApplyLag), fmt.Sprintf("%9d", n.ApplyLag)), optional(n.Elections), n.Coordinator)
+	}
+
+	fmt.Fprintf(&b, "\n%sLeader timeline%s\n", bold, reset)
+	for i := len(snap.Timeline) - 1; i >= 0; i-- {
+		change := snap.Timeline[i]
+		leader := paint(green, "node "+change.Leader)
+		if change.Leader == "" {
+			leader = paint(red, "no leader")
+		}
+		fmt.Fprintf(&b, "  %s  term %-5d %s\n", change.Time.Format("15:04:05"), change.Term, leader)
+	}
+
+	fmt.Fprintf(&b, "\n%sRecent log entries%s", bold, reset)
+	if snap.EntriesFrom != "" {
+		fmt.Fprintf(&b, " (node %s)", snap.EntriesFrom)
+	}
+	b.WriteString("\n")
+	if len(snap.Entries) == 0 {
+		b.WriteString("  none\n")
+	}
+	for _, e := range snap.Entries {
+		fmt.Fprintf(&b, "  %8d  term %-5d %s\n", e.Index, e.Term, e.Type)
+	}
+
+	fmt.Fprintf(&b, "\n%sElection events%s\n", bold, reset)
+	if len(snap.Events) == 0 {
+		b.WriteString("  none\n")
+	}
+	for i := len(snap.Events) - 1; i >= 0; i-- {
+		e := snap.Events[i]
+		fmt.Fprintf(&b, "  %s  %s\n", e.Time.Format("15:04:05"), paint(eventColor(e.Kind), e.Message))
+	}
+
+	fmt.Fprintf(&b, "\n%sPress Ctrl+C to exit the monitor%s\n", yellow, reset)
+	s.out.Write(b.Bytes())
+}
+
+func paint(color, s string) string {
+	if color == "" {
+		return s
+	}
+	return color + s + reset
+}
+
+func stateColor(state raft.NodeState) string {
+	switch state {
+	case raft.Leader:
+		return green + bold
+	case raft.Candidate:
+		return yellow
+	}
+	return blue
+}
+
+// lagColor marks a node that has not applied what the leader committed
+func lagColor(lag uint64) string {
+	switch {
+	case lag == 0:
+		return ""
+	case lag < raft.MaxAppendEntries:
+		return yellow
+	}
+	return red
+}
+
+func eventColor(kind string) string {
+	switch kind {
+	case eventLeader, eventUp:
+		return green
+	case eventElection:
+		return yellow
+	case eventDown:
+		return red
+	}
+	return cyan
+}
+
+// optional formats a value the monitor may not know
+func optional(v *uint64) string {
+	if v == nil {
+		return strings.Repeat(" ", 8) + "-"
+	}
+	return fmt.Sprintf("%9d", *v)
+}
@@ -0,0 +1,192 @@
+// Command raft-certs generates a local CA and a certificate for every Raft
+// node, for development clusters running with mutual TLS. Production
+// clusters should get their certificates from a real CA.
+//
+//	go run ./cmd/raft-certs -out certs -nodes 1,2,3
+//
+// writes ca.pem, ca-key.pem and node-<id>.pem, node-<id>-key.pem per node.
+// An existing CA in the output directory is reused, so certificates for
+// nodes added later are signed by the same CA.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func main() {
+	out := flag.String("out", "certs", "directory to write the certificates to")
+	nodes := flag.String("nodes", "1,2,3", "comma-separated node IDs to issue certificates for")
+	hosts := flag.String("hosts", "localhost,127.0.0.1", "comma-separated host names and IPs added to every node certificate")
+	validFor := flag.Duration("valid", 365*24*time.Hour, "validity of the issued certificates")
+	flag.Parse()
+
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		log.Fatalf("Failed to create %s: %v", *out, err)
+	}
+
+	ca, caKey, err := loadOrCreateCA(*out, *validFor)
+	if err != nil {
+		log.Fatalf("CA: %v", err)
+	}
+
+	for _, id := range splitList(*nodes) {
+		if err := issueNodeCert(*out, id, splitList(*hosts), ca, caKey, *validFor); err != nil {
+			log.Fatalf("Node %s: %v", id, err)
+		}
+		log.Printf("Wrote certificate for node %s", id)
+	}
+
+	fmt.Printf("\nStart each node with:\n")
+	fmt.Printf("  RAFT_TLS_CA=%s\n", filepath.Join(*out, "ca.pem"))
+	fmt.Printf("  RAFT_TLS_CERT=%s\n", filepath.Join(*out, "node-<id>.pem"))
+	fmt.Printf("  RAFT_TLS_KEY=%s\n", filepath.Join(*out, "node-<id>-key.pem"))
+}
+
+// loadOrCreateCA returns the CA in dir, creating a new one if there is none
+func loadOrCreateCA(dir string, validFor time.Duration) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+	if certErr == nil && keyErr == nil {
+		cert, err := parseCert(certPEM)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := parseKey(keyPEM)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("Using existing CA in %s", dir)
+		return cert, key, nil
+	}
+	if !errors.Is(certErr, os.ErrNotExist) || !errors.Is(keyErr, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("%s and %s must both exist or both be missing", certPath, keyPath)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: "homebar raft dev CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validFor),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	if err := writePEM(certPath, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	if err := writeKey(keyPath, key); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Created CA in %s", dir)
+
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+// issueNodeCert writes a certificate for the node, valid for serving and
+// dialing Raft RPCs. Its common name is the node ID, which peers check.
+func issueNodeCert(dir, id string, hosts []string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, validFor time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: id, OrganizationalUnit: []string{"homebar raft"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %w", err)
+	}
+	if err := writePEM(filepath.Join(dir, fmt.Sprintf("node-%s.pem", id)), "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	return writeKey(filepath.Join(dir, fmt.Sprintf("node-%s-key.pem", id)), key)
+}
+
+func serialNumber() *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		log.Fatalf("Failed to generate serial number: %v", err)
+	}
+	return n
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key: %w", err)
+	}
+	return writePEM(path, "EC PRIVATE KEY", der, 0600)
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, perm); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+func parseCert(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data in CA certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parseKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data in CA key")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,770 @@
+// Command raftctl inspects and repairs the Raft data of a stopped node. It
+// works on a node's data directory, such as raft-data/node-1, and reads
+// every storage engine; the engine is detected from the files found there
+// unless -storage names it.
+//
+//	raftctl info raft-data/node-1
+//	raftctl dump [-from N] [-to N] [-json] raft-data/node-1
+//	raftctl verify raft-data/node-1
+//	raftctl diff raft-data/node-1 raft-data/node-2
+//	raftctl truncate -from N [-force] raft-data/node-1
+//	raftctl snapshot export raft-data/node-1 snapshot.json
+//	raftctl snapshot import [-force] raft-data/node-1 snapshot.json
+//
+// The node must not be running: BoltStorage refuses to open a locked
+// database, the other engines would be read while they change.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/kexincchen/homebar/internal/command"
+	"github.com/kexincchen/homebar/internal/raft"
+)
+
+const usage = `raftctl inspects and repairs the Raft data of a stopped node.
+
+Usage:
+  raftctl info [-storage ENGINE] DIR                 Show state, configuration, snapshot and log range
+  raftctl dump [-storage ENGINE] [-from N] [-to N] [-json] DIR
+                                                     List log entries with their command types
+  raftctl verify [-storage ENGINE] DIR               Check index and term continuity of the log
+  raftctl diff [-storage ENGINE] DIR DIR             Find where the logs of two nodes diverge
+  raftctl truncate [-storage ENGINE] -from N [-force] DIR
+                                                     Discard log entries from index N onwards
+  raftctl snapshot export [-storage ENGINE] DIR FILE Write the node's snapshot to FILE (- for stdout)
+  raftctl snapshot import [-storage ENGINE] [-force] DIR FILE
+                                                     Replace the node's snapshot, discarding the log it covers
+
+DIR is a node's data directory, such as raft-data/node-1. ENGINE is file, wal
+or bolt and is detected from the files in DIR when omitted.
+`
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("raftctl: ")
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "info":
+		err = runInfo(args)
+	case "dump":
+		err = runDump(args)
+	case "verify":
+		err = runVerify(args)
+	case "diff":
+		err = runDiff(args)
+	case "truncate":
+		err = runTruncate(args)
+	case "snapshot":
+		err = runSnapshot(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	var failed errFailed
+	if errors.As(err, &failed) {
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// errFailed reports a check that found problems, which have been printed already
+type errFailed struct{}
+
+func (errFailed) Error() string { return "check failed" }
+
+// newFlags returns the flag set of a command with the -storage flag every command takes
+func newFlags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	engine := fs.String("storage", "", "storage engine: file, wal or bolt (detected when empty)")
+	return fs, engine
+}
+
+// nodeData is everything a node persisted
+type nodeData struct {
+	dir         string
+	engine      string
+	term        uint64
+	votedFor    string
+	lastApplied uint64
+	config      *raft.Configuration
+	snapshot    *raft.Snapshot
+	entries     []raft.LogEntry // As stored, in storage order
+	damage      []string        // Found by the read-only open and left in place
+}
+
+// open opens the storage in dir for writing and loads everything in it,
+// repairing what a crash left behind as a starting node would. The storage
+// stays open for commands that change it.
+func open(engine, dir string) (*nodeData, raft.Storage, error) {
+	storage, engine, err := raft.OpenNodeStorage(engine, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	d := &nodeData{dir: dir, engine: engine}
+	if err := d.read(storage); err != nil {
+		storage.Close()
+		return nil, nil, err
+	}
+	return d, storage, nil
+}
+
+// load reads everything a node persisted without changing any file. Damage
+// found on the way is kept for verify and printed as a warning by the other
+// commands.
+func load(engine, dir string) (*nodeData, error) {
+	storage, engine, damage, err := raft.OpenNodeStorageReadOnly(engine, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer storage.Close()
+
+	d := &nodeData{dir: dir, engine: engine, damage: damage}
+	if err := d.read(storage); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// warn prints the damage the read-only open found
+func (d *nodeData) warn() {
+	for _, problem := range d.damage {
+		fmt.Fprintf(os.Stderr, "warning: %s: %s, run verify\n", d.dir, problem)
+	}
+}
+
+// read loads the state, configuration, snapshot and log from storage
+func (d *nodeData) read(storage raft.Storage) error {
+	var err error
+	if d.term, d.votedFor, d.lastApplied, err = storage.LoadState(); err != nil {
+		return fmt.Errorf("failed to load state: %w", err)
+	}
+	if d.config, err = storage.LoadConfiguration(); err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	if d.snapshot, err = storage.LoadSnapshot(); err != nil {
+		return fmt.Errorf("failed to load snapshot: %w", err)
+	}
+	if d.entries, err = storage.LoadLog(); err != nil {
+		return fmt.Errorf("failed to load log: %w", err)
+	}
+	return nil
+}
+
+// snapshotIndex returns the index the snapshot covers, 0 without one
+func (d *nodeData) snapshotIndex() uint64 {
+	if d.snapshot == nil {
+		return 0
+	}
+	return d.snapshot.LastIncludedIndex
+}
+
+// log returns the entries after the snapshot by index, the way the node
+// restores them: a later copy of an index replaces an earlier one
+func (d *nodeData) log() map[uint64]raft.LogEntry {
+	entries := make(map[uint64]raft.LogEntry, len(d.entries))
+	for _, e := range d.entries {
+		if e.Index > d.snapshotIndex() {
+			entries[e.Index] = e
+		}
+	}
+	return entries
+}
+
+// bounds returns the first and last index of the log after the snapshot,
+// or snapshot index + 1 and the snapshot index when it is empty
+func (d *nodeData) bounds() (uint64, uint64) {
+	entries := d.log()
+	if len(entries) == 0 {
+		return d.snapshotIndex() + 1, d.snapshotIndex()
+	}
+	first, last := uint64(math.MaxUint64), uint64(0)
+	for index := range entries {
+		first, last = min(first, index), max(last, index)
+	}
+	return first, last
+}
+
+// logRange describes the indexes the log after the snapshot holds
+func (d *nodeData) logRange() string {
+	first, last := d.bounds()
+	if last < first {
+		return "empty"
+	}
+	return fmt.Sprintf("%d..%d (%d entries)", first, last, len(d.log()))
+}
+
+// latestConfiguration returns the configuration in effect at the end of
+// the log, and where it comes from
+func (d *nodeData) latestConfiguration() (*raft.Configuration, string) {
+	var latest *raft.LogEntry
+	for _, e := range d.log() {
+		if e.Type == raft.EntryConfiguration && (latest == nil || e.Index > latest.Index) {
+			e := e
+			latest = &e
+		}
+	}
+	if latest != nil {
+		if config, err := raft.ConfigurationOf(*latest); err == nil {
+			return &config, fmt.Sprintf("log index %d", latest.Index)
+		}
+	}
+	if d.snapshot != nil && d.snapshot.Configuration != nil {
+		return d.snapshot.Configuration, "snapshot"
+	}
+	if d.config != nil {
+		return d.config, "persisted configuration"
+	}
+	return nil, ""
+}
+
+func runInfo(args []string) error {
+	fs, engine := newFlags("info")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("info takes one data directory")
+	}
+
+	d, err := load(*engine, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	d.warn()
+
+	fmt.Printf("Directory:     %s (%s storage)\n", d.dir, d.engine)
+	fmt.Printf("Current term:  %d\n", d.term)
+	fmt.Printf("Voted for:     %s\n", orNone(d.votedFor))
+	fmt.Printf("Last applied:  %d\n", d.lastApplied)
+	if d.snapshot != nil {
+		fmt.Printf("Snapshot:      index %d, term %d, %d bytes\n",
+			d.snapshot.LastIncludedIndex, d.snapshot.LastIncludedTerm, len(d.snapshot.Data))
+	} else {
+		fmt.Printf("Snapshot:      none\n")
+	}
+	fmt.Printf("Log:           %s\n", d.logRange())
+	if config, source := d.latestConfiguration(); config != nil {
+		fmt.Printf("Configuration: %s (from %s)\n", describeConfiguration(*config), source)
+	} else {
+		fmt.Printf("Configuration: bootstrap from RAFT_PEERS\n")
+	}
+	return nil
+}
+
+// dumpedEntry is the JSON form of an entry printed by dump -json
+type dumpedEntry struct {
+	Index       uint64      `json:"index"`
+	Term        uint64      `json:"term"`
+	Type        string      `json:"type"`
+	CommandType string      `json:"command_type,omitempty"`
+	Command     interface{} `json:"command,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
+
+func runDump(args []string) error {
+	fs, engine := newFlags("dump")
+	from := fs.Uint64("from", 0, "first index to print")
+	to := fs.Uint64("to", 0, "last index to print (0 for the end of the log)")
+	asJSON := fs.Bool("json", false, "print one JSON object per entry, with the decoded command")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("dump takes one data directory")
+	}
+
+	d, err := load(*engine, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	d.warn()
+
+	entries := d.log()
+	indexes := make([]uint64, 0, len(entries))
+	for index := range entries {
+		if index >= *from && (*to == 0 || index <= *to) {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	enc := json.NewEncoder(os.Stdout)
+	if !*asJSON {
+		if d.snapshot != nil && *from <= d.snapshot.LastIncludedIndex {
+			fmt.Printf("%8s %6s  (snapshot up to here)\n", fmt.Sprint(d.snapshot.LastIncludedIndex), fmt.Sprint(d.snapshot.LastIncludedTerm))
+		}
+		fmt.Printf("%8s %6s  %-14s %s\n", "INDEX", "TERM", "TYPE", "COMMAND")
+	}
+	for _, index := range indexes {
+		e := entries[index]
+		out := describeEntry(e)
+		if *asJSON {
+			if err := enc.Encode(out); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Printf("%8d %6d  %-14s %s\n", out.Index, out.Term, out.Type, summarize(e, out))
+	}
+	return nil
+}
+
+// describeEntry decodes an entry's type and command
+func describeEntry(e raft.LogEntry) dumpedEntry {
+	out := dumpedEntry{Index: e.Index, Term: e.Term}
+	switch e.Type {
+	case raft.EntryNoop:
+		out.Type = "noop"
+	case raft.EntryConfiguration:
+		out.Type = "configuration"
+		config, err := raft.ConfigurationOf(e)
+		if err != nil {
+			out.Error = err.Error()
+		} else {
+			out.Command = config
+		}
+	case raft.EntryNormal:
+		out.Type = "command"
+		out.CommandType = command.TypeOf(e.Command)
+		cmd, err := command.Decode(e.Command)
+		if err != nil {
+			out.Error = err.Error()
+			out.Command = e.Command
+		} else {
+			out.Command = cmd
+		}
+	default:
+		out.Type = fmt.Sprintf("type-%d", e.Type)
+		out.Command = e.Command
+	}
+	return out
+}
+
+// summarize returns the one-line description of an entry printed by dump
+func summarize(e raft.LogEntry, out dumpedEntry) string {
+	switch {
+	case out.Error != "":
+		return fmt.Sprintf("%s  ERROR: %s", out.CommandType, out.Error)
+	case e.Type == raft.EntryConfiguration:
+		return describeConfiguration(out.Command.(raft.Configuration))
+	case e.Type == raft.EntryNormal:
+		if session := command.SessionOf(e.Command); session != nil {
+			return fmt.Sprintf("%s  client=%s seq=%d", out.CommandType, session.ClientID, session.Sequence)
+		}
+		return out.CommandType
+	}
+	return ""
+}
+
+func runVerify(args []string) error {
+	fs, engine := newFlags("verify")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("verify takes one data directory")
+	}
+
+	d, err := load(*engine, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	problems, notes := verify(d)
+	for _, note := range notes {
+		fmt.Printf("note: %s\n", note)
+	}
+	for _, problem := range problems {
+		fmt.Printf("PROBLEM: %s\n", problem)
+	}
+
+	if len(problems) > 0 {
+		fmt.Printf("%s: %d problem(s) found\n", d.dir, len(problems))
+		return errFailed{}
+	}
+	fmt.Printf("%s: OK, log %s, term %d, last applied %d\n", d.dir, d.logRange(), d.term, d.lastApplied)
+	return nil
+}
+
+// verify checks the persisted data for what the node relies on when it
+// restarts: a contiguous log following the snapshot, terms that never go
+// down and never exceed the current term, and commands that decode
+func verify(d *nodeData) (problems, notes []string) {
+	problemf := func(format string, args ...interface{}) { problems = append(problems, fmt.Sprintf(format, args...)) }
+	notef := func(format string, args ...interface{}) { notes = append(notes, fmt.Sprintf(format, args...)) }
+
+	// A writable open, such as the node's on restart, cuts a torn tail off
+	// and refuses a bad record before it
+	for _, damage := range d.damage {
+		problemf("%s", damage)
+	}
+
+	base := d.snapshotIndex()
+	var prev *raft.LogEntry
+	covered := 0
+	for i := range d.entries {
+		e := d.entries[i]
+		if e.Index == 0 {
+			continue // Placeholder some engines store in front of the log
+		}
+		if e.Index <= base {
+			covered++
+			if e.Index == base && e.Term != d.snapshot.LastIncludedTerm {
+				problemf("entry %d has term %d but the snapshot ends there with term %d", e.Index, e.Term, d.snapshot.LastIncludedTerm)
+			}
+			continue
+		}
+
+		switch {
+		case prev == nil && e.Index != base+1:
+			if base > 0 {
+				problemf("log starts at index %d but the snapshot ends at %d, entries %d..%d are missing", e.Index, base, base+1, e.Index-1)
+			} else {
+				problemf("log starts at index %d, entries 1..%d are missing", e.Index, e.Index-1)
+			}
+		case prev != nil && e.Index <= prev.Index:
+			problemf("entry %d is stored after entry %d, out of order or duplicated", e.Index, prev.Index)
+		case prev != nil && e.Index != prev.Index+1:
+			problemf("gap between index %d and %d", prev.Index, e.Index)
+		}
+
+		lastTerm := uint64(0)
+		if prev != nil {
+			lastTerm = prev.Term
+		} else if d.snapshot != nil {
+			lastTerm = d.snapshot.LastIncludedTerm
+		}
+		if e.Term == 0 {
+			problemf("entry %d has term 0", e.Index)
+		} else if e.Term < lastTerm {
+			problemf("term goes down from %d to %d at index %d", lastTerm, e.Term, e.Index)
+		}
+		if e.Term > d.term {
+			problemf("entry %d has term %d, after the current term %d", e.Index, e.Term, d.term)
+		}
+
+		if out := describeEntry(e); out.Error != "" {
+			problemf("entry %d: %s", e.Index, out.Error)
+		}
+		prev = &d.entries[i]
+	}
+	if covered > 0 {
+		notef("%d stored entries are covered by the snapshot at %d and are ignored", covered, base)
+	}
+
+	_, last := d.bounds()
+	if d.lastApplied > last {
+		problemf("last applied index %d is past the end of the log at %d", d.lastApplied, last)
+	}
+	if d.snapshot != nil && d.snapshot.LastIncludedTerm > d.term {
+		problemf("snapshot term %d is after the current term %d", d.snapshot.LastIncludedTerm, d.term)
+	}
+
+	if config, source := d.latestConfiguration(); config != nil {
+		if d.votedFor != "" && !config.Has(d.votedFor) {
+			notef("voted for node %s, which is not a voter in the configuration from %s", d.votedFor, source)
+		}
+	}
+	// The persisted configuration is the one at the start of the log, which
+	// a snapshot replaces
+	if d.config != nil && d.snapshot != nil && d.snapshot.Configuration != nil &&
+		describeConfiguration(*d.config) != describeConfiguration(*d.snapshot.Configuration) {
+		notef("persisted configuration %s differs from the snapshot's %s, the node uses the latter",
+			describeConfiguration(*d.config), describeConfiguration(*d.snapshot.Configuration))
+	}
+	return problems, notes
+}
+
+func runDiff(args []string) error {
+	fs, engine := newFlags("diff")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("diff takes two data directories")
+	}
+
+	a, err := load(*engine, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := load(*engine, fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	a.warn()
+	b.warn()
+
+	for _, d := range []*nodeData{a, b} {
+		fmt.Printf("%s: log %s, snapshot at %d, term %d, last applied %d\n",
+			d.dir, d.logRange(), d.snapshotIndex(), d.term, d.lastApplied)
+	}
+
+	aFirst, aLast := a.bounds()
+	bFirst, bLast := b.bounds()
+	from, to := max(aFirst, bFirst), min(aLast, bLast)
+	if from > to {
+		fmt.Println("The logs do not overlap, compare their snapshots instead")
+		return errFailed{}
+	}
+
+	// By the Log Matching Property, logs holding an entry with the same
+	// index and term are identical up to it, so the first index where the
+	// terms differ is where the logs diverge
+	aLog, bLog := a.log(), b.log()
+	for index := from; index <= to; index++ {
+		ea, okA := aLog[index]
+		eb, okB := bLog[index]
+		if !okA || !okB {
+			fmt.Printf("Index %d is missing from %s, run verify\n", index, map[bool]string{true: b.dir, false: a.dir}[okA])
+			return errFailed{}
+		}
+		if ea.Term != eb.Term {
+			if index > from {
+				fmt.Printf("The logs agree on %d..%d\n", from, index-1)
+			}
+			fmt.Printf("They diverge at index %d:\n", index)
+			fmt.Printf("  %s: term %d %s\n", a.dir, ea.Term, summarize(ea, describeEntry(ea)))
+			fmt.Printf("  %s: term %d %s\n", b.dir, eb.Term, summarize(eb, describeEntry(eb)))
+			return errFailed{}
+		}
+		if !sameContent(ea, eb) {
+			fmt.Printf("Index %d has term %d on both nodes but different content, one of the logs is corrupt\n", index, ea.Term)
+			return errFailed{}
+		}
+	}
+
+	fmt.Printf("The logs agree on %d..%d\n", from, to)
+	switch {
+	case aLast > bLast:
+		fmt.Printf("%s has %d more entries, %d..%d\n", a.dir, aLast-bLast, bLast+1, aLast)
+		return errFailed{}
+	case bLast > aLast:
+		fmt.Printf("%s has %d more entries, %d..%d\n", b.dir, bLast-aLast, aLast+1, bLast)
+		return errFailed{}
+	}
+	return nil
+}
+
+// sameContent compares the JSON form of two entries, as entries read back
+// from storage hold generic maps rather than typed commands
+func sameContent(a, b raft.LogEntry) bool {
+	if a.Type != b.Type {
+		return false
+	}
+	if a.Type == raft.EntryConfiguration {
+		ca, errA := raft.ConfigurationOf(a)
+		cb, errB := raft.ConfigurationOf(b)
+		return errA == nil && errB == nil && describeConfiguration(ca) == describeConfiguration(cb)
+	}
+	da, errA := json.Marshal(a.Command)
+	db, errB := json.Marshal(b.Command)
+	return errA == nil && errB == nil && string(da) == string(db)
+}
+
+func runTruncate(args []string) error {
+	fs, engine := newFlags("truncate")
+	from := fs.Uint64("from", 0, "first index to discard")
+	force := fs.Bool("force", false, "also discard entries the node has applied")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *from == 0 {
+		return errors.New("truncate takes -from and one data directory")
+	}
+
+	d, storage, err := open(*engine, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	_, last := d.bounds()
+	switch {
+	case *from <= d.snapshotIndex():
+		return fmt.Errorf("entries up to %d are in the snapshot and cannot be truncated", d.snapshotIndex())
+	case *from > last:
+		fmt.Printf("Nothing to do, the log ends at %d\n", last)
+		return nil
+	case *from <= d.lastApplied && !*force:
+		return fmt.Errorf("entries up to %d were applied, so they are committed; "+
+			"discarding them leaves this node's database ahead of its log. Use -force to truncate anyway", d.lastApplied)
+	}
+
+	if err := storage.TruncateSuffix(*from); err != nil {
+		return fmt.Errorf("failed to truncate log: %w", err)
+	}
+	fmt.Printf("Discarded entries %d..%d\n", *from, last)
+
+	if *from <= d.lastApplied {
+		if err := storage.SaveState(d.term, d.votedFor, *from-1); err != nil {
+			return fmt.Errorf("failed to save state: %w", err)
+		}
+		fmt.Printf("Last applied lowered from %d to %d; the node's database still holds the discarded entries\n", d.lastApplied, *from-1)
+	}
+	return nil
+}
+
+func runSnapshot(args []string) error {
+	if len(args) == 0 {
+		return errors.New("snapshot takes export or import")
+	}
+	switch args[0] {
+	case "export":
+		return runSnapshotExport(args[1:])
+	case "import":
+		return runSnapshotImport(args[1:])
+	}
+	return fmt.Errorf("unknown snapshot command %q, expected export or import", args[0])
+}
+
+func runSnapshotExport(args []string) error {
+	fs, engine := newFlags("snapshot export")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("snapshot export takes a data directory and a file")
+	}
+
+	d, err := load(*engine, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	d.warn()
+	if d.snapshot == nil {
+		return fmt.Errorf("%s has no snapshot", d.dir)
+	}
+
+	var out io.Writer = os.Stdout
+	if path := fs.Arg(1); path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", path, err)
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := json.NewEncoder(out).Encode(d.snapshot); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if fs.Arg(1) != "-" {
+		fmt.Printf("Exported snapshot at index %d, term %d to %s\n",
+			d.snapshot.LastIncludedIndex, d.snapshot.LastIncludedTerm, fs.Arg(1))
+	}
+	return nil
+}
+
+func runSnapshotImport(args []string) error {
+	fs, engine := newFlags("snapshot import")
+	force := fs.Bool("force", false, "replace a snapshot that covers more of the log")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("snapshot import takes a data directory and a file")
+	}
+
+	data, err := os.ReadFile(fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	var snapshot raft.Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	if snapshot.LastIncludedIndex == 0 || snapshot.LastIncludedTerm == 0 {
+		return errors.New("snapshot has no last included index or term")
+	}
+
+	d, storage, err := open(*engine, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	if d.snapshotIndex() > snapshot.LastIncludedIndex && !*force {
+		return fmt.Errorf("the node's snapshot at %d is newer than the imported one at %d; use -force to replace it",
+			d.snapshotIndex(), snapshot.LastIncludedIndex)
+	}
+
+	// Keep the entries after the snapshot if the log agrees with it,
+	// otherwise the whole log is superseded, as with InstallSnapshot
+	_, last := d.bounds()
+	entry, ok := d.log()[snapshot.LastIncludedIndex]
+	matches := ok && entry.Term == snapshot.LastIncludedTerm
+	truncateTo := snapshot.LastIncludedIndex
+	if !matches {
+		truncateTo = max(truncateTo, last)
+	}
+
+	if err := storage.SaveSnapshot(snapshot); err != nil {
+		return fmt.Errorf("failed to save snapshot: %w", err)
+	}
+	if err := storage.TruncatePrefix(truncateTo); err != nil {
+		return fmt.Errorf("failed to truncate log: %w", err)
+	}
+	if snapshot.Configuration != nil {
+		if err := storage.SaveConfiguration(*snapshot.Configuration); err != nil {
+			return fmt.Errorf("failed to save configuration: %w", err)
+		}
+	}
+
+	// A node restores its database from the snapshot on startup when it has
+	// applied less than the snapshot covers. If the log was superseded, what
+	// it applied may not be part of the snapshot's history.
+	term, lastApplied := max(d.term, snapshot.LastIncludedTerm), d.lastApplied
+	if !matches && lastApplied > 0 {
+		lastApplied = 0
+	}
+	if err := storage.SaveState(term, d.votedFor, lastApplied); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+
+	fmt.Printf("Imported snapshot at index %d, term %d into %s\n", snapshot.LastIncludedIndex, snapshot.LastIncludedTerm, d.dir)
+	if matches {
+		fmt.Printf("Kept log entries after %d\n", snapshot.LastIncludedIndex)
+	} else {
+		fmt.Printf("Discarded the log up to %d, it does not continue the snapshot\n", truncateTo)
+		if d.lastApplied > 0 {
+			fmt.Println("The node restores its database from the snapshot when it starts")
+		}
+	}
+	return nil
+}
+
+// describeConfiguration lists the voters and learners of a configuration
+// in a stable order
+func describeConfiguration(config raft.Configuration) string {
+	ids := func(m map[string]string) string {
+		list := make([]string, 0, len(m))
+		for id, addr := range m {
+			list = append(list, id+"="+addr)
+		}
+		sort.Strings(list)
+		return strings.Join(list, ",")
+	}
+	desc := "voters " + ids(config.Members)
+	if len(config.Learners) > 0 {
+		desc += ", learners " + ids(config.Learners)
+	}
+	return desc
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/kexincchen/homebar/internal/raft"
+	"github.com/kexincchen/homebar/internal/service"
+)
+
+// Followers pass client requests on to the leader. By default they act as
+// a reverse proxy, so clients never notice which node they talk to; with
+// LEADER_FORWARDING=redirect they answer with a 307 to the leader instead.
+//
+// GET requests are served by the follower itself while it keeps up with
+// the leader. A client bounds how far behind the data may be with
+// X-Max-Staleness, the number of committed entries the follower may not
+// have applied yet; reads asking for linearizable or lease consistency
+// always go to the leader.
+const (
+	forwardProxy    = "proxy"
+	forwardRedirect = "redirect"
+)
+
+const (
+	// forwardedByHeader marks a request a follower sent on to the leader
+	forwardedByHeader = "X-Forwarded-By-Node"
+	// leaderHeader tells the sender of a misdirected request who leads now
+	leaderHeader = "X-Raft-Leader"
+	// maxStalenessHeader bounds the apply lag of a follower serving a read
+	maxStalenessHeader = "X-Max-Staleness"
+
+	maxForwardBody        = 32 << 20         // Largest request body a follower buffers for retries
+	forwardAttempts       = 5                // Tries across leader changes before giving up
+	forwardAttemptTimeout = 10 * time.Second // Time the leader has to answer one try
+	leaderWaitTimeout     = 3 * time.Second  // Time to wait for an election when no leader is known
+)
+
+// hopHeaders apply to a single connection and are not forwarded
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// lagReporter tells how far the local state machine trails the leader
+type lagReporter interface {
+	ApplyLag() (uint64, bool)
+}
+
+type leaderForwarder struct {
+	node   *raft.RaftNode
+	lag    lagReporter
+	mode   string
+	client *http.Client
+}
+
+// forwardToLeader returns gin middleware that lets the leader handle every
+// request that reaches a follower, apart from reads the follower is recent
+// enough to serve
+func forwardToLeader(node *raft.RaftNode, lag lagReporter, mode string) (gin.HandlerFunc, error) {
+	switch mode {
+	case "":
+		mode = forwardProxy
+	case forwardProxy, forwardRedirect:
+	default:
+		return nil, fmt.Errorf("unknown LEADER_FORWARDING mode %q, expected %s or %s", mode, forwardProxy, forwardRedirect)
+	}
+
+	f := &leaderForwarder{
+		node: node,
+		lag:  lag,
+		mode: mode,
+		client: &http.Client{
+			Timeout: forwardAttemptTimeout,
+			// Whatever the leader answers goes back to the client unchanged
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+	return f.handle, nil
+}
+
+func (f *leaderForwarder) handle(c *gin.Context) {
+	if strings.HasPrefix(c.Request.URL.Path, "/health") ||
+		strings.HasPrefix(c.Request.URL.Path, "/metrics") ||
+		strings.HasPrefix(c.Request.URL.Path, "/raft") {
+		c.Next()
+		return
+	}
+
+	if f.node.IsLeader() {
+		log.Printf("[LEADER %s] handle %s %s",
+			f.node.ID(), c.Request.Method, c.Request.URL.Path)
+		c.Next()
+		return
+	}
+
+	// A forwarded request is not passed on a second time; the follower that
+	// sent it retries once it has learned about the new leader
+	if c.GetHeader(forwardedByHeader) != "" {
+		c.Header(leaderHeader, f.node.LeaderID())
+		c.AbortWithStatusJSON(http.StatusMisdirectedRequest, gin.H{"error": "not the leader"})
+		return
+	}
+
+	if local, err := f.serveLocally(c); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if local {
+		// The lag was checked here, the read itself must not ask the leader
+		c.Request = c.Request.WithContext(service.WithReadConsistency(c.Request.Context(), service.ReadStale))
+		c.Next()
+		return
+	}
+
+	if f.mode == forwardRedirect {
+		f.redirect(c)
+		return
+	}
+	f.proxy(c)
+}
+
+// serveLocally reports whether this follower may answer the request from
+// its own database
+func (f *leaderForwarder) serveLocally(c *gin.Context) (bool, error) {
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		return false, nil
+	}
+	if v := c.GetHeader("X-Read-Consistency"); v != "" && v != string(service.ReadStale) {
+		return false, nil
+	}
+
+	maxLag := uint64(math.MaxUint64)
+	if v := c.GetHeader(maxStalenessHeader); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("%s must be a number of log entries", maxStalenessHeader)
+		}
+		maxLag = n
+	}
+
+	lag, known := f.lag.ApplyLag()
+	if !known || lag > maxLag {
+		log.Printf("[FOLLOWER %s] %d entries behind (known=%t), reading %s from the leader",
+			f.node.ID(), lag, known, c.Request.URL.Path)
+		return false, nil
+	}
+	c.Header("X-Served-By", f.node.ID())
+	return true, nil
+}
+
+// redirect sends the client to the same URL on the leader
+func (f *leaderForwarder) redirect(c *gin.Context) {
+	leader := f.node.LeaderID()
+	if leader == "" {
+		log.Printf("[FOLLOWER %s] leader unknown -> 503  (%s %s)",
+			f.node.ID(), c.Request.Method, c.Request.URL.Path)
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable,
+			gin.H{"error": "leader unknown"})
+		return
+	}
+
+	addr := f.node.BusinessAddr(leader)
+	if addr == "" {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable,
+			gin.H{"error": fmt.Sprintf("no API address known for leader %s", leader)})
+		return
+	}
+	target := addr + c.Request.URL.RequestURI()
+	log.Printf("[FORWARD %s] %s %s  --> leader %s  (%s)",
+		f.node.ID(), c.Request.Method, c.Request.URL.Path, leader, target)
+
+	c.Header("Location", target)
+	c.AbortWithStatus(http.StatusTemporaryRedirect)
+}
+
+// proxy sends the request to the leader and relays its response. The body
+// is buffered so that the request can be sent again if leadership moves.
+func (f *leaderForwarder) proxy(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxForwardBody+1))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+		return
+	}
+	if len(body) > maxForwardBody {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body too large to forward"})
+		return
+	}
+
+	requestID := c.GetHeader("X-Request-ID")
+	if requestID == "" {
+		requestID = uuid.New().String()
+	}
+
+	// A request that may have reached the leader is only sent again if
+	// applying it twice does no harm
+	retrySafe := isIdempotent(c.Request.Method) || c.GetHeader("X-Client-ID") != ""
+
+	var lastErr error
+	for attempt := 1; attempt <= forwardAttempts; attempt++ {
+		if attempt > 1 {
+			if err := sleepContext(c.Request.Context(), time.Duration(attempt-1)*50*time.Millisecond); err != nil {
+				lastErr = err
+				break
+			}
+		}
+
+		leader, err := f.awaitLeader(c.Request.Context())
+		if err != nil {
+			lastErr = err
+			break
+		}
+
+		// This node may have won an election in the meantime
+		if leader == f.node.ID() {
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+			c.Next()
+			return
+		}
+
+		resp, reached, err := f.send(c, leader, body, requestID)
+		if err != nil {
+			lastErr = err
+			if reached && !retrySafe {
+				break
+			}
+			log.Warn().Err(err).Str("request_id", requestID).
+				Msgf("🔁 Node %s retrying %s %s, leader %s unavailable", f.node.ID(), c.Request.Method, c.Request.URL.Path, leader)
+			continue
+		}
+		if resp.StatusCode == http.StatusMisdirectedRequest {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("node %s is no longer the leader", leader)
+			log.Warn().Str("request_id", requestID).
+				Msgf("🔁 Node %s retrying %s %s, node %s stepped down", f.node.ID(), c.Request.Method, c.Request.URL.Path, leader)
+			continue
+		}
+
+		log.Printf("[FORWARD %s] %s %s  --> leader %s  (%d)",
+			f.node.ID(), c.Request.Method, c.Request.URL.Path, leader, resp.StatusCode)
+		relayResponse(c, resp)
+		return
+	}
+
+	c.Header("X-Request-ID", requestID)
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+		"error": fmt.Sprintf("failed to forward request to the leader: %v", lastErr),
+	})
+}
+
+// awaitLeader returns the current leader, waiting for an election to finish
+// if none is known
+func (f *leaderForwarder) awaitLeader(ctx context.Context) (string, error) {
+	deadline := time.Now().Add(leaderWaitTimeout)
+	for {
+		if leader := f.node.LeaderID(); leader != "" {
+			return leader, nil
+		}
+		if time.Now().After(deadline) {
+			return "", errors.New("leader unknown")
+		}
+		if err := sleepContext(ctx, raft.HeartbeatInterval); err != nil {
+			return "", err
+		}
+	}
+}
+
+// send forwards one try of the request to the leader. It reports whether
+// the request may have reached the leader, which is only ruled out when
+// the connection could not be established.
+func (f *leaderForwarder) send(c *gin.Context, leader string, body []byte, requestID string) (*http.Response, bool, error) {
+	addr := f.node.BusinessAddr(leader)
+	if addr == "" {
+		return nil, false, fmt.Errorf("no API address known for leader %s", leader)
+	}
+	target := addr + c.Request.URL.RequestURI()
+	req, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+
+	req.Header = c.Request.Header.Clone()
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.Header.Set("X-Request-ID", requestID)
+	req.Header.Set(forwardedByHeader, f.node.ID())
+	req.Header.Set("X-Forwarded-Host", c.Request.Host)
+	if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+		req.Header.Set("X-Forwarded-For", prior+", "+c.ClientIP())
+	} else {
+		req.Header.Set("X-Forwarded-For", c.ClientIP())
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		dialFailed := errors.As(err, &opErr) && opErr.Op == "dial"
+		return nil, !dialFailed, err
+	}
+	return resp, true, nil
+}
+
+// relayResponse writes the leader's response to the client
+func relayResponse(c *gin.Context, resp *http.Response) {
+	defer resp.Body.Close()
+
+	header := c.Writer.Header()
+	for k, values := range resp.Header {
+		for _, v := range values {
+			header.Add(k, v)
+		}
+	}
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+
+	c.Status(resp.StatusCode)
+	if _, err := io.Copy(c.Writer, resp.Body); err != nil {
+		log.Warn().Err(err).Msg("Failed to relay response from the leader")
+	}
+	c.Abort()
+}
+
+// isIdempotent reports whether sending a request twice has the same effect as once
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
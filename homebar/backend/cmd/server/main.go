@@ -4,11 +4,12 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 	"os/signal"
 	"syscall"
@@ -28,14 +29,17 @@ import (
 )
 
 var (
-	raftNodePtr *raft.RaftNode
-	appNodeID   string
+	isLeader  atomic.Bool // Role shown in the request log, kept current by watchRole
+	appNodeID string
 )
 
 func main() {
 
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
+	// Handlers pass the gin context on to services, which read values such
+	// as the requested read consistency from the request context
+	router.ContextWithFallback = true
 	router.Use(gin.Recovery())
 
 	// Initialize configuration
@@ -58,15 +62,30 @@ func main() {
 		nodeID = "1" // Default node ID if not specified
 	}
 
+	// The topology names every node's addresses; RAFT_PEERS lists the
+	// members to bootstrap with, as id=raft-address or just the ID of a node
+	// in the topology. Without RAFT_PEERS every node in the topology is one.
+	topology, err := raft.TopologyFromEnv()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid cluster topology")
+	}
+
 	var peerIDs []string
 	peerMap := map[string]string{}
 	if env := os.Getenv("RAFT_PEERS"); env != "" {
 		for _, kv := range strings.Split(env, ",") {
-			p := strings.SplitN(kv, "=", 2)
-			if len(p) == 2 {
-				peerIDs = append(peerIDs, strings.TrimSpace(p[0]))
-				peerMap[p[0]] = p[1]
+			id, addr, _ := strings.Cut(kv, "=")
+			id = strings.TrimSpace(id)
+			if id == "" {
+				continue
 			}
+			peerIDs = append(peerIDs, id)
+			peerMap[id] = topology.Addresses(id, strings.TrimSpace(addr)).Raft
+		}
+	} else {
+		for _, id := range topology.IDs() {
+			peerIDs = append(peerIDs, id)
+			peerMap[id] = topology.Addresses(id, "").Raft
 		}
 	}
 
@@ -83,6 +102,8 @@ func main() {
 	ingredientRepo := postgres.NewIngredientRepository(dbConn)
 	productIngredientRepo := postgres.NewProductIngredientRepository(dbConn)
 	inventoryRepo := postgres.NewInventoryRepository(dbConn)
+	snapshotRepo := postgres.NewSnapshotRepository(dbConn)
+	sessionRepo := postgres.NewSessionRepository(dbConn)
 
 	// Initialize services with all repositories
 	userService := service.NewUserService(userRepo, customerRepo, merchantRepo, dbConn)
@@ -104,6 +125,8 @@ func main() {
 	raftService, err := service.NewRaftService(
 		orderService,
 		ingredientService,
+		snapshotRepo,
+		sessionRepo,
 		nodeID,
 		peerIDs,
 		peerMap,
@@ -129,10 +152,19 @@ func main() {
 	// Configure Raft
 
 	raftNode := raftService.GetRaftNode()
-	raftNodePtr = raftNode
 	appNodeID = nodeID
 
-	router.Use(redirectIfFollower(raftNode))
+	// Count every request, including those passed on to the leader
+	metrics := newMetrics(raftNode, dbConn)
+	router.Use(metrics.middleware())
+
+	forward, err := forwardToLeader(raftNode, raftService, os.Getenv("LEADER_FORWARDING"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid leader forwarding configuration")
+	}
+	router.Use(forward)
+	router.Use(readConsistencyMiddleware())
+	router.Use(clientSessionMiddleware())
 	// Enable CORS middleware
 	router.Use(corsMiddleware())
 
@@ -212,12 +244,8 @@ func main() {
 		})
 	})
 
-	rpcSrv := raft.SetupRaftRPCServer(raftNode)
-	go func() {
-		if err := rpcSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatal().Err(err).Msg("Raft RPC listen error")
-		}
-	}()
+	// Prometheus metrics of this node
+	router.GET("/metrics", metrics.handler())
 
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to create Raft order service")
@@ -226,6 +254,7 @@ func main() {
 	// Start the Raft node
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	watchRole(ctx, raftNode)
 	if err := raftService.Start(ctx); err != nil {
 		log.Fatal().Err(err).Msg("Failed to start Raft node")
 	}
@@ -258,10 +287,17 @@ func main() {
 	}
 	defer clusterCoordinator.Stop()
 
-	// Start the HTTP server (this will block)
+	// Start the HTTP server (this will block). It listens on the port of
+	// the node's API address unless PORT overrides it.
+	apiAddr := raftNode.Addresses(nodeID).API
 	port := os.Getenv("PORT")
 	if port == "" {
-		port = "8080" // Default port if not specified
+		port, err = raft.ListenAddr(apiAddr)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("No API address for node %s, set PORT or the topology", nodeID)
+		}
+	} else if listen, err := raft.ListenAddr(apiAddr); err == nil && strings.TrimPrefix(listen, ":") != strings.TrimPrefix(port, ":") {
+		log.Warn().Msgf("PORT %s differs from the API address %s other nodes forward requests to", port, apiAddr)
 	}
 	if !strings.HasPrefix(port, ":") {
 		port = ":" + port
@@ -284,47 +320,63 @@ func main() {
 	<-quit
 	log.Info().Msg("Shutting down...")
 
+	// Hand leadership over first so writes do not stall until an election timeout
+	if raftNode.IsLeader() {
+		if err := raftNode.TransferLeadership(""); err != nil {
+			log.Warn().Err(err).Msg("Leadership transfer failed")
+		} else {
+			log.Info().Msg("Leadership transferred")
+		}
+	}
+
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	_ = srv.Shutdown(shutdownCtx)
 	cancel()
 }
 
-// redirectIfFollower returns gin middleware that forwards non-leader nodes.
-func redirectIfFollower(node *raft.RaftNode) gin.HandlerFunc {
+// readConsistencyMiddleware lets clients pick the consistency of reads with
+// the X-Read-Consistency header: linearizable, lease or stale
+func readConsistencyMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if strings.HasPrefix(c.Request.URL.Path, "/health") ||
-			strings.HasPrefix(c.Request.URL.Path, "/raft") {
+		v := c.GetHeader("X-Read-Consistency")
+		if v == "" {
 			c.Next()
 			return
 		}
 
-		if node.IsLeader() {
-			log.Printf("[LEADER %s] handle %s %s",
-				node.ID(), c.Request.Method, c.Request.URL.Path)
-			c.Next()
+		consistency, err := service.ParseReadConsistency(v)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		leader := node.LeaderID()
-		if leader == "" {
-			log.Printf("[FOLLOWER %s] leader unknown -> 503  (%s %s)",
-				node.ID(), c.Request.Method, c.Request.URL.Path)
-			c.AbortWithStatusJSON(http.StatusServiceUnavailable,
-				gin.H{"error": "leader unknown"})
+		c.Request = c.Request.WithContext(service.WithReadConsistency(c.Request.Context(), consistency))
+		c.Next()
+	}
+}
+
+// clientSessionMiddleware applies writes at most once per client request.
+// Clients send a stable X-Client-ID and number their requests with
+// X-Client-Seq, repeating the number when they retry.
+func clientSessionMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clientID, seq := c.GetHeader("X-Client-ID"), c.GetHeader("X-Client-Seq")
+		if clientID == "" && seq == "" {
+			c.Next()
 			return
 		}
 
-		target := fmt.Sprintf("http://localhost:90%s%s", leader, c.Request.URL.Path)
-		if q := c.Request.URL.RawQuery; q != "" {
-			target += "?" + q
+		n, err := strconv.ParseUint(seq, 10, 64)
+		if clientID == "" || err != nil || n == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "X-Client-ID and a positive X-Client-Seq must be sent together",
+			})
+			return
 		}
 
-		log.Printf("[FORWARD %s] %s %s  --> leader %s  (%s)",
-			node.ID(), c.Request.Method, c.Request.URL.Path, leader, target)
-
-		c.Header("Location", target)
-		c.AbortWithStatus(http.StatusTemporaryRedirect)
+		c.Request = c.Request.WithContext(service.WithClientSession(c.Request.Context(), clientID, n))
+		c.Next()
 	}
 }
 
@@ -333,7 +385,7 @@ func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Read-Consistency, X-Client-ID, X-Client-Seq, X-Request-ID, X-Max-Staleness")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -344,22 +396,45 @@ func corsMiddleware() gin.HandlerFunc {
 	}
 }
 
+// watchRole follows the node's state changes for the request log, so
+// requests do not take the Raft lock to find out the role
+func watchRole(ctx context.Context, node *raft.RaftNode) {
+	observer := node.RegisterObserver(16, raft.EventStateChange)
+	go func() {
+		defer node.DeregisterObserver(observer)
+		for {
+			select {
+			case <-observer.Events():
+				// Read the state rather than the event's, in case a later one was dropped
+				isLeader.Store(node.IsLeader())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
 // Logger middleware
 func loggerMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
-		if strings.HasPrefix(c.Request.URL.Path, "/health") {
+		if strings.HasPrefix(c.Request.URL.Path, "/health") ||
+			strings.HasPrefix(c.Request.URL.Path, "/metrics") {
 			c.Next()
 			return
 		}
 
 		role := "FOLLOWER"
-		if raftNodePtr != nil && raftNodePtr.IsLeader() {
+		if isLeader.Load() {
 			role = "LEADER"
 		}
 		// Log request details
 		startTime := time.Now()
-		requestID := uuid.New().String()
+		// Keep the ID of a request forwarded by a follower
+		requestID := c.GetHeader("X-Request-ID")
+		if requestID == "" {
+			requestID = uuid.New().String()
+		}
 
 		// Set request ID header for tracking
 		c.Writer.Header().Set("X-Request-ID", requestID)
@@ -405,7 +480,8 @@ func (w bodyLogWriter) Write(b []byte) (int, error) {
 func RequestLogger() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
-		if strings.HasPrefix(c.Request.URL.Path, "/health") {
+		if strings.HasPrefix(c.Request.URL.Path, "/health") ||
+			strings.HasPrefix(c.Request.URL.Path, "/metrics") {
 			c.Next()
 			return
 		}
@@ -0,0 +1,189 @@
+// Package command defines the commands replicated through the Raft log.
+//
+// Every command is wrapped in an Envelope that names its type and the schema
+// version of its payload. Decoders are registered per type and version, so an
+// entry written by an older release still decodes after the payload of its
+// type has changed. Entries written before envelopes existed are recognised
+// and upgraded by decodeLegacy.
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Command is the typed payload of a log entry
+type Command interface {
+	// CommandType returns the name the command is registered under
+	CommandType() string
+}
+
+// Envelope is the form in which a command is stored in the log
+type Envelope struct {
+	Type    string          `json:"type"`
+	Version int             `json:"version"`
+	Payload json.RawMessage `json:"payload"`
+	Session *Session        `json:"session,omitempty"` // Client request the command was proposed for, if any
+}
+
+// DecodeFunc decodes the payload of one schema version into the current command
+type DecodeFunc func(payload []byte) (Command, error)
+
+// codec holds the decoders of every schema version of a command type
+type codec struct {
+	current  int
+	decoders map[int]DecodeFunc
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]*codec)
+)
+
+// Register adds the decoder for one schema version of a command type. The
+// highest registered version is the one Encode writes.
+func Register(typ string, version int, decode DecodeFunc) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if version < 1 {
+		panic(fmt.Sprintf("command: %s version %d must be positive", typ, version))
+	}
+	c, ok := registry[typ]
+	if !ok {
+		c = &codec{decoders: make(map[int]DecodeFunc)}
+		registry[typ] = c
+	}
+	if _, dup := c.decoders[version]; dup {
+		panic(fmt.Sprintf("command: %s version %d registered twice", typ, version))
+	}
+	c.decoders[version] = decode
+	if version > c.current {
+		c.current = version
+	}
+}
+
+// Types returns the registered command types in sorted order
+func Types() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	types := make([]string, 0, len(registry))
+	for typ := range registry {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Encode wraps a command in an envelope at the current schema version of its type
+func Encode(cmd Command) (Envelope, error) {
+	typ := cmd.CommandType()
+
+	registryMu.RLock()
+	c, ok := registry[typ]
+	registryMu.RUnlock()
+	if !ok {
+		return Envelope{}, fmt.Errorf("unknown command type %q", typ)
+	}
+
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("failed to marshal %s command: %w", typ, err)
+	}
+	return Envelope{Type: typ, Version: c.current, Payload: payload}, nil
+}
+
+// Decode recovers the typed command from a log entry's Command field. The
+// field holds an Envelope on the node that proposed it and a generic map
+// once it has been through storage or an RPC.
+func Decode(v interface{}) (Command, error) {
+	env, err := toEnvelope(v)
+	if err != nil {
+		return nil, err
+	}
+	if env.Version == 0 && env.Payload == nil {
+		return decodeLegacy(v)
+	}
+
+	registryMu.RLock()
+	c, ok := registry[env.Type]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown command type %q", env.Type)
+	}
+	decode, ok := c.decoders[env.Version]
+	if !ok {
+		return nil, fmt.Errorf("unsupported version %d of command %q", env.Version, env.Type)
+	}
+
+	cmd, err := decode(env.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s v%d: %w", env.Type, env.Version, err)
+	}
+	return cmd, nil
+}
+
+// TypeOf returns the command type stored in a log entry's Command field
+// without decoding the payload, or "unknown"
+func TypeOf(v interface{}) string {
+	env, err := toEnvelope(v)
+	if err != nil || env.Type == "" {
+		return "unknown"
+	}
+	return env.Type
+}
+
+// SessionOf returns the client session stored in a log entry's Command
+// field, or nil if the command was not proposed for a client request
+func SessionOf(v interface{}) *Session {
+	env, err := toEnvelope(v)
+	if err != nil {
+		return nil
+	}
+	return env.Session
+}
+
+// toEnvelope converts the Command field of a log entry into an Envelope.
+// Legacy commands decode into an envelope with only the type set.
+func toEnvelope(v interface{}) (Envelope, error) {
+	switch e := v.(type) {
+	case Envelope:
+		return e, nil
+	case *Envelope:
+		return *e, nil
+	}
+
+	data, ok := v.([]byte)
+	if raw, isRaw := v.(json.RawMessage); isRaw {
+		data, ok = raw, true
+	}
+	if !ok {
+		var err error
+		if data, err = json.Marshal(v); err != nil {
+			return Envelope{}, fmt.Errorf("failed to marshal command: %w", err)
+		}
+	}
+
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return Envelope{}, fmt.Errorf("failed to unmarshal command envelope: %w", err)
+	}
+	return env, nil
+}
+
+// decodeJSON returns a DecodeFunc that unmarshals a payload into a new T
+func decodeJSON[T any, PT interface {
+	*T
+	Command
+}]() DecodeFunc {
+	return func(payload []byte) (Command, error) {
+		cmd := PT(new(T))
+		if err := json.Unmarshal(payload, cmd); err != nil {
+			return nil, err
+		}
+		return cmd, nil
+	}
+}
@@ -0,0 +1,288 @@
+package command
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kexincchen/homebar/internal/domain"
+)
+
+// orderCommand is the raft.OrderCommand earlier releases proposed, as it
+// sat in the log of the node that proposed it
+type orderCommand struct {
+	Type           string
+	OrderID        uint
+	CustomerID     uint
+	MerchantID     uint
+	OrderItems     []orderItemCommand
+	AdditionalData map[string]interface{}
+}
+
+type orderItemCommand struct {
+	ProductID uint    `json:"product_id"`
+	Quantity  int     `json:"quantity"`
+	Price     float64 `json:"price"`
+}
+
+// throughStorage returns v the way a node reads it back from storage or an
+// RPC: JSON decoded into generic maps
+func throughStorage(t *testing.T, v interface{}) interface{} {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// checkDecode decodes an entry and compares the result with want, or the
+// error with wantErr if it is set
+func checkDecode(t *testing.T, entry interface{}, want Command, wantErr string) {
+	t.Helper()
+	got, err := Decode(entry)
+	if wantErr != "" {
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("Decode(%#v) = %#v, %v, want error %q", entry, got, err, wantErr)
+		}
+		return
+	}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("Decode(%#v) = %#v, %v, want %#v", entry, got, err, want)
+	}
+}
+
+// TestDecodeLegacy checks that commands written before envelopes decode into
+// their typed form, both as proposed and once read back from storage
+func TestDecodeLegacy(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry interface{}
+		want  Command
+		err   string
+	}{
+		{
+			name: "create order",
+			entry: orderCommand{
+				Type:           TypeCreateOrder,
+				CustomerID:     3,
+				MerchantID:     4,
+				OrderItems:     []orderItemCommand{{ProductID: 7, Quantity: 2, Price: 4.5}},
+				AdditionalData: map[string]interface{}{"notes": "no ice"},
+			},
+			want: &CreateOrder{
+				CustomerID: 3,
+				MerchantID: 4,
+				Items:      []OrderItem{{ProductID: 7, Quantity: 2, Price: 4.5}},
+				Notes:      "no ice",
+			},
+		},
+		{
+			name: "update order status",
+			entry: orderCommand{
+				Type:           TypeUpdateOrderStatus,
+				OrderID:        9,
+				AdditionalData: map[string]interface{}{"status": "completed"},
+			},
+			want: &UpdateOrderStatus{OrderID: 9, Status: domain.OrderStatusCompleted},
+		},
+		{
+			name: "update order",
+			entry: map[string]interface{}{
+				"Type":           TypeUpdateOrder,
+				"OrderID":        float64(9),
+				"AdditionalData": map[string]interface{}{"status": "cancelled", "notes": "out of limes"},
+			},
+			want: &UpdateOrder{OrderID: 9, Status: "cancelled", Notes: "out of limes"},
+		},
+		{
+			name: "create ingredient",
+			entry: map[string]interface{}{
+				"Type": TypeCreateIngredient,
+				"AdditionalData": map[string]interface{}{
+					"merchant_id": float64(4), "name": "Lime", "quantity": float64(20), "unit": "pcs",
+				},
+			},
+			want: &CreateIngredient{IngredientFields: IngredientFields{MerchantID: 4, Name: "Lime", Quantity: 20, Unit: "pcs"}},
+		},
+		{
+			name: "update ingredient",
+			entry: map[string]interface{}{
+				"Type": TypeUpdateIngredient,
+				"AdditionalData": map[string]interface{}{
+					"id": float64(12), "merchant_id": float64(4), "name": "Lime", "quantity": float64(15),
+					"low_stock_threshold": float64(5),
+				},
+			},
+			want: &UpdateIngredient{ID: 12, IngredientFields: IngredientFields{MerchantID: 4, Name: "Lime", Quantity: 15, LowStockThreshold: 5}},
+		},
+		{
+			name: "delete ingredient",
+			entry: map[string]interface{}{
+				"Type":           TypeDeleteIngredient,
+				"AdditionalData": map[string]interface{}{"id": float64(12)},
+			},
+			want: &DeleteIngredient{ID: 12},
+		},
+		{
+			name:  "status missing",
+			entry: orderCommand{Type: TypeUpdateOrderStatus, OrderID: 9},
+			err:   "invalid status",
+		},
+		{
+			name:  "unknown type",
+			entry: orderCommand{Type: "update_inventory"},
+			err:   `unknown command type "update_inventory"`,
+		},
+		{
+			name:  "reserve inventory",
+			entry: orderCommand{Type: TypeReserveInventory, OrderItems: []orderItemCommand{{ProductID: 7, Quantity: 1, Price: 4.5}}},
+			want:  &ReserveInventory{Items: []OrderItem{{ProductID: 7, Quantity: 1, Price: 4.5}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkDecode(t, tt.entry, tt.want, tt.err)
+			checkDecode(t, throughStorage(t, tt.entry), tt.want, tt.err)
+		})
+	}
+}
+
+// TestDecodeEnvelope checks that enveloped commands of every schema version
+// decode after a JSON round trip, and that unknown types and versions fail
+func TestDecodeEnvelope(t *testing.T) {
+	at := time.Date(2024, 5, 1, 18, 30, 0, 0, time.UTC)
+	restock := []domain.IngredientAmount{{IngredientID: 2, Quantity: 1.5}}
+
+	tests := []struct {
+		name  string
+		entry interface{}
+		want  Command
+		err   string
+	}{
+		{
+			name:  "create order v1",
+			entry: Envelope{Type: TypeCreateOrder, Version: 1, Payload: json.RawMessage(`{"customer_id":3,"merchant_id":4,"items":[{"product_id":7,"quantity":2,"price":4.5}],"notes":"no ice"}`)},
+			want:  &CreateOrder{CustomerID: 3, MerchantID: 4, Items: []OrderItem{{ProductID: 7, Quantity: 2, Price: 4.5}}, Notes: "no ice"},
+		},
+		{
+			name:  "update order status v1",
+			entry: Envelope{Type: TypeUpdateOrderStatus, Version: 1, Payload: json.RawMessage(`{"order_id":9,"status":"cancelled"}`)},
+			want:  &UpdateOrderStatus{OrderID: 9, Status: domain.OrderStatusCancelled},
+		},
+		{
+			name:  "update ingredient v1",
+			entry: Envelope{Type: TypeUpdateIngredient, Version: 1, Payload: json.RawMessage(`{"id":12,"merchant_id":4,"name":"Lime","quantity":15}`)},
+			want:  &UpdateIngredient{ID: 12, IngredientFields: IngredientFields{MerchantID: 4, Name: "Lime", Quantity: 15}},
+		},
+		{
+			name: "create order v2",
+			entry: encode(t, &CreateOrder{
+				OrderID: 21, CustomerID: 3, MerchantID: 4, TotalAmount: 9,
+				Items:       []OrderItem{{ID: 40, ProductID: 7, Quantity: 2, Price: 4.5}},
+				Ingredients: restock, CreatedAt: at,
+			}),
+			want: &CreateOrder{
+				OrderID: 21, CustomerID: 3, MerchantID: 4, TotalAmount: 9,
+				Items:       []OrderItem{{ID: 40, ProductID: 7, Quantity: 2, Price: 4.5}},
+				Ingredients: restock, CreatedAt: at,
+			},
+		},
+		{
+			name:  "update order status v2",
+			entry: encode(t, &UpdateOrderStatus{OrderID: 21, Status: domain.OrderStatusCancelled, Restock: restock, UpdatedAt: at}),
+			want:  &UpdateOrderStatus{OrderID: 21, Status: domain.OrderStatusCancelled, Restock: restock, UpdatedAt: at},
+		},
+		{
+			name:  "update order v2",
+			entry: encode(t, &UpdateOrder{OrderID: 21, Status: "completed", Notes: "picked up", UpdatedAt: at}),
+			want:  &UpdateOrder{OrderID: 21, Status: "completed", Notes: "picked up", UpdatedAt: at},
+		},
+		{
+			name:  "create ingredient v2",
+			entry: encode(t, &CreateIngredient{ID: 12, IngredientFields: IngredientFields{MerchantID: 4, Name: "Lime", Unit: "pcs"}, CreatedAt: at}),
+			want:  &CreateIngredient{ID: 12, IngredientFields: IngredientFields{MerchantID: 4, Name: "Lime", Unit: "pcs"}, CreatedAt: at},
+		},
+		{
+			name:  "delete ingredient",
+			entry: encode(t, &DeleteIngredient{ID: 12}),
+			want:  &DeleteIngredient{ID: 12},
+		},
+		{
+			name:  "reserve inventory v1",
+			entry: Envelope{Type: TypeReserveInventory, Version: 1, Payload: json.RawMessage(`{"order_id":0,"items":[{"product_id":7,"quantity":1,"price":4.5}]}`)},
+			want:  &ReserveInventory{Items: []OrderItem{{ProductID: 7, Quantity: 1, Price: 4.5}}},
+		},
+		{
+			name:  "delete order",
+			entry: encode(t, &DeleteOrder{OrderID: 21, Restock: restock, DeletedAt: at}),
+			want:  &DeleteOrder{OrderID: 21, Restock: restock, DeletedAt: at},
+		},
+		{
+			name:  "unknown type",
+			entry: Envelope{Type: "brew_coffee", Version: 1, Payload: json.RawMessage(`{}`)},
+			err:   `unknown command type "brew_coffee"`,
+		},
+		{
+			name:  "unknown version",
+			entry: Envelope{Type: TypeCreateOrder, Version: 3, Payload: json.RawMessage(`{}`)},
+			err:   `unsupported version 3 of command "create_order"`,
+		},
+		{
+			name:  "bad payload",
+			entry: Envelope{Type: TypeDeleteOrder, Version: 1, Payload: json.RawMessage(`{"order_id":"21"}`)},
+			err:   "failed to decode delete_order v1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkDecode(t, tt.entry, tt.want, tt.err)
+			checkDecode(t, throughStorage(t, tt.entry), tt.want, tt.err)
+		})
+	}
+}
+
+// TestEnvelopeFields checks that the type and session of an entry survive a
+// JSON round trip without decoding the payload
+func TestEnvelopeFields(t *testing.T) {
+	if env := encode(t, &CreateOrder{}); env.Version != 2 {
+		t.Fatalf("Encode wrote %s v%d, want the current v2", env.Type, env.Version)
+	}
+	env := encode(t, &DeleteIngredient{ID: 12})
+	if env.Version != 1 {
+		t.Fatalf("Encode wrote %s v%d, want v1", env.Type, env.Version)
+	}
+	session := &Session{ClientID: "c-1", Sequence: 4, At: time.Date(2024, 5, 1, 18, 30, 0, 0, time.UTC)}
+	env.Session = session
+
+	entry := throughStorage(t, env)
+	if got := TypeOf(entry); got != TypeDeleteIngredient {
+		t.Fatalf("TypeOf = %q, want %q", got, TypeDeleteIngredient)
+	}
+	if got := SessionOf(entry); !reflect.DeepEqual(got, session) {
+		t.Fatalf("SessionOf = %+v, want %+v", got, session)
+	}
+	if got := TypeOf("not a command"); got != "unknown" {
+		t.Fatalf("TypeOf of a string = %q, want unknown", got)
+	}
+	if got := SessionOf(throughStorage(t, orderCommand{Type: TypeCreateOrder})); got != nil {
+		t.Fatalf("SessionOf of a legacy command = %+v, want nil", got)
+	}
+}
+
+func encode(t *testing.T, cmd Command) Envelope {
+	t.Helper()
+	env, err := Encode(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
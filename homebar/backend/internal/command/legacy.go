@@ -0,0 +1,87 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/kexincchen/homebar/internal/domain"
+)
+
+// legacyCommand is the untyped command written to the log before envelopes
+// were introduced. Command specific values were carried in AdditionalData.
+type legacyCommand struct {
+	Type           string
+	OrderID        uint
+	CustomerID     uint
+	MerchantID     uint
+	OrderItems     []OrderItem
+	AdditionalData map[string]interface{}
+}
+
+// decodeLegacy upgrades a command written before envelopes to its typed form
+func decodeLegacy(v interface{}) (Command, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal legacy command: %w", err)
+	}
+	var old legacyCommand
+	if err := json.Unmarshal(data, &old); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal legacy command: %w", err)
+	}
+
+	switch old.Type {
+	case TypeCreateOrder:
+		notes, _ := old.AdditionalData["notes"].(string)
+		return &CreateOrder{
+			CustomerID: old.CustomerID,
+			MerchantID: old.MerchantID,
+			Items:      old.OrderItems,
+			Notes:      notes,
+		}, nil
+
+	case TypeUpdateOrderStatus:
+		status, ok := old.AdditionalData["status"].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid status in legacy %s command", old.Type)
+		}
+		return &UpdateOrderStatus{OrderID: old.OrderID, Status: domain.OrderStatus(status)}, nil
+
+	case TypeUpdateOrder:
+		status, _ := old.AdditionalData["status"].(string)
+		notes, _ := old.AdditionalData["notes"].(string)
+		return &UpdateOrder{OrderID: old.OrderID, Status: status, Notes: notes}, nil
+
+	case TypeCreateIngredient, TypeUpdateIngredient:
+		// AdditionalData held the JSON form of the domain ingredient
+		var ingredient domain.Ingredient
+		if err := remarshal(old.AdditionalData, &ingredient); err != nil {
+			return nil, fmt.Errorf("invalid ingredient in legacy %s command: %w", old.Type, err)
+		}
+		if old.Type == TypeCreateIngredient {
+			return &CreateIngredient{IngredientFields: NewIngredientFields(&ingredient)}, nil
+		}
+		return &UpdateIngredient{ID: ingredient.ID, IngredientFields: NewIngredientFields(&ingredient)}, nil
+
+	case TypeDeleteIngredient:
+		id, ok := old.AdditionalData["id"].(float64)
+		if !ok {
+			return nil, fmt.Errorf("invalid ingredient ID in legacy %s command", old.Type)
+		}
+		return &DeleteIngredient{ID: int64(id)}, nil
+
+	case TypeReserveInventory:
+		return &ReserveInventory{OrderID: old.OrderID, Items: old.OrderItems}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown command type %q", old.Type)
+	}
+}
+
+// remarshal converts a generic JSON value into a typed one
+func remarshal(from interface{}, to interface{}) error {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, to)
+}
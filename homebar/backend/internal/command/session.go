@@ -0,0 +1,16 @@
+package command
+
+import "time"
+
+// Session identifies the client request a command was proposed for. The
+// state machine applies each sequence number of a client once and answers
+// a retried request with the result it recorded the first time.
+type Session struct {
+	ClientID string `json:"client_id"`
+	Sequence uint64 `json:"seq"`
+
+	// At is the leader's clock when the command was proposed. Sessions expire
+	// by this time rather than the applying node's, so every node drops them
+	// at the same point in the log.
+	At time.Time `json:"at"`
+}
@@ -0,0 +1,184 @@
+package command
+
+import (
+	"time"
+
+	"github.com/kexincchen/homebar/internal/domain"
+)
+
+// Command types
+const (
+	TypeCreateOrder       = "create_order"
+	TypeUpdateOrderStatus = "update_order_status"
+	TypeUpdateOrder       = "update_order"
+	TypeCreateIngredient  = "create_ingredient"
+	TypeUpdateIngredient  = "update_ingredient"
+	TypeDeleteIngredient  = "delete_ingredient"
+	TypeReserveInventory  = "reserve_inventory"
+	TypeDeleteOrder       = "delete_order"
+)
+
+// Version 2 added the inputs the leader resolves before proposing: row IDs,
+// timestamps, item prices and the stock an order takes or returns. Version 1
+// payloads decode into the same structs with those fields left zero.
+func init() {
+	for version := 1; version <= 2; version++ {
+		Register(TypeCreateOrder, version, decodeJSON[CreateOrder]())
+		Register(TypeUpdateOrderStatus, version, decodeJSON[UpdateOrderStatus]())
+		Register(TypeUpdateOrder, version, decodeJSON[UpdateOrder]())
+		Register(TypeCreateIngredient, version, decodeJSON[CreateIngredient]())
+		Register(TypeUpdateIngredient, version, decodeJSON[UpdateIngredient]())
+	}
+	Register(TypeDeleteIngredient, 1, decodeJSON[DeleteIngredient]())
+	Register(TypeReserveInventory, 1, decodeJSON[ReserveInventory]())
+	Register(TypeDeleteOrder, 1, decodeJSON[DeleteOrder]())
+}
+
+// OrderItem is one product line of an order
+type OrderItem struct {
+	ID        uint    `json:"id,omitempty"`
+	ProductID uint    `json:"product_id"`
+	Quantity  int     `json:"quantity"`
+	Price     float64 `json:"price"`
+}
+
+// CreateOrder places an order and takes its ingredients out of stock
+type CreateOrder struct {
+	OrderID     uint                      `json:"order_id"`
+	CustomerID  uint                      `json:"customer_id"`
+	MerchantID  uint                      `json:"merchant_id"`
+	Items       []OrderItem               `json:"items"`
+	TotalAmount float64                   `json:"total_amount"`
+	Notes       string                    `json:"notes,omitempty"`
+	Ingredients []domain.IngredientAmount `json:"ingredients,omitempty"`
+	CreatedAt   time.Time                 `json:"created_at"`
+}
+
+func (*CreateOrder) CommandType() string { return TypeCreateOrder }
+
+// Order returns the domain order and items the command creates
+func (c *CreateOrder) Order() (*domain.Order, []domain.OrderItem) {
+	order := &domain.Order{
+		ID:          c.OrderID,
+		CustomerID:  c.CustomerID,
+		MerchantID:  c.MerchantID,
+		TotalAmount: c.TotalAmount,
+		Status:      domain.OrderStatusPending,
+		Notes:       c.Notes,
+		CreatedAt:   c.CreatedAt,
+		UpdatedAt:   c.CreatedAt,
+	}
+	items := make([]domain.OrderItem, len(c.Items))
+	for i, item := range c.Items {
+		items[i] = domain.OrderItem{
+			ID:        item.ID,
+			OrderID:   c.OrderID,
+			ProductID: item.ProductID,
+			Quantity:  item.Quantity,
+			Price:     item.Price,
+		}
+	}
+	return order, items
+}
+
+// UpdateOrderStatus moves an order to a new status. Cancelling a pending
+// order returns Restock to the inventory.
+type UpdateOrderStatus struct {
+	OrderID   uint                      `json:"order_id"`
+	Status    domain.OrderStatus        `json:"status"`
+	Restock   []domain.IngredientAmount `json:"restock,omitempty"`
+	UpdatedAt time.Time                 `json:"updated_at"`
+}
+
+func (*UpdateOrderStatus) CommandType() string { return TypeUpdateOrderStatus }
+
+// UpdateOrder changes the status and notes of an order
+type UpdateOrder struct {
+	OrderID   uint      `json:"order_id"`
+	Status    string    `json:"status"`
+	Notes     string    `json:"notes"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (*UpdateOrder) CommandType() string { return TypeUpdateOrder }
+
+// DeleteOrder removes an order, returning Restock to the inventory if the
+// order is still pending
+type DeleteOrder struct {
+	OrderID   uint                      `json:"order_id"`
+	Restock   []domain.IngredientAmount `json:"restock,omitempty"`
+	DeletedAt time.Time                 `json:"deleted_at"`
+}
+
+func (*DeleteOrder) CommandType() string { return TypeDeleteOrder }
+
+// IngredientFields are the replicated attributes of an ingredient
+type IngredientFields struct {
+	MerchantID        int64   `json:"merchant_id"`
+	Name              string  `json:"name"`
+	Description       string  `json:"description"`
+	Quantity          float64 `json:"quantity"`
+	Unit              string  `json:"unit"`
+	LowStockThreshold float64 `json:"low_stock_threshold"`
+}
+
+// NewIngredientFields copies the replicated attributes of an ingredient
+func NewIngredientFields(i *domain.Ingredient) IngredientFields {
+	return IngredientFields{
+		MerchantID:        i.MerchantID,
+		Name:              i.Name,
+		Description:       i.Description,
+		Quantity:          i.Quantity,
+		Unit:              i.Unit,
+		LowStockThreshold: i.LowStockThreshold,
+	}
+}
+
+// Ingredient returns a domain ingredient with these attributes
+func (f IngredientFields) Ingredient(id int64) *domain.Ingredient {
+	return &domain.Ingredient{
+		ID:                id,
+		MerchantID:        f.MerchantID,
+		Name:              f.Name,
+		Description:       f.Description,
+		Quantity:          f.Quantity,
+		Unit:              f.Unit,
+		LowStockThreshold: f.LowStockThreshold,
+	}
+}
+
+// CreateIngredient adds an ingredient to a merchant's inventory
+type CreateIngredient struct {
+	ID int64 `json:"id"`
+	IngredientFields
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (*CreateIngredient) CommandType() string { return TypeCreateIngredient }
+
+// UpdateIngredient replaces the attributes of an ingredient
+type UpdateIngredient struct {
+	ID int64 `json:"id"`
+	IngredientFields
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (*UpdateIngredient) CommandType() string { return TypeUpdateIngredient }
+
+// DeleteIngredient removes an ingredient
+type DeleteIngredient struct {
+	ID int64 `json:"id"`
+}
+
+func (*DeleteIngredient) CommandType() string { return TypeDeleteIngredient }
+
+// ReserveInventory records that the stock for the items was checked before
+// an order was placed. It changes nothing when applied: orders take their
+// ingredients out of stock with CreateOrder. Logs written by earlier releases
+// hold it, so it stays registered.
+type ReserveInventory struct {
+	OrderID uint        `json:"order_id"`
+	Items   []OrderItem `json:"items"`
+}
+
+func (*ReserveInventory) CommandType() string { return TypeReserveInventory }
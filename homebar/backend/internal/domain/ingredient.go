@@ -25,4 +25,10 @@ type ProductIngredient struct {
 	Quantity       float64 `json:"quantity"`
 	IngredientName string  `json:"ingredient_name"`
 	IngredientUnit string  `json:"ingredient_unit"`
-}
\ No newline at end of file
+}
+
+// IngredientAmount is a quantity of one ingredient taken from or returned to stock
+type IngredientAmount struct {
+	IngredientID int64   `json:"ingredient_id"`
+	Quantity     float64 `json:"quantity"`
+}
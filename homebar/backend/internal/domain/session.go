@@ -0,0 +1,15 @@
+package domain
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ClientSession is the latest request a client had applied and its outcome
+type ClientSession struct {
+	ClientID   string          `json:"client_id"`
+	Sequence   uint64          `json:"seq"`
+	Result     json.RawMessage `json:"result,omitempty"` // JSON of the created row, if any
+	Error      string          `json:"error,omitempty"`  // Error returned by applying the command
+	LastActive time.Time       `json:"last_active"`
+}
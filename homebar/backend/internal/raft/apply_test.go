@@ -0,0 +1,120 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// TestApplyBackpressure stalls the state machines of a cluster and checks
+// that the leader keeps its leadership while refusing new commands, and
+// that everything proposed is applied once the state machines resume
+func TestApplyBackpressure(t *testing.T) {
+	ids := []string{"1", "2", "3"}
+	addrs := make(map[string]string)
+	for _, id := range ids {
+		addrs[id] = "apply-" + id
+	}
+
+	network := NewMemoryNetwork()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// State machines apply nothing while stall is held
+	var stall sync.RWMutex
+	var nodes []*RaftNode
+	for _, id := range ids {
+		logger := zerolog.Nop()
+		applyCh := make(chan LogEntry, 4)
+		node := NewRaftNodeWithConfig(Config{
+			ID:              id,
+			Peers:           ids,
+			PeerAddrs:       addrs,
+			ApplyCh:         applyCh,
+			Transport:       network.Transport(addrs[id]),
+			MaxApplyBacklog: 20,
+			PreVote:         true,
+			CheckQuorum:     true,
+			Logger:          &logger,
+		})
+		if err := node.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case entry := <-applyCh:
+					stall.RLock()
+					stall.RUnlock()
+					node.NotifyApplied(entry.Index)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	leader := func() *RaftNode {
+		for _, node := range nodes {
+			if node.IsLeader() {
+				return node
+			}
+		}
+		return nil
+	}
+	var first *RaftNode
+	for deadline := time.Now().Add(5 * time.Second); first == nil && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		first = leader()
+	}
+	if first == nil {
+		t.Fatal("no leader elected")
+	}
+	term := first.Status().Term
+
+	stall.Lock()
+	var futures []*Future
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		var f *Future
+		if f, err = first.Propose(i); err == nil {
+			futures = append(futures, f)
+		}
+	}
+	if !errors.Is(err, ErrApplyBacklog) {
+		stall.Unlock()
+		t.Fatalf("Propose with stalled state machines returned %v after %d commands, want ErrApplyBacklog", err, len(futures))
+	}
+
+	// Heartbeats do not wait for the state machine
+	time.Sleep(4 * MaxElectionTimeout)
+	if status := first.Status(); status.State != Leader || status.Term != term {
+		stall.Unlock()
+		t.Fatalf("leader is %s in term %d with its state machine stalled, want leader in term %d", status.State, status.Term, term)
+	}
+	stall.Unlock()
+
+	for _, f := range futures {
+		waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+		_, err := f.Wait(waitCtx)
+		waitCancel()
+		if err != nil {
+			t.Fatalf("command at index %d: %v", f.Index(), err)
+		}
+	}
+	if _, err := first.Propose("after"); err != nil {
+		t.Fatalf("Propose once the state machines caught up: %v", err)
+	}
+}
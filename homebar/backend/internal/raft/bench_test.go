@@ -0,0 +1,148 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// The benchmarks measure write throughput of a 3-node cluster in one
+// process: nodes talk over a MemoryNetwork and persist to real storage, so
+// the numbers include encoding, fsync and the replication round trips, but
+// not the network or the database the commands are applied to.
+
+// benchOrder stands in for an order command
+type benchOrder struct {
+	CustomerID int64   `json:"customer_id"`
+	ProductIDs []int64 `json:"product_ids"`
+	Quantities []int   `json:"quantities"`
+	Notes      string  `json:"notes"`
+}
+
+// benchCluster starts a 3-node cluster on the named storage engine and
+// returns its leader
+func benchCluster(b *testing.B, engine string) *RaftNode {
+	ids := []string{"1", "2", "3"}
+	addrs := make(map[string]string)
+	for _, id := range ids {
+		addrs[id] = "bench-" + id
+	}
+
+	network := NewMemoryNetwork()
+	dir := b.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var nodes []*RaftNode
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		storage, err := NewStorage(engine, id, dir)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		logger := zerolog.Nop()
+		applyCh := make(chan LogEntry, MaxLogEntriesBuffer)
+		node := NewRaftNodeWithConfig(Config{
+			ID:        id,
+			Peers:     ids,
+			PeerAddrs: addrs,
+			ApplyCh:   applyCh,
+			Storage:   storage,
+			Transport: network.Transport(addrs[id]),
+			Logger:    &logger,
+		})
+		if err := node.Start(ctx); err != nil {
+			b.Fatal(err)
+		}
+		nodes = append(nodes, node)
+
+		// Resolve futures the way RaftService does once an order is stored
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case entry := <-applyCh:
+					node.NotifyApplied(entry.Index)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		b.Cleanup(func() { storage.Close() })
+	}
+	b.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, node := range nodes {
+			if node.IsLeader() {
+				return node
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.Fatal("no leader elected")
+	return nil
+}
+
+// BenchmarkClusterOrders proposes orders from concurrent clients and waits
+// for each one to be applied
+func BenchmarkClusterOrders(b *testing.B) {
+	// FileStorage rewrites the whole log on every append and is left out
+	for _, engine := range []string{StorageWAL, StorageBolt} {
+		for _, clients := range []int{1, 16, 128} {
+			b.Run(fmt.Sprintf("storage=%s/clients=%d", engine, clients), func(b *testing.B) {
+				benchmarkOrders(b, engine, clients)
+			})
+		}
+	}
+}
+
+func benchmarkOrders(b *testing.B, engine string, clients int) {
+	leader := benchCluster(b, engine)
+	order := benchOrder{CustomerID: 7, ProductIDs: []int64{1, 2, 3}, Quantities: []int{2, 1, 1}, Notes: "no ice"}
+
+	var next int64
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+
+	b.ResetTimer()
+	start := time.Now()
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.AddInt64(&next, 1) <= int64(b.N) {
+				f, err := leader.Propose(order)
+				if err == nil {
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					_, err = f.Wait(ctx)
+					cancel()
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	select {
+	case err := <-errs:
+		b.Fatal(err)
+	default:
+	}
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "orders/s")
+}
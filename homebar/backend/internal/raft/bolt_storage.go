@@ -0,0 +1,286 @@
+package raft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Embedded key-value storage.
+//
+// Everything a node persists lives in one bbolt file. The meta bucket holds
+// the state, configuration and snapshot under fixed keys; the log bucket
+// holds one JSON entry per index, keyed by the big-endian index so that keys
+// sort in log order and a cursor reads a range of entries directly. Every
+// method runs in a single transaction that is fsynced on commit, so a crash
+// leaves either all or none of a call's changes.
+
+var (
+	boltMetaBucket = []byte("meta")
+	boltLogBucket  = []byte("log")
+
+	boltStateKey    = []byte("state")
+	boltConfigKey   = []byte("config")
+	boltSnapshotKey = []byte("snapshot")
+)
+
+// BoltStorage implements the Storage interface with an embedded bbolt database
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+// NewBoltStorage opens the database of a node, creating it if needed
+func NewBoltStorage(nodeID string, dir string) (Storage, error) {
+	if dir == "" {
+		dir = "raft-data"
+	}
+	return openBolt(filepath.Join(dir, fmt.Sprintf("node-%s", nodeID), "raft.db"))
+}
+
+// openBolt opens the database at path
+func openBolt(path string) (*BoltStorage, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	// The file is locked while open; give up instead of hanging if another
+	// process holds it
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltMetaBucket, boltLogBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create buckets: %w", err)
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+// openBoltReadOnly opens the database at path without changing it. Every
+// write fails.
+func openBoltReadOnly(path string) (*BoltStorage, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltMetaBucket, boltLogBucket} {
+			if tx.Bucket(name) == nil {
+				return fmt.Errorf("bucket %s is missing", name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+// boltKey encodes a log index as a key that sorts in index order
+func boltKey(index uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, index)
+	return key
+}
+
+// putMeta stores the JSON form of v under key in the meta bucket
+func (bs *BoltStorage) putMeta(key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", key, err)
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMetaBucket).Put(key, data)
+	})
+}
+
+// getMeta decodes the value under key in the meta bucket into v, reporting
+// whether there was one
+func (bs *BoltStorage) getMeta(key []byte, v interface{}) (bool, error) {
+	var found bool
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltMetaBucket).Get(key)
+		if data == nil {
+			return nil
+		}
+		found = true
+		if err := json.Unmarshal(data, v); err != nil {
+			return fmt.Errorf("failed to unmarshal %s: %w", key, err)
+		}
+		return nil
+	})
+	return found, err
+}
+
+// SaveState persists the current term, votedFor, and lastApplied
+func (bs *BoltStorage) SaveState(term uint64, votedFor string, lastApplied uint64) error {
+	return bs.putMeta(boltStateKey, persistentState{CurrentTerm: term, VotedFor: votedFor, LastApplied: lastApplied})
+}
+
+// LoadState loads the saved term, votedFor, and lastApplied
+func (bs *BoltStorage) LoadState() (uint64, string, uint64, error) {
+	var state persistentState
+	if _, err := bs.getMeta(boltStateKey, &state); err != nil {
+		return 0, "", 0, err
+	}
+	return state.CurrentTerm, state.VotedFor, state.LastApplied, nil
+}
+
+// AppendLog writes the entries in one transaction. Stored entries at or
+// after the index of the first one are deleted first.
+func (bs *BoltStorage) AppendLog(entries []LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	first := entries[0].Index
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltLogBucket)
+		if err := deleteFrom(b, first); err != nil {
+			return err
+		}
+		if last, _ := b.Cursor().Last(); last != nil && binary.BigEndian.Uint64(last)+1 != first {
+			return fmt.Errorf("entry %d does not follow the last stored entry %d", first, binary.BigEndian.Uint64(last))
+		}
+
+		for i, entry := range entries {
+			if entry.Index != first+uint64(i) {
+				return fmt.Errorf("entry %d does not follow entry %d", entry.Index, first+uint64(i)-1)
+			}
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return fmt.Errorf("failed to marshal entry %d: %w", entry.Index, err)
+			}
+			if err := b.Put(boltKey(entry.Index), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadLog loads all log entries
+func (bs *BoltStorage) LoadLog() ([]LogEntry, error) {
+	return bs.Entries(0, 0)
+}
+
+// Entries returns the stored entries with lo <= index < hi. A hi of zero
+// reads to the end of the log.
+func (bs *BoltStorage) Entries(lo, hi uint64) ([]LogEntry, error) {
+	var entries []LogEntry
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltLogBucket).Cursor()
+		for k, v := c.Seek(boltKey(lo)); k != nil; k, v = c.Next() {
+			if hi != 0 && binary.BigEndian.Uint64(k) >= hi {
+				break
+			}
+			var entry LogEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("failed to unmarshal entry %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// SaveSnapshot persists the latest snapshot, replacing any older one
+func (bs *BoltStorage) SaveSnapshot(snapshot Snapshot) error {
+	return bs.putMeta(boltSnapshotKey, snapshot)
+}
+
+// LoadSnapshot loads the latest snapshot, or nil if none has been taken
+func (bs *BoltStorage) LoadSnapshot() (*Snapshot, error) {
+	var snapshot Snapshot
+	found, err := bs.getMeta(boltSnapshotKey, &snapshot)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// TruncatePrefix discards all log entries up to and including index
+func (bs *BoltStorage) TruncatePrefix(index uint64) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltLogBucket)
+
+		// Deleting under a cursor can skip the following key, so collect first
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= index; k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// TruncateSuffix discards all log entries from index onwards
+func (bs *BoltStorage) TruncateSuffix(index uint64) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return deleteFrom(tx.Bucket(boltLogBucket), index)
+	})
+}
+
+// deleteFrom deletes the entries of the log bucket from index onwards
+func deleteFrom(b *bolt.Bucket, index uint64) error {
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.Seek(boltKey(index)); k != nil; k, _ = c.Next() {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveConfiguration persists the membership at the start of the log
+func (bs *BoltStorage) SaveConfiguration(config Configuration) error {
+	return bs.putMeta(boltConfigKey, config)
+}
+
+// LoadConfiguration loads the membership at the start of the log, or nil if none was saved
+func (bs *BoltStorage) LoadConfiguration() (*Configuration, error) {
+	var config Configuration
+	found, err := bs.getMeta(boltConfigKey, &config)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Close closes the database and releases its file lock
+func (bs *BoltStorage) Close() error {
+	return bs.db.Close()
+}
@@ -0,0 +1,33 @@
+package raft
+
+import "time"
+
+// Clock is the node's source of time. The simulation tests replace the
+// system clock with a seeded one so that timeouts fire deterministically.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+
+	// AfterFunc calls f once d has elapsed. f may run on any goroutine.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending call created by Clock.AfterFunc
+type Timer interface {
+	// Reset reschedules the call to happen after d
+	Reset(d time.Duration) bool
+
+	// Stop prevents the call from happening if it has not already
+	Stop() bool
+}
+
+// systemClock is the Clock backed by the time package
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
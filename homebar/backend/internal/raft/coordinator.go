@@ -6,14 +6,21 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"net/url"
-	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
+
+	"github.com/kexincchen/homebar/internal/command"
+)
+
+const (
+	observerBuffer = 64               // Events of the local node waiting for the coordinator
+	healthInterval = 5 * time.Second  // How often the other nodes are probed
+	eventKeepAlive = 15 * time.Second // Comment sent on idle event streams so proxies keep them open
 )
 
 // ClusterState represents the overall state of the Raft cluster
@@ -25,13 +32,34 @@ type ClusterState struct {
 	LastUpdated time.Time
 }
 
-// NodeStatus represents the status of a node in the cluster
+// NodeStatus represents the status of a node in the cluster. Term and
+// indexes of other nodes are as they last reported them.
 type NodeStatus struct {
-	ID        string
-	State     NodeState
-	IsHealthy bool
-	LastSeen  time.Time
-	Address   string
+	ID                 string        `json:"id"`
+	State              NodeState     `json:"state"`
+	Role               string        `json:"role"` // RoleVoter or RoleLearner
+	IsHealthy          bool          `json:"healthy"`
+	LastSeen           time.Time     `json:"last_seen"`
+	Address            string        `json:"api_address"`
+	RaftAddress        string        `json:"raft_address"`
+	CoordinatorAddress string        `json:"coordinator_address"`
+	Term               uint64        `json:"term"`
+	CommitIndex        uint64        `json:"commit_index"`
+	AppliedIndex       uint64        `json:"applied_index"`
+	Replication        *PeerProgress `json:"replication,omitempty"` // Leader's progress for this node, when the reporting node leads
+}
+
+// ClusterStatus is the cluster as seen by one node's coordinator, served
+// on /cluster/status and streamed on /cluster/events
+type ClusterStatus struct {
+	NodeID      string            `json:"node_id"` // Node whose coordinator reports
+	LeaderID    string            `json:"leader"`
+	Term        uint64            `json:"term"`
+	CommitIndex uint64            `json:"commit_index"`
+	Healthy     int               `json:"nodes"` // Number of healthy nodes
+	Roles       map[string]string `json:"roles"`
+	Members     []NodeStatus      `json:"members"` // Sorted by node ID
+	UpdatedAt   time.Time         `json:"updated_at"`
 }
 
 // ClusterCoordinator manages the Raft cluster membership and monitoring
@@ -43,7 +71,12 @@ type ClusterCoordinator struct {
 	logger     *zerolog.Logger
 	stopCh     chan struct{}
 	peerAddrs  map[string]string
+	topology   *Topology // The registered node's, for the API and coordinator addresses of members
 	selfID     string
+
+	// Event stream subscribers and the last status sent to them
+	subscribers map[chan ClusterStatus]struct{}
+	published   string
 }
 
 // NewClusterCoordinator creates a new coordinator for managing the cluster
@@ -57,9 +90,10 @@ func NewClusterCoordinator(logger *zerolog.Logger, peerAddrs map[string]string)
 			Nodes:       make(map[string]NodeStatus),
 			LastUpdated: time.Now(),
 		},
-		logger:    logger,
-		stopCh:    make(chan struct{}),
-		peerAddrs: peerAddrs,
+		logger:      logger,
+		stopCh:      make(chan struct{}),
+		peerAddrs:   peerAddrs,
+		subscribers: make(map[chan ClusterStatus]struct{}),
 	}
 }
 
@@ -68,22 +102,20 @@ func (c *ClusterCoordinator) RegisterNode(node *RaftNode) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-	if !strings.HasPrefix(port, ":") {
-		port = ":" + port
-	}
-	selfAddr := "http://127.0.0.1" + port
+	c.topology = node.Topology()
+	self := node.Addresses(node.id)
+	config := node.Configuration()
 
 	c.nodes[node.id] = node
 	c.state.Nodes[node.id] = NodeStatus{
-		ID:        node.id,
-		State:     Follower, // Assume follower initially
-		IsHealthy: true,
-		LastSeen:  time.Now(),
-		Address:   selfAddr,
+		ID:                 node.id,
+		State:              Follower, // Assume follower initially
+		Role:               config.Role(node.id),
+		IsHealthy:          true,
+		LastSeen:           time.Now(),
+		Address:            self.API,
+		RaftAddress:        self.Raft,
+		CoordinatorAddress: self.Coordinator,
 	}
 
 	for id, raftAddr := range c.peerAddrs {
@@ -94,14 +126,7 @@ func (c *ClusterCoordinator) RegisterNode(node *RaftNode) {
 			continue
 		}
 
-		businessAddr := raftToBusinessAddr(raftAddr)
-		c.state.Nodes[id] = NodeStatus{
-			ID:        id,
-			State:     Follower,
-			IsHealthy: false,
-			LastSeen:  time.Time{},
-			Address:   businessAddr,
-		}
+		c.state.Nodes[id] = c.peerStatus(id, raftAddr, config.Role(id))
 	}
 }
 
@@ -109,7 +134,9 @@ func (c *ClusterCoordinator) RegisterNode(node *RaftNode) {
 func (c *ClusterCoordinator) Start(ctx context.Context, nodeID string) error {
 	c.selfID = nodeID
 	// Start HTTP server for admin API
-	c.startHTTPServer(nodeID)
+	if err := c.startHTTPServer(nodeID); err != nil {
+		return err
+	}
 
 	// Start periodic health checks and state updates
 	go c.runMonitoring(ctx)
@@ -145,14 +172,39 @@ func (c *ClusterCoordinator) GetClusterState() ClusterState {
 	return state
 }
 
-// runMonitoring periodically checks node health and updates cluster state
+// runMonitoring keeps the cluster state up to date: the local node is read
+// whenever it reports an event, with a burst of commits read once, and other
+// nodes are probed every healthInterval and as soon as the local leader
+// loses or regains contact with one
 func (c *ClusterCoordinator) runMonitoring(ctx context.Context) {
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	c.mu.RLock()
+	self := c.nodes[c.selfID]
+	c.mu.RUnlock()
 
+	var events <-chan Event
+	if self != nil {
+		observer := self.RegisterObserver(observerBuffer, EventStateChange, EventLeaderChange, EventTermChange,
+			EventCommit, EventApplied, EventPeerUnreachable, EventPeerReachable)
+		defer self.DeregisterObserver(observer)
+		events = observer.Events()
+	}
+
+	healthTicker := time.NewTicker(healthInterval)
+	defer healthTicker.Stop()
+
+	c.checkNodesHealth()
+	c.updateClusterState()
 	for {
 		select {
-		case <-ticker.C:
+		case event := <-events:
+			// One read of the node's status covers every event queued
+			// behind this one
+			if drainEvents(events, event) {
+				c.checkNodesHealth()
+			}
+			c.updateClusterState()
+
+		case <-healthTicker.C:
 			c.checkNodesHealth()
 			c.updateClusterState()
 
@@ -165,34 +217,27 @@ func (c *ClusterCoordinator) runMonitoring(ctx context.Context) {
 	}
 }
 
-// checkNodesHealth checks the health of all nodes in the cluster
-func (c *ClusterCoordinator) checkNodesHealth() {
-	c.mu.RLock()
-	nodes := make([]*RaftNode, 0, len(c.nodes))
-	for _, node := range c.nodes {
-		nodes = append(nodes, node)
+// drainEvents empties the queue of pending events and reports whether any
+// of them, or the first one, changed the reachability of a peer
+func drainEvents(events <-chan Event, first Event) bool {
+	peerChanged := isPeerEvent(first)
+	for {
+		select {
+		case event := <-events:
+			peerChanged = peerChanged || isPeerEvent(event)
+		default:
+			return peerChanged
+		}
 	}
-	c.mu.RUnlock()
-
-	for _, node := range nodes {
-		// For local nodes, we can check directly
-		// For remote nodes, we would use the RPC client
-
-		// Update node status
-		c.mu.Lock()
-		status := c.state.Nodes[node.id]
-		status.LastSeen = time.Now()
-		status.IsHealthy = true // Assume healthy if we can access it
-
-		// Get state from node (for local nodes)
-		node.mu.Lock()
-		status.State = node.state
-		node.mu.Unlock()
+}
 
-		c.state.Nodes[node.id] = status
-		c.mu.Unlock()
-	}
+func isPeerEvent(event Event) bool {
+	return event.Type == EventPeerUnreachable || event.Type == EventPeerReachable
+}
 
+// checkNodesHealth probes the API of every other node and asks its
+// coordinator for the node's own status
+func (c *ClusterCoordinator) checkNodesHealth() {
 	c.mu.RLock()
 	peers := make(map[string]NodeStatus, len(c.state.Nodes))
 	for id, st := range c.state.Nodes {
@@ -207,68 +252,503 @@ func (c *ClusterCoordinator) checkNodesHealth() {
 		healthUrl := strings.TrimRight(st.Address, "/") + "/health"
 
 		ok := probe(healthUrl)
+		report, err := fetchStatus(strings.TrimRight(st.CoordinatorAddress, "/") + "/cluster/self")
+
 		c.mu.Lock()
-		cur := c.state.Nodes[id]
+		cur, exists := c.state.Nodes[id]
+		if !exists {
+			// Removed from the configuration meanwhile
+			c.mu.Unlock()
+			continue
+		}
 		cur.IsHealthy = ok
-		cur.LastSeen = time.Now()
+		if ok {
+			cur.LastSeen = time.Now()
+		}
+		if err == nil {
+			cur.State = report.State
+			cur.Term = report.Term
+			cur.CommitIndex = report.CommitIndex
+			cur.AppliedIndex = report.AppliedIndex
+		}
 		c.state.Nodes[id] = cur
 		c.mu.Unlock()
 	}
 }
 
-// updateClusterState collects and updates the overall cluster state
+// updateClusterState refreshes the cluster state from the local node and
+// notifies event stream subscribers if it changed
 func (c *ClusterCoordinator) updateClusterState() {
+	c.mu.RLock()
+	self := c.nodes[c.selfID]
+	c.mu.RUnlock()
+	if self == nil {
+		return
+	}
+	status := self.Status()
+	config := self.Configuration()
+
+	c.mu.Lock()
+	c.state.LeaderID = status.LeaderID
+	c.state.Term = status.Term
+	c.state.CommitIndex = status.CommitIndex
+	c.state.LastUpdated = time.Now()
+
+	// Follow membership changes made through the replicated configuration
+	c.syncMembership(config)
+
+	for id, st := range c.state.Nodes {
+		if id == c.selfID {
+			st.State = status.State
+			st.IsHealthy = true
+			st.LastSeen = c.state.LastUpdated
+			st.Term = status.Term
+			st.CommitIndex = status.CommitIndex
+			st.AppliedIndex = status.AppliedIndex
+		}
+		st.Replication = nil
+		if progress, ok := status.Peers[id]; ok {
+			st.Replication = &progress
+		}
+		// The leader is known here before the nodes are probed again
+		if id != c.selfID && status.LeaderID != "" {
+			if id == status.LeaderID {
+				st.State = Leader
+			} else if st.State == Leader {
+				st.State = Follower
+			}
+		}
+		c.state.Nodes[id] = st
+	}
+	c.mu.Unlock()
+
+	c.publish()
+}
+
+// syncMembership adds newly joined members to the cluster state, records
+// the role of every member and drops removed ones. Must be called with c.mu held.
+func (c *ClusterCoordinator) syncMembership(config Configuration) {
+	for id, raftAddr := range config.all() {
+		c.peerAddrs[id] = raftAddr
+		addrs := c.topology.Addresses(id, raftAddr)
+		if status, ok := c.state.Nodes[id]; ok {
+			status.Role = config.Role(id)
+			status.RaftAddress = addrs.Raft
+			c.state.Nodes[id] = status
+			continue
+		}
+		if addrs.Raft == "" {
+			continue
+		}
+		c.state.Nodes[id] = c.peerStatus(id, raftAddr, config.Role(id))
+	}
+
+	for id, status := range c.state.Nodes {
+		if id == c.selfID {
+			// Not part of the cluster before it has been added
+			status.Role = config.Role(id)
+			c.state.Nodes[id] = status
+			continue
+		}
+		if !config.Contains(id) {
+			delete(c.state.Nodes, id)
+			delete(c.peerAddrs, id)
+		}
+	}
+}
+
+// topologyRaftAddr returns the Raft address the topology lists for a node
+// joining the cluster
+func (c *ClusterCoordinator) topologyRaftAddr(id string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.topology.node(id).Raft
+}
+
+// peerStatus is the initial status of another node, until it is probed
+func (c *ClusterCoordinator) peerStatus(id, raftAddr, role string) NodeStatus {
+	addrs := c.topology.Addresses(id, raftAddr)
+	return NodeStatus{
+		ID:                 id,
+		State:              Follower,
+		Role:               role,
+		IsHealthy:          false,
+		LastSeen:           time.Time{},
+		Address:            addrs.API,
+		RaftAddress:        addrs.Raft,
+		CoordinatorAddress: addrs.Coordinator,
+	}
+}
+
+// ClusterStatus returns the cluster as seen by this coordinator
+func (c *ClusterCoordinator) ClusterStatus() ClusterStatus {
+	state := c.GetClusterState()
+
+	status := ClusterStatus{
+		NodeID:      c.selfID,
+		LeaderID:    state.LeaderID,
+		Term:        state.Term,
+		CommitIndex: state.CommitIndex,
+		Roles:       make(map[string]string, len(state.Nodes)),
+		Members:     make([]NodeStatus, 0, len(state.Nodes)),
+		UpdatedAt:   state.LastUpdated,
+	}
+	for id, ns := range state.Nodes {
+		if ns.IsHealthy {
+			status.Healthy++
+		}
+		status.Roles[id] = ns.Role
+		status.Members = append(status.Members, ns)
+	}
+	sort.Slice(status.Members, func(i, j int) bool {
+		return status.Members[i].ID < status.Members[j].ID
+	})
+	return status
+}
+
+// fingerprint identifies a status for change detection, leaving out the
+// timestamps that change on every refresh
+func (s ClusterStatus) fingerprint() string {
+	s.UpdatedAt = time.Time{}
+	members := make([]NodeStatus, len(s.Members))
+	for i, m := range s.Members {
+		m.LastSeen = time.Time{}
+		if m.Replication != nil {
+			progress := *m.Replication
+			progress.LastContact = time.Time{}
+			m.Replication = &progress
+		}
+		members[i] = m
+	}
+	s.Members = members
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+// publish sends the status to event stream subscribers if it changed since
+// the last one sent. A subscriber that has not read the previous status
+// gets the new one in its place.
+func (c *ClusterCoordinator) publish() {
+	status := c.ClusterStatus()
+	key := status.fingerprint()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if key == c.published {
+		return
+	}
+	c.published = key
+
+	for ch := range c.subscribers {
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- status:
+		default:
+		}
+	}
+}
+
+// subscribe registers an event stream for status changes
+func (c *ClusterCoordinator) subscribe() chan ClusterStatus {
+	ch := make(chan ClusterStatus, 1)
+	c.mu.Lock()
+	c.subscribers[ch] = struct{}{}
+	c.mu.Unlock()
+	return ch
+}
+
+func (c *ClusterCoordinator) unsubscribe(ch chan ClusterStatus) {
+	c.mu.Lock()
+	delete(c.subscribers, ch)
+	c.mu.Unlock()
+}
+
+// handleEvents streams the cluster status as Server-Sent Events. A status
+// event is sent on connect and whenever the status changes, and a leader
+// event precedes it when the leader or term changed.
+func (c *ClusterCoordinator) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := c.subscribe()
+	defer c.unsubscribe(ch)
 
-	// Find the leader and its term
-	var maxTerm uint64
-	for _, node := range c.nodes {
-		node.mu.Lock()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	status := c.ClusterStatus()
+	leader, term := status.LeaderID, status.Term
+	writeEvent(w, "status", status)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case status := <-ch:
+			if status.LeaderID != leader || status.Term != term {
+				writeEvent(w, "leader", map[string]interface{}{
+					"leader":          status.LeaderID,
+					"previous_leader": leader,
+					"term":            status.Term,
+				})
+				leader, term = status.LeaderID, status.Term
+			}
+			writeEvent(w, "status", status)
+			flusher.Flush()
 
-		if node.state == Leader {
-			c.state.LeaderID = node.id
-			maxTerm = node.currentTerm
-			c.state.CommitIndex = node.commitIndex
-		} else if node.currentTerm > maxTerm {
-			maxTerm = node.currentTerm
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+
+		case <-c.stopCh:
+			return
 		}
+	}
+}
 
-		node.mu.Unlock()
+// writeEvent writes one Server-Sent Event with a JSON payload
+func writeEvent(w http.ResponseWriter, event string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
 	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+}
 
-	c.state.Term = maxTerm
-	c.state.LastUpdated = time.Now()
+// handleMembers lists (GET), adds (POST) and removes (DELETE) members. POST
+// adds a voter; learners are added through handleLearners. Changes must be
+// made on the leader and take effect once committed.
+func (c *ClusterCoordinator) handleMembers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	c.mu.RLock()
+	node := c.nodes[c.selfID]
+	c.mu.RUnlock()
+	if node == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "node not registered"})
+		return
+	}
+
+	var (
+		index uint64
+		err   error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(node.Configuration())
+		return
+
+	case http.MethodPost:
+		var req struct {
+			ID      string `json:"id"`
+			Address string `json:"address"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err == nil && req.Address == "" {
+			req.Address = c.topologyRaftAddr(req.ID)
+		}
+		if req.ID == "" || req.Address == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "id and address are required, unless the topology has the address"})
+			return
+		}
+		index, err = node.AddMember(req.ID, req.Address)
+
+	case http.MethodDelete:
+		id := strings.TrimPrefix(r.URL.Path, "/cluster/members/")
+		if id == "" || id == r.URL.Path {
+			id = r.URL.Query().Get("id")
+		}
+		if id == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "id is required"})
+			return
+		}
+		index, err = node.RemoveMember(id)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeMembershipChange(w, node, index, err)
+}
+
+// handleLearners adds a learner (POST /cluster/learners) or promotes one to
+// a voting member once it has caught up (POST /cluster/learners/:id/promote)
+func (c *ClusterCoordinator) handleLearners(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.mu.RLock()
+	node := c.nodes[c.selfID]
+	c.mu.RUnlock()
+	if node == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "node not registered"})
+		return
+	}
+
+	if id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/cluster/learners/"), "/promote"); ok && id != "" {
+		index, err := node.PromoteLearner(id)
+		writeMembershipChange(w, node, index, err)
+		return
+	}
+
+	var req struct {
+		ID      string `json:"id"`
+		Address string `json:"address"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err == nil && req.Address == "" {
+		req.Address = c.topologyRaftAddr(req.ID)
+	}
+	if req.ID == "" || req.Address == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "id and address are required, unless the topology has the address"})
+		return
+	}
+	index, err := node.AddLearner(req.ID, req.Address)
+	writeMembershipChange(w, node, index, err)
+}
+
+// writeMembershipChange answers a membership request with the index of the
+// proposed configuration entry, or with the reason it was refused
+func writeMembershipChange(w http.ResponseWriter, node *RaftNode, index uint64, err error) {
+	switch {
+	case err == nil:
+		config := node.Configuration()
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"index":    index,
+			"members":  config.Members,
+			"learners": config.Learners,
+		})
+	case errors.Is(err, ErrNotLeader):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error(), "leader": node.LeaderID()})
+	case errors.Is(err, ErrConfigChangePending), errors.Is(err, ErrLeaderNotReady), errors.Is(err, ErrLearnerBehind):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	}
 }
 
-// startHTTPServer starts an HTTP server for administrative API endpoints
-func (c *ClusterCoordinator) startHTTPServer(nodeID string) {
+// handleTransferLeadership hands leadership of this node over to another
+// member, or to the most up-to-date one when no target is given
+func (c *ClusterCoordinator) handleTransferLeadership(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.mu.RLock()
+	node := c.nodes[c.selfID]
+	c.mu.RUnlock()
+	if node == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "node not registered"})
+		return
+	}
+
+	var req struct {
+		Target string `json:"target"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid request body"})
+			return
+		}
+	}
+	if req.Target == "" {
+		req.Target = r.URL.Query().Get("target")
+	}
+
+	err := node.TransferLeadership(req.Target)
+	switch {
+	case err == nil:
+		json.NewEncoder(w).Encode(map[string]string{"previous_leader": c.selfID, "target": req.Target})
+	case errors.Is(err, ErrNotLeader):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error(), "leader": node.LeaderID()})
+	case errors.Is(err, ErrLeadershipTransfer):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	case errors.Is(err, ErrTransferTimeout):
+		w.WriteHeader(http.StatusGatewayTimeout)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	}
+}
+
+// startHTTPServer starts an HTTP server for administrative API endpoints on
+// the port of the node's coordinator address
+func (c *ClusterCoordinator) startHTTPServer(nodeID string) error {
+	c.mu.RLock()
+	listenAddr, err := ListenAddr(c.topology.Addresses(nodeID, c.peerAddrs[nodeID]).Coordinator)
+	c.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to find coordinator address of node %s: %w", nodeID, err)
+	}
+
 	mux := http.NewServeMux()
 
 	// Add endpoints for cluster management
 	mux.HandleFunc("/cluster/status", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		state := c.GetClusterState()
-
-		alive := 0
-		for _, ns := range state.Nodes {
-			if ns.IsHealthy {
-				alive++
-			}
-		}
-		fmt.Fprintf(w, `{"leader":"%s","term":%d,"nodes":%d}`,
-			state.LeaderID, state.Term, alive)
+		json.NewEncoder(w).Encode(c.ClusterStatus())
 	})
 
 	mux.HandleFunc("/cluster/nodes", func(w http.ResponseWriter, r *http.Request) {
 		// Return info about all nodes
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
 
-		state := c.GetClusterState()
-		fmt.Fprintf(w, `{"count":%d}`, len(state.Nodes))
+		status := c.ClusterStatus()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"count": len(status.Members),
+			"nodes": status.Members,
+		})
+	})
+
+	// This node's own view, which the coordinators of the other nodes poll
+	mux.HandleFunc("/cluster/self", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		c.mu.RLock()
+		node := c.nodes[c.selfID]
+		c.mu.RUnlock()
+		if node == nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"error": "node not registered"})
+			return
+		}
+		json.NewEncoder(w).Encode(node.Status())
 	})
 
+	mux.HandleFunc("/cluster/events", c.handleEvents)
+
 	mux.HandleFunc("/cluster/logs", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
@@ -290,10 +770,11 @@ func (c *ClusterCoordinator) startHTTPServer(nodeID string) {
 			// Get logs from the specific node
 			node := c.nodes[nodeID]
 			node.mu.Lock()
-			if len(node.log) > 0 {
+			if len(node.log) > 1 {
+				// node.log[0] stands for the snapshot, not an entry
 				startIdx := len(node.log) - limit
-				if startIdx < 0 {
-					startIdx = 0
+				if startIdx < 1 {
+					startIdx = 1
 				}
 				logEntries = append(logEntries, node.log[startIdx:]...)
 			}
@@ -302,10 +783,10 @@ func (c *ClusterCoordinator) startHTTPServer(nodeID string) {
 			// Get leader logs as a default
 			for _, node := range c.nodes {
 				node.mu.Lock()
-				if node.state == Leader && len(node.log) > 0 {
+				if node.state == Leader && len(node.log) > 1 {
 					startIdx := len(node.log) - limit
-					if startIdx < 0 {
-						startIdx = 0
+					if startIdx < 1 {
+						startIdx = 1
 					}
 					logEntries = append(logEntries, node.log[startIdx:]...)
 					node.mu.Unlock()
@@ -325,9 +806,14 @@ func (c *ClusterCoordinator) startHTTPServer(nodeID string) {
 		response := make([]LogEntryResponse, 0, len(logEntries))
 		for _, entry := range logEntries {
 			// Try to determine command type
-			cmdType := "unknown"
-			if cmd, ok := entry.Command.(OrderCommand); ok {
-				cmdType = cmd.Type
+			var cmdType string
+			switch entry.Type {
+			case EntryNoop:
+				cmdType = "noop"
+			case EntryConfiguration:
+				cmdType = "configuration"
+			default:
+				cmdType = command.TypeOf(entry.Command)
 			}
 
 			response = append(response, LogEntryResponse{
@@ -341,12 +827,15 @@ func (c *ClusterCoordinator) startHTTPServer(nodeID string) {
 		json.NewEncoder(w).Encode(response)
 	})
 
-	// Use a different coordinator port for each node
-	coordPort := 8090 + int(nodeID[0]-'0') // Assumes nodeID is a single digit
+	mux.HandleFunc("/cluster/members", c.handleMembers)
+	mux.HandleFunc("/cluster/members/", c.handleMembers)
+	mux.HandleFunc("/cluster/learners", c.handleLearners)
+	mux.HandleFunc("/cluster/learners/", c.handleLearners)
+	mux.HandleFunc("/cluster/transfer-leadership", c.handleTransferLeadership)
 
 	// Start the HTTP server
 	c.httpServer = &http.Server{
-		Addr:    fmt.Sprintf(":%d", coordPort),
+		Addr:    listenAddr,
 		Handler: mux,
 	}
 
@@ -355,6 +844,25 @@ func (c *ClusterCoordinator) startHTTPServer(nodeID string) {
 			c.logger.Error().Err(err).Msg("HTTP server error")
 		}
 	}()
+	return nil
+}
+
+// fetchStatus asks a node's coordinator for the node's own status
+func fetchStatus(url string) (Status, error) {
+	var status Status
+	cli := &http.Client{Timeout: 300 * time.Millisecond}
+	resp, err := cli.Get(url)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return status, fmt.Errorf("failed to decode status: %w", err)
+	}
+	return status, nil
 }
 
 func probe(url string) bool {
@@ -366,11 +874,3 @@ func probe(url string) bool {
 	resp.Body.Close()
 	return resp.StatusCode == http.StatusOK
 }
-
-func raftToBusinessAddr(raftAddr string) string {
-	u, _ := url.Parse(strings.TrimSuffix(raftAddr, "/raft"))
-	host, portStr, _ := strings.Cut(u.Host, ":")
-	port, _ := strconv.Atoi(portStr)
-	businessPort := port + 920
-	return fmt.Sprintf("http://%s:%d", host, businessPort)
-}
@@ -0,0 +1,128 @@
+package raft
+
+// Pre-Vote and CheckQuorum keep a node that was cut off from the cluster
+// from forcing elections when it comes back (Raft thesis, section 9.6).
+//
+// With Pre-Vote a node whose election timer fires first asks its peers
+// whether they would vote for it in the next term. Only when a majority
+// agrees does it increment its term and start the real election, so a node
+// that cannot win never bumps the term and dethrones a healthy leader.
+//
+// With CheckQuorum a leader steps down once it has not heard from a
+// majority within an election timeout, and voters ignore vote requests
+// while they are hearing from a leader.
+
+// campaign is called when the election timer fires on a voting member
+func (n *RaftNode) campaign() {
+	if n.preVote {
+		n.startPreVote()
+	} else {
+		n.startElection(false)
+	}
+}
+
+// startPreVote polls the peers for the next term without changing any state
+func (n *RaftNode) startPreVote() {
+	term := n.currentTerm + 1
+	n.preVoteTerm = term
+
+	// Try again after another timeout if the pre-vote fails
+	n.resetElectionTimer()
+
+	votesReceived := 1
+	if votesReceived >= n.config.quorum() {
+		n.startElection(false)
+		return
+	}
+
+	n.logger.Info().Msgf("🗳️  Node %s starts pre-vote for term %d", n.id, term)
+
+	args := RequestVoteArgs{
+		Term:         term,
+		CandidateID:  n.id,
+		LastLogIndex: n.lastLogIndex(),
+		LastLogTerm:  n.lastLogTerm(),
+		PreVote:      true,
+	}
+
+	for _, peer := range n.peers {
+		if !n.config.Has(peer.id) {
+			continue // Learners do not vote
+		}
+		p := peer
+		n.spawn(func() {
+			var reply RequestVoteReply
+			if err := p.client.RequestVote(args, &reply); err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+
+			// Ignore the answer if the pre-vote was abandoned meanwhile
+			if n.state == Leader || n.preVoteTerm != term {
+				return
+			}
+
+			if reply.Term > n.currentTerm {
+				n.becomeFollower(reply.Term)
+				return
+			}
+
+			if reply.VoteGranted {
+				votesReceived++
+				if votesReceived >= n.config.quorum() {
+					n.startElection(false)
+				}
+			}
+		})
+	}
+}
+
+// handlePreVote answers a pre-vote request. The vote is only hypothetical,
+// so neither the term nor votedFor changes.
+func (n *RaftNode) handlePreVote(args RequestVoteArgs, reply *RequestVoteReply) {
+	reply.Term = n.currentTerm
+	reply.VoteGranted = args.Term > n.currentTerm &&
+		!n.hasActiveLeader() &&
+		n.isLogUpToDate(args.LastLogIndex, args.LastLogTerm)
+}
+
+// hasActiveLeader reports whether this node is the leader or has heard from
+// one within the minimum election timeout. Such a node will not help
+// depose the leader, which is also what makes leader leases safe.
+func (n *RaftNode) hasActiveLeader() bool {
+	if n.state == Leader {
+		return true
+	}
+	return n.clock.Now().Sub(n.lastLeaderContact) < MinElectionTimeout
+}
+
+// isLogUpToDate reports whether a candidate's log is at least as up-to-date as ours
+func (n *RaftNode) isLogUpToDate(lastLogIndex, lastLogTerm uint64) bool {
+	ourLastTerm := n.lastLogTerm()
+	return lastLogTerm > ourLastTerm ||
+		(lastLogTerm == ourLastTerm && lastLogIndex >= n.lastLogIndex())
+}
+
+// recordContact notes that a peer answered an RPC sent in the current term
+func (n *RaftNode) recordContact(peerID string) {
+	n.lastContact[peerID] = n.clock.Now()
+}
+
+// hasQuorumContact reports whether a majority of the members, counting the
+// leader itself, have answered within the maximum election timeout
+func (n *RaftNode) hasQuorumContact() bool {
+	now := n.clock.Now()
+	count := 0
+	for id := range n.config.Members {
+		if id == n.id {
+			count++
+			continue
+		}
+		if last, ok := n.lastContact[id]; ok && now.Sub(last) <= MaxElectionTimeout {
+			count++
+		}
+	}
+	return count >= n.config.quorum()
+}
@@ -0,0 +1,223 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	grpc "github.com/gorilla/rpc/v2"
+	jrpc "github.com/gorilla/rpc/v2/json"
+	"github.com/rs/zerolog/log"
+)
+
+// HTTPTransport sends Raft RPCs as JSON-RPC requests over HTTP and serves
+// them on the /raft path
+type HTTPTransport struct {
+	listenAddr string
+	server     *http.Server
+	tls        *tlsMaterial // Mutual TLS between nodes, nil for plain HTTP
+}
+
+// NewHTTPTransport creates a transport that serves Raft RPCs on listenAddr
+func NewHTTPTransport(listenAddr string) *HTTPTransport {
+	return &HTTPTransport{listenAddr: listenAddr}
+}
+
+// NewTLSTransport creates a transport that serves and sends Raft RPCs over
+// mutual TLS, see TLSConfig
+func NewTLSTransport(listenAddr string, cfg TLSConfig) (*HTTPTransport, error) {
+	material, err := cfg.load()
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPTransport{listenAddr: listenAddr, tls: material}, nil
+}
+
+// Dial returns a client for the peer's /raft endpoint
+func (t *HTTPTransport) Dial(peerID string, addr string) (RPCClient, error) {
+	if t.tls == nil {
+		return NewRaftClient(peerID, addr)
+	}
+
+	// Peer addresses are configured the same way with and without TLS
+	if strings.HasPrefix(addr, "http://") {
+		addr = "https://" + strings.TrimPrefix(addr, "http://")
+	}
+	client, err := NewRaftClient(peerID, addr)
+	if err != nil {
+		return nil, err
+	}
+	client.httpClient.Transport = &http.Transport{TLSClientConfig: t.tls.clientConfig(peerID)}
+	return client, nil
+}
+
+// Serve starts the RPC server. The listener is opened before returning so
+// that address errors are reported to the caller.
+func (t *HTTPTransport) Serve(handler RPCHandler) error {
+	if t.server != nil {
+		return fmt.Errorf("raft transport already serving on %s", t.listenAddr)
+	}
+
+	listener, err := net.Listen("tcp", t.listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", t.listenAddr, err)
+	}
+
+	t.server = SetupRaftRPCServer(handler, t.listenAddr)
+	if t.tls != nil {
+		t.server.TLSConfig = t.tls.serverConfig()
+		listener = tls.NewListener(listener, t.server.TLSConfig)
+	}
+	go func() {
+		if err := t.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Str("addr", t.listenAddr).Msg("Raft RPC server stopped")
+		}
+	}()
+	return nil
+}
+
+// Close shuts the RPC server down
+func (t *HTTPTransport) Close() error {
+	if t.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return t.server.Shutdown(ctx)
+}
+
+// RaftClient is used to send RPCs to other nodes
+type RaftClient struct {
+	nodeID     string
+	httpClient *http.Client
+	endpoint   string
+}
+
+// NewRaftClient creates a new client for communicating with a peer node
+func NewRaftClient(nodeID string, endpoint string) (*RaftClient, error) {
+
+	return &RaftClient{
+		nodeID: nodeID,
+		// Each call sets its own deadline through the request context
+		httpClient: &http.Client{},
+		endpoint:   endpoint,
+	}, nil
+}
+
+// RequestVote sends a RequestVote RPC to a peer
+func (c *RaftClient) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
+	return c.call("RaftService.RequestVote", args, reply, RPCTimeout)
+}
+
+// AppendEntries sends an AppendEntries RPC to a peer
+func (c *RaftClient) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
+	return c.call("RaftService.AppendEntries", args, reply, RPCTimeout)
+}
+
+// InstallSnapshot sends an InstallSnapshot RPC to a peer
+func (c *RaftClient) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	return c.call("RaftService.InstallSnapshot", args, reply, SnapshotRPCTimeout)
+}
+
+// TimeoutNow sends a TimeoutNow RPC to a peer
+func (c *RaftClient) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	return c.call("RaftService.TimeoutNow", args, reply, RPCTimeout)
+}
+
+// call sends a JSON-RPC request to the peer and decodes the reply
+func (c *RaftClient) call(method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	body, err := jrpc.EncodeClientRequest(method, args)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return fmt.Errorf("%w: %v", ErrPeerUnreachable, err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	return jrpc.DecodeClientResponse(resp.Body, reply)
+}
+
+// RaftService exposes Raft RPCs via HTTP
+type RaftService struct {
+	node RPCHandler
+}
+
+// RegisterRaftService registers the Raft service with an RPC server
+func RegisterRaftService(node RPCHandler, rpcServer *grpc.Server) {
+	rpcServer.RegisterService(&RaftService{node: node}, "")
+}
+
+// SetupRaftRPCServer creates and configures an RPC server for Raft communication
+func SetupRaftRPCServer(node RPCHandler, addr string) *http.Server {
+	rpcServer := grpc.NewServer()
+	rpcServer.RegisterCodec(jrpc.NewCodec(), "application/json")
+	RegisterRaftService(node, rpcServer)
+	mux := http.NewServeMux()
+	mux.Handle("/raft", rpcServer)
+	httpServer := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	}
+	return httpServer
+}
+
+// authorize rejects an RPC whose TLS certificate does not belong to the
+// node it claims to come from
+func (s *RaftService) authorize(r *http.Request, claimed string) error {
+	if err := checkPeer(r, claimed); err != nil {
+		log.Warn().Err(err).Str("remote", r.RemoteAddr).Msg("Rejected Raft RPC")
+		return err
+	}
+	return nil
+}
+
+func (s *RaftService) RequestVote(r *http.Request, args *RequestVoteArgs, reply *RequestVoteReply) error {
+	if err := s.authorize(r, args.CandidateID); err != nil {
+		return err
+	}
+	return s.node.RequestVote(*args, reply)
+}
+
+func (s *RaftService) AppendEntries(r *http.Request, args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	if err := s.authorize(r, args.LeaderID); err != nil {
+		return err
+	}
+	return s.node.AppendEntries(*args, reply)
+}
+
+func (s *RaftService) InstallSnapshot(r *http.Request, args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	if err := s.authorize(r, args.LeaderID); err != nil {
+		return err
+	}
+	return s.node.InstallSnapshot(*args, reply)
+}
+
+func (s *RaftService) TimeoutNow(r *http.Request, args *TimeoutNowArgs, reply *TimeoutNowReply) error {
+	if err := s.authorize(r, args.LeaderID); err != nil {
+		return err
+	}
+	return s.node.TimeoutNow(*args, reply)
+}
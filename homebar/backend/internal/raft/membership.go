@@ -0,0 +1,365 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotLeader is returned when an operation must be performed on the leader
+	ErrNotLeader = errors.New("not the leader")
+	// ErrConfigChangePending is returned while an earlier membership change is uncommitted
+	ErrConfigChangePending = errors.New("a membership change is already in progress")
+	// ErrLeaderNotReady is returned before the leader has committed an entry in its term
+	ErrLeaderNotReady = errors.New("leader has not committed an entry in its term yet")
+	// ErrLearnerBehind is returned when promoting a learner that has not caught up with the leader's log
+	ErrLearnerBehind = errors.New("learner has not caught up with the leader")
+)
+
+// NewConfiguration builds a configuration from a node ID -> address map
+func NewConfiguration(members map[string]string) Configuration {
+	config := Configuration{Members: make(map[string]string, len(members))}
+	for id, addr := range members {
+		config.Members[id] = addr
+	}
+	return config
+}
+
+// Has reports whether id is a voting member
+func (c Configuration) Has(id string) bool {
+	_, ok := c.Members[id]
+	return ok
+}
+
+// IsLearner reports whether id is a non-voting member
+func (c Configuration) IsLearner(id string) bool {
+	_, ok := c.Learners[id]
+	return ok
+}
+
+// Contains reports whether id is a voter or a learner
+func (c Configuration) Contains(id string) bool {
+	return c.Has(id) || c.IsLearner(id)
+}
+
+// Role returns RoleVoter or RoleLearner for a member, or "" for a node
+// outside the configuration
+func (c Configuration) Role(id string) string {
+	switch {
+	case c.Has(id):
+		return RoleVoter
+	case c.IsLearner(id):
+		return RoleLearner
+	}
+	return ""
+}
+
+// all returns the addresses of voters and learners together
+func (c Configuration) all() map[string]string {
+	members := make(map[string]string, len(c.Members)+len(c.Learners))
+	for id, addr := range c.Learners {
+		members[id] = addr
+	}
+	for id, addr := range c.Members {
+		members[id] = addr
+	}
+	return members
+}
+
+// Clone returns a deep copy of the configuration
+func (c Configuration) Clone() Configuration {
+	config := NewConfiguration(c.Members)
+	if len(c.Learners) > 0 {
+		config.Learners = make(map[string]string, len(c.Learners))
+		for id, addr := range c.Learners {
+			config.Learners[id] = addr
+		}
+	}
+	return config
+}
+
+// quorum returns the number of votes needed for a majority
+func (c Configuration) quorum() int {
+	return len(c.Members)/2 + 1
+}
+
+// decodeConfiguration recovers a Configuration from a log entry command,
+// which is a map after a JSON round trip through storage or RPC
+func decodeConfiguration(cmd interface{}) (Configuration, error) {
+	if config, ok := cmd.(Configuration); ok {
+		return config.Clone(), nil
+	}
+
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return Configuration{}, fmt.Errorf("failed to marshal configuration: %w", err)
+	}
+
+	var config Configuration
+	if err := json.Unmarshal(data, &config); err != nil {
+		return Configuration{}, fmt.Errorf("failed to unmarshal configuration: %w", err)
+	}
+	if config.Members == nil {
+		config.Members = make(map[string]string)
+	}
+	return config, nil
+}
+
+// ConfigurationOf returns the configuration carried by an EntryConfiguration entry
+func ConfigurationOf(entry LogEntry) (Configuration, error) {
+	if entry.Type != EntryConfiguration {
+		return Configuration{}, fmt.Errorf("entry %d is not a configuration entry", entry.Index)
+	}
+	return decodeConfiguration(entry.Command)
+}
+
+// Configuration returns the latest cluster configuration, which may not be committed yet
+func (n *RaftNode) Configuration() Configuration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.config.Clone()
+}
+
+// AddMember adds a voting member to the cluster. It returns the log index of
+// the configuration entry; the change is in effect once that index commits.
+func (n *RaftNode) AddMember(id string, addr string) (uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if id == "" {
+		return 0, fmt.Errorf("member id is required")
+	}
+	if cur, ok := n.config.Members[id]; ok && cur == addr {
+		return n.configIndex, nil
+	}
+
+	config := n.config.Clone()
+	config.Members[id] = addr
+	delete(config.Learners, id)
+	return n.proposeConfiguration(config)
+}
+
+// AddLearner adds a non-voting member to the cluster. A learner receives the
+// log like any follower but neither votes nor counts towards a majority, so
+// a new node can catch up before it affects availability. It returns the
+// log index of the configuration entry.
+func (n *RaftNode) AddLearner(id string, addr string) (uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if id == "" {
+		return 0, fmt.Errorf("learner id is required")
+	}
+	if n.config.Has(id) {
+		return 0, fmt.Errorf("node %s is already a voting member", id)
+	}
+	if cur, ok := n.config.Learners[id]; ok && cur == addr {
+		return n.configIndex, nil
+	}
+
+	config := n.config.Clone()
+	if config.Learners == nil {
+		config.Learners = make(map[string]string)
+	}
+	config.Learners[id] = addr
+	return n.proposeConfiguration(config)
+}
+
+// PromoteLearner turns a learner into a voting member once its log is
+// within MaxAppendEntries entries of the leader's, so that the new voter
+// does not hold up commits while it catches up. Otherwise it returns
+// ErrLearnerBehind and the promotion can be retried later. It returns the log index of
+// the configuration entry.
+func (n *RaftNode) PromoteLearner(id string) (uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	addr, ok := n.config.Learners[id]
+	if !ok {
+		return 0, fmt.Errorf("node %s is not a learner", id)
+	}
+	if n.state != Leader {
+		return 0, ErrNotLeader
+	}
+
+	// Caught up means reachable and at most one AppendEntries behind,
+	// without a snapshot to install first
+	match := n.matchIndex[id]
+	last, contacted := n.lastContact[id]
+	if match < n.log[0].Index || n.lastLogIndex()-min(match, n.lastLogIndex()) > MaxAppendEntries ||
+		!contacted || n.clock.Now().Sub(last) > MaxElectionTimeout {
+		return 0, fmt.Errorf("%w: match index %d, leader at %d", ErrLearnerBehind, match, n.lastLogIndex())
+	}
+
+	config := n.config.Clone()
+	delete(config.Learners, id)
+	config.Members[id] = addr
+	return n.proposeConfiguration(config)
+}
+
+// RemoveMember removes a voter or learner from the cluster. It returns the
+// log index of the configuration entry; the change is in effect once that index commits.
+func (n *RaftNode) RemoveMember(id string) (uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.config.Contains(id) {
+		return 0, fmt.Errorf("node %s is not a member", id)
+	}
+	if n.config.Has(id) && len(n.config.Members) == 1 {
+		return 0, fmt.Errorf("cannot remove the last member")
+	}
+
+	config := n.config.Clone()
+	delete(config.Members, id)
+	delete(config.Learners, id)
+	return n.proposeConfiguration(config)
+}
+
+// Role returns this node's role in its latest configuration, RoleVoter or
+// RoleLearner, or "" if it is not part of the cluster
+func (n *RaftNode) Role() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.config.Role(n.id)
+}
+
+// proposeConfiguration appends a single-server membership change to the log.
+// Only one change may be uncommitted at a time, and the leader must have
+// committed an entry in its own term first so that changes from an earlier
+// leader cannot overlap with this one.
+func (n *RaftNode) proposeConfiguration(config Configuration) (uint64, error) {
+	if n.state != Leader {
+		return 0, ErrNotLeader
+	}
+	if n.transfer != nil {
+		return 0, ErrLeadershipTransfer
+	}
+	if n.configIndex > n.commitIndex {
+		return 0, ErrConfigChangePending
+	}
+	if n.termAt(n.commitIndex) != n.currentTerm {
+		return 0, ErrLeaderNotReady
+	}
+
+	index := n.lastLogIndex() + 1
+	n.log = append(n.log, LogEntry{
+		Index:   index,
+		Term:    n.currentTerm,
+		Type:    EntryConfiguration,
+		Command: config,
+	})
+	n.persistLog(index)
+	n.setConfiguration(config, index)
+	n.updateCommitIndex()
+
+	n.logger.Info().Msgf("🧩 Node %s proposed configuration %v (learners %v) at index %d", n.id, config.Members, config.Learners, index)
+
+	n.sendHeartbeats()
+	return index, nil
+}
+
+// setConfiguration makes config the active membership and updates the peer set
+func (n *RaftNode) setConfiguration(config Configuration, index uint64) {
+	n.config = config
+	n.configIndex = index
+
+	for id, addr := range config.all() {
+		n.peerAddrs[id] = addr
+		if id == n.id {
+			continue
+		}
+
+		peer, ok := n.peers[id]
+		if !ok {
+			peer = &RaftPeer{id: id}
+			n.peers[id] = peer
+			if n.state == Leader {
+				n.nextIndex[id] = n.lastLogIndex() + 1
+				n.matchIndex[id] = 0
+				n.lastContact[id] = n.clock.Now()
+			}
+		}
+		if addr := n.peerEndpoint(id); n.started && (peer.client == nil || peer.addr != addr) {
+			client, err := n.transport.Dial(id, addr)
+			if err != nil {
+				n.logger.Error().Err(err).Msgf("Failed to create client for peer %s", id)
+				continue
+			}
+			peer.client = client
+			peer.addr = addr
+		}
+	}
+
+	for id := range n.peers {
+		if !config.Contains(id) {
+			delete(n.peers, id)
+			delete(n.nextIndex, id)
+			delete(n.matchIndex, id)
+			delete(n.lastContact, id)
+		}
+	}
+}
+
+// setBaseConfiguration records the configuration in effect at the start of
+// the log. Only this one is persisted: later configurations are in the log,
+// and one that is not committed yet may still be truncated away.
+func (n *RaftNode) setBaseConfiguration(config Configuration) {
+	n.baseConfig = config.Clone()
+	if n.storage != nil {
+		if err := n.storage.SaveConfiguration(config); err != nil {
+			n.logger.Error().Err(err).Msg("Failed to persist configuration")
+		}
+	}
+}
+
+// configAt returns the configuration in effect at the given log index
+func (n *RaftNode) configAt(index uint64) (Configuration, uint64) {
+	for i := min(index, n.lastLogIndex()); i > n.log[0].Index; i-- {
+		entry := n.entryAt(i)
+		if entry.Type != EntryConfiguration {
+			continue
+		}
+		config, err := decodeConfiguration(entry.Command)
+		if err != nil {
+			n.logger.Error().Err(err).Uint64("index", i).Msg("Skipping unreadable configuration entry")
+			continue
+		}
+		return config, i
+	}
+	return n.baseConfig.Clone(), 0
+}
+
+// reloadConfiguration re-derives the active membership from the log, used
+// after entries have been appended or truncated
+func (n *RaftNode) reloadConfiguration() {
+	config, index := n.configAt(n.lastLogIndex())
+	if index != 0 && index == n.configIndex {
+		return
+	}
+	n.setConfiguration(config, index)
+}
+
+// Addresses returns the addresses a member serves on, from its Raft
+// address in the configuration and the cluster topology
+func (n *RaftNode) Addresses(id string) NodeAddresses {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.topology.Addresses(id, n.peerAddrs[id])
+}
+
+// Topology returns the cluster topology the node was configured with
+func (n *RaftNode) Topology() *Topology {
+	return n.topology
+}
+
+// BusinessAddr returns the base URL of the HTTP API served by a member
+func (n *RaftNode) BusinessAddr(id string) string {
+	return n.Addresses(id).API
+}
+
+// peerEndpoint returns the Raft RPC endpoint for a peer
+func (n *RaftNode) peerEndpoint(id string) string {
+	return n.topology.Addresses(id, n.peerAddrs[id]).Raft
+}
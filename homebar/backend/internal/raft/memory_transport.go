@@ -0,0 +1,214 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MemoryNetwork connects MemoryTransports inside a single process. Requests
+// travel over channels instead of sockets, which lets several RaftNodes run
+// in one test.
+type MemoryNetwork struct {
+	mu        sync.RWMutex
+	endpoints map[string]chan memoryRequest
+}
+
+// NewMemoryNetwork creates an empty in-process network
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{endpoints: make(map[string]chan memoryRequest)}
+}
+
+// Transport returns a transport that serves RPCs at addr on this network
+func (net *MemoryNetwork) Transport(addr string) *MemoryTransport {
+	return &MemoryTransport{network: net, addr: addr}
+}
+
+// memoryRequest is a single RPC in flight. Arguments and replies are
+// passed as JSON so nodes never share memory, exactly as over HTTP.
+type memoryRequest struct {
+	method string
+	args   []byte
+	done   chan memoryResponse
+}
+
+type memoryResponse struct {
+	reply []byte
+	err   error
+}
+
+// MemoryTransport is a Transport bound to one address on a MemoryNetwork
+type MemoryTransport struct {
+	network *MemoryNetwork
+	addr    string
+
+	mu   sync.Mutex
+	reqs chan memoryRequest
+	stop chan struct{}
+}
+
+// Dial returns a client that sends RPCs to addr on the same network
+func (t *MemoryTransport) Dial(peerID string, addr string) (RPCClient, error) {
+	return &memoryClient{network: t.network, addr: addr}, nil
+}
+
+// Serve registers the transport's address and dispatches incoming RPCs to
+// handler, each on its own goroutine like an HTTP server would
+func (t *MemoryTransport) Serve(handler RPCHandler) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.reqs != nil {
+		return fmt.Errorf("raft transport already serving on %s", t.addr)
+	}
+
+	t.network.mu.Lock()
+	if _, taken := t.network.endpoints[t.addr]; taken {
+		t.network.mu.Unlock()
+		return fmt.Errorf("address %s already in use", t.addr)
+	}
+	reqs := make(chan memoryRequest)
+	t.network.endpoints[t.addr] = reqs
+	t.network.mu.Unlock()
+
+	t.reqs = reqs
+	t.stop = make(chan struct{})
+	go t.dispatch(handler, reqs, t.stop)
+	return nil
+}
+
+// Close unregisters the address; RPCs sent to it fail as unreachable
+func (t *MemoryTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.reqs == nil {
+		return nil
+	}
+
+	t.network.mu.Lock()
+	if t.network.endpoints[t.addr] == t.reqs {
+		delete(t.network.endpoints, t.addr)
+	}
+	t.network.mu.Unlock()
+
+	close(t.stop)
+	t.reqs = nil
+	t.stop = nil
+	return nil
+}
+
+func (t *MemoryTransport) dispatch(handler RPCHandler, reqs chan memoryRequest, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case req := <-reqs:
+			go func() {
+				reply, err := handleMemoryRequest(handler, req.method, req.args)
+				// The caller may have given up, never block on it
+				select {
+				case req.done <- memoryResponse{reply: reply, err: err}:
+				default:
+				}
+			}()
+		}
+	}
+}
+
+// handleMemoryRequest decodes the arguments, calls the handler and encodes the reply
+func handleMemoryRequest(handler RPCHandler, method string, data []byte) ([]byte, error) {
+	switch method {
+	case "RequestVote":
+		var args RequestVoteArgs
+		var reply RequestVoteReply
+		return invokeMemoryRequest(data, &args, &reply, func() error { return handler.RequestVote(args, &reply) })
+	case "AppendEntries":
+		var args AppendEntriesArgs
+		var reply AppendEntriesReply
+		return invokeMemoryRequest(data, &args, &reply, func() error { return handler.AppendEntries(args, &reply) })
+	case "InstallSnapshot":
+		var args InstallSnapshotArgs
+		var reply InstallSnapshotReply
+		return invokeMemoryRequest(data, &args, &reply, func() error { return handler.InstallSnapshot(args, &reply) })
+	case "TimeoutNow":
+		var args TimeoutNowArgs
+		var reply TimeoutNowReply
+		return invokeMemoryRequest(data, &args, &reply, func() error { return handler.TimeoutNow(args, &reply) })
+	default:
+		return nil, fmt.Errorf("unknown method %s", method)
+	}
+}
+
+func invokeMemoryRequest(data []byte, args interface{}, reply interface{}, call func() error) ([]byte, error) {
+	if err := json.Unmarshal(data, args); err != nil {
+		return nil, err
+	}
+	if err := call(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(reply)
+}
+
+// memoryClient sends RPCs to one address on a MemoryNetwork
+type memoryClient struct {
+	network *MemoryNetwork
+	addr    string
+}
+
+// RequestVote sends a RequestVote RPC to a peer
+func (c *memoryClient) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
+	return c.call("RequestVote", args, reply, RPCTimeout)
+}
+
+// AppendEntries sends an AppendEntries RPC to a peer
+func (c *memoryClient) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
+	return c.call("AppendEntries", args, reply, RPCTimeout)
+}
+
+// InstallSnapshot sends an InstallSnapshot RPC to a peer
+func (c *memoryClient) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	return c.call("InstallSnapshot", args, reply, SnapshotRPCTimeout)
+}
+
+// TimeoutNow sends a TimeoutNow RPC to a peer
+func (c *memoryClient) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	return c.call("TimeoutNow", args, reply, RPCTimeout)
+}
+
+// call delivers the request to the peer's dispatch loop and waits for the reply
+func (c *memoryClient) call(method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	c.network.mu.RLock()
+	reqs, ok := c.network.endpoints[c.addr]
+	c.network.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: nothing listening on %s", ErrPeerUnreachable, c.addr)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	req := memoryRequest{method: method, args: data, done: make(chan memoryResponse, 1)}
+	select {
+	case reqs <- req:
+	case <-timer.C:
+		return fmt.Errorf("%s to %s: %w", method, c.addr, context.DeadlineExceeded)
+	}
+
+	select {
+	case resp := <-req.done:
+		if resp.err != nil {
+			return resp.err
+		}
+		return json.Unmarshal(resp.reply, reply)
+	case <-timer.C:
+		return fmt.Errorf("%s to %s: %w", method, c.addr, context.DeadlineExceeded)
+	}
+}
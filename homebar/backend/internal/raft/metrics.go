@@ -0,0 +1,137 @@
+package raft
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus metrics of a node. Indexes and per-peer progress are read from
+// the node when scraped; events such as elections are counted as they happen.
+
+// nodeMetrics holds the metrics updated by the node itself
+type nodeMetrics struct {
+	elections         prometheus.Counter
+	applyLatency      prometheus.Histogram
+	rejectedProposals prometheus.Counter
+}
+
+func newNodeMetrics(id string) *nodeMetrics {
+	labels := prometheus.Labels{"node_id": id}
+	return &nodeMetrics{
+		elections: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "raft_elections_total",
+			Help:        "Elections started by this node.",
+			ConstLabels: labels,
+		}),
+		applyLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "raft_submit_to_apply_seconds",
+			Help:        "Time from proposing a command on the leader until the state machine applied it.",
+			ConstLabels: labels,
+			Buckets:     []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}),
+		rejectedProposals: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "raft_proposals_rejected_total",
+			Help:        "Commands refused by the leader because too many entries were waiting to be applied.",
+			ConstLabels: labels,
+		}),
+	}
+}
+
+var (
+	termDesc = prometheus.NewDesc("raft_term",
+		"Current term of the node.", []string{"node_id"}, nil)
+	stateDesc = prometheus.NewDesc("raft_state",
+		"1 for the state the node is in, 0 for the others.", []string{"node_id", "state"}, nil)
+	commitIndexDesc = prometheus.NewDesc("raft_commit_index",
+		"Highest log index known to be committed.", []string{"node_id"}, nil)
+	appliedIndexDesc = prometheus.NewDesc("raft_applied_index",
+		"Highest log index the state machine has applied.", []string{"node_id"}, nil)
+	lastLogIndexDesc = prometheus.NewDesc("raft_last_log_index",
+		"Index of the last entry in the node's log.", []string{"node_id"}, nil)
+	applyLagDesc = prometheus.NewDesc("raft_apply_lag",
+		"Committed entries the state machine has not applied yet.", []string{"node_id"}, nil)
+	applyQueueDesc = prometheus.NewDesc("raft_apply_queue_length",
+		"Committed entries handed to the state machine and waiting in its apply channel.", []string{"node_id"}, nil)
+	applyBacklogDesc = prometheus.NewDesc("raft_apply_backlog",
+		"Entries in the log the state machine has not applied yet, committed or not.", []string{"node_id"}, nil)
+	applyBacklogLimitDesc = prometheus.NewDesc("raft_apply_backlog_limit",
+		"Apply backlog at which the leader refuses new commands.", []string{"node_id"}, nil)
+	matchIndexDesc = prometheus.NewDesc("raft_peer_match_index",
+		"Highest log index known to be replicated on a peer, reported by the leader.", []string{"node_id", "peer"}, nil)
+	replicationLagDesc = prometheus.NewDesc("raft_peer_replication_lag",
+		"Entries in the leader's log not yet replicated on a peer.", []string{"node_id", "peer"}, nil)
+)
+
+// metricsCollector exports a node's metrics to Prometheus
+type metricsCollector struct {
+	n *RaftNode
+}
+
+// Collector returns a Prometheus collector for the node's metrics
+func (n *RaftNode) Collector() prometheus.Collector {
+	return metricsCollector{n: n}
+}
+
+// Describe implements prometheus.Collector
+func (c metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- termDesc
+	ch <- stateDesc
+	ch <- commitIndexDesc
+	ch <- appliedIndexDesc
+	ch <- lastLogIndexDesc
+	ch <- applyLagDesc
+	ch <- applyQueueDesc
+	ch <- applyBacklogDesc
+	ch <- applyBacklogLimitDesc
+	ch <- matchIndexDesc
+	ch <- replicationLagDesc
+	c.n.metrics.elections.Describe(ch)
+	c.n.metrics.applyLatency.Describe(ch)
+	c.n.metrics.rejectedProposals.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (c metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	n := c.n
+	n.mu.Lock()
+	id := n.id
+	state := n.state
+	term := n.currentTerm
+	commitIndex := n.commitIndex
+	appliedIndex := n.appliedIndex
+	lastLogIndex := n.lastLogIndex()
+	applyBacklog := n.applyBacklog()
+	applyBacklogLimit := n.maxApplyBacklog
+	applyQueue := len(n.applyCh)
+	var match map[string]uint64
+	if state == Leader {
+		match = make(map[string]uint64, len(n.peers))
+		for peerID := range n.peers {
+			match[peerID] = n.matchIndex[peerID]
+		}
+	}
+	n.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(termDesc, prometheus.GaugeValue, float64(term), id)
+	for _, s := range []NodeState{Follower, Candidate, Leader} {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(stateDesc, prometheus.GaugeValue, v, id, string(s))
+	}
+	ch <- prometheus.MustNewConstMetric(commitIndexDesc, prometheus.GaugeValue, float64(commitIndex), id)
+	ch <- prometheus.MustNewConstMetric(appliedIndexDesc, prometheus.GaugeValue, float64(appliedIndex), id)
+	ch <- prometheus.MustNewConstMetric(lastLogIndexDesc, prometheus.GaugeValue, float64(lastLogIndex), id)
+	ch <- prometheus.MustNewConstMetric(applyLagDesc, prometheus.GaugeValue, float64(commitIndex-min(appliedIndex, commitIndex)), id)
+	ch <- prometheus.MustNewConstMetric(applyQueueDesc, prometheus.GaugeValue, float64(applyQueue), id)
+	ch <- prometheus.MustNewConstMetric(applyBacklogDesc, prometheus.GaugeValue, float64(applyBacklog), id)
+	ch <- prometheus.MustNewConstMetric(applyBacklogLimitDesc, prometheus.GaugeValue, float64(applyBacklogLimit), id)
+	for peerID, m := range match {
+		ch <- prometheus.MustNewConstMetric(matchIndexDesc, prometheus.GaugeValue, float64(m), id, peerID)
+		ch <- prometheus.MustNewConstMetric(replicationLagDesc, prometheus.GaugeValue, float64(lastLogIndex-min(m, lastLogIndex)), id, peerID)
+	}
+
+	n.metrics.elections.Collect(ch)
+	n.metrics.applyLatency.Collect(ch)
+	n.metrics.rejectedProposals.Collect(ch)
+}
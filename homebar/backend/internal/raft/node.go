@@ -2,11 +2,14 @@ package raft
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
 	"strings"
 
 	"math/rand"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -25,7 +28,22 @@ type RaftNode struct {
 	votedFor    string
 	log         []LogEntry
 	commitIndex uint64
-	lastApplied uint64
+
+	// Highest index handed to the state machine on applyCh. It is kept in
+	// memory only, as entries still in the channel may never be applied.
+	handedOverIndex uint64
+
+	// Highest index the state machine reported as applied through
+	// NotifyApplied. This is the applied index persisted with the term.
+	appliedIndex uint64
+
+	// Prometheus metrics updated as events happen
+	metrics *nodeMetrics
+
+	// Observers notified of state, leader, term, commit, apply and peer
+	// events. Guarded by observerMu, which is taken with or without mu.
+	observers  map[*Observer]struct{}
+	observerMu sync.RWMutex
 
 	// Leader state
 	nextIndex  map[string]uint64
@@ -35,9 +53,42 @@ type RaftNode struct {
 	applyCh chan LogEntry // Channel to send committed log entries to state machine
 	mu      sync.Mutex    // Protects concurrent access to node state
 
+	// Commands are refused while this many entries are waiting to be applied
+	maxApplyBacklog uint64
+
 	// Timers
-	electionTimer  *time.Timer
-	heartbeatTimer *time.Timer
+	clock            Clock
+	rand             *rand.Rand // Randomizes election timeouts, guarded by mu
+	electionTimer    Timer
+	electionDeadline time.Time // A timer firing before the deadline was reset meanwhile
+	heartbeatTimer   Timer
+	applyNotify      chan struct{} // Wakes the apply loop when commitIndex advances
+	stopped          bool
+
+	// Runs background work such as RPCs to peers
+	spawn func(f func())
+
+	// Pre-Vote and CheckQuorum
+	preVote           bool
+	checkQuorum       bool
+	preVoteTerm       uint64               // Term polled by the pre-vote in progress, 0 if none
+	lastLeaderContact time.Time            // When a follower last heard from the leader
+	leaderCommit      uint64               // Highest commit index a follower has heard of from a leader
+	lastContact       map[string]time.Time // When the leader last heard back from each peer
+
+	// Leadership transfer in progress on the leader, nil if none
+	transfer *leadershipTransfer
+
+	// Reads waiting for a heartbeat round to confirm leadership
+	readRound    uint64 // Latest heartbeat round, advanced for every ReadIndex
+	pendingReads []*readRequest
+
+	// Futures of commands proposed on this node, by log index
+	proposals map[uint64]*Future
+
+	// Proposal batching: entries appended by Submit are written by one flush
+	unpersisted    uint64 // First appended entry not yet written to storage, 0 if none
+	flushScheduled bool   // A flush of the unpersisted entries is pending
 
 	// Configuration
 	heartbeatInterval time.Duration
@@ -51,47 +102,227 @@ type RaftNode struct {
 
 	// Add storage field
 	storage Storage
+
+	// Carries RPCs to and from peers, JSON-RPC over HTTP unless replaced
+	transport Transport
+
+	// Addresses of members beyond their Raft address in the configuration
+	topology *Topology
+
+	// Snapshotting and log compaction
+	stateMachine      StateMachine // Produces and restores snapshots of the applied state
+	snapshot          *Snapshot    // Latest snapshot, sent to followers that fall behind the log
+	snapshotThreshold uint64       // Applied entries kept in the log before compacting
+	restoring         bool         // True while a received snapshot is being restored
+
+	// Cluster membership
+	config      Configuration // Latest configuration in the log, in effect as soon as it is appended
+	configIndex uint64        // Log index of the entry that carried config, 0 if it predates the log
+	baseConfig  Configuration // Configuration in effect at the start of the log (snapshot or bootstrap)
+	started     bool          // Peer clients are dialed once the node has been started
+}
+
+// Config holds everything needed to create a RaftNode. Optional fields
+// fall back to the defaults used in production when left empty.
+type Config struct {
+	ID           string
+	Peers        []string          // Bootstrap members, including this node
+	PeerAddrs    map[string]string // Raft RPC address of each member
+	ApplyCh      chan LogEntry     // Receives committed entries in log order
+	ApplyCommand func(cmd interface{}) error
+
+	// Storage persists state, log and snapshots. Defaults to the engine
+	// named by RAFT_STORAGE under RAFT_STORAGE_DIR.
+	Storage Storage
+
+	// Transport carries RPCs to peers. Defaults to JSON-RPC over HTTP on
+	// the port of this node's Raft address.
+	Transport Transport
+
+	// Topology names the addresses of members the configuration has no
+	// Raft address for, and those of their API and coordinator. NewRaftNode
+	// reads it from RAFT_TOPOLOGY_FILE or RAFT_TOPOLOGY.
+	Topology *Topology
+
+	// Clock drives election and heartbeat timeouts. Defaults to the system clock.
+	Clock Clock
+
+	// Rand randomizes election timeouts. Defaults to a time-seeded source.
+	Rand *rand.Rand
+
+	// Go runs background work such as RPCs to peers. Defaults to starting a
+	// goroutine; the simulation tests use it to tell when a node is idle.
+	Go func(f func())
+
+	// SnapshotThreshold is the number of applied entries kept in the log
+	// before it is compacted. Defaults to SnapshotThreshold.
+	SnapshotThreshold uint64
+
+	// MaxApplyBacklog is the number of entries the leader accepts beyond
+	// what its state machine has applied before refusing new commands with
+	// ErrApplyBacklog. Defaults to MaxApplyBacklog.
+	MaxApplyBacklog uint64
+
+	// PreVote makes a node check that it could win before starting an
+	// election, so rejoining nodes do not bump the term
+	PreVote bool
+
+	// CheckQuorum makes a leader step down when it loses touch with a
+	// majority, and voters ignore elections while a leader is active
+	CheckQuorum bool
+
+	Logger *zerolog.Logger
 }
 
 // NewRaftNode creates a new Raft node with the given configuration
 func NewRaftNode(id string, peers []string, peerAddrs map[string]string, applyCh chan LogEntry, applyCommand func(cmd interface{}) error) *RaftNode {
+	cfg := Config{
+		ID:           id,
+		Peers:        peers,
+		PeerAddrs:    peerAddrs,
+		ApplyCh:      applyCh,
+		ApplyCommand: applyCommand,
+		PreVote:      true,
+		CheckQuorum:  true,
+	}
+
+	for env, limit := range map[string]*uint64{"RAFT_SNAPSHOT_THRESHOLD": &cfg.SnapshotThreshold, "RAFT_MAX_APPLY_BACKLOG": &cfg.MaxApplyBacklog} {
+		if v := os.Getenv(env); v != "" {
+			if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+				*limit = n
+			} else {
+				log.Warn().Str("value", v).Msgf("Ignoring invalid %s", env)
+			}
+		}
+	}
+
+	for env, flag := range map[string]*bool{"RAFT_PRE_VOTE": &cfg.PreVote, "RAFT_CHECK_QUORUM": &cfg.CheckQuorum} {
+		if v := os.Getenv(env); v != "" {
+			if enabled, err := strconv.ParseBool(v); err == nil {
+				*flag = enabled
+			} else {
+				log.Warn().Str("value", v).Msgf("Ignoring invalid %s", env)
+			}
+		}
+	}
+
+	topology, err := TopologyFromEnv()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid cluster topology")
+	}
+	cfg.Topology = topology
+
+	// Peers authenticate each other when certificates are configured. A
+	// node set up for TLS never falls back to plain HTTP.
+	tlsConfig, err := TLSConfigFromEnv()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid Raft TLS configuration")
+	}
+	if tlsConfig != nil {
+		listenAddr, err := ListenAddr(topology.Addresses(id, peerAddrs[id]).Raft)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("No Raft address for node %s, set it in RAFT_PEERS or the topology", id)
+		}
+		transport, err := NewTLSTransport(listenAddr, *tlsConfig)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to set up Raft TLS")
+		}
+		cfg.Transport = transport
+	}
+
+	// Initialize storage
+	storageDir := os.Getenv("RAFT_STORAGE_DIR")
+	storage, err := NewStorage(os.Getenv("RAFT_STORAGE"), id, storageDir)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to initialize storage")
+		// Continue with in-memory only as fallback
+	} else {
+		cfg.Storage = storage
+	}
+
+	return NewRaftNodeWithConfig(cfg)
+}
+
+// NewRaftNodeWithConfig creates a Raft node and restores whatever state its
+// storage holds
+func NewRaftNodeWithConfig(cfg Config) *RaftNode {
+	id := cfg.ID
 	logger := log.With().
 		Str("component", "raft").
 		Str("node_id", id).
 		Logger()
+	if cfg.Logger != nil {
+		logger = *cfg.Logger
+	}
 
 	node := &RaftNode{
 		id:                id,
 		peers:             make(map[string]*RaftPeer),
-		peerAddrs:         peerAddrs,
+		peerAddrs:         make(map[string]string),
 		log:               []LogEntry{{Term: 0, Index: 0}}, // Start with a dummy entry
-		applyCh:           applyCh,
+		applyCh:           cfg.ApplyCh,
 		currentTerm:       0,
 		votedFor:          "",
 		commitIndex:       0,
-		lastApplied:       0,
 		nextIndex:         make(map[string]uint64),
 		matchIndex:        make(map[string]uint64),
-		applyCommand:      applyCommand,
+		applyCommand:      cfg.ApplyCommand,
 		heartbeatInterval: HeartbeatInterval,
+		snapshotThreshold: cfg.SnapshotThreshold,
+		maxApplyBacklog:   cfg.MaxApplyBacklog,
+		storage:           cfg.Storage,
+		transport:         cfg.Transport,
+		clock:             cfg.Clock,
+		rand:              cfg.Rand,
+		spawn:             cfg.Go,
+		applyNotify:       make(chan struct{}, 1),
+		preVote:           cfg.PreVote,
+		checkQuorum:       cfg.CheckQuorum,
+		lastContact:       make(map[string]time.Time),
+		proposals:         make(map[uint64]*Future),
+		metrics:           newNodeMetrics(id),
+		topology:          cfg.Topology,
 		logger:            &logger,
 	}
 
+	if node.snapshotThreshold == 0 {
+		node.snapshotThreshold = SnapshotThreshold
+	}
+	if node.maxApplyBacklog == 0 {
+		node.maxApplyBacklog = MaxApplyBacklog
+	}
+	if node.transport == nil {
+		listenAddr, err := ListenAddr(cfg.Topology.Addresses(id, cfg.PeerAddrs[id]).Raft)
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("No Raft address for node %s, set it in RAFT_PEERS or the topology", id)
+		}
+		node.transport = NewHTTPTransport(listenAddr)
+	}
+	if node.clock == nil {
+		node.clock = systemClock{}
+	}
+	if node.rand == nil {
+		node.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if node.spawn == nil {
+		node.spawn = func(f func()) { go f() }
+	}
+
 	// Log node creation
 	logger.Info().
 		Str("state", string(Follower)).
-		Int("peers", len(peers)).
+		Int("peers", len(cfg.Peers)).
 		Msg("Raft node created")
 
-	// Initialize storage
-	storageDir := os.Getenv("RAFT_STORAGE_DIR")
-	storage, err := NewFileStorage(id, storageDir)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to initialize storage")
-		// Continue with in-memory only as fallback
-	} else {
-		node.storage = storage
+	// Bootstrap membership from the static peer list; anything persisted
+	// or found in the log below takes precedence
+	bootstrap := make(map[string]string)
+	for _, peerID := range cfg.Peers {
+		bootstrap[peerID] = cfg.PeerAddrs[peerID]
+	}
+	node.baseConfig = NewConfiguration(bootstrap)
 
+	if storage := node.storage; storage != nil {
 		// Load persistent state
 		term, votedFor, lastApplied, err := storage.LoadState()
 		if err != nil {
@@ -99,149 +330,288 @@ func NewRaftNode(id string, peers []string, peerAddrs map[string]string, applyCh
 		} else {
 			node.currentTerm = term
 			node.votedFor = votedFor
-			node.lastApplied = lastApplied
+			node.handedOverIndex = lastApplied
+			node.appliedIndex = lastApplied
 			node.commitIndex = max(node.commitIndex, lastApplied)
 		}
 
+		// Load the membership at the start of the log. A new node keeps
+		// its bootstrap membership, so that the log it grows always starts
+		// from the same configuration whatever RAFT_PEERS says later.
+		if config, err := storage.LoadConfiguration(); err != nil {
+			logger.Printf("Failed to load configuration: %v", err)
+		} else if config != nil {
+			node.baseConfig = config.Clone()
+		} else {
+			node.setBaseConfiguration(node.baseConfig)
+		}
+
+		// Load the latest snapshot, which replaces the start of the log
+		snapshot, err := storage.LoadSnapshot()
+		if err != nil {
+			logger.Printf("Failed to load snapshot: %v", err)
+		} else if snapshot != nil {
+			node.snapshot = snapshot
+			node.log = []LogEntry{{Index: snapshot.LastIncludedIndex, Term: snapshot.LastIncludedTerm}}
+			if snapshot.Configuration != nil {
+				node.baseConfig = snapshot.Configuration.Clone()
+			}
+			node.commitIndex = max(node.commitIndex, snapshot.LastIncludedIndex)
+		}
+
 		// Load log
 		log, err := storage.LoadLog()
 		if err != nil {
 			logger.Printf("Failed to load log: %v", err)
-		} else if len(log) > 0 {
-			node.log = log
+		} else {
+			node.restoreLog(log)
 		}
 	}
 
-	// Initialize peer connections
-	for _, peerID := range peers {
-		if peerID != id { // Don't add self as peer
-			node.peers[peerID] = &RaftPeer{
-				id:     peerID,
-				client: nil, // Will be initialized when starting the node
-			}
-		}
-	}
+	// Initialize peers from the latest configuration in the log; clients
+	// are created when starting the node
+	config, configIndex := node.configAt(node.lastLogIndex())
+	node.setConfiguration(config, configIndex)
 
 	return node
 }
 
+// SetTransport replaces the default HTTP transport. It must be called before Start.
+func (n *RaftNode) SetTransport(t Transport) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.transport = t
+}
+
 // Start initializes the Raft node and begins operation
 func (n *RaftNode) Start(ctx context.Context) error {
 	n.logger.Info().Msgf("Starting Raft node %s", n.id)
 
 	// Initialize peer connections
+	n.mu.Lock()
 	for id, peer := range n.peers {
-		addr := n.peerAddrs[id]
-		if addr == "" {
-			addr = fmt.Sprintf("http://localhost:808%s/raft", id)
-		}
-		client, err := NewRaftClient(id, addr)
+		addr := n.peerEndpoint(id)
+		client, err := n.transport.Dial(id, addr)
 		if err != nil {
+			n.mu.Unlock()
 			return fmt.Errorf("failed to connect to peer %s: %w", id, err)
 		}
 		peer.client = client
+		peer.addr = addr
+	}
+	n.started = true
+	n.mu.Unlock()
+
+	// Resume after the last entry the state machine has applied, which
+	// may be ahead of the applied index saved with the term
+	saved := n.appliedIndex
+	if n.stateMachine != nil {
+		applied, err := n.stateMachine.AppliedIndex()
+		if err != nil {
+			return fmt.Errorf("failed to read applied index of the state machine: %w", err)
+		}
+		n.mu.Lock()
+		n.resumeFrom(applied)
+		n.mu.Unlock()
 	}
 
-	// Become follower at the term we have just loaded
+	// Bring the state machine up to the snapshot if it is behind it. The
+	// saved applied index is only behind the snapshot when the node stopped
+	// while restoring it or raftctl imported one, so restore it then too.
+	if n.snapshot != nil && min(saved, n.handedOverIndex) < n.snapshot.LastIncludedIndex {
+		if n.stateMachine != nil {
+			if err := n.stateMachine.RestoreSnapshot(n.snapshot.LastIncludedIndex, n.snapshot.Data); err != nil {
+				return fmt.Errorf("failed to restore snapshot: %w", err)
+			}
+		}
+		n.mu.Lock()
+		n.handedOverIndex = n.snapshot.LastIncludedIndex
+		n.appliedIndex = n.snapshot.LastIncludedIndex
+		n.persistState()
+		n.mu.Unlock()
+	}
+
+	// Become follower at the term we have just loaded. The node may have
+	// acknowledged a leader just before it restarted, so keep honouring
+	// that leader's lease for an election timeout.
+	n.mu.Lock()
+	n.lastLeaderContact = n.clock.Now()
 	n.becomeFollower(n.currentTerm)
+	n.mu.Unlock()
 
-	// Start the main loop
+	// Accept RPCs from peers
+	if err := n.transport.Serve(n); err != nil {
+		return fmt.Errorf("failed to serve raft RPCs: %w", err)
+	}
+
+	// Start the main loop and hand committed entries to the state machine
 	go n.run(ctx)
+	go n.applyLoop(ctx)
 
 	return nil
 }
 
-// run is the main loop of the Raft node
+// run waits for the node to be stopped. Timeouts are handled by timer
+// callbacks and RPCs by the transport; applyLoop hands committed entries to
+// the state machine.
 func (n *RaftNode) run(ctx context.Context) {
-	// Initialize timers if they haven't been initialized yet
-	if n.electionTimer == nil {
-		timeout := MinElectionTimeout + time.Duration(rand.Int63n(int64(MaxElectionTimeout-MinElectionTimeout)))
-		n.electionTimer = time.NewTimer(timeout)
+	<-ctx.Done()
+	n.logger.Info().Msgf("Shutting down Raft node %s", n.id)
+	n.mu.Lock()
+	n.stopped = true
+	n.failProposals(0, math.MaxUint64, ErrNodeStopped)
+	n.electionTimer.Stop()
+	if n.heartbeatTimer != nil {
+		n.heartbeatTimer.Stop()
+	}
+	n.mu.Unlock()
+	if err := n.transport.Close(); err != nil {
+		n.logger.Error().Err(err).Msg("Failed to close raft transport")
 	}
+}
 
-	if n.heartbeatTimer == nil {
-		n.heartbeatTimer = time.NewTimer(n.heartbeatInterval)
+// electionTimeout starts an election when no leader has been heard from
+func (n *RaftNode) electionTimeout() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// The timer may have been reset while this call was waiting for the lock
+	if n.stopped || n.clock.Now().Before(n.electionDeadline) {
+		return
 	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			n.logger.Info().Msgf("Shutting down Raft node %s", n.id)
-			return
+	if n.state != Leader && n.config.Has(n.id) {
+		n.campaign()
+	} else if n.state != Leader {
+		// Nodes outside the configuration never campaign
+		n.becomeFollower(n.currentTerm)
+	}
+}
 
-		case <-n.electionTimer.C:
-			n.mu.Lock()
-			if n.state != Leader {
-				n.startElection()
-			}
-			n.mu.Unlock()
+// heartbeatTimeout sends the periodic heartbeats while this node leads
+func (n *RaftNode) heartbeatTimeout() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 
-		case <-n.heartbeatTimer.C:
-			n.mu.Lock()
-			if n.state == Leader {
-				n.sendHeartbeats()
-				n.heartbeatTimer.Reset(n.heartbeatInterval)
-			}
-			n.mu.Unlock()
-		}
+	if n.stopped || n.state != Leader {
+		return
+	}
+
+	if n.checkQuorum && !n.hasQuorumContact() {
+		n.logger.Info().Msgf("📉 Node %s lost contact with a majority, stepping down in term %d", n.id, n.currentTerm)
+		n.setLeader("")
+		n.becomeFollower(n.currentTerm)
+		return
+	}
+
+	n.sendHeartbeats()
+	n.heartbeatTimer.Reset(n.heartbeatInterval)
+}
+
+// resetElectionTimer schedules the next election after a random timeout
+func (n *RaftNode) resetElectionTimer() {
+	timeout := MinElectionTimeout + time.Duration(n.rand.Int63n(int64(MaxElectionTimeout-MinElectionTimeout)))
+	n.electionDeadline = n.clock.Now().Add(timeout)
+	if n.electionTimer == nil {
+		n.electionTimer = n.clock.AfterFunc(timeout, n.electionTimeout)
+	} else {
+		n.electionTimer.Reset(timeout)
+	}
+}
 
-		// Apply committed entries to state machine
-		n.applyCommittedEntries()
+// signalApply wakes the apply loop to apply newly committed entries
+func (n *RaftNode) signalApply() {
+	select {
+	case n.applyNotify <- struct{}{}:
+	default:
 	}
 }
 
 // becomeFollower transitions this node to follower state
 func (n *RaftNode) becomeFollower(term uint64) {
-	oldTerm := n.currentTerm
-	if term > n.currentTerm {
-		n.currentTerm = term
-	}
+	// Proposed entries may still be committed by the next leader
+	n.flushLog()
 
-	n.state = Follower
+	oldTerm := n.currentTerm
+	n.setTerm(term)
+	n.setState(Follower)
+	n.preVoteTerm = 0
 
+	// Persist state to storage; heartbeats in the same term change nothing
 	if term > oldTerm {
 		n.votedFor = ""
+		n.persistState()
 	}
-	// Persist state to storage
-	n.persistState()
 
-	// Reset election timer with random timeout
-	timeout := MinElectionTimeout + time.Duration(rand.Int63n(int64(MaxElectionTimeout-MinElectionTimeout)))
-	if n.electionTimer == nil {
-		n.electionTimer = time.NewTimer(timeout)
-	} else {
-		n.electionTimer.Reset(timeout)
+	// Reads waiting on this node's leadership can no longer be confirmed
+	if len(n.pendingReads) > 0 {
+		n.failReads(ErrNotLeader)
+	}
+
+	// Neither can proposals that were not committed yet
+	if len(n.proposals) > 0 {
+		n.failProposals(n.commitIndex+1, math.MaxUint64, ErrLeadershipLost)
 	}
+
+	// A leader handing over leadership has succeeded once a newer term shows up
+	if n.transfer != nil {
+		if n.currentTerm > n.transfer.term {
+			n.finishTransfer(nil)
+		} else {
+			n.finishTransfer(errors.New("stepped down before the transfer completed"))
+		}
+	}
+
+	// Reset election timer with random timeout
+	n.resetElectionTimer()
 }
 
 // becomeCandidate transitions this node to candidate state
 func (n *RaftNode) becomeCandidate() {
-	n.state = Candidate
-	n.currentTerm++
+	n.setState(Candidate)
+	n.setTerm(n.currentTerm + 1)
 	n.votedFor = n.id
+	n.preVoteTerm = 0
 
 	// Persist state to storage
 	n.persistState()
 
 	// Reset election timer
-	timeout := MinElectionTimeout + time.Duration(rand.Int63n(int64(MaxElectionTimeout-MinElectionTimeout)))
-	n.electionTimer.Reset(timeout)
+	n.resetElectionTimer()
 }
 
 // becomeLeader transitions this node to leader state
 func (n *RaftNode) becomeLeader() {
-	n.state = Leader
-	n.leaderID = n.id
+	n.setState(Leader)
+	n.setLeader(n.id)
 
 	n.logger.Info().Msgf("👑 Node %s becomes LEADER for term %d", n.id, n.currentTerm)
 
-	// Initialize nextIndex and matchIndex
-	lastLogIndex := uint64(len(n.log) - 1)
+	// Initialize nextIndex and matchIndex; peers count as recently heard
+	// from so CheckQuorum gives them an election timeout to respond
+	lastLogIndex := n.lastLogIndex()
 	for peerID := range n.peers {
 		n.nextIndex[peerID] = lastLogIndex + 1
 		n.matchIndex[peerID] = 0
+		n.lastContact[peerID] = n.clock.Now()
+	}
+
+	// Acknowledgements from an earlier term say nothing about this one,
+	// and every peer is probed before entries are pipelined to it
+	for _, peer := range n.peers {
+		peer.ackedRound = 0
+		peer.ackedAt = time.Time{}
+		peer.replicating = false
+		peer.inflight = 0
 	}
 
+	// Append a no-op so entries from earlier terms can be committed and
+	// membership changes are allowed in this term
+	index := n.lastLogIndex() + 1
+	n.log = append(n.log, LogEntry{Index: index, Term: n.currentTerm, Type: EntryNoop})
+	n.persistLog(index)
+	n.updateCommitIndex()
+
 	// Stop the election timer - leaders don't need election timeouts
 	// as they should remain leaders until they detect a higher term
 	if n.electionTimer != nil {
@@ -250,14 +620,15 @@ func (n *RaftNode) becomeLeader() {
 
 	// Start sending heartbeats
 	if n.heartbeatTimer == nil {
-		n.heartbeatTimer = time.NewTimer(n.heartbeatInterval)
+		n.heartbeatTimer = n.clock.AfterFunc(n.heartbeatInterval, n.heartbeatTimeout)
 	} else {
 		n.heartbeatTimer.Reset(n.heartbeatInterval)
 	}
 }
 
-// startElection initiates a new election
-func (n *RaftNode) startElection() {
+// startElection initiates a new election. A leadership transfer election
+// is granted by voters that still hear from the current leader.
+func (n *RaftNode) startElection(leadershipTransfer bool) {
 	n.becomeCandidate()
 
 	// Vote for self
@@ -265,16 +636,25 @@ func (n *RaftNode) startElection() {
 
 	participants := 1
 	n.logger.Info().Msgf("⏳ Node %s starts election for term %d", n.id, n.currentTerm)
+	n.metrics.elections.Inc()
+
+	// A single-member cluster elects itself
+	if votesReceived >= n.config.quorum() {
+		n.becomeLeader()
+		return
+	}
 
 	// Prepare RequestVote arguments
-	lastLogIndex := uint64(len(n.log) - 1)
-	lastLogTerm := n.log[lastLogIndex].Term
+	lastLogIndex := n.lastLogIndex()
+	lastLogTerm := n.lastLogTerm()
 
 	args := RequestVoteArgs{
 		Term:         n.currentTerm,
 		CandidateID:  n.id,
 		LastLogIndex: lastLogIndex,
 		LastLogTerm:  lastLogTerm,
+
+		LeadershipTransfer: leadershipTransfer,
 	}
 
 	// Ask for votes from all peers
@@ -282,13 +662,17 @@ func (n *RaftNode) startElection() {
 	var wg sync.WaitGroup
 
 	for _, peer := range n.peers {
+		if !n.config.Has(peer.id) {
+			continue // Learners do not vote
+		}
 		wg.Add(1)
-		go func(p *RaftPeer) {
+		p := peer
+		n.spawn(func() {
 			defer wg.Done()
 
 			var reply RequestVoteReply
 			if err := p.client.RequestVote(args, &reply); err != nil {
-				if !(strings.Contains(err.Error(), "context deadline exceeded") || strings.Contains(err.Error(), "connection refused")) {
+				if !(errors.Is(err, ErrPeerUnreachable) || strings.Contains(err.Error(), "context deadline exceeded") || strings.Contains(err.Error(), "connection refused")) {
 					n.logger.Info().Msgf("⚠️  Node %s vote request to %s failed: %v", n.id, p.id, err)
 				}
 				return
@@ -316,7 +700,7 @@ func (n *RaftNode) startElection() {
 				votesMu.Unlock()
 
 				// Check if we have majority
-				if votesReceived > (len(n.peers)+1)/2 {
+				if votesReceived >= n.config.quorum() {
 					n.becomeLeader()
 				}
 
@@ -324,157 +708,347 @@ func (n *RaftNode) startElection() {
 					n.id, p.id, votesReceived, participants)
 
 			}
-		}(peer)
+		})
 	}
 }
 
-// sendHeartbeats sends heartbeats to all peers
+// sendHeartbeats sends an AppendEntries to every peer, so that each one
+// acknowledges the current round even when it has nothing new to receive
 func (n *RaftNode) sendHeartbeats() {
 	for _, peer := range n.peers {
-		go n.sendAppendEntries(peer)
+		n.replicateTo(peer, true)
+	}
+}
+
+// replicate sends new entries to every peer as far as its window allows
+func (n *RaftNode) replicate() {
+	for _, peer := range n.peers {
+		n.replicateTo(peer, false)
 	}
 }
 
-// sendAppendEntries sends an AppendEntries RPC to a peer
-func (n *RaftNode) sendAppendEntries(peer *RaftPeer) {
-	nextIdx := n.nextIndex[peer.id]
-	prevLogIndex := nextIdx - 1
-	prevLogTerm := uint64(0)
+// replicateTo sends the entries a peer is missing. Once a reply has shown
+// where the peer's log matches ours, up to MaxInflightAppends requests are
+// kept in flight, each one continuing where the previous one ended; until
+// then the peer is probed with a single request at a time. A heartbeat
+// sends a request even if there is nothing new or the window is full.
+func (n *RaftNode) replicateTo(peer *RaftPeer, heartbeat bool) {
+	if n.state != Leader {
+		return
+	}
 
-	if prevLogIndex > 0 && prevLogIndex < uint64(len(n.log)) {
-		prevLogTerm = n.log[prevLogIndex].Term
+	nextIdx := max(1, n.nextIndex[peer.id])
+	if nextIdx <= n.log[0].Index {
+		// The entries this peer needs have been compacted into the snapshot
+		if !peer.installingSnapshot {
+			n.spawn(func() { n.sendInstallSnapshot(peer) })
+		} else if heartbeat {
+			// Keep the peer from timing out while the snapshot is in flight
+			n.sendAppendEntries(peer, n.log[0].Index, nil, true)
+		}
+		return
 	}
 
-	// Get entries to send
-	var entries []LogEntry
-	if nextIdx < uint64(len(n.log)) {
-		entries = n.log[nextIdx:]
+	sent := false
+	for nextIdx <= n.lastLogIndex() && n.canSend(peer) {
+		entries := n.log[nextIdx-n.log[0].Index:]
 		if len(entries) > MaxAppendEntries {
 			entries = entries[:MaxAppendEntries]
 		}
+		n.sendAppendEntries(peer, nextIdx-1, append([]LogEntry(nil), entries...), false)
+		sent = true
+
+		if !peer.replicating {
+			break
+		}
+		nextIdx += uint64(len(entries))
+		n.nextIndex[peer.id] = nextIdx
+	}
+
+	if heartbeat && !sent {
+		// Vouch only for entries known to match, so the heartbeat cannot
+		// fail because of requests still in flight
+		prevLogIndex := nextIdx - 1
+		if peer.replicating {
+			prevLogIndex = max(n.matchIndex[peer.id], n.log[0].Index)
+		}
+		n.sendAppendEntries(peer, prevLogIndex, nil, false)
+	}
+}
+
+// canSend reports whether another request with entries fits the peer's window
+func (n *RaftNode) canSend(peer *RaftPeer) bool {
+	if peer.replicating {
+		return peer.inflight < MaxInflightAppends
 	}
+	return peer.inflight == 0
+}
 
+// sendAppendEntries sends an AppendEntries RPC with the entries following
+// prevLogIndex to a peer and handles the reply. The result of a heartbeat
+// sent while a snapshot is in flight is ignored apart from the ack.
+func (n *RaftNode) sendAppendEntries(peer *RaftPeer, prevLogIndex uint64, entries []LogEntry, heartbeatOnly bool) {
 	args := AppendEntriesArgs{
 		Term:         n.currentTerm,
 		LeaderID:     n.id,
 		PrevLogIndex: prevLogIndex,
-		PrevLogTerm:  prevLogTerm,
+		PrevLogTerm:  n.termAt(prevLogIndex),
 		Entries:      entries,
 		LeaderCommit: n.commitIndex,
 	}
-
-	var reply AppendEntriesReply
-	if err := peer.client.AppendEntries(args, &reply); err != nil {
-		return
+	round, sentAt := n.readRound, n.clock.Now()
+	if len(entries) > 0 {
+		peer.inflight++
 	}
 
-	n.mu.Lock()
-	defer n.mu.Unlock()
+	n.spawn(func() {
+		var reply AppendEntriesReply
+		err := peer.client.AppendEntries(args, &reply)
 
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.handleAppendEntriesReply(peer, args, &reply, err, round, sentAt, heartbeatOnly)
+	})
+}
+
+// handleAppendEntriesReply updates the peer's progress from an AppendEntries reply
+func (n *RaftNode) handleAppendEntriesReply(peer *RaftPeer, args AppendEntriesArgs, reply *AppendEntriesReply, err error, round uint64, sentAt time.Time, heartbeatOnly bool) {
 	// If we're no longer the leader or term has changed, ignore response
 	if n.state != Leader || n.currentTerm != args.Term {
 		return
 	}
+	if len(args.Entries) > 0 && peer.inflight > 0 {
+		peer.inflight--
+	}
+
+	n.setReachable(peer, err)
+	if err != nil {
+		// Entries after the lost request were sent in vain; probe again
+		// from the last known match once the peer answers
+		if peer.replicating {
+			peer.replicating = false
+			n.nextIndex[peer.id] = n.matchIndex[peer.id] + 1
+		}
+		return
+	}
 
 	// If peer has higher term, become follower
 	if reply.Term > n.currentTerm {
 		n.becomeFollower(reply.Term)
 		return
 	}
+	n.recordContact(peer.id)
+	n.recordAck(peer, round, sentAt)
 
+	// The snapshot reply moves nextIndex past the compacted entries
+	if heartbeatOnly {
+		return
+	}
+
+	prevLogIndex := args.PrevLogIndex
 	if reply.Success {
-		// Update nextIndex and matchIndex for successful append
-		n.matchIndex[peer.id] = prevLogIndex + uint64(len(entries))
-		n.nextIndex[peer.id] = n.matchIndex[peer.id] + 1
+		// Replies to pipelined requests may arrive out of order
+		n.matchIndex[peer.id] = max(n.matchIndex[peer.id], prevLogIndex+uint64(len(args.Entries)))
+		if !peer.replicating {
+			peer.replicating = true
+			n.nextIndex[peer.id] = n.matchIndex[peer.id] + 1
+		}
+		n.nextIndex[peer.id] = max(n.nextIndex[peer.id], n.matchIndex[peer.id]+1)
 
 		// Check if we can commit more entries
 		n.updateCommitIndex()
-	} else {
-		// If append failed, decrement nextIndex and retry
-		if reply.ConflictTerm > 0 {
-			// Fast backtracking using conflict information
-			conflictTermStartIndex := uint64(0)
-			// Find the first index of conflicting term in our log
-			for i := prevLogIndex; i > 0; i-- {
-				if i < uint64(len(n.log)) && n.log[i].Term == reply.ConflictTerm {
-					conflictTermStartIndex = i
-					break
-				}
-			}
 
-			if conflictTermStartIndex > 0 {
-				// We found an entry with the conflict term, try the next index
-				n.nextIndex[peer.id] = conflictTermStartIndex + 1
-			} else {
-				// We don't have the conflict term, go to the first index of that term
-				n.nextIndex[peer.id] = reply.ConflictIndex
+		// A transfer target that has caught up is told to take over
+		n.maybeSendTimeoutNow(peer.id)
+
+		// Keep the pipeline full
+		n.replicateTo(peer, false)
+		return
+	}
+
+	// A later request has already matched further; this one is stale
+	if prevLogIndex < n.matchIndex[peer.id] {
+		return
+	}
+	peer.replicating = false
+
+	// If append failed, decrement nextIndex and retry
+	if reply.ConflictTerm > 0 {
+		// Fast backtracking using conflict information
+		conflictTermStartIndex := uint64(0)
+		// Find the first index of conflicting term in our log
+		for i := prevLogIndex; i > n.log[0].Index; i-- {
+			if i <= n.lastLogIndex() && n.termAt(i) == reply.ConflictTerm {
+				conflictTermStartIndex = i
+				break
 			}
+		}
+
+		if conflictTermStartIndex > 0 {
+			// We found an entry with the conflict term, try the next index
+			n.nextIndex[peer.id] = conflictTermStartIndex + 1
 		} else {
-			// Simpler backtracking if conflict info not provided
-			n.nextIndex[peer.id] = max(1, n.nextIndex[peer.id]-1)
+			// We don't have the conflict term, go to the first index of that term
+			n.nextIndex[peer.id] = reply.ConflictIndex
 		}
+	} else if reply.ConflictIndex > 0 {
+		// The peer's log is shorter, continue right after its last entry
+		n.nextIndex[peer.id] = max(1, min(reply.ConflictIndex, prevLogIndex))
+	} else {
+		// Simpler backtracking if conflict info not provided
+		n.nextIndex[peer.id] = max(1, prevLogIndex)
 	}
+	n.nextIndex[peer.id] = max(n.nextIndex[peer.id], n.matchIndex[peer.id]+1)
 }
 
 // updateCommitIndex updates the commit index based on matchIndex values
 func (n *RaftNode) updateCommitIndex() {
 	// Find the highest index that is replicated to a majority of nodes
-	for i := n.commitIndex + 1; i < uint64(len(n.log)); i++ {
+	commit := n.commitIndex
+	for i := n.commitIndex + 1; i <= n.lastLogIndex(); i++ {
 		// Only consider entries from current term
-		if n.log[i].Term != n.currentTerm {
+		if n.termAt(i) != n.currentTerm {
 			continue
 		}
 
-		count := 1 // Count self
-		for _, matchIdx := range n.matchIndex {
-			if matchIdx >= i {
+		count := 0
+		for id := range n.config.Members {
+			if id == n.id {
+				// The leader's own copy counts once it has been written
+				if n.unpersisted == 0 || i < n.unpersisted {
+					count++
+				}
+			} else if n.matchIndex[id] >= i {
 				count++
 			}
 		}
 
 		// Check if we have a majority
-		if count > (len(n.peers)+1)/2 {
-			n.commitIndex = i
+		if count >= n.config.quorum() {
+			commit = i
 		} else {
 			break
 		}
 	}
-}
+	n.commitTo(commit)
 
-// applyCommittedEntries applies any newly committed entries to the state machine
-func (n *RaftNode) applyCommittedEntries() {
-	n.mu.Lock()
-	defer n.mu.Unlock()
+	// A leader that has been removed steps down once its removal commits
+	if n.state == Leader && n.configIndex <= n.commitIndex && !n.config.Has(n.id) {
+		n.logger.Info().Msgf("👋 Node %s removed from the configuration, stepping down", n.id)
+		n.becomeFollower(n.currentTerm)
+	}
 
-	for n.lastApplied < n.commitIndex {
-		// Record previous value to check for changes
-		prevLastApplied := n.lastApplied
+	// Reads held back until the leader committed an entry in its term
+	if n.state == Leader {
+		n.confirmReads()
+	}
+}
 
-		for n.lastApplied < n.commitIndex {
-			n.lastApplied++
-			entry := n.log[n.lastApplied]
-			n.applyCh <- entry
+// applyLoop hands committed entries to the state machine through applyCh.
+// It only takes the lock to copy up to MaxApplyBatch entries out of the
+// log and to record them as handed over, so while a slow state machine
+// leaves applyCh full the node keeps heartbeating, voting and replicating.
+func (n *RaftNode) applyLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.applyNotify:
 		}
 
-		// If lastApplied changed, persist state
-		if prevLastApplied != n.lastApplied {
-			n.persistState()
+		for {
+			batch := n.nextApplyBatch()
+			if len(batch) == 0 {
+				break
+			}
+			for _, entry := range batch {
+				select {
+				case n.applyCh <- entry:
+				case <-ctx.Done():
+					return
+				}
+			}
+			n.handedOver(batch[len(batch)-1].Index)
 		}
 	}
 }
 
-// Submit adds a new command to the log (called by clients)
-func (n *RaftNode) Submit(command interface{}) (uint64, error) {
+// resumeFrom makes the entries after applied the next ones to hand to the
+// state machine
+func (n *RaftNode) resumeFrom(applied uint64) {
+	if last := n.lastLogIndex(); applied > last {
+		n.logger.Warn().Msgf("⚠️ State machine has applied up to index %d, past the end of the log at %d", applied, last)
+	}
+	n.handedOverIndex = applied
+	n.appliedIndex = applied
+	n.commitIndex = max(n.commitIndex, min(applied, n.lastLogIndex()))
+}
+
+// nextApplyBatch copies the committed entries after handedOverIndex, at most
+// MaxApplyBatch of them. Committed entries are never overwritten, and those
+// a snapshot installed meanwhile covers are skipped by the state machine.
+func (n *RaftNode) nextApplyBatch() []LogEntry {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
+	// A snapshot restore replaces the state machine wholesale; hold back
+	// later entries until it has finished
+	if n.restoring || n.stopped || n.handedOverIndex >= n.commitIndex {
+		return nil
+	}
+
+	from := n.handedOverIndex + 1
+	to := min(n.commitIndex, n.handedOverIndex+MaxApplyBatch)
+	return append([]LogEntry(nil), n.log[from-n.log[0].Index:to-n.log[0].Index+1]...)
+}
+
+// handedOver records that the entries up to index are in applyCh. Nothing
+// is persisted: the applied index only moves once the state machine reports
+// the entries as applied.
+func (n *RaftNode) handedOver(index uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// An installed snapshot may have moved handedOverIndex past the batch
+	n.handedOverIndex = max(n.handedOverIndex, index)
+}
+
+// applyBacklog returns the number of entries in the log the state machine
+// has not applied yet, committed or not
+func (n *RaftNode) applyBacklog() uint64 {
+	last := n.lastLogIndex()
+	return last - min(n.appliedIndex, last)
+}
+
+// Submit adds a new command to the log (called by clients)
+func (n *RaftNode) Submit(command interface{}) (uint64, error) {
+	f, err := n.Propose(command)
+	if err != nil {
+		return 0, err
+	}
+	return f.Index(), nil
+}
+
+// appendCommand appends a command to the leader's log and starts
+// replicating it
+func (n *RaftNode) appendCommand(command interface{}) (LogEntry, error) {
 	// If not the leader, reject the command
 	if n.state != Leader {
-		return 0, fmt.Errorf("not the leader")
+		return LogEntry{}, ErrNotLeader
+	}
+	if n.transfer != nil {
+		return LogEntry{}, ErrLeadershipTransfer
+	}
+
+	// Push back on clients while the state machine cannot keep up, rather
+	// than letting the log and applyCh fill up behind it
+	if n.applyBacklog() >= n.maxApplyBacklog {
+		n.metrics.rejectedProposals.Inc()
+		return LogEntry{}, ErrApplyBacklog
 	}
 
 	// Append to log
-	index := uint64(len(n.log))
+	index := n.lastLogIndex() + 1
 	entry := LogEntry{
 		Index:   index,
 		Term:    n.currentTerm,
@@ -482,15 +1056,42 @@ func (n *RaftNode) Submit(command interface{}) (uint64, error) {
 	}
 
 	n.log = append(n.log, entry)
-	n.logger.Info().Msgf("🔄 Node %s submitted command at index %d", n.id, index)
+	n.logger.Debug().Msgf("🔄 Node %s submitted command at index %d", n.id, index)
 
-	// Persist log entry
-	n.persistLog(index)
+	// Commands proposed until the flush runs share its write and its requests
+	if n.unpersisted == 0 {
+		n.unpersisted = index
+	}
+	if !n.flushScheduled {
+		n.flushScheduled = true
+		n.spawn(n.flushProposals)
+	}
+
+	return entry, nil
+}
 
-	// Send the new entry to all peers immediately
-	go n.sendHeartbeats()
+// flushProposals sends the proposed entries to the peers and writes them
+// to storage with a single append, then counts the leader's own copy
+func (n *RaftNode) flushProposals() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 
-	return index, nil
+	n.flushScheduled = false
+	if n.state != Leader {
+		return
+	}
+
+	// Followers append the entries while the leader writes its own copy
+	n.replicate()
+	n.flushLog()
+	n.updateCommitIndex()
+}
+
+// flushLog writes the entries proposed since the last flush
+func (n *RaftNode) flushLog() {
+	if n.unpersisted != 0 {
+		n.persistLog(n.unpersisted)
+	}
 }
 
 // RequestVote handles a RequestVote RPC from another node
@@ -498,6 +1099,27 @@ func (n *RaftNode) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) er
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
+	// A learner has no vote; its term follows the leader's AppendEntries
+	if n.config.IsLearner(n.id) {
+		reply.Term = n.currentTerm
+		reply.VoteGranted = false
+		return nil
+	}
+
+	if args.PreVote {
+		n.handlePreVote(args, reply)
+		return nil
+	}
+
+	// While a leader is active, elections are only started by nodes that
+	// were cut off; ignore them without adopting their term. An election
+	// started by a leadership transfer was asked for by the leader itself.
+	if n.checkQuorum && !args.LeadershipTransfer && args.Term > n.currentTerm && n.hasActiveLeader() {
+		reply.Term = n.currentTerm
+		reply.VoteGranted = false
+		return nil
+	}
+
 	// Update term if necessary
 	termChanged := false
 	if args.Term > n.currentTerm {
@@ -517,11 +1139,7 @@ func (n *RaftNode) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) er
 	// If we haven't voted yet or already voted for this candidate
 	if n.votedFor == "" || n.votedFor == args.CandidateID {
 		// Check if candidate's log is at least as up-to-date as ours
-		lastLogIndex := uint64(len(n.log) - 1)
-		lastLogTerm := n.log[lastLogIndex].Term
-
-		if args.LastLogTerm > lastLogTerm ||
-			(args.LastLogTerm == lastLogTerm && args.LastLogIndex >= lastLogIndex) {
+		if n.isLogUpToDate(args.LastLogIndex, args.LastLogTerm) {
 			// Grant vote
 			prevVotedFor := n.votedFor
 			n.votedFor = args.CandidateID
@@ -533,8 +1151,7 @@ func (n *RaftNode) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) er
 			}
 
 			// Reset election timer since we voted
-			timeout := MinElectionTimeout + time.Duration(rand.Int63n(int64(MaxElectionTimeout-MinElectionTimeout)))
-			n.electionTimer.Reset(timeout)
+			n.resetElectionTimer()
 		}
 	}
 
@@ -558,7 +1175,9 @@ func (n *RaftNode) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesRep
 	if args.Term >= n.currentTerm {
 		prevTerm := n.currentTerm
 		n.becomeFollower(args.Term)
-		n.leaderID = args.LeaderID
+		n.setLeader(args.LeaderID)
+		n.lastLeaderContact = n.clock.Now()
+		n.leaderCommit = max(n.leaderCommit, args.LeaderCommit)
 
 		// If term changed, persist state
 		if prevTerm != args.Term {
@@ -566,26 +1185,37 @@ func (n *RaftNode) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesRep
 		}
 
 		// Reset election timer on valid heartbeat
-		timeout := MinElectionTimeout + time.Duration(rand.Int63n(int64(MaxElectionTimeout-MinElectionTimeout)))
-		n.electionTimer.Reset(timeout)
+		n.resetElectionTimer()
+	}
+
+	// Entries covered by our snapshot are already committed, skip over them
+	if base := n.log[0].Index; args.PrevLogIndex < base {
+		skip := base - args.PrevLogIndex
+		if skip >= uint64(len(args.Entries)) {
+			args.Entries = nil
+		} else {
+			args.Entries = args.Entries[skip:]
+		}
+		args.PrevLogIndex = base
+		args.PrevLogTerm = n.log[0].Term
 	}
 
 	// Check if we have the previous log entry
 	if args.PrevLogIndex > 0 {
-		if args.PrevLogIndex >= uint64(len(n.log)) {
+		if args.PrevLogIndex > n.lastLogIndex() {
 			// We don't have this entry, provide hint
-			reply.ConflictIndex = uint64(len(n.log))
+			reply.ConflictIndex = n.lastLogIndex() + 1
 			reply.ConflictTerm = 0
 			return nil
 		}
 
-		if n.log[args.PrevLogIndex].Term != args.PrevLogTerm {
+		if n.termAt(args.PrevLogIndex) != args.PrevLogTerm {
 			// We have a conflicting entry, provide term info
-			reply.ConflictTerm = n.log[args.PrevLogIndex].Term
+			reply.ConflictTerm = n.termAt(args.PrevLogIndex)
 
 			// Find first index with conflicting term
-			for i := uint64(1); i < uint64(len(n.log)); i++ {
-				if n.log[i].Term == reply.ConflictTerm {
+			for i := n.log[0].Index + 1; i <= n.lastLogIndex(); i++ {
+				if n.termAt(i) == reply.ConflictTerm {
 					reply.ConflictIndex = i
 					break
 				}
@@ -601,18 +1231,21 @@ func (n *RaftNode) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesRep
 	if len(args.Entries) > 0 {
 		nextIdx := args.PrevLogIndex + 1
 		logChanged := false
-		persistIndex := uint64(len(n.log))
+		truncated := false
+		persistIndex := n.lastLogIndex() + 1
 
 		// Handle new entries
 		for i, entry := range args.Entries {
-			if nextIdx+uint64(i) < uint64(len(n.log)) {
+			if nextIdx+uint64(i) <= n.lastLogIndex() {
 				// Entry exists, check if terms match
-				if n.log[nextIdx+uint64(i)].Term != entry.Term {
+				if n.termAt(nextIdx+uint64(i)) != entry.Term {
 					// Terms don't match, truncate log and append new entries
-					n.log = n.log[:nextIdx+uint64(i)]
+					n.failProposals(nextIdx+uint64(i), math.MaxUint64, ErrEntryOverwritten)
+					n.log = n.log[:nextIdx+uint64(i)-n.log[0].Index]
 					n.log = append(n.log, args.Entries[i:]...)
 					persistIndex = nextIdx + uint64(i)
 					logChanged = true
+					truncated = true
 					break
 				}
 			} else {
@@ -628,11 +1261,27 @@ func (n *RaftNode) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesRep
 		if logChanged && n.storage != nil {
 			n.persistLog(persistIndex)
 		}
+
+		// Membership follows the latest configuration entry in the log,
+		// including when a conflicting one was just truncated away
+		if logChanged {
+			configChanged := truncated
+			for _, entry := range args.Entries {
+				if entry.Type == EntryConfiguration {
+					configChanged = true
+				}
+			}
+			if configChanged {
+				n.reloadConfiguration()
+			}
+		}
 	}
 
-	// Update commit index if needed
-	if args.LeaderCommit > n.commitIndex {
-		n.commitIndex = min(args.LeaderCommit, uint64(len(n.log)-1))
+	// Update commit index if needed. Only the entries this request vouched
+	// for are known to match the leader's log; a heartbeat checked against
+	// an earlier entry says nothing about the ones after it.
+	if lastNew := args.PrevLogIndex + uint64(len(args.Entries)); args.LeaderCommit > n.commitIndex && lastNew > n.commitIndex {
+		n.commitTo(min(args.LeaderCommit, lastNew))
 	}
 
 	return nil
@@ -656,6 +1305,49 @@ func (n *RaftNode) ID() string {
 	return n.id
 }
 
+// lastLogIndex returns the index of the last entry in the log. n.log[0] is a
+// placeholder for the last entry covered by the snapshot (index 0 if none).
+func (n *RaftNode) lastLogIndex() uint64 {
+	return n.log[0].Index + uint64(len(n.log)-1)
+}
+
+// lastLogTerm returns the term of the last entry in the log
+func (n *RaftNode) lastLogTerm() uint64 {
+	return n.log[len(n.log)-1].Term
+}
+
+// entryAt returns the entry at the given log index, which must be retained
+func (n *RaftNode) entryAt(index uint64) LogEntry {
+	return n.log[index-n.log[0].Index]
+}
+
+// termAt returns the term of the entry at index, or 0 if it is not retained
+func (n *RaftNode) termAt(index uint64) uint64 {
+	if index < n.log[0].Index || index > n.lastLogIndex() {
+		return 0
+	}
+	return n.log[index-n.log[0].Index].Term
+}
+
+// restoreLog rebuilds the in-memory log from persisted entries, skipping
+// anything already covered by the snapshot
+func (n *RaftNode) restoreLog(entries []LogEntry) {
+	for _, entry := range entries {
+		if entry.Index <= n.log[0].Index {
+			continue
+		}
+
+		pos := entry.Index - n.log[0].Index
+		if pos > uint64(len(n.log)) {
+			n.logger.Warn().Uint64("index", entry.Index).Msg("Gap in persisted log, ignoring the rest")
+			break
+		}
+
+		// A later copy of an index replaces the earlier one
+		n.log = append(n.log[:pos], entry)
+	}
+}
+
 // Helper functions for min/max that work with uint64
 func min(a, b uint64) uint64 {
 	if a < b {
@@ -671,17 +1363,10 @@ func max(a, b uint64) uint64 {
 	return b
 }
 
-// Add this method to update lastApplied
-func (n *RaftNode) UpdateLastApplied(index uint64) {
-	n.mu.Lock()
-	defer n.mu.Unlock()
-	n.lastApplied = index
-}
-
 // Add method to persist Raft state
 func (n *RaftNode) persistState() {
 	if n.storage != nil {
-		if err := n.storage.SaveState(n.currentTerm, n.votedFor, n.lastApplied); err != nil {
+		if err := n.storage.SaveState(n.currentTerm, n.votedFor, n.appliedIndex); err != nil {
 			n.logger.Info().Msgf("Failed to persist state: %v", err)
 		}
 	}
@@ -689,11 +1374,17 @@ func (n *RaftNode) persistState() {
 
 // Add method to persist log entries
 func (n *RaftNode) persistLog(startIndex uint64) {
-	if n.storage == nil || startIndex >= uint64(len(n.log)) {
+	// Proposed entries not flushed yet go out with this write
+	if n.unpersisted != 0 && n.unpersisted < startIndex {
+		startIndex = n.unpersisted
+	}
+	n.unpersisted = 0
+
+	if n.storage == nil || startIndex <= n.log[0].Index || startIndex > n.lastLogIndex() {
 		return
 	}
 
-	entries := n.log[startIndex:]
+	entries := n.log[startIndex-n.log[0].Index:]
 	if err := n.storage.AppendLog(entries); err != nil {
 		n.logger.Info().Msgf("Failed to persist log entries: %v", err)
 	}
@@ -0,0 +1,177 @@
+package raft
+
+import (
+	"sync/atomic"
+)
+
+// Observers let other parts of the application react to what a node goes
+// through without polling it. Events are delivered on a buffered channel
+// per observer and never block the node: when an observer's buffer is full
+// the event is dropped and counted. An observer that needs the latest state
+// rather than every event can read Status after receiving one, as events
+// that follow a dropped one are still delivered.
+
+// EventType identifies what happened to a node
+type EventType string
+
+const (
+	EventStateChange     EventType = "state"            // The node became follower, candidate or leader
+	EventLeaderChange    EventType = "leader"           // The node learned of a new leader, or lost it
+	EventTermChange      EventType = "term"             // The node moved to a new term
+	EventCommit          EventType = "commit"           // The commit index advanced
+	EventApplied         EventType = "applied"          // The state machine applied entries
+	EventPeerUnreachable EventType = "peer_unreachable" // An RPC from the leader to a peer failed
+	EventPeerReachable   EventType = "peer_reachable"   // A peer answered the leader again
+)
+
+// Event is something that happened to a node. State, LeaderID and Term are
+// the node's at the time of the event, whatever its type.
+type Event struct {
+	Type     EventType `json:"type"`
+	NodeID   string    `json:"node_id"`
+	State    NodeState `json:"state"`
+	LeaderID string    `json:"leader"`
+	Term     uint64    `json:"term"`
+	Index    uint64    `json:"index,omitempty"` // Commit index or applied index
+	PeerID   string    `json:"peer,omitempty"`  // Peer that became unreachable or reachable
+	Error    string    `json:"error,omitempty"` // Why the peer is unreachable
+}
+
+// Observer receives the events of a node it was registered with
+type Observer struct {
+	ch      chan Event
+	types   map[EventType]bool // Nil for every type
+	dropped atomic.Uint64
+}
+
+// Events returns the channel events are delivered on. It is closed when
+// the observer is deregistered.
+func (o *Observer) Events() <-chan Event {
+	return o.ch
+}
+
+// Dropped returns the number of events dropped because the buffer was full
+func (o *Observer) Dropped() uint64 {
+	return o.dropped.Load()
+}
+
+// RegisterObserver starts delivering the node's events of the given types,
+// or of every type if none are given, to a new observer with room for
+// buffer undelivered events
+func (n *RaftNode) RegisterObserver(buffer int, types ...EventType) *Observer {
+	o := &Observer{ch: make(chan Event, buffer)}
+	if len(types) > 0 {
+		o.types = make(map[EventType]bool, len(types))
+		for _, t := range types {
+			o.types[t] = true
+		}
+	}
+
+	n.observerMu.Lock()
+	defer n.observerMu.Unlock()
+	if n.observers == nil {
+		n.observers = make(map[*Observer]struct{})
+	}
+	n.observers[o] = struct{}{}
+	return o
+}
+
+// DeregisterObserver stops delivering events to an observer and closes its channel
+func (n *RaftNode) DeregisterObserver(o *Observer) {
+	n.observerMu.Lock()
+	defer n.observerMu.Unlock()
+	if _, ok := n.observers[o]; !ok {
+		return
+	}
+	delete(n.observers, o)
+	close(o.ch)
+}
+
+// notify delivers an event to the observers interested in it. It is called
+// with n.mu held and never blocks.
+func (n *RaftNode) notify(event Event) {
+	n.observerMu.RLock()
+	defer n.observerMu.RUnlock()
+	if len(n.observers) == 0 {
+		return
+	}
+
+	event.NodeID = n.id
+	event.State = n.state
+	event.LeaderID = n.leaderID
+	event.Term = n.currentTerm
+	for o := range n.observers {
+		if o.types != nil && !o.types[event.Type] {
+			continue
+		}
+		select {
+		case o.ch <- event:
+		default:
+			o.dropped.Add(1)
+		}
+	}
+}
+
+// setState moves the node to a new state and notifies observers if it changed
+func (n *RaftNode) setState(state NodeState) {
+	if n.state == state {
+		return
+	}
+	n.state = state
+	n.notify(Event{Type: EventStateChange})
+}
+
+// setTerm moves the node to a newer term and notifies observers
+func (n *RaftNode) setTerm(term uint64) {
+	if term <= n.currentTerm {
+		return
+	}
+	n.currentTerm = term
+	n.notify(Event{Type: EventTermChange})
+}
+
+// setLeader records the leader of the current term and notifies observers
+// if it changed
+func (n *RaftNode) setLeader(id string) {
+	if n.leaderID == id {
+		return
+	}
+	n.leaderID = id
+	n.notify(Event{Type: EventLeaderChange})
+}
+
+// commitTo advances the commit index, wakes the run loop to apply the newly
+// committed entries and notifies observers
+func (n *RaftNode) commitTo(index uint64) {
+	if index <= n.commitIndex {
+		return
+	}
+	n.commitIndex = index
+	n.signalApply()
+	n.notify(Event{Type: EventCommit, Index: index})
+}
+
+// setApplied records the highest index the state machine has applied and
+// notifies observers if it advanced
+func (n *RaftNode) setApplied(index uint64) {
+	if index <= n.appliedIndex {
+		return
+	}
+	n.appliedIndex = index
+	n.notify(Event{Type: EventApplied, Index: index})
+}
+
+// setReachable records whether the latest RPC to a peer got an answer and
+// notifies observers when that changes
+func (n *RaftNode) setReachable(peer *RaftPeer, err error) {
+	unreachable := err != nil
+	if peer.unreachable == unreachable {
+		return
+	}
+	peer.unreachable = unreachable
+	if unreachable {
+		n.notify(Event{Type: EventPeerUnreachable, PeerID: peer.id, Error: err.Error()})
+	} else {
+		n.notify(Event{Type: EventPeerReachable, PeerID: peer.id})
+	}
+}
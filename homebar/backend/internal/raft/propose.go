@@ -0,0 +1,116 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Proposals wait for the outcome of a command instead of only learning its
+// log index. The leader keeps a Future per proposed index. The state machine
+// resolves it with its result when it applies the entry, and the node fails
+// it as soon as the entry can no longer be applied through this node: when
+// it is overwritten by a newer leader, when the node steps down before the
+// entry was committed, or when the node stops.
+
+var (
+	// ErrLeadershipLost is returned for a proposal whose leader stepped down
+	// before it was committed. A later leader may still commit it.
+	ErrLeadershipLost = errors.New("leadership lost before the entry was committed")
+	// ErrEntryOverwritten is returned for a proposal replaced in the log by a newer leader
+	ErrEntryOverwritten = errors.New("entry was overwritten by a newer leader")
+	// ErrAppliedBySnapshot is returned for a proposal that reached the state
+	// machine through a snapshot from the leader, which carries no results
+	ErrAppliedBySnapshot = errors.New("entry was applied through a snapshot")
+	// ErrNodeStopped is returned for proposals still pending when the node stops
+	ErrNodeStopped = errors.New("raft node stopped")
+	// ErrApplyBacklog is returned for new commands while the leader's state
+	// machine is too far behind its log. The command can be retried shortly.
+	ErrApplyBacklog = errors.New("too many entries waiting to be applied")
+)
+
+// Future is the outcome of a proposed command
+type Future struct {
+	index    uint64
+	term     uint64
+	proposed time.Time
+	done     chan struct{}
+	result   interface{}
+	err      error
+}
+
+// Index returns the log index of the proposed entry
+func (f *Future) Index() uint64 {
+	return f.index
+}
+
+// Term returns the term the entry was proposed in
+func (f *Future) Term() uint64 {
+	return f.term
+}
+
+// Done is closed once the future has resolved
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the entry has been applied and returns the state
+// machine's result, or until the proposal failed or ctx ended
+func (f *Future) Wait(ctx context.Context) (interface{}, error) {
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolve completes the future; the caller removes it from the pending set
+func (f *Future) resolve(result interface{}, err error) {
+	f.result = result
+	f.err = err
+	close(f.done)
+}
+
+// Propose appends a command to the log and returns a future that resolves
+// once the state machine has applied it. Submit proposes the same way but
+// only returns the index.
+func (n *RaftNode) Propose(command interface{}) (*Future, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	entry, err := n.appendCommand(command)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Future{index: entry.Index, term: entry.Term, proposed: n.clock.Now(), done: make(chan struct{})}
+	n.proposals[entry.Index] = f
+	return f, nil
+}
+
+// NotifyAppliedResult is NotifyApplied for state machines that report the
+// outcome of applying an entry. The result resolves the entry's future if
+// it was proposed on this node; NotifyApplied resolves it with no result.
+func (n *RaftNode) NotifyAppliedResult(index uint64, result interface{}, err error) {
+	n.mu.Lock()
+	n.setApplied(index)
+	if f, ok := n.proposals[index]; ok {
+		delete(n.proposals, index)
+		f.resolve(result, err)
+		n.metrics.applyLatency.Observe(n.clock.Now().Sub(f.proposed).Seconds())
+	}
+	n.mu.Unlock()
+
+	n.maybeSnapshot(index)
+}
+
+// failProposals fails the pending proposals with from <= index <= to
+func (n *RaftNode) failProposals(from, to uint64, err error) {
+	for index, f := range n.proposals {
+		if index >= from && index <= to {
+			delete(n.proposals, index)
+			f.resolve(nil, err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package raft
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Linearizable reads without writing to the log (Raft thesis, section 6.4).
+//
+// ReadIndex records a read, then the leader sends a round of heartbeats. Once
+// a majority has acknowledged a heartbeat sent after the read was recorded,
+// no other leader can have been elected before the read arrived, so the
+// commit index at that point is a safe read index: once the state machine has
+// applied it, a local read returns the latest committed state.
+//
+// LeaseReadIndex skips the heartbeat round while the leader holds a lease.
+// With CheckQuorum, voters ignore elections for MinElectionTimeout after
+// hearing from a leader, so a leader whose heartbeat was acknowledged by a
+// majority keeps its leadership for LeaseDuration after sending it, as long
+// as clocks do not drift by more than the margin.
+
+// readRequest is a read waiting for its leadership confirmation
+type readRequest struct {
+	round uint64 // Heartbeat round that has to be acknowledged by a majority
+	done  chan readResult
+}
+
+type readResult struct {
+	index uint64
+	err   error
+}
+
+// ReadIndex confirms leadership with a round of heartbeats and returns the
+// index the state machine must apply before serving a linearizable read
+func (n *RaftNode) ReadIndex(ctx context.Context) (uint64, error) {
+	n.mu.Lock()
+	req, err := n.startRead(false)
+	n.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return n.awaitRead(ctx, req)
+}
+
+// LeaseReadIndex is like ReadIndex but answers at once while the leader holds
+// a lease. Without CheckQuorum no lease is held and it falls back to ReadIndex.
+func (n *RaftNode) LeaseReadIndex(ctx context.Context) (uint64, error) {
+	n.mu.Lock()
+	req, err := n.startRead(true)
+	n.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return n.awaitRead(ctx, req)
+}
+
+// startRead registers a read and starts the heartbeat round confirming it
+func (n *RaftNode) startRead(lease bool) (*readRequest, error) {
+	if n.state != Leader {
+		return nil, ErrNotLeader
+	}
+
+	req := &readRequest{done: make(chan readResult, 1)}
+
+	// The commit index is only known to be current once the leader has
+	// committed an entry in its own term
+	if lease && n.termAt(n.commitIndex) == n.currentTerm && n.leaseValid() {
+		req.done <- readResult{index: n.commitIndex}
+		return req, nil
+	}
+
+	n.readRound++
+	req.round = n.readRound
+	n.pendingReads = append(n.pendingReads, req)
+
+	n.confirmReads()
+	if len(n.pendingReads) > 0 {
+		n.sendHeartbeats()
+	}
+	return req, nil
+}
+
+// awaitRead waits for a read to be confirmed or the context to end
+func (n *RaftNode) awaitRead(ctx context.Context, req *readRequest) (uint64, error) {
+	select {
+	case res := <-req.done:
+		return res.index, res.err
+	case <-ctx.Done():
+		n.mu.Lock()
+		for i, pending := range n.pendingReads {
+			if pending == req {
+				n.pendingReads = append(n.pendingReads[:i], n.pendingReads[i+1:]...)
+				break
+			}
+		}
+		n.mu.Unlock()
+		return 0, ctx.Err()
+	}
+}
+
+// recordAck notes that a peer acknowledged an AppendEntries sent at sentAt
+// during the given heartbeat round, and confirms the reads it completes
+func (n *RaftNode) recordAck(peer *RaftPeer, round uint64, sentAt time.Time) {
+	if round > peer.ackedRound {
+		peer.ackedRound = round
+	}
+	if sentAt.After(peer.ackedAt) {
+		peer.ackedAt = sentAt
+	}
+	n.confirmReads()
+}
+
+// confirmReads answers the reads whose heartbeat round a majority has acknowledged
+func (n *RaftNode) confirmReads() {
+	if len(n.pendingReads) == 0 || n.termAt(n.commitIndex) != n.currentTerm {
+		return
+	}
+
+	rounds := make([]uint64, 0, len(n.config.Members))
+	for id := range n.config.Members {
+		if id == n.id {
+			rounds = append(rounds, n.readRound)
+		} else if peer, ok := n.peers[id]; ok {
+			rounds = append(rounds, peer.ackedRound)
+		}
+	}
+	quorum := n.config.quorum()
+	if len(rounds) < quorum {
+		return
+	}
+	sort.Slice(rounds, func(i, j int) bool { return rounds[i] > rounds[j] })
+	confirmed := rounds[quorum-1]
+
+	pending := n.pendingReads[:0]
+	for _, req := range n.pendingReads {
+		if req.round <= confirmed {
+			req.done <- readResult{index: n.commitIndex}
+		} else {
+			pending = append(pending, req)
+		}
+	}
+	n.pendingReads = pending
+}
+
+// failReads aborts every read waiting for confirmation
+func (n *RaftNode) failReads(err error) {
+	for _, req := range n.pendingReads {
+		req.done <- readResult{err: err}
+	}
+	n.pendingReads = nil
+}
+
+// leaseValid reports whether a majority acknowledged a heartbeat recent
+// enough that no other leader can have been elected since
+func (n *RaftNode) leaseValid() bool {
+	// Voters only honour leases with CheckQuorum, and a transfer asks the
+	// target to campaign regardless of the lease
+	if !n.checkQuorum || n.transfer != nil {
+		return false
+	}
+
+	now := n.clock.Now()
+	acked := make([]time.Time, 0, len(n.config.Members))
+	for id := range n.config.Members {
+		if id == n.id {
+			acked = append(acked, now)
+		} else if peer, ok := n.peers[id]; ok {
+			acked = append(acked, peer.ackedAt)
+		}
+	}
+	quorum := n.config.quorum()
+	if len(acked) < quorum {
+		return false
+	}
+	sort.Slice(acked, func(i, j int) bool { return acked[i].After(acked[j]) })
+	return now.Before(acked[quorum-1].Add(LeaseDuration))
+}
+
+// LeaderCommit returns the leader's commit index as far as this node knows
+// it, for bounding the staleness of reads served by a follower. It reports
+// false when the node has not heard from a leader within an election
+// timeout and cannot tell how far behind it is.
+func (n *RaftNode) LeaderCommit() (uint64, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.state == Leader {
+		return n.commitIndex, true
+	}
+	if n.leaderID == "" || n.clock.Now().Sub(n.lastLeaderContact) > MaxElectionTimeout {
+		return 0, false
+	}
+	return max(n.leaderCommit, n.commitIndex), true
+}
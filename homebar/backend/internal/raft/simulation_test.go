@@ -0,0 +1,1758 @@
+package raft
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+var (
+	simSchedules = flag.Int("sim.schedules", 2000, "number of random schedules run by TestSimulation")
+	simSeed      = flag.Int64("sim.seed", 0, "run only the schedule with this seed")
+)
+
+// The simulation drives a cluster of RaftNodes from a single goroutine.
+// Timers, messages and faults are events on a virtual timeline ordered by
+// time and a stable key, and after every event the simulation waits until
+// all node goroutines are idle again. Together with seeded random sources
+// this makes each schedule reproducible from its seed.
+
+// simEvent is a message delivery, RPC timeout, fault or timer expiry
+type simEvent struct {
+	at   time.Time
+	key  string
+	fire func()
+}
+
+// simTimer implements Timer on the virtual clock. A timer is an event that
+// stays registered and is rescheduled on Reset.
+type simTimer struct {
+	sim    *sim
+	node   *simNode
+	key    string
+	f      func()
+	at     time.Time
+	active bool
+}
+
+func (t *simTimer) Reset(d time.Duration) bool {
+	t.sim.mu.Lock()
+	defer t.sim.mu.Unlock()
+	wasActive := t.active
+	t.at = t.sim.now.Add(d)
+	t.active = !t.node.dead
+	return wasActive
+}
+
+func (t *simTimer) Stop() bool {
+	t.sim.mu.Lock()
+	defer t.sim.mu.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+// simClock is the Clock handed to one node incarnation
+type simClock struct {
+	sim  *sim
+	node *simNode
+}
+
+func (c simClock) Now() time.Time {
+	c.sim.mu.Lock()
+	defer c.sim.mu.Unlock()
+	return c.sim.now
+}
+
+func (c simClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.sim.mu.Lock()
+	defer c.sim.mu.Unlock()
+	t := &simTimer{
+		sim:    c.sim,
+		node:   c.node,
+		key:    fmt.Sprintf("t/%s/%d/%d", c.node.id, c.node.incarnation, len(c.node.timers)),
+		f:      f,
+		at:     c.sim.now.Add(d),
+		active: !c.node.dead,
+	}
+	c.node.timers = append(c.node.timers, t)
+	c.sim.timers = append(c.sim.timers, t)
+	return t
+}
+
+// simTransport connects one node incarnation to the simulated network
+type simTransport struct {
+	sim  *sim
+	node *simNode
+}
+
+func (t *simTransport) Dial(peerID string, addr string) (RPCClient, error) {
+	return &simClient{sim: t.sim, from: t.node, to: peerID}, nil
+}
+
+// Serve is a no-op, the simulation delivers requests to the node directly
+func (t *simTransport) Serve(handler RPCHandler) error { return nil }
+
+func (t *simTransport) Close() error { return nil }
+
+// simCall is an RPC whose caller is blocked waiting for a reply
+type simCall struct {
+	done     chan simResult
+	finished bool
+}
+
+type simResult struct {
+	reply []byte
+	err   error
+}
+
+type simClient struct {
+	sim  *sim
+	from *simNode
+	to   string
+}
+
+func (c *simClient) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
+	return c.sim.call(c.from, c.to, "RequestVote", args, reply, RPCTimeout)
+}
+
+func (c *simClient) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
+	return c.sim.call(c.from, c.to, "AppendEntries", args, reply, RPCTimeout)
+}
+
+func (c *simClient) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	return c.sim.call(c.from, c.to, "InstallSnapshot", args, reply, SnapshotRPCTimeout)
+}
+
+func (c *simClient) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	return c.sim.call(c.from, c.to, "TimeoutNow", args, reply, RPCTimeout)
+}
+
+// simLink is the one-way connection between two nodes. Each link draws
+// delays and drops from its own source so that concurrent senders on
+// different links cannot change each other's outcome.
+type simLink struct {
+	rng *rand.Rand
+	seq uint64
+}
+
+// simStateMachine is a node's applied state. Like the database in
+// production it survives crashes of the node that owns it.
+type simStateMachine struct {
+	sim *sim
+	id  string
+
+	mu    sync.Mutex
+	index uint64 // Last applied index
+	hash  uint64 // Running hash of every applied entry
+	done  uint64 // Last index fully handled by the apply goroutine
+}
+
+type simSnapshot struct {
+	Index uint64 `json:"index"`
+	Hash  uint64 `json:"hash"`
+}
+
+func (m *simStateMachine) apply(entry LogEntry) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Entries queued before a snapshot restore are already covered by it
+	if entry.Index <= m.index {
+		return false
+	}
+	if entry.Index != m.index+1 {
+		m.sim.violation("node %s applied index %d after %d", m.id, entry.Index, m.index)
+	}
+
+	h := fnv.New64a()
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], m.hash)
+	h.Write(buf[:])
+	h.Write([]byte(entryKey(entry)))
+	m.index = entry.Index
+	m.hash = h.Sum64()
+	m.sim.recordApplied(m.id, m.index, m.hash)
+	return true
+}
+
+func (m *simStateMachine) AppliedIndex() (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.index, nil
+}
+
+func (m *simStateMachine) Snapshot() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return json.Marshal(simSnapshot{Index: m.index, Hash: m.hash})
+}
+
+func (m *simStateMachine) RestoreSnapshot(index uint64, data []byte) error {
+	var snap simSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	if snap.Index != index {
+		m.sim.violation("node %s restored snapshot for index %d with state at %d", m.id, index, snap.Index)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.index = snap.Index
+	m.hash = snap.Hash
+	m.done = max(m.done, snap.Index)
+	m.sim.recordApplied(m.id, m.index, m.hash)
+	return nil
+}
+
+func (m *simStateMachine) handled(index uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.done = max(m.done, index)
+}
+
+func (m *simStateMachine) caughtUp(index uint64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.done >= index
+}
+
+// simNode is one incarnation of a node; a restart creates a new one
+type simNode struct {
+	id          string
+	incarnation int
+	raft        *RaftNode
+	sm          *simStateMachine
+	storage     Storage
+	cancel      context.CancelFunc
+	stop        chan struct{}
+	hold        chan struct{} // Closed to stop applying entries
+	stalled     bool          // Entries are handed over but no longer applied
+
+	// Guarded by sim.mu
+	dead   bool
+	timers []*simTimer
+	calls  []*simCall
+}
+
+// simRead is a ReadIndex or lease read started on a node that believed it
+// was the leader. Its index must cover everything committed before it started.
+type simRead struct {
+	node  *simNode
+	lease bool
+	floor uint64
+	req   *readRequest
+}
+
+// committedEntry is the first value seen committed at an index
+type committedEntry struct {
+	key        string
+	term       uint64
+	commitTerm uint64 // Term of the node that first reported it committed
+}
+
+type sim struct {
+	t     *testing.T
+	seed  int64
+	rng   *rand.Rand // Fault schedule, used by the simulation goroutine only
+	ids   []string
+	addrs map[string]string
+	dir   string
+
+	dropRate    float64
+	minDelay    time.Duration
+	maxDelay    time.Duration
+	preVote     bool
+	checkQuorum bool
+
+	nodes        map[string]*simNode // Current incarnation, nil while crashed
+	incarnations map[string]int
+	checked      map[string]uint64 // Commit index up to which a node's log was checked
+	machines     map[string]*simStateMachine
+	group        map[string]int // Nodes in different groups cannot talk
+	commands     int
+	trace        []string
+
+	// Checked properties
+	leaders   map[uint64]string // Election safety: term -> leader
+	committed map[uint64]committedEntry
+	reads     []simRead // Linearizability: reads waiting for their read index
+
+	mu       sync.Mutex
+	now      time.Time
+	queue    []*simEvent
+	timers   []*simTimer
+	links    map[[2]string]*simLink
+	active   int
+	applied  map[uint64]uint64 // State machine safety: index -> hash
+	failures []string
+}
+
+// newSim creates a simulation of a 3 or 5 node cluster on a network whose
+// loss and latency, and the election options, are drawn from the seed
+func newSim(t *testing.T, seed int64) *sim {
+	rng := rand.New(rand.NewSource(seed))
+	s := &sim{
+		t:            t,
+		seed:         seed,
+		rng:          rng,
+		dropRate:     []float64{0, 0.01, 0.05, 0.2}[rng.Intn(4)],
+		minDelay:     time.Millisecond,
+		maxDelay:     time.Duration(1+rng.Intn(30)) * time.Millisecond,
+		preVote:      rng.Intn(2) == 0,
+		checkQuorum:  rng.Intn(2) == 0,
+		addrs:        make(map[string]string),
+		dir:          t.TempDir(),
+		nodes:        make(map[string]*simNode),
+		incarnations: make(map[string]int),
+		checked:      make(map[string]uint64),
+		machines:     make(map[string]*simStateMachine),
+		group:        make(map[string]int),
+		leaders:      make(map[uint64]string),
+		committed:    make(map[uint64]committedEntry),
+		now:          time.Unix(0, 0),
+		links:        make(map[[2]string]*simLink),
+		applied:      make(map[uint64]uint64),
+	}
+	size := 3 + 2*rng.Intn(2)
+	for i := 1; i <= size; i++ {
+		id := fmt.Sprint(i)
+		s.ids = append(s.ids, id)
+		s.addrs[id] = "sim://" + id
+		s.machines[id] = &simStateMachine{sim: s, id: id}
+	}
+	return s
+}
+
+// start creates a new incarnation of a node from its persisted state. Seeds
+// take turns between FileStorage, a WALStorage with tiny segments and
+// BoltStorage.
+func (s *sim) start(id string) {
+	var (
+		storage Storage
+		err     error
+	)
+	switch s.seed % 3 {
+	case 0:
+		storage, err = NewFileStorage(id, s.dir)
+	case 1:
+		storage, err = openWAL(filepath.Join(s.dir, "node-"+id, "wal"), 512)
+	default:
+		storage, err = NewBoltStorage(id, s.dir)
+	}
+	if err != nil {
+		s.t.Fatalf("seed %d: %v", s.seed, err)
+	}
+
+	incarnation := s.incarnations[id]
+	s.incarnations[id]++
+
+	node := &simNode{id: id, incarnation: incarnation, sm: s.machines[id], storage: storage,
+		stop: make(chan struct{}), hold: make(chan struct{})}
+	logger := zerolog.Nop()
+	applyCh := make(chan LogEntry, 4096)
+	node.raft = NewRaftNodeWithConfig(Config{
+		ID:                id,
+		Peers:             s.ids,
+		PeerAddrs:         s.addrs,
+		ApplyCh:           applyCh,
+		Storage:           storage,
+		Transport:         &simTransport{sim: s, node: node},
+		Clock:             simClock{sim: s, node: node},
+		Rand:              rand.New(rand.NewSource(s.seed*1000 + int64(incarnation)*10 + int64(id[0]))),
+		Go:                s.spawn,
+		SnapshotThreshold: 8,
+		PreVote:           s.preVote,
+		CheckQuorum:       s.checkQuorum,
+		Logger:            &logger,
+	})
+	node.raft.SetStateMachine(node.sm)
+
+	// Apply committed entries the way RaftService does, until the node is
+	// stalled
+	go func() {
+		entries, hold := applyCh, node.hold
+		for {
+			select {
+			case entry := <-entries:
+				if node.sm.apply(entry) {
+					node.raft.NotifyApplied(entry.Index)
+				}
+				node.sm.handled(entry.Index)
+			case <-hold:
+				entries, hold = nil, nil
+			case <-node.stop:
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	node.cancel = cancel
+	s.nodes[id] = node
+	if err := node.raft.Start(ctx); err != nil {
+		s.t.Fatalf("seed %d: failed to start node %s: %v", s.seed, id, err)
+	}
+	s.settle()
+}
+
+// crash stops a node abruptly. Calls it is waiting on fail at once, and
+// anything it has not persisted is lost with the RaftNode.
+func (s *sim) crash(id string) {
+	node := s.nodes[id]
+	if node == nil {
+		return
+	}
+
+	s.mu.Lock()
+	node.dead = true
+	for _, t := range node.timers {
+		t.active = false
+	}
+	for _, call := range node.calls {
+		s.finish(call, simResult{err: ErrPeerUnreachable})
+	}
+	s.mu.Unlock()
+
+	node.cancel()
+	s.settle()
+	close(node.stop)
+	node.storage.Close()
+	s.nodes[id] = nil
+}
+
+// stall stops a running node's state machine from taking entries off the
+// apply channel. The node goes on committing and handing entries over, and a
+// later crash loses them before they are applied.
+func (s *sim) stall(id string) {
+	node := s.nodes[id]
+	if node == nil || node.stalled {
+		return
+	}
+	s.settle()
+	node.stalled = true
+	close(node.hold)
+}
+
+// spawn is the node's Go hook; it counts goroutines that are runnable
+func (s *sim) spawn(f func()) {
+	s.mu.Lock()
+	s.active++
+	s.mu.Unlock()
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			s.active--
+			s.mu.Unlock()
+		}()
+		f()
+	}()
+}
+
+// call sends an RPC over the simulated network and blocks its goroutine
+// until the reply arrives or the call times out in virtual time
+func (s *sim) call(from *simNode, to string, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if from.dead {
+		s.mu.Unlock()
+		return ErrPeerUnreachable
+	}
+
+	call := &simCall{done: make(chan simResult, 1)}
+	pending := from.calls[:0]
+	for _, c := range from.calls {
+		if !c.finished {
+			pending = append(pending, c)
+		}
+	}
+	from.calls = append(pending, call)
+
+	link := s.link(from.id, to)
+	link.seq++
+	key := fmt.Sprintf("%s/%s/%d", from.id, to, link.seq)
+	if delay, ok := s.transmit(link, from.id, to); ok {
+		s.schedule(delay, "m/"+key, func() { s.deliver(from, to, method, data, call) })
+	}
+	s.schedule(timeout, "x/"+key, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.finish(call, simResult{err: fmt.Errorf("%s to %s: %w", method, to, context.DeadlineExceeded)})
+	})
+
+	// The caller is blocked until the simulation finishes the call
+	s.active--
+	s.mu.Unlock()
+
+	result := <-call.done
+	if result.err != nil {
+		return result.err
+	}
+	return json.Unmarshal(result.reply, reply)
+}
+
+// deliver hands a request to the receiving node and sends back its reply
+func (s *sim) deliver(from *simNode, to string, method string, data []byte, call *simCall) {
+	if s.group[from.id] != s.group[to] {
+		return
+	}
+
+	// A crashed node refuses connections instead of letting them time out
+	node := s.nodes[to]
+	if node == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.finish(call, simResult{err: fmt.Errorf("%w: node %s is down", ErrPeerUnreachable, to)})
+		return
+	}
+
+	reply, err := handleMemoryRequest(node.raft, method, data)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link := s.link(to, from.id)
+	link.seq++
+	if delay, ok := s.transmit(link, to, from.id); ok {
+		key := fmt.Sprintf("r/%s/%s/%d", to, from.id, link.seq)
+		s.schedule(delay, key, func() {
+			if s.group[from.id] != s.group[to] {
+				return
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.finish(call, simResult{reply: reply})
+		})
+	}
+}
+
+// transmit decides whether a message on link is dropped and how long it takes
+func (s *sim) transmit(link *simLink, from, to string) (time.Duration, bool) {
+	delay := s.minDelay + time.Duration(link.rng.Int63n(int64(s.maxDelay-s.minDelay)+1))
+	// Now and then a message is held up long enough to be reordered
+	if link.rng.Intn(50) == 0 {
+		delay += time.Duration(link.rng.Int63n(int64(4 * MaxElectionTimeout)))
+	}
+	dropped := link.rng.Float64() < s.dropRate
+	return delay, !dropped && s.group[from] == s.group[to]
+}
+
+// finish wakes the goroutine blocked in call; s.mu must be held
+func (s *sim) finish(call *simCall, result simResult) {
+	if call.finished {
+		return
+	}
+	call.finished = true
+	s.active++
+	call.done <- result
+}
+
+// link returns the link from one node to another; s.mu must be held
+func (s *sim) link(from, to string) *simLink {
+	k := [2]string{from, to}
+	link, ok := s.links[k]
+	if !ok {
+		h := fnv.New64a()
+		h.Write([]byte(from + "->" + to))
+		link = &simLink{rng: rand.New(rand.NewSource(s.seed ^ int64(h.Sum64())))}
+		s.links[k] = link
+	}
+	return link
+}
+
+// schedule adds a one-off event; s.mu must be held
+func (s *sim) schedule(after time.Duration, key string, fire func()) {
+	s.queue = append(s.queue, &simEvent{at: s.now.Add(after), key: key, fire: fire})
+}
+
+// step runs the earliest event due before deadline. It reports false once
+// there is none left.
+func (s *sim) step(deadline time.Time) bool {
+	s.mu.Lock()
+	var next *simEvent
+	nextQueued := -1
+	for i, e := range s.queue {
+		if next == nil || e.at.Before(next.at) || (e.at.Equal(next.at) && e.key < next.key) {
+			next, nextQueued = e, i
+		}
+	}
+	var timer *simTimer
+	for _, t := range s.timers {
+		if !t.active {
+			continue
+		}
+		if next == nil || t.at.Before(next.at) || (t.at.Equal(next.at) && t.key < next.key) {
+			next = &simEvent{at: t.at, key: t.key, fire: t.f}
+			timer = t
+		}
+	}
+	if next == nil || next.at.After(deadline) {
+		s.now = deadline
+		s.mu.Unlock()
+		return false
+	}
+
+	if timer != nil {
+		timer.active = false
+	} else {
+		s.queue = append(s.queue[:nextQueued], s.queue[nextQueued+1:]...)
+	}
+	s.now = next.at
+	s.mu.Unlock()
+
+	next.fire()
+	s.settle()
+	s.check()
+	return true
+}
+
+// runFor advances virtual time by d
+func (s *sim) runFor(d time.Duration) {
+	s.mu.Lock()
+	deadline := s.now.Add(d)
+	s.mu.Unlock()
+	for s.step(deadline) {
+	}
+	s.prune()
+}
+
+// prune drops timers of crashed incarnations
+func (s *sim) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	live := s.timers[:0]
+	for _, t := range s.timers {
+		if !t.node.dead {
+			live = append(live, t)
+		}
+	}
+	s.timers = live
+}
+
+// settle waits until every node goroutine is blocked on the simulation and
+// every committed entry has been handed to the state machine, and applied
+// unless the node is stalled
+func (s *sim) settle() {
+	giveUp := time.Now().Add(10 * time.Second)
+	for !s.idle() {
+		if time.Now().After(giveUp) {
+			s.t.Fatalf("seed %d: cluster did not settle, a node is stuck\n%s", s.seed, strings.Join(s.trace, "\n"))
+		}
+		runtime.Gosched()
+	}
+}
+
+func (s *sim) idle() bool {
+	s.mu.Lock()
+	active := s.active
+	s.mu.Unlock()
+	if active > 0 {
+		return false
+	}
+
+	for _, id := range s.ids {
+		node := s.nodes[id]
+		if node == nil {
+			continue
+		}
+		n := node.raft
+		n.mu.Lock()
+		caughtUp := !n.restoring && n.handedOverIndex == n.commitIndex
+		handedOver := n.handedOverIndex
+		n.mu.Unlock()
+		if !caughtUp || (!node.stalled && !node.sm.caughtUp(handedOver)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *sim) violation(format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, fmt.Sprintf(format, args...))
+}
+
+// recordApplied checks that every node reaches the same state at index
+func (s *sim) recordApplied(id string, index, hash uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.applied[index]; !ok {
+		s.applied[index] = hash
+	} else if prev != hash {
+		s.failures = append(s.failures, fmt.Sprintf("state machine safety: node %s diverged at index %d", id, index))
+	}
+}
+
+// check verifies the safety properties against the current state of every
+// running node
+func (s *sim) check() {
+	type view struct {
+		id      string
+		state   NodeState
+		term    uint64
+		base    uint64
+		commit  uint64
+		entries []LogEntry
+	}
+
+	var views []view
+	for _, id := range s.ids {
+		node := s.nodes[id]
+		if node == nil {
+			continue
+		}
+		n := node.raft
+		n.mu.Lock()
+		views = append(views, view{
+			id:      id,
+			state:   n.state,
+			term:    n.currentTerm,
+			base:    n.log[0].Index,
+			commit:  n.commitIndex,
+			entries: append([]LogEntry(nil), n.log...),
+		})
+		n.mu.Unlock()
+	}
+
+	// Election safety: at most one leader per term
+	for _, v := range views {
+		if v.state != Leader {
+			continue
+		}
+		if prev, ok := s.leaders[v.term]; ok && prev != v.id {
+			s.violation("election safety: %s and %s both led term %d", prev, v.id, v.term)
+		}
+		s.leaders[v.term] = v.id
+	}
+
+	// Committed entries never change
+	for _, v := range views {
+		for _, e := range v.entries[1:] {
+			if e.Index > v.commit {
+				break
+			}
+			if e.Index <= s.checked[v.id] {
+				continue
+			}
+			s.checked[v.id] = e.Index
+			key := entryKey(e)
+			if prev, ok := s.committed[e.Index]; !ok {
+				s.committed[e.Index] = committedEntry{key: key, term: e.Term, commitTerm: v.term}
+			} else if prev.key != key {
+				s.violation("node %s committed %q at index %d, previously %q", v.id, key, e.Index, prev.key)
+			}
+		}
+	}
+
+	// Log matching: logs that agree on an entry agree on everything before it
+	for i := range views {
+		for j := i + 1; j < len(views); j++ {
+			a, b := views[i], views[j]
+			from := max(a.base, b.base) + 1
+			to := min(a.base+uint64(len(a.entries)-1), b.base+uint64(len(b.entries)-1))
+			matched := false
+			for idx := to; idx >= from && idx > 0; idx-- {
+				ea, eb := a.entries[idx-a.base], b.entries[idx-b.base]
+				if !matched && ea.Term == eb.Term {
+					matched = true
+				}
+				if matched && entryKey(ea) != entryKey(eb) {
+					s.violation("log matching: %s and %s differ at index %d below a matching entry", a.id, b.id, idx)
+					break
+				}
+			}
+		}
+	}
+
+	// Leader completeness: a leader holds every entry committed in an
+	// earlier or its own term
+	for _, v := range views {
+		if v.state != Leader {
+			continue
+		}
+		last := v.base + uint64(len(v.entries)-1)
+		for idx, c := range s.committed {
+			if c.commitTerm > v.term || idx <= v.base {
+				continue
+			}
+			if idx > last || entryKey(v.entries[idx-v.base]) != c.key {
+				s.violation("leader completeness: leader %s of term %d is missing committed index %d", v.id, v.term, idx)
+			}
+		}
+	}
+
+	// Linearizability: a read never misses an entry committed before it started
+	reads := s.reads[:0]
+	for _, r := range s.reads {
+		select {
+		case res := <-r.req.done:
+			if res.err == nil && res.index < r.floor {
+				s.violation("linearizability: read on %s (lease %v) returned index %d, but index %d was committed before it started",
+					r.node.id, r.lease, res.index, r.floor)
+			}
+		default:
+			s.mu.Lock()
+			dead := r.node.dead
+			s.mu.Unlock()
+			if !dead {
+				reads = append(reads, r)
+			}
+		}
+	}
+	s.reads = reads
+
+	s.mu.Lock()
+	failures := s.failures
+	s.mu.Unlock()
+	if len(failures) > 0 {
+		s.t.Fatalf("seed %d: %s\nschedule:\n%s", s.seed, strings.Join(failures, "\n"), strings.Join(s.trace, "\n"))
+	}
+}
+
+// submit proposes a command on every node that believes it is the leader,
+// including stale leaders cut off from the majority
+func (s *sim) submit() {
+	for _, id := range s.ids {
+		node := s.nodes[id]
+		if node == nil {
+			continue
+		}
+		s.commands++
+		if _, err := node.raft.Submit(fmt.Sprintf("cmd-%d", s.commands)); err == nil {
+			s.settle()
+		}
+	}
+}
+
+// read starts a read on every node that believes it is the leader
+func (s *sim) read() {
+	var floor uint64
+	for index := range s.committed {
+		floor = max(floor, index)
+	}
+	for _, id := range s.ids {
+		node := s.nodes[id]
+		if node == nil {
+			continue
+		}
+		lease := s.rng.Intn(2) == 0
+		node.raft.mu.Lock()
+		req, err := node.raft.startRead(lease)
+		node.raft.mu.Unlock()
+		if err == nil {
+			s.reads = append(s.reads, simRead{node: node, lease: lease, floor: floor, req: req})
+		}
+	}
+}
+
+// transferLeadership asks the leader, if any, to hand over to a random node
+func (s *sim) transferLeadership() {
+	leader := s.leader()
+	if leader == nil {
+		return
+	}
+	target := s.ids[s.rng.Intn(len(s.ids))]
+	s.logf("transfer %s -> %s", leader.id, target)
+	leader.mu.Lock()
+	_, _ = leader.startLeadershipTransfer(target)
+	leader.mu.Unlock()
+	s.settle()
+}
+
+// partition splits the cluster into two random groups
+func (s *sim) partition() {
+	for _, id := range s.ids {
+		s.group[id] = s.rng.Intn(2)
+	}
+}
+
+func (s *sim) heal() {
+	for _, id := range s.ids {
+		s.group[id] = 0
+	}
+}
+
+func (s *sim) logf(format string, args ...interface{}) {
+	s.mu.Lock()
+	now := s.now
+	s.mu.Unlock()
+	s.trace = append(s.trace, fmt.Sprintf(format, args...)+fmt.Sprintf(" @%s", now.Sub(time.Unix(0, 0))))
+}
+
+// leader returns the node all live nodes agree is leading the highest term
+func (s *sim) leader() *RaftNode {
+	var leader *RaftNode
+	var term uint64
+	for _, id := range s.ids {
+		node := s.nodes[id]
+		if node == nil {
+			continue
+		}
+		n := node.raft
+		n.mu.Lock()
+		if n.state == Leader && n.currentTerm >= term {
+			leader, term = n, n.currentTerm
+		}
+		n.mu.Unlock()
+	}
+	return leader
+}
+
+// describe summarizes every node for failure messages
+func (s *sim) describe() string {
+	var lines []string
+	for _, id := range s.ids {
+		node := s.nodes[id]
+		if node == nil {
+			lines = append(lines, fmt.Sprintf("node %s: crashed, applied %d", id, s.machines[id].index))
+			continue
+		}
+		n := node.raft
+		n.mu.Lock()
+		lines = append(lines, fmt.Sprintf("node %s: %s term %d log (%d, %d] commit %d applied %d, state machine at %d",
+			id, n.state, n.currentTerm, n.log[0].Index, n.lastLogIndex(), n.commitIndex, n.handedOverIndex, s.machines[id].index))
+		n.mu.Unlock()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// entryKey identifies an entry's content for comparisons across nodes.
+// Commands arrive as their JSON form on followers, so compare that, with
+// configurations decoded first as their map form orders fields differently.
+func entryKey(e LogEntry) string {
+	command := e.Command
+	if e.Type == EntryConfiguration {
+		if config, err := decodeConfiguration(command); err == nil {
+			command = config
+		}
+	}
+	cmd, ok := command.(string)
+	if !ok && command != nil {
+		data, _ := json.Marshal(command)
+		cmd = string(data)
+	}
+	return strconv.FormatUint(e.Index, 10) + "/" + strconv.FormatUint(e.Term, 10) + "/" +
+		strconv.Itoa(int(e.Type)) + "/" + cmd
+}
+
+// runSchedule plays one random schedule of faults and client commands and
+// then checks that the healed cluster makes progress again
+func runSchedule(t *testing.T, seed int64) {
+	s := newSim(t, seed)
+
+	for _, id := range s.ids {
+		s.start(id)
+	}
+
+	for round := 0; round < 12; round++ {
+		switch r := s.rng.Intn(10); {
+		case r < 2:
+			s.partition()
+			s.logf("partition %v", s.group)
+		case r < 4:
+			s.heal()
+			s.logf("heal")
+		case r < 6:
+			// A node stalled first is crashed with entries handed over
+			// but not applied
+			id := s.ids[s.rng.Intn(len(s.ids))]
+			switch node := s.nodes[id]; {
+			case node == nil:
+				s.logf("restart %s ", id)
+				s.start(id)
+			case !node.stalled && s.rng.Intn(3) == 0:
+				s.logf("stall %s", id)
+				s.stall(id)
+			default:
+				s.logf("crash %s", id)
+				s.crash(id)
+			}
+		case r < 9:
+			s.logf("submit")
+			s.submit()
+		default:
+			s.transferLeadership()
+		}
+
+		s.runFor(time.Duration(50+s.rng.Intn(400)) * time.Millisecond)
+		if s.rng.Intn(2) == 0 {
+			s.submit()
+		}
+		if s.rng.Intn(2) == 0 {
+			s.logf("read")
+			s.read()
+			s.settle()
+		}
+	}
+
+	// Liveness: once every node is back and connected, a leader is
+	// elected and a new command reaches every state machine
+	s.heal()
+	s.dropRate = 0
+	for _, id := range s.ids {
+		if node := s.nodes[id]; node != nil && node.stalled {
+			s.logf("crash %s", id)
+			s.crash(id)
+		}
+		if s.nodes[id] == nil {
+			s.logf("restart %s ", id)
+			s.start(id)
+		}
+	}
+	s.logf("final heal")
+
+	var index uint64
+	for attempt := 0; attempt < 20 && index == 0; attempt++ {
+		s.runFor(500 * time.Millisecond)
+		leader := s.leader()
+		if leader == nil {
+			continue
+		}
+		s.commands++
+		f, err := leader.Propose(fmt.Sprintf("cmd-%d", s.commands))
+		if err != nil {
+			continue
+		}
+		s.settle()
+
+		// A leader elected just before the heal may still be deposed and
+		// its entry overwritten; propose again until one is applied
+		s.runFor(500 * time.Millisecond)
+		select {
+		case <-f.Done():
+			if f.err == nil {
+				index = f.Index()
+			}
+		default:
+		}
+	}
+	if index == 0 {
+		t.Fatalf("seed %d: no command was applied after healing\n%s\n%s", seed, s.describe(), strings.Join(s.trace, "\n"))
+	}
+
+	// Allow for a snapshot transfer lost before the heal to time out
+	s.runFor(SnapshotRPCTimeout + 2*time.Second)
+	for _, id := range s.ids {
+		if !s.machines[id].caughtUp(index) {
+			t.Fatalf("seed %d: index %d not applied everywhere after healing\n%s\n%s",
+				seed, index, s.describe(), strings.Join(s.trace, "\n"))
+		}
+	}
+
+	for _, id := range s.ids {
+		s.crash(id)
+	}
+}
+
+// TestSimulation runs many random schedules of partitions, message loss,
+// delays, crashes and restarts against in-process clusters and checks the
+// Raft safety properties after every event. A failing seed can be replayed
+// with -sim.seed.
+func TestSimulation(t *testing.T) {
+	if *simSeed != 0 {
+		runSchedule(t, *simSeed)
+		return
+	}
+
+	schedules := *simSchedules
+	if testing.Short() && schedules > 100 {
+		schedules = 100
+	}
+	for seed := int64(1); seed <= int64(schedules); seed++ {
+		seed := seed
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			t.Parallel()
+			runSchedule(t, seed)
+		})
+	}
+}
+
+// TestPreVoteRejoin checks that a node rejoining after a partition does not
+// disrupt the leader when Pre-Vote is enabled
+func TestPreVoteRejoin(t *testing.T) {
+	for _, preVote := range []bool{false, true} {
+		s := newSim(t, 1)
+		s.dropRate, s.maxDelay = 0, 5*time.Millisecond
+		s.preVote, s.checkQuorum = preVote, false
+		for _, id := range s.ids {
+			s.start(id)
+		}
+		s.runFor(time.Second)
+
+		leader := s.leader()
+		if leader == nil {
+			t.Fatalf("preVote=%v: no leader elected", preVote)
+		}
+		term := leader.currentTerm
+
+		// Cut off one follower for many election timeouts
+		isolated := s.ids[0]
+		if isolated == leader.id {
+			isolated = s.ids[1]
+		}
+		s.group[isolated] = 1
+		s.runFor(2 * time.Second)
+		s.heal()
+		s.runFor(time.Second)
+
+		disrupted := !leader.IsLeader() || leader.currentTerm != term
+		if preVote && disrupted {
+			t.Fatalf("node %s rejoining forced an election despite Pre-Vote", isolated)
+		}
+		if !preVote && !disrupted {
+			t.Fatalf("expected node %s rejoining to force an election without Pre-Vote", isolated)
+		}
+
+		for _, id := range s.ids {
+			s.crash(id)
+		}
+	}
+}
+
+// TestCheckQuorumStepDown checks that a leader cut off from the majority
+// stops acting as leader when CheckQuorum is enabled
+func TestCheckQuorumStepDown(t *testing.T) {
+	for _, checkQuorum := range []bool{false, true} {
+		s := newSim(t, 1)
+		s.dropRate, s.maxDelay = 0, 5*time.Millisecond
+		s.preVote, s.checkQuorum = true, checkQuorum
+		for _, id := range s.ids {
+			s.start(id)
+		}
+		s.runFor(time.Second)
+
+		leader := s.leader()
+		if leader == nil {
+			t.Fatalf("checkQuorum=%v: no leader elected", checkQuorum)
+		}
+		s.group[leader.id] = 1
+		s.runFor(time.Second)
+
+		if checkQuorum && leader.IsLeader() {
+			t.Fatalf("isolated leader %s did not step down", leader.id)
+		}
+		if !checkQuorum && !leader.IsLeader() {
+			t.Fatalf("isolated leader %s stepped down without CheckQuorum", leader.id)
+		}
+
+		for _, id := range s.ids {
+			s.crash(id)
+		}
+	}
+}
+
+// TestLeadershipTransfer checks that a leader brings a lagging target up to
+// date and hands over to it in the next term, with Pre-Vote and CheckQuorum on
+func TestLeadershipTransfer(t *testing.T) {
+	s := newSim(t, 1)
+	s.dropRate, s.maxDelay = 0, 5*time.Millisecond
+	s.preVote, s.checkQuorum = true, true
+	for _, id := range s.ids {
+		s.start(id)
+	}
+	s.runFor(time.Second)
+
+	leader := s.leader()
+	if leader == nil {
+		t.Fatal("no leader elected")
+	}
+	term := leader.currentTerm
+
+	target := s.ids[0]
+	if target == leader.id {
+		target = s.ids[1]
+	}
+
+	// Let the target fall behind
+	s.group[target] = 1
+	for i := 0; i < 5; i++ {
+		s.submit()
+	}
+	s.runFor(500 * time.Millisecond)
+	s.heal()
+
+	leader.mu.Lock()
+	done, err := leader.startLeadershipTransfer(target)
+	leader.mu.Unlock()
+	if err != nil {
+		t.Fatalf("failed to start transfer: %v", err)
+	}
+	s.settle()
+	if _, err := leader.Submit("rejected"); !errors.Is(err, ErrLeadershipTransfer) {
+		t.Fatalf("Submit during transfer returned %v, want ErrLeadershipTransfer", err)
+	}
+
+	s.runFor(time.Second)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("transfer failed: %v", err)
+		}
+	default:
+		t.Fatal("transfer did not complete")
+	}
+
+	if newLeader := s.leader(); newLeader == nil || newLeader.id != target {
+		t.Fatalf("expected node %s to lead\n%s", target, s.describe())
+	}
+	if got := s.nodes[target].raft.currentTerm; got != term+1 {
+		t.Fatalf("target leads term %d, want %d", got, term+1)
+	}
+	if _, err := s.nodes[target].raft.Submit("accepted"); err != nil {
+		t.Fatalf("new leader rejected a command: %v", err)
+	}
+
+	for _, id := range s.ids {
+		s.crash(id)
+	}
+}
+
+// TestLearner checks that a learner catches up without voting or
+// campaigning, and that it is only promoted to a voter once it is current
+func TestLearner(t *testing.T) {
+	s := newSim(t, 1)
+	s.dropRate, s.maxDelay = 0, 5*time.Millisecond
+	s.preVote, s.checkQuorum = true, true
+	for _, id := range s.ids {
+		s.start(id)
+	}
+	s.runFor(time.Second)
+	for i := 0; i < 5; i++ {
+		s.submit()
+	}
+	s.runFor(500 * time.Millisecond)
+
+	leader := s.leader()
+	if leader == nil {
+		t.Fatal("no leader elected")
+	}
+
+	// The new node knows only the existing members and waits to be added
+	learner := "9"
+	s.addrs[learner] = "sim://" + learner
+	s.machines[learner] = &simStateMachine{sim: s, id: learner}
+	s.start(learner)
+	if _, err := leader.AddLearner(learner, s.addrs[learner]); err != nil {
+		t.Fatalf("failed to add learner: %v", err)
+	}
+	s.settle()
+	s.runFor(time.Second)
+
+	node := s.nodes[learner].raft
+	if role := node.Role(); role != RoleLearner {
+		t.Fatalf("node %s has role %q, want %q", learner, role, RoleLearner)
+	}
+	if node.commitIndex != leader.commitIndex {
+		t.Fatalf("learner committed %d, leader %d", node.commitIndex, leader.commitIndex)
+	}
+	if quorum := leader.Configuration().quorum(); quorum != len(s.ids)/2+1 {
+		t.Fatalf("learner changed the quorum to %d", quorum)
+	}
+
+	// Cut off, a learner neither campaigns nor can be promoted
+	term := node.currentTerm
+	s.group[learner] = 1
+	for i := 0; i < 3; i++ {
+		s.submit()
+	}
+	s.runFor(2 * time.Second)
+	if node.currentTerm != term || node.state != Follower {
+		t.Fatalf("isolated learner moved to term %d as %s", node.currentTerm, node.state)
+	}
+	if _, err := leader.PromoteLearner(learner); !errors.Is(err, ErrLearnerBehind) {
+		t.Fatalf("promoting an unreachable learner returned %v, want ErrLearnerBehind", err)
+	}
+
+	// The snapshot sent while it was cut off has to time out before the
+	// learner receives a new one
+	s.group[learner] = 0
+	s.runFor(SnapshotRPCTimeout + time.Second)
+	if _, err := leader.PromoteLearner(learner); err != nil {
+		t.Fatalf("failed to promote learner: %v", err)
+	}
+	s.settle()
+	s.runFor(time.Second)
+
+	if role := node.Role(); role != RoleVoter {
+		t.Fatalf("promoted node has role %q, want %q", role, RoleVoter)
+	}
+	if !leader.Configuration().Has(learner) {
+		t.Fatalf("leader configuration does not list node %s as a voter", learner)
+	}
+
+	for _, id := range append(s.ids, learner) {
+		s.crash(id)
+	}
+}
+
+// TestMembership adds and removes voters, including the leader, and checks
+// that a configuration entry a new leader truncates does not come back
+// when the node that proposed it restarts
+func TestMembership(t *testing.T) {
+	s := newSim(t, 2)
+	s.dropRate, s.maxDelay = 0, 5*time.Millisecond
+	s.preVote, s.checkQuorum = true, true
+	for _, id := range s.ids {
+		s.start(id)
+	}
+	s.runFor(time.Second)
+
+	// A leader cut off from the others proposes a change that never commits
+	leader := s.leader()
+	if leader == nil {
+		t.Fatal("no leader elected")
+	}
+	isolated := leader.id
+	s.group[isolated] = 1
+	if _, err := leader.AddMember("8", "sim://8"); err != nil {
+		t.Fatalf("failed to propose member: %v", err)
+	}
+	s.crash(isolated)
+	s.runFor(2 * time.Second)
+	for i := 0; i < 3; i++ {
+		s.submit()
+	}
+
+	// Back up, it must drop the change along with the entry
+	s.group[isolated] = 0
+	s.start(isolated)
+	s.runFor(time.Second)
+	if config := s.nodes[isolated].raft.Configuration(); config.Contains("8") {
+		t.Fatalf("node %s kept the truncated configuration %v", isolated, config.Members)
+	}
+
+	// Add a voter that knows only the existing members
+	leader = s.leader()
+	if leader == nil {
+		t.Fatal("no leader after the isolated node rejoined")
+	}
+	added := "9"
+	s.addrs[added] = "sim://" + added
+	s.machines[added] = &simStateMachine{sim: s, id: added}
+	s.start(added)
+	if _, err := leader.AddMember(added, s.addrs[added]); err != nil {
+		t.Fatalf("failed to add member: %v", err)
+	}
+	s.settle()
+	s.runFor(time.Second)
+
+	node := s.nodes[added].raft
+	if role := node.Role(); role != RoleVoter {
+		t.Fatalf("added node has role %q, want %q", role, RoleVoter)
+	}
+	if quorum := leader.Configuration().quorum(); quorum != (len(s.ids)+1)/2+1 {
+		t.Fatalf("quorum is %d with %d voters", quorum, len(s.ids)+1)
+	}
+	if node.commitIndex != leader.commitIndex {
+		t.Fatalf("added node committed %d, leader %d", node.commitIndex, leader.commitIndex)
+	}
+	voters := s.ids
+	s.ids = append(s.ids, added)
+
+	// Remove a follower
+	var removed string
+	for _, id := range voters {
+		if id != leader.id {
+			removed = id
+			break
+		}
+	}
+	if _, err := leader.RemoveMember(removed); err != nil {
+		t.Fatalf("failed to remove member: %v", err)
+	}
+	s.settle()
+	s.runFor(time.Second)
+	if config := leader.Configuration(); config.Contains(removed) {
+		t.Fatalf("leader configuration still lists node %s", removed)
+	}
+	leader.mu.Lock()
+	_, hasPeer := leader.peers[removed]
+	leader.mu.Unlock()
+	if hasPeer {
+		t.Fatalf("leader still replicates to removed node %s", removed)
+	}
+	s.crash(removed)
+
+	// Remove the leader itself; it steps down once its removal commits
+	old := leader
+	if _, err := old.RemoveMember(old.id); err != nil {
+		t.Fatalf("failed to remove the leader: %v", err)
+	}
+	s.settle()
+	s.runFor(3 * time.Second)
+
+	old.mu.Lock()
+	state := old.state
+	old.mu.Unlock()
+	if state == Leader {
+		t.Fatalf("removed leader %s is still leading", old.id)
+	}
+	leader = s.leader()
+	if leader == nil || leader == old {
+		t.Fatalf("no new leader after the leader was removed\n%s", s.describe())
+	}
+	if config := leader.Configuration(); config.Contains(old.id) || !config.Has(added) {
+		t.Fatalf("configuration after removing the leader is %v", config.Members)
+	}
+	commit := leader.commitIndex
+	s.submit()
+	s.runFor(time.Second)
+	if leader.commitIndex <= commit {
+		t.Fatalf("remaining members committed nothing after the leader left")
+	}
+
+	s.check()
+	for _, id := range s.ids {
+		s.crash(id)
+	}
+}
+
+// TestCrashUnapplied crashes a node while committed entries it handed over
+// still wait in its apply channel. On restart the node must resume after the
+// last entry the state machine applied, not the last one handed over, and
+// reach the same state as the others. Seeds cover every storage engine.
+func TestCrashUnapplied(t *testing.T) {
+	for seed := int64(3); seed <= 5; seed++ {
+		s := newSim(t, seed)
+		s.dropRate, s.maxDelay = 0, 5*time.Millisecond
+		for _, id := range s.ids {
+			s.start(id)
+		}
+		s.runFor(time.Second)
+
+		leader := s.leader()
+		if leader == nil {
+			t.Fatalf("seed %d: no leader elected", seed)
+		}
+		var id string
+		for _, other := range s.ids {
+			if other != leader.id {
+				id = other
+				break
+			}
+		}
+
+		s.stall(id)
+		for i := 0; i < 5; i++ {
+			s.submit()
+			s.runFor(100 * time.Millisecond)
+		}
+
+		// Electing a new leader makes the stalled node persist its state
+		// after the handover
+		s.crash(leader.id)
+		s.runFor(time.Second)
+		if s.leader() == nil {
+			t.Fatalf("seed %d: no leader elected after crashing %s", seed, leader.id)
+		}
+
+		node := s.nodes[id]
+		node.raft.mu.Lock()
+		handedOver := node.raft.handedOverIndex
+		node.raft.mu.Unlock()
+		applied, _ := node.sm.AppliedIndex()
+		if handedOver <= applied {
+			t.Fatalf("seed %d: node %s handed over %d and applied %d, want entries pending", seed, id, handedOver, applied)
+		}
+		if _, _, saved, err := node.storage.LoadState(); err != nil || saved > applied {
+			t.Fatalf("seed %d: node %s persisted applied index %d, %v while its state machine is at %d",
+				seed, id, saved, err, applied)
+		}
+		s.crash(id)
+
+		s.start(id)
+		s.start(leader.id)
+		s.runFor(time.Second)
+		leader = s.leader()
+		if leader == nil {
+			t.Fatalf("seed %d: no leader after restart", seed)
+		}
+		leader.mu.Lock()
+		commit := leader.commitIndex
+		leader.mu.Unlock()
+		if got, _ := s.machines[id].AppliedIndex(); got != commit {
+			t.Fatalf("seed %d: node %s applied %d after restart, want %d\n%s", seed, id, got, commit, s.describe())
+		}
+		s.check()
+
+		for _, id := range s.ids {
+			s.crash(id)
+		}
+	}
+}
+
+// TestReadIndex checks that a leader cut off from the majority can neither
+// confirm a ReadIndex nor keep its lease, and that a healthy leader answers
+// lease reads without a heartbeat round
+func TestReadIndex(t *testing.T) {
+	s := newSim(t, 1)
+	s.dropRate, s.maxDelay = 0, 5*time.Millisecond
+	s.preVote, s.checkQuorum = true, true
+	for _, id := range s.ids {
+		s.start(id)
+	}
+	s.runFor(time.Second)
+
+	leader := s.leader()
+	if leader == nil {
+		t.Fatal("no leader elected")
+	}
+
+	startRead := func(lease bool) *readRequest {
+		leader.mu.Lock()
+		req, err := leader.startRead(lease)
+		leader.mu.Unlock()
+		if err != nil {
+			t.Fatalf("failed to start read: %v", err)
+		}
+		s.settle()
+		return req
+	}
+	result := func(req *readRequest) (readResult, bool) {
+		select {
+		case res := <-req.done:
+			return res, true
+		default:
+			return readResult{}, false
+		}
+	}
+
+	// A lease read on a healthy leader needs no round trip
+	if res, ok := result(startRead(true)); !ok || res.err != nil || res.index != leader.commitIndex {
+		t.Fatalf("lease read = %+v, %v; want index %d at once", res, ok, leader.commitIndex)
+	}
+
+	// A ReadIndex is confirmed by the next heartbeat round
+	req := startRead(false)
+	s.runFor(50 * time.Millisecond)
+	if res, ok := result(req); !ok || res.err != nil {
+		t.Fatalf("ReadIndex = %+v, %v; want it confirmed", res, ok)
+	}
+
+	// Once isolated, the lease runs out and ReadIndex cannot be confirmed
+	s.group[leader.id] = 1
+	s.runFor(LeaseDuration)
+	lease, readIndex := startRead(true), startRead(false)
+	s.runFor(100 * time.Millisecond)
+	for _, req := range []*readRequest{lease, readIndex} {
+		if res, ok := result(req); ok && res.err == nil {
+			t.Fatalf("isolated leader %s served a read at index %d", leader.id, res.index)
+		}
+	}
+
+	// CheckQuorum makes the leader step down, failing the reads
+	s.runFor(time.Second)
+	if leader.IsLeader() {
+		t.Fatalf("isolated leader %s did not step down", leader.id)
+	}
+	for _, req := range []*readRequest{lease, readIndex} {
+		if res, ok := result(req); !ok || !errors.Is(res.err, ErrNotLeader) {
+			t.Fatalf("read on deposed leader = %+v, %v; want ErrNotLeader", res, ok)
+		}
+	}
+
+	for _, id := range s.ids {
+		s.crash(id)
+	}
+}
+
+// TestProposeFuture checks that a proposal resolves once the entry is
+// applied, and fails as soon as its leader steps down without committing it
+func TestProposeFuture(t *testing.T) {
+	s := newSim(t, 1)
+	s.dropRate, s.maxDelay = 0, 5*time.Millisecond
+	s.preVote, s.checkQuorum = true, true
+	for _, id := range s.ids {
+		s.start(id)
+	}
+	s.runFor(time.Second)
+
+	leader := s.leader()
+	if leader == nil {
+		t.Fatal("no leader elected")
+	}
+	propose := func(command string) *Future {
+		f, err := leader.Propose(command)
+		if err != nil {
+			t.Fatalf("Propose(%q): %v", command, err)
+		}
+		s.settle()
+		return f
+	}
+	resolved := func(f *Future) (error, bool) {
+		select {
+		case <-f.Done():
+			_, err := f.Wait(context.Background())
+			return err, true
+		default:
+			return nil, false
+		}
+	}
+
+	committed := propose("committed")
+	s.runFor(100 * time.Millisecond)
+	if err, ok := resolved(committed); !ok || err != nil {
+		t.Fatalf("future of entry %d = %v, %v; want it applied", committed.Index(), err, ok)
+	}
+
+	// Cut off from the majority the entry cannot commit; CheckQuorum makes
+	// the leader step down and the future fails
+	s.group[leader.id] = 1
+	lost := propose("lost")
+	s.runFor(100 * time.Millisecond)
+	if err, ok := resolved(lost); ok {
+		t.Fatalf("future of uncommitted entry %d resolved with %v", lost.Index(), err)
+	}
+	s.runFor(time.Second)
+	if err, ok := resolved(lost); !ok || !errors.Is(err, ErrLeadershipLost) {
+		t.Fatalf("future on deposed leader = %v, %v; want ErrLeadershipLost", err, ok)
+	}
+	if _, err := leader.Propose("rejected"); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("Propose on a follower returned %v, want ErrNotLeader", err)
+	}
+
+	for _, id := range s.ids {
+		s.crash(id)
+	}
+}
+
+// TestObserver checks that observers are told of commits, applied entries,
+// unreachable peers and the changes of state, term and leader of an election
+func TestObserver(t *testing.T) {
+	s := newSim(t, 1)
+	s.dropRate, s.maxDelay = 0, 5*time.Millisecond
+	s.preVote, s.checkQuorum = true, true
+	for _, id := range s.ids {
+		s.start(id)
+	}
+	s.runFor(time.Second)
+
+	leader := s.leader()
+	if leader == nil {
+		t.Fatal("no leader elected")
+	}
+	observers := make(map[string]*Observer)
+	for _, id := range s.ids {
+		observers[id] = s.nodes[id].raft.RegisterObserver(1024)
+	}
+	// received returns the events of one type delivered to a node's
+	// observer, keeping the others for later calls
+	pending := make(map[string][]Event)
+	received := func(id string, want EventType) []Event {
+		for drained := false; !drained; {
+			select {
+			case e := <-observers[id].Events():
+				if e.NodeID != id {
+					t.Fatalf("observer of %s received an event of %s", id, e.NodeID)
+				}
+				pending[id] = append(pending[id], e)
+			default:
+				drained = true
+			}
+		}
+		var events, rest []Event
+		for _, e := range pending[id] {
+			if e.Type == want {
+				events = append(events, e)
+			} else {
+				rest = append(rest, e)
+			}
+		}
+		pending[id] = rest
+		return events
+	}
+	var follower string
+	for _, id := range s.ids {
+		if id != leader.id {
+			follower = id
+			break
+		}
+	}
+
+	f, err := leader.Propose("observed")
+	if err != nil {
+		t.Fatalf("Propose: %v", err)
+	}
+	s.runFor(100 * time.Millisecond)
+	if events := received(leader.id, EventCommit); len(events) == 0 || events[len(events)-1].Index < f.Index() {
+		t.Fatalf("leader commit events %+v, want one up to %d", events, f.Index())
+	}
+	if events := received(follower, EventApplied); len(events) == 0 || events[len(events)-1].Index < f.Index() {
+		t.Fatalf("follower applied events %+v, want one up to %d", events, f.Index())
+	}
+
+	// Messages held up in the network make other peers flap now and then
+	hasPeer := func(events []Event, peer string) bool {
+		for _, e := range events {
+			if e.PeerID == peer {
+				return true
+			}
+		}
+		return false
+	}
+	s.group[follower] = 1
+	s.runFor(500 * time.Millisecond)
+	if events := received(leader.id, EventPeerUnreachable); !hasPeer(events, follower) {
+		t.Fatalf("leader unreachable events %+v, want one for %s", events, follower)
+	}
+	s.heal()
+	s.runFor(500 * time.Millisecond)
+	if events := received(leader.id, EventPeerReachable); !hasPeer(events, follower) {
+		t.Fatalf("leader reachable events %+v, want one for %s", events, follower)
+	}
+
+	// Cut off from the others the leader steps down and they elect a new one
+	s.group[leader.id] = 1
+	s.runFor(2 * time.Second)
+	if events := received(leader.id, EventStateChange); len(events) == 0 || events[0].State != Follower {
+		t.Fatalf("deposed leader state events %+v, want follower", events)
+	}
+	newLeader := s.leader()
+	if newLeader == nil || newLeader == leader {
+		t.Fatal("no new leader elected")
+	}
+	terms := received(follower, EventTermChange)
+	leaders := received(follower, EventLeaderChange)
+	if len(terms) == 0 || len(leaders) == 0 {
+		t.Fatalf("follower term events %+v and leader events %+v, want both", terms, leaders)
+	}
+	if last := leaders[len(leaders)-1]; last.LeaderID != newLeader.id || last.Term != newLeader.Status().Term {
+		t.Fatalf("last leader event %+v, want %s in term %d", last, newLeader.id, newLeader.Status().Term)
+	}
+
+	for _, id := range s.ids {
+		// Ranging over the events ends once the channel is closed
+		s.nodes[id].raft.DeregisterObserver(observers[id])
+		for range observers[id].Events() {
+		}
+		if n := observers[id].Dropped(); n != 0 {
+			t.Fatalf("observer of %s dropped %d events", id, n)
+		}
+	}
+	for _, id := range s.ids {
+		s.crash(id)
+	}
+}
@@ -0,0 +1,249 @@
+package raft
+
+import "math"
+
+// StateMachine is implemented by the service that applies committed commands.
+// It lets the node compact its log into a snapshot and hand that snapshot to
+// followers that have fallen too far behind.
+type StateMachine interface {
+	// AppliedIndex returns the index of the last entry the state machine
+	// has applied. It must be stored with the effects of that entry, so
+	// that after a crash the node resumes applying right after it.
+	AppliedIndex() (uint64, error)
+
+	// Snapshot serializes the state produced by every entry applied so far
+	Snapshot() ([]byte, error)
+
+	// RestoreSnapshot replaces the state with a snapshot covering all entries
+	// up to and including index
+	RestoreSnapshot(index uint64, data []byte) error
+}
+
+// SetStateMachine registers the state machine used for snapshots
+func (n *RaftNode) SetStateMachine(sm StateMachine) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.stateMachine = sm
+}
+
+// NotifyApplied is called by the state machine once it has applied the entry
+// at index. When enough entries have accumulated since the last snapshot the
+// state machine is snapshotted and the log prefix discarded.
+//
+// It must be called from the goroutine that applies entries so that the
+// snapshot reflects exactly the entries up to index.
+func (n *RaftNode) NotifyApplied(index uint64) {
+	n.NotifyAppliedResult(index, nil, nil)
+}
+
+// maybeSnapshot compacts the log once enough entries up to index are applied
+func (n *RaftNode) maybeSnapshot(index uint64) {
+	n.mu.Lock()
+	sm := n.stateMachine
+	base := n.log[0].Index
+	due := sm != nil && n.snapshotThreshold > 0 && index > base && index-base >= n.snapshotThreshold
+	n.mu.Unlock()
+
+	if !due {
+		return
+	}
+
+	data, err := sm.Snapshot()
+	if err != nil {
+		n.logger.Error().Err(err).Uint64("index", index).Msg("Failed to snapshot state machine")
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.compactLog(index, data)
+}
+
+// compactLog replaces the log up to and including index with a snapshot
+func (n *RaftNode) compactLog(index uint64, data []byte) {
+	// A snapshot installed from the leader may already cover this index
+	if index <= n.log[0].Index || index > n.lastLogIndex() {
+		return
+	}
+
+	// Entries proposed after index must reach storage before the log is cut
+	n.flushLog()
+
+	config, _ := n.configAt(index)
+	snapshot := Snapshot{
+		LastIncludedIndex: index,
+		LastIncludedTerm:  n.termAt(index),
+		Data:              data,
+		Configuration:     &config,
+	}
+
+	if n.storage != nil {
+		if err := n.storage.SaveSnapshot(snapshot); err != nil {
+			n.logger.Error().Err(err).Msg("Failed to persist snapshot")
+			return
+		}
+		if err := n.storage.TruncatePrefix(index); err != nil {
+			n.logger.Error().Err(err).Msg("Failed to truncate log prefix")
+		}
+		// The saved applied index must not fall behind the snapshot, or
+		// the snapshot is restored again on restart
+		n.persistState()
+	}
+
+	// Copy the retained suffix so the compacted entries can be freed
+	retained := n.log[index-n.log[0].Index+1:]
+	log := make([]LogEntry, 0, len(retained)+1)
+	log = append(log, LogEntry{Index: snapshot.LastIncludedIndex, Term: snapshot.LastIncludedTerm})
+	n.log = append(log, retained...)
+	n.snapshot = &snapshot
+	n.setBaseConfiguration(config)
+
+	n.logger.Info().Msgf("📦 Node %s compacted log up to index %d (term %d)", n.id, index, snapshot.LastIncludedTerm)
+}
+
+// sendInstallSnapshot sends the latest snapshot to a peer whose next entry
+// has already been compacted away
+func (n *RaftNode) sendInstallSnapshot(peer *RaftPeer) {
+	n.mu.Lock()
+	if n.state != Leader || n.snapshot == nil || peer.installingSnapshot {
+		n.mu.Unlock()
+		return
+	}
+
+	args := InstallSnapshotArgs{
+		Term:              n.currentTerm,
+		LeaderID:          n.id,
+		LastIncludedIndex: n.snapshot.LastIncludedIndex,
+		LastIncludedTerm:  n.snapshot.LastIncludedTerm,
+		Data:              n.snapshot.Data,
+		Configuration:     n.snapshot.Configuration,
+	}
+	peer.installingSnapshot = true
+	n.mu.Unlock()
+
+	n.logger.Info().Msgf("📤 Node %s sending snapshot at index %d to %s", n.id, args.LastIncludedIndex, peer.id)
+
+	var reply InstallSnapshotReply
+	err := peer.client.InstallSnapshot(args, &reply)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	peer.installingSnapshot = false
+
+	if err != nil {
+		n.logger.Info().Msgf("⚠️  Node %s snapshot to %s failed: %v", n.id, peer.id, err)
+		return
+	}
+
+	// If we're no longer the leader or term has changed, ignore response
+	if n.state != Leader || n.currentTerm != args.Term {
+		return
+	}
+
+	// If peer has higher term, become follower
+	if reply.Term > n.currentTerm {
+		n.becomeFollower(reply.Term)
+		return
+	}
+	n.recordContact(peer.id)
+
+	n.matchIndex[peer.id] = max(n.matchIndex[peer.id], args.LastIncludedIndex)
+	n.nextIndex[peer.id] = n.matchIndex[peer.id] + 1
+	n.updateCommitIndex()
+}
+
+// InstallSnapshot handles an InstallSnapshot RPC from the leader
+func (n *RaftNode) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	n.mu.Lock()
+
+	reply.Term = n.currentTerm
+
+	// If term is smaller than current term, reject
+	if args.Term < n.currentTerm {
+		n.mu.Unlock()
+		return nil
+	}
+
+	n.becomeFollower(args.Term)
+	n.setLeader(args.LeaderID)
+	n.lastLeaderContact = n.clock.Now()
+	n.leaderCommit = max(n.leaderCommit, args.LastIncludedIndex)
+	reply.Term = n.currentTerm
+
+	// Everything up to our commit index is already applied or queued
+	if args.LastIncludedIndex <= n.commitIndex || n.restoring {
+		n.mu.Unlock()
+		return nil
+	}
+
+	snapshot := Snapshot{
+		LastIncludedIndex: args.LastIncludedIndex,
+		LastIncludedTerm:  args.LastIncludedTerm,
+		Data:              args.Data,
+		Configuration:     args.Configuration,
+	}
+
+	// Keep the entries after the snapshot if our log agrees with it,
+	// otherwise the whole log is superseded
+	oldLastIndex := n.lastLogIndex()
+	truncateTo := args.LastIncludedIndex
+	var retained []LogEntry
+	if args.LastIncludedIndex < oldLastIndex && n.termAt(args.LastIncludedIndex) == args.LastIncludedTerm {
+		retained = n.log[args.LastIncludedIndex-n.log[0].Index+1:]
+	} else {
+		truncateTo = max(truncateTo, oldLastIndex)
+		n.failProposals(args.LastIncludedIndex+1, math.MaxUint64, ErrEntryOverwritten)
+	}
+
+	// Entries covered by the snapshot skip the state machine's apply path
+	n.failProposals(0, args.LastIncludedIndex, ErrAppliedBySnapshot)
+
+	if n.storage != nil {
+		if err := n.storage.SaveSnapshot(snapshot); err != nil {
+			n.mu.Unlock()
+			return err
+		}
+		if err := n.storage.TruncatePrefix(truncateTo); err != nil {
+			n.logger.Error().Err(err).Msg("Failed to truncate log prefix")
+		}
+	}
+
+	log := make([]LogEntry, 0, len(retained)+1)
+	log = append(log, LogEntry{Index: snapshot.LastIncludedIndex, Term: snapshot.LastIncludedTerm})
+	n.log = append(log, retained...)
+	n.snapshot = &snapshot
+	if snapshot.Configuration != nil {
+		n.setBaseConfiguration(*snapshot.Configuration)
+	}
+	n.reloadConfiguration()
+	n.commitTo(snapshot.LastIncludedIndex)
+	n.handedOverIndex = snapshot.LastIncludedIndex
+
+	n.logger.Info().Msgf("📥 Node %s installing snapshot at index %d from %s", n.id, args.LastIncludedIndex, args.LeaderID)
+
+	sm := n.stateMachine
+	n.restoring = true
+	n.mu.Unlock()
+
+	// Restore outside the lock so heartbeats keep flowing while the
+	// state machine is rebuilt
+	var err error
+	if sm != nil {
+		err = sm.RestoreSnapshot(snapshot.LastIncludedIndex, snapshot.Data)
+	}
+
+	n.mu.Lock()
+	n.restoring = false
+	if err == nil {
+		n.setApplied(snapshot.LastIncludedIndex)
+		n.persistState()
+	}
+	// Entries after the snapshot may have been committed meanwhile
+	n.signalApply()
+	n.mu.Unlock()
+
+	if err != nil {
+		n.logger.Error().Err(err).Msg("Failed to restore snapshot")
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package raft
+
+import (
+	"time"
+)
+
+// Status is a point-in-time view of a node, as reported by the coordinator
+type Status struct {
+	ID           string                  `json:"id"`
+	State        NodeState               `json:"state"`
+	Role         string                  `json:"role"` // RoleVoter, RoleLearner or "" outside the configuration
+	LeaderID     string                  `json:"leader"`
+	Term         uint64                  `json:"term"`
+	CommitIndex  uint64                  `json:"commit_index"`
+	AppliedIndex uint64                  `json:"applied_index"`
+	LastLogIndex uint64                  `json:"last_log_index"`
+	Peers        map[string]PeerProgress `json:"peers,omitempty"` // Replication progress of every peer, on the leader only
+}
+
+// PeerProgress is the leader's view of replication to one peer
+type PeerProgress struct {
+	NextIndex   uint64    `json:"next_index"`
+	MatchIndex  uint64    `json:"match_index"`
+	LastContact time.Time `json:"last_contact"` // Last reply in the current term, zero if none
+}
+
+// Status returns the node's current state and, on the leader, the
+// replication progress of its peers
+func (n *RaftNode) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	status := Status{
+		ID:           n.id,
+		State:        n.state,
+		Role:         n.config.Role(n.id),
+		LeaderID:     n.leaderID,
+		Term:         n.currentTerm,
+		CommitIndex:  n.commitIndex,
+		AppliedIndex: n.appliedIndex,
+		LastLogIndex: n.lastLogIndex(),
+	}
+	if n.state == Leader {
+		status.Peers = make(map[string]PeerProgress, len(n.peers))
+		for id := range n.peers {
+			status.Peers[id] = PeerProgress{
+				NextIndex:   n.nextIndex[id],
+				MatchIndex:  n.matchIndex[id],
+				LastContact: n.lastContact[id],
+			}
+		}
+	}
+	return status
+}
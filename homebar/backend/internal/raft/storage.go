@@ -17,22 +17,65 @@ type Storage interface {
 	// LoadState loads the saved term, votedFor, and lastApplied
 	LoadState() (term uint64, votedFor string, lastApplied uint64, err error)
 
-	// AppendLog appends entries to the log file
+	// AppendLog appends entries to the log. Stored entries at or after the
+	// index of the first one are replaced, as when a follower overwrites a
+	// conflicting suffix.
 	AppendLog(entries []LogEntry) error
 
 	// LoadLog loads all log entries
 	LoadLog() ([]LogEntry, error)
 
+	// SaveSnapshot persists the latest snapshot, replacing any older one
+	SaveSnapshot(snapshot Snapshot) error
+
+	// LoadSnapshot loads the latest snapshot, or nil if none has been taken
+	LoadSnapshot() (*Snapshot, error)
+
+	// TruncatePrefix discards all log entries up to and including index
+	TruncatePrefix(index uint64) error
+
+	// TruncateSuffix discards all log entries from index onwards
+	TruncateSuffix(index uint64) error
+
+	// SaveConfiguration persists the membership at the start of the log
+	SaveConfiguration(config Configuration) error
+
+	// LoadConfiguration loads the membership at the start of the log, or nil if none was saved
+	LoadConfiguration() (*Configuration, error)
+
 	// Close releases any resources
 	Close() error
 }
 
+// Storage engines selectable with RAFT_STORAGE
+const (
+	StorageFile = "file" // JSON files rewritten on every change, without fsync
+	StorageWAL  = "wal"  // Segmented write-ahead log, see WALStorage
+	StorageBolt = "bolt" // Embedded key-value database, see BoltStorage
+)
+
+// NewStorage opens the storage engine of the given kind for a node
+func NewStorage(kind string, nodeID string, dir string) (Storage, error) {
+	switch kind {
+	case "", StorageFile:
+		return NewFileStorage(nodeID, dir)
+	case StorageWAL:
+		return NewWALStorage(nodeID, dir)
+	case StorageBolt:
+		return NewBoltStorage(nodeID, dir)
+	default:
+		return nil, fmt.Errorf("unknown storage engine %q", kind)
+	}
+}
+
 // FileStorage implements the Storage interface using files
 type FileStorage struct {
-	mu        sync.Mutex
-	stateFile string
-	logFile   string
-	dir       string
+	mu           sync.Mutex
+	stateFile    string
+	logFile      string
+	snapshotFile string
+	configFile   string
+	dir          string
 }
 
 // NewFileStorage creates a new file-based storage
@@ -47,11 +90,117 @@ func NewFileStorage(nodeID string, dir string) (Storage, error) {
 		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
+	return fileStorageIn(fullDir), nil
+}
+
+// fileStorageIn returns the FileStorage kept in a node's data directory
+func fileStorageIn(nodeDir string) *FileStorage {
 	return &FileStorage{
-		stateFile: filepath.Join(fullDir, "state.json"),
-		logFile:   filepath.Join(fullDir, "log.json"),
-		dir:       fullDir,
-	}, nil
+		stateFile:    filepath.Join(nodeDir, "state.json"),
+		logFile:      filepath.Join(nodeDir, "log.json"),
+		snapshotFile: filepath.Join(nodeDir, "snapshot.json"),
+		configFile:   filepath.Join(nodeDir, "config.json"),
+		dir:          nodeDir,
+	}
+}
+
+// OpenNodeStorage opens the storage in one node's data directory, such as
+// raft-data/node-1, for tools working on a stopped node. An empty kind
+// selects the engine whose files are found there. It returns the engine used.
+// Like a starting node it repairs what a crash left behind, such as a torn
+// tail of the write-ahead log.
+func OpenNodeStorage(kind string, nodeDir string) (Storage, string, error) {
+	return openNodeStorage(kind, nodeDir, false)
+}
+
+// OpenNodeStorageReadOnly opens the storage in one node's data directory
+// like OpenNodeStorage, for tools that only look at it. Opening changes no
+// file: damage a writable open would repair or refuse, such as a torn tail or
+// a bad record of the write-ahead log, is returned as a list of problems and
+// the log ends before it. The write-ahead log and bolt database also refuse
+// writes.
+func OpenNodeStorageReadOnly(kind string, nodeDir string) (Storage, string, []string, error) {
+	storage, kind, err := openNodeStorage(kind, nodeDir, true)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	var damage []string
+	if w, ok := storage.(*WALStorage); ok {
+		damage = w.Damage()
+	}
+	return storage, kind, damage, nil
+}
+
+func openNodeStorage(kind string, nodeDir string, readOnly bool) (Storage, string, error) {
+	if info, err := os.Stat(nodeDir); err != nil {
+		return nil, "", fmt.Errorf("failed to open data directory: %w", err)
+	} else if !info.IsDir() {
+		return nil, "", fmt.Errorf("%s is not a directory", nodeDir)
+	}
+
+	if kind == "" {
+		detected, err := DetectStorage(nodeDir)
+		if err != nil {
+			return nil, "", err
+		}
+		kind = detected
+	}
+
+	var (
+		storage Storage
+		err     error
+	)
+	switch kind {
+	case StorageFile:
+		// Loading the JSON files changes nothing
+		storage = fileStorageIn(nodeDir)
+	case StorageWAL:
+		if readOnly {
+			storage, err = openWALReadOnly(filepath.Join(nodeDir, "wal"))
+		} else {
+			storage, err = openWAL(filepath.Join(nodeDir, "wal"), WALSegmentSize)
+		}
+	case StorageBolt:
+		if readOnly {
+			storage, err = openBoltReadOnly(filepath.Join(nodeDir, "raft.db"))
+		} else {
+			storage, err = openBolt(filepath.Join(nodeDir, "raft.db"))
+		}
+	default:
+		err = fmt.Errorf("unknown storage engine %q", kind)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return storage, kind, nil
+}
+
+// DetectStorage returns the engine whose files are in a node's data directory
+func DetectStorage(nodeDir string) (string, error) {
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(nodeDir, name))
+		return err == nil
+	}
+
+	var found []string
+	if exists("state.json") || exists("log.json") || exists("snapshot.json") {
+		found = append(found, StorageFile)
+	}
+	if exists("wal") {
+		found = append(found, StorageWAL)
+	}
+	if exists("raft.db") {
+		found = append(found, StorageBolt)
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no Raft storage found in %s", nodeDir)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("%s holds data of several storage engines (%v), choose one", nodeDir, found)
+	}
 }
 
 // State represents the persistent Raft state
@@ -109,7 +258,8 @@ func (fs *FileStorage) LoadState() (uint64, string, uint64, error) {
 	return state.CurrentTerm, state.VotedFor, state.LastApplied, nil
 }
 
-// AppendLog appends entries to the log file
+// AppendLog appends entries to the log file, replacing stored entries at or
+// after the index of the first one
 func (fs *FileStorage) AppendLog(entries []LogEntry) error {
 	if len(entries) == 0 {
 		return nil
@@ -127,10 +277,16 @@ func (fs *FileStorage) AppendLog(entries []LogEntry) error {
 		return fmt.Errorf("failed to load existing log: %w", err)
 	}
 
-	// Append new entries
+	// Drop the conflicting suffix, then append new entries
+	log = truncateFrom(log, entries[0].Index)
 	log = append(log, entries...)
 
 	// Write back the full log
+	return fs.writeLogInternal(log)
+}
+
+// writeLogInternal replaces the log file with the given entries without locking
+func (fs *FileStorage) writeLogInternal(log []LogEntry) error {
 	data, err := json.Marshal(log)
 	if err != nil {
 		return fmt.Errorf("failed to marshal log: %w", err)
@@ -177,6 +333,130 @@ func (fs *FileStorage) loadLogInternal() ([]LogEntry, error) {
 	return log, nil
 }
 
+// SaveSnapshot persists the latest snapshot, replacing any older one
+func (fs *FileStorage) SaveSnapshot(snapshot Snapshot) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	tmpFile := fs.snapshotFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write snapshot file: %w", err)
+	}
+
+	return os.Rename(tmpFile, fs.snapshotFile)
+}
+
+// LoadSnapshot loads the latest snapshot, or nil if none has been taken
+func (fs *FileStorage) LoadSnapshot() (*Snapshot, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, err := os.Stat(fs.snapshotFile); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(fs.snapshotFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot file: %w", err)
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal snapshot: %w", err)
+	}
+
+	return &snapshot, nil
+}
+
+// TruncatePrefix discards all log entries up to and including index
+func (fs *FileStorage) TruncatePrefix(index uint64) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	log, err := fs.loadLogInternal()
+	if err != nil {
+		return fmt.Errorf("failed to load existing log: %w", err)
+	}
+
+	kept := make([]LogEntry, 0, len(log))
+	for _, entry := range log {
+		if entry.Index > index {
+			kept = append(kept, entry)
+		}
+	}
+
+	return fs.writeLogInternal(kept)
+}
+
+// TruncateSuffix discards all log entries from index onwards
+func (fs *FileStorage) TruncateSuffix(index uint64) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	log, err := fs.loadLogInternal()
+	if err != nil {
+		return fmt.Errorf("failed to load existing log: %w", err)
+	}
+
+	return fs.writeLogInternal(truncateFrom(log, index))
+}
+
+// truncateFrom returns the entries of log before index, keeping the dummy entry
+func truncateFrom(log []LogEntry, index uint64) []LogEntry {
+	kept := log[:0]
+	for _, entry := range log {
+		if entry.Index < index || entry.Index == 0 {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// SaveConfiguration persists the membership at the start of the log
+func (fs *FileStorage) SaveConfiguration(config Configuration) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to marshal configuration: %w", err)
+	}
+
+	tmpFile := fs.configFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write configuration file: %w", err)
+	}
+
+	return os.Rename(tmpFile, fs.configFile)
+}
+
+// LoadConfiguration loads the membership at the start of the log, or nil if none was saved
+func (fs *FileStorage) LoadConfiguration() (*Configuration, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, err := os.Stat(fs.configFile); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(fs.configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration file: %w", err)
+	}
+
+	var config Configuration
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal configuration: %w", err)
+	}
+
+	return &config, nil
+}
+
 // Close releases any resources
 func (fs *FileStorage) Close() error {
 	// Nothing to close for file storage
@@ -0,0 +1,430 @@
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// storageEngines opens every Storage implementation in a directory. Each
+// one must pass the conformance tests below.
+var storageEngines = []struct {
+	name string
+	open func(dir string) (Storage, error)
+}{
+	{StorageFile, func(dir string) (Storage, error) { return NewFileStorage("1", dir) }},
+	{StorageWAL, func(dir string) (Storage, error) { return openWAL(filepath.Join(dir, "wal"), 256) }},
+	{StorageBolt, func(dir string) (Storage, error) { return NewBoltStorage("1", dir) }},
+}
+
+// storageCase is one conformance test, given a way to reopen the storage
+// it is handed from the same directory
+type storageCase func(t *testing.T, s Storage, reopen func() Storage)
+
+var storageCases = []struct {
+	name string
+	test storageCase
+}{
+	{"Empty", testStorageEmpty},
+	{"State", testStorageState},
+	{"AppendLog", testStorageAppendLog},
+	{"OverwriteConflict", testStorageOverwriteConflict},
+	{"TruncateSuffix", testStorageTruncateSuffix},
+	{"TruncatePrefix", testStorageTruncatePrefix},
+	{"RewriteBelowCompaction", testStorageRewriteBelowCompaction},
+	{"Snapshot", testStorageSnapshot},
+	{"Configuration", testStorageConfiguration},
+	{"Reopen", testStorageReopen},
+}
+
+// TestStorageConformance runs the shared Storage tests against every engine
+func TestStorageConformance(t *testing.T) {
+	for _, engine := range storageEngines {
+		for _, c := range storageCases {
+			engine, c := engine, c
+			t.Run(engine.name+"/"+c.name, func(t *testing.T) {
+				dir := t.TempDir()
+				open := func() Storage {
+					s, err := engine.open(dir)
+					if err != nil {
+						t.Fatalf("failed to open storage: %v", err)
+					}
+					return s
+				}
+
+				s := open()
+				reopen := func() Storage {
+					if err := s.Close(); err != nil {
+						t.Fatalf("failed to close storage: %v", err)
+					}
+					s = open()
+					return s
+				}
+				defer func() { s.Close() }()
+				c.test(t, s, reopen)
+			})
+		}
+	}
+}
+
+// testEntries returns entries first..last written in term
+func testEntries(first, last, term uint64) []LogEntry {
+	var entries []LogEntry
+	for i := first; i <= last; i++ {
+		entries = append(entries, LogEntry{
+			Index:   i,
+			Term:    term,
+			Command: map[string]interface{}{"op": fmt.Sprintf("set-%d-%d", term, i)},
+		})
+	}
+	return entries
+}
+
+// mustAppend appends entries or fails the test
+func mustAppend(t *testing.T, s Storage, entries []LogEntry) {
+	t.Helper()
+	if err := s.AppendLog(entries); err != nil {
+		t.Fatalf("AppendLog(%d..%d): %v", entries[0].Index, entries[len(entries)-1].Index, err)
+	}
+}
+
+// checkLog compares the stored log with want, ignoring the placeholder entry
+// FileStorage keeps at index 0
+func checkLog(t *testing.T, s Storage, want []LogEntry) {
+	t.Helper()
+	loaded, err := s.LoadLog()
+	if err != nil {
+		t.Fatalf("LoadLog: %v", err)
+	}
+	var got []LogEntry
+	for _, entry := range loaded {
+		if entry.Index != 0 {
+			got = append(got, entry)
+		}
+	}
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("log mismatch\n got: %+v\nwant: %+v", got, want)
+	}
+}
+
+// concat joins slices of entries
+func concat(parts ...[]LogEntry) []LogEntry {
+	var all []LogEntry
+	for _, part := range parts {
+		all = append(all, part...)
+	}
+	return all
+}
+
+func testStorageEmpty(t *testing.T, s Storage, _ func() Storage) {
+	term, votedFor, lastApplied, err := s.LoadState()
+	if err != nil || term != 0 || votedFor != "" || lastApplied != 0 {
+		t.Fatalf("LoadState = %d, %q, %d, %v; want zero state", term, votedFor, lastApplied, err)
+	}
+	if snapshot, err := s.LoadSnapshot(); err != nil || snapshot != nil {
+		t.Fatalf("LoadSnapshot = %+v, %v; want nil", snapshot, err)
+	}
+	if config, err := s.LoadConfiguration(); err != nil || config != nil {
+		t.Fatalf("LoadConfiguration = %+v, %v; want nil", config, err)
+	}
+	checkLog(t, s, nil)
+}
+
+func testStorageState(t *testing.T, s Storage, _ func() Storage) {
+	for _, want := range []persistentState{{3, "2", 7}, {4, "", 9}} {
+		if err := s.SaveState(want.CurrentTerm, want.VotedFor, want.LastApplied); err != nil {
+			t.Fatalf("SaveState: %v", err)
+		}
+		term, votedFor, lastApplied, err := s.LoadState()
+		if err != nil {
+			t.Fatalf("LoadState: %v", err)
+		}
+		if got := (persistentState{term, votedFor, lastApplied}); got != want {
+			t.Fatalf("LoadState = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func testStorageAppendLog(t *testing.T, s Storage, _ func() Storage) {
+	entries := testEntries(1, 30, 1)
+	entries[4].Type = EntryNoop
+	mustAppend(t, s, entries[:10])
+	mustAppend(t, s, entries[10:])
+	checkLog(t, s, entries)
+
+	if err := s.AppendLog(testEntries(32, 32, 1)); err == nil {
+		// FileStorage does not check for gaps; the others must
+		if _, ok := s.(*FileStorage); !ok {
+			t.Fatalf("AppendLog accepted a gap after entry 30")
+		}
+	}
+}
+
+func testStorageOverwriteConflict(t *testing.T, s Storage, _ func() Storage) {
+	mustAppend(t, s, testEntries(1, 20, 1))
+	mustAppend(t, s, testEntries(8, 12, 2))
+	checkLog(t, s, concat(testEntries(1, 7, 1), testEntries(8, 12, 2)))
+
+	mustAppend(t, s, testEntries(13, 15, 2))
+	checkLog(t, s, concat(testEntries(1, 7, 1), testEntries(8, 15, 2)))
+}
+
+func testStorageTruncateSuffix(t *testing.T, s Storage, _ func() Storage) {
+	mustAppend(t, s, testEntries(1, 20, 1))
+	if err := s.TruncateSuffix(25); err != nil {
+		t.Fatalf("TruncateSuffix past the end: %v", err)
+	}
+	checkLog(t, s, testEntries(1, 20, 1))
+
+	if err := s.TruncateSuffix(6); err != nil {
+		t.Fatalf("TruncateSuffix: %v", err)
+	}
+	checkLog(t, s, testEntries(1, 5, 1))
+
+	mustAppend(t, s, testEntries(6, 8, 3))
+	checkLog(t, s, concat(testEntries(1, 5, 1), testEntries(6, 8, 3)))
+}
+
+func testStorageTruncatePrefix(t *testing.T, s Storage, reopen func() Storage) {
+	mustAppend(t, s, testEntries(1, 20, 1))
+	if err := s.TruncatePrefix(12); err != nil {
+		t.Fatalf("TruncatePrefix: %v", err)
+	}
+	checkLog(t, s, testEntries(13, 20, 1))
+
+	mustAppend(t, s, testEntries(21, 22, 1))
+	s = reopen()
+	checkLog(t, s, testEntries(13, 22, 1))
+
+	if err := s.TruncatePrefix(22); err != nil {
+		t.Fatalf("TruncatePrefix of the whole log: %v", err)
+	}
+	checkLog(t, s, nil)
+	mustAppend(t, s, testEntries(23, 24, 2))
+	checkLog(t, s, testEntries(23, 24, 2))
+}
+
+// A follower installing a snapshot that conflicts with its log discards the
+// whole log and then receives entries right after the snapshot, which can be
+// below the point it truncated to
+func testStorageRewriteBelowCompaction(t *testing.T, s Storage, reopen func() Storage) {
+	mustAppend(t, s, testEntries(1, 20, 1))
+	if err := s.TruncatePrefix(20); err != nil {
+		t.Fatalf("TruncatePrefix: %v", err)
+	}
+	mustAppend(t, s, testEntries(16, 18, 2))
+	checkLog(t, s, testEntries(16, 18, 2))
+
+	s = reopen()
+	checkLog(t, s, testEntries(16, 18, 2))
+}
+
+func testStorageSnapshot(t *testing.T, s Storage, _ func() Storage) {
+	snapshots := []Snapshot{
+		{LastIncludedIndex: 10, LastIncludedTerm: 1, Data: []byte(`{"orders":[]}`)},
+		{LastIncludedIndex: 20, LastIncludedTerm: 2, Data: []byte(`{"orders":[1]}`),
+			Configuration: &Configuration{Members: map[string]string{"1": "node1:8081", "2": "node2:8082"}}},
+	}
+	for _, want := range snapshots {
+		if err := s.SaveSnapshot(want); err != nil {
+			t.Fatalf("SaveSnapshot: %v", err)
+		}
+		got, err := s.LoadSnapshot()
+		if err != nil {
+			t.Fatalf("LoadSnapshot: %v", err)
+		}
+		if got == nil || !reflect.DeepEqual(*got, want) {
+			t.Fatalf("LoadSnapshot = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func testStorageConfiguration(t *testing.T, s Storage, _ func() Storage) {
+	for _, want := range []Configuration{
+		{Members: map[string]string{"1": "node1:8081", "2": "node2:8082", "3": "node3:8083"}},
+		{Members: map[string]string{"1": "node1:8081", "2": "node2:8082"}},
+	} {
+		if err := s.SaveConfiguration(want); err != nil {
+			t.Fatalf("SaveConfiguration: %v", err)
+		}
+		got, err := s.LoadConfiguration()
+		if err != nil {
+			t.Fatalf("LoadConfiguration: %v", err)
+		}
+		if got == nil || !reflect.DeepEqual(*got, want) {
+			t.Fatalf("LoadConfiguration = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func testStorageReopen(t *testing.T, s Storage, reopen func() Storage) {
+	snapshot := Snapshot{LastIncludedIndex: 5, LastIncludedTerm: 1, Data: []byte("state")}
+	config := Configuration{Members: map[string]string{"1": "node1:8081", "3": "node3:8083"}}
+	mustAppend(t, s, testEntries(1, 40, 1))
+	mustAppend(t, s, testEntries(30, 35, 2))
+	if err := s.TruncatePrefix(5); err != nil {
+		t.Fatalf("TruncatePrefix: %v", err)
+	}
+	if err := s.SaveState(2, "3", 28); err != nil {
+		t.Fatalf("SaveState: %v", err)
+	}
+	if err := s.SaveSnapshot(snapshot); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+	if err := s.SaveConfiguration(config); err != nil {
+		t.Fatalf("SaveConfiguration: %v", err)
+	}
+
+	s = reopen()
+	term, votedFor, lastApplied, err := s.LoadState()
+	if err != nil || term != 2 || votedFor != "3" || lastApplied != 28 {
+		t.Fatalf("LoadState = %d, %q, %d, %v after reopening", term, votedFor, lastApplied, err)
+	}
+	if got, err := s.LoadSnapshot(); err != nil || got == nil || !reflect.DeepEqual(*got, snapshot) {
+		t.Fatalf("LoadSnapshot = %+v, %v after reopening", got, err)
+	}
+	if got, err := s.LoadConfiguration(); err != nil || got == nil || !reflect.DeepEqual(*got, config) {
+		t.Fatalf("LoadConfiguration = %+v, %v after reopening", got, err)
+	}
+	checkLog(t, s, concat(testEntries(6, 29, 1), testEntries(30, 35, 2)))
+}
+
+// TestWALTornTail checks that a record torn by a crash at the end of the log
+// is cut off, while damage anywhere else is reported
+func TestWALTornTail(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openWAL(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustAppend(t, w, testEntries(1, 20, 1))
+	w.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+walSegmentExt))
+	if len(segments) < 2 {
+		t.Fatalf("expected several segments, got %d", len(segments))
+	}
+
+	// Half of a record at the end of the last segment
+	record, _ := encodeWALEntry(testEntries(21, 21, 1)[0])
+	appendFile(t, segments[len(segments)-1], record[:len(record)/2])
+
+	w, err = openWAL(dir, 256)
+	if err != nil {
+		t.Fatalf("failed to open log with a torn tail: %v", err)
+	}
+	checkLog(t, w, testEntries(1, 20, 1))
+	mustAppend(t, w, testEntries(21, 22, 1))
+	checkLog(t, w, testEntries(1, 22, 1))
+	w.Close()
+
+	// The same damage in an earlier segment is corruption
+	appendFile(t, segments[0], record[:len(record)/2])
+	if _, err := openWAL(dir, 256); !errors.Is(err, ErrWALCorrupt) {
+		t.Fatalf("opening a log with a bad record in the middle returned %v, want ErrWALCorrupt", err)
+	}
+}
+
+// TestWALReadOnly checks that a read-only open reports a torn tail and a bad
+// record instead of cutting or refusing them, and changes no file
+func TestWALReadOnly(t *testing.T) {
+	nodeDir := t.TempDir()
+	dir := filepath.Join(nodeDir, "wal")
+	w, err := openWAL(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustAppend(t, w, testEntries(1, 20, 1))
+	w.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+walSegmentExt))
+	record, _ := encodeWALEntry(testEntries(21, 21, 1)[0])
+	last := segments[len(segments)-1]
+	appendFile(t, last, record[:len(record)/2])
+	torn, _ := os.ReadFile(last)
+
+	s, kind, damage, err := OpenNodeStorageReadOnly("", nodeDir)
+	if err != nil {
+		t.Fatalf("failed to open log with a torn tail read-only: %v", err)
+	}
+	if kind != StorageWAL || len(damage) != 1 || !strings.Contains(damage[0], "torn tail") {
+		t.Fatalf("OpenNodeStorageReadOnly = %s, %q, want the torn tail reported", kind, damage)
+	}
+	checkLog(t, s, testEntries(1, 20, 1))
+	if err := s.AppendLog(testEntries(21, 21, 1)); err == nil {
+		t.Fatal("AppendLog succeeded on a read-only log")
+	}
+	s.Close()
+	if data, _ := os.ReadFile(last); !bytes.Equal(data, torn) {
+		t.Fatalf("read-only open changed the last segment from %d to %d bytes", len(torn), len(data))
+	}
+
+	// A bad record in an earlier segment ends the log there
+	appendFile(t, segments[0], record[:len(record)/2])
+	s, _, damage, err = OpenNodeStorageReadOnly(StorageWAL, nodeDir)
+	if err != nil {
+		t.Fatalf("failed to open corrupt log read-only: %v", err)
+	}
+	defer s.Close()
+	if len(damage) != 1 || !strings.Contains(damage[0], "bad record") {
+		t.Fatalf("damage = %q, want the bad record reported", damage)
+	}
+	entries, err := s.LoadLog()
+	if err != nil || len(entries) == 0 || entries[len(entries)-1].Index >= 20 {
+		t.Fatalf("LoadLog = %d entries, %v, want the log to end at the bad record", len(entries), err)
+	}
+}
+
+// TestBoltStorageEntries checks range reads by index
+func TestBoltStorageEntries(t *testing.T) {
+	s, err := NewBoltStorage("1", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	bs := s.(*BoltStorage)
+
+	mustAppend(t, bs, testEntries(1, 20, 1))
+	if err := bs.TruncatePrefix(4); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ lo, hi, first, last uint64 }{
+		{1, 8, 5, 7},
+		{10, 13, 10, 12},
+		{18, 0, 18, 20},
+		{21, 0, 0, 0},
+	} {
+		got, err := bs.Entries(c.lo, c.hi)
+		if err != nil {
+			t.Fatalf("Entries(%d, %d): %v", c.lo, c.hi, err)
+		}
+		var want []LogEntry
+		if c.first != 0 {
+			want = testEntries(c.first, c.last, 1)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Entries(%d, %d) = %+v, want %+v", c.lo, c.hi, got, want)
+		}
+	}
+}
+
+// appendFile appends data to the file at path
+func appendFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,132 @@
+package raft
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Mutual TLS between Raft nodes.
+//
+// Every node holds a certificate signed by the cluster CA whose common name
+// is its node ID. Both sides of a connection present their certificate and
+// check the other's against the CA. On top of that, a client only talks to
+// a server whose certificate names the peer it dialed, and a server only
+// accepts an RPC whose certificate names the node the RPC claims to come
+// from, so a member cannot impersonate another one in an election or as
+// leader.
+
+// TLSConfig names the PEM files used for mutual TLS between Raft nodes
+type TLSConfig struct {
+	CertFile string // This node's certificate
+	KeyFile  string // Private key of CertFile
+	CAFile   string // CA that signs the certificates of all members
+}
+
+// TLSConfigFromEnv reads the file paths from RAFT_TLS_CERT, RAFT_TLS_KEY and
+// RAFT_TLS_CA. It returns nil if none is set; setting only some is an error.
+func TLSConfigFromEnv() (*TLSConfig, error) {
+	cfg := &TLSConfig{
+		CertFile: os.Getenv("RAFT_TLS_CERT"),
+		KeyFile:  os.Getenv("RAFT_TLS_KEY"),
+		CAFile:   os.Getenv("RAFT_TLS_CA"),
+	}
+	if cfg.CertFile == "" && cfg.KeyFile == "" && cfg.CAFile == "" {
+		return nil, nil
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" || cfg.CAFile == "" {
+		return nil, errors.New("RAFT_TLS_CERT, RAFT_TLS_KEY and RAFT_TLS_CA must be set together")
+	}
+	return cfg, nil
+}
+
+// tlsMaterial is a loaded TLSConfig
+type tlsMaterial struct {
+	cert tls.Certificate
+	ca   *x509.CertPool
+}
+
+// load reads the certificate, key and CA
+func (c TLSConfig) load() (*tlsMaterial, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load node certificate: %w", err)
+	}
+
+	pem, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+	ca := x509.NewCertPool()
+	if !ca.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+	}
+	return &tlsMaterial{cert: cert, ca: ca}, nil
+}
+
+// serverConfig requires clients to present a certificate signed by the CA.
+// Which node a certificate belongs to is checked per RPC by checkPeer.
+func (m *tlsMaterial) serverConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{m.cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    m.ca,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// clientConfig accepts only a server certificate signed by the CA for peerID.
+// Peers are identified by node ID rather than host name, so the standard
+// host name check is replaced by the identity check.
+func (m *tlsMaterial) clientConfig(peerID string) *tls.Config {
+	return &tls.Config{
+		Certificates:       []tls.Certificate{m.cert},
+		RootCAs:            m.ca,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true, // Replaced by VerifyConnection below
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("peer presented no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range cs.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+				Roots:         m.ca,
+				Intermediates: intermediates,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			})
+			if err != nil {
+				return fmt.Errorf("failed to verify certificate of node %s: %w", peerID, err)
+			}
+			if id := PeerIdentity(cs.PeerCertificates[0]); id != peerID {
+				return fmt.Errorf("dialed node %s but its certificate belongs to node %q", peerID, id)
+			}
+			return nil
+		},
+	}
+}
+
+// PeerIdentity returns the node ID a certificate was issued to
+func PeerIdentity(cert *x509.Certificate) string {
+	return cert.Subject.CommonName
+}
+
+// checkPeer verifies that an RPC received over TLS comes from the node it
+// claims to come from. Plain HTTP requests carry no identity to check.
+func checkPeer(r *http.Request, claimed string) error {
+	if r.TLS == nil {
+		return nil
+	}
+	if len(r.TLS.PeerCertificates) == 0 {
+		return errors.New("client presented no certificate")
+	}
+	if id := PeerIdentity(r.TLS.PeerCertificates[0]); id != claimed {
+		return fmt.Errorf("request claims to come from node %s but the certificate belongs to node %q", claimed, id)
+	}
+	return nil
+}
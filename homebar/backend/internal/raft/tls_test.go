@@ -0,0 +1,222 @@
+package raft
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCA issues node certificates the way cmd/raft-certs does
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test raft CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{t: t, dir: t.TempDir(), cert: cert, key: key}
+	ca.write("ca.pem", "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) write(name, blockType string, der []byte) string {
+	path := filepath.Join(ca.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		ca.t.Fatal(err)
+	}
+	return path
+}
+
+// issue writes a certificate for a node and loads it with the CA
+func (ca *testCA) issue(id string) *tlsMaterial {
+	ca.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: id},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+
+	material, err := TLSConfig{
+		CertFile: ca.write("node-"+id+".pem", "CERTIFICATE", der),
+		KeyFile:  ca.write("node-"+id+"-key.pem", "EC PRIVATE KEY", keyDER),
+		CAFile:   filepath.Join(ca.dir, "ca.pem"),
+	}.load()
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return material
+}
+
+// voteHandler grants every vote and counts the RPCs that reached it
+type voteHandler struct {
+	calls atomic.Int32
+}
+
+func (h *voteHandler) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
+	h.calls.Add(1)
+	reply.Term = args.Term
+	reply.VoteGranted = true
+	return nil
+}
+
+func (h *voteHandler) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
+	return nil
+}
+
+func (h *voteHandler) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	return nil
+}
+
+func (h *voteHandler) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	return nil
+}
+
+// serveTLS serves Raft RPCs over mutual TLS with the given node material and
+// returns the http:// address peers are configured with
+func serveTLS(t *testing.T, material *tlsMaterial, handler RPCHandler) string {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(SetupRaftRPCServer(handler, "").Handler)
+	srv.TLS = material.serverConfig()
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // Handshakes the tests reject
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return "http://" + srv.Listener.Addr().String() + "/raft"
+}
+
+// TestTLSPeerIdentity checks that both sides of a Raft RPC accept a
+// certificate of the CA only if it names the node they expect
+func TestTLSPeerIdentity(t *testing.T) {
+	ca := newTestCA(t)
+	node1, node2, node3 := ca.issue("1"), ca.issue("2"), ca.issue("3")
+	other := newTestCA(t).issue("1")
+
+	tests := []struct {
+		name   string
+		server *tlsMaterial // Certificate of the node serving as node 1
+		client *tlsMaterial // Certificate of the node calling as node 2
+		err    string
+	}{
+		{name: "matching certificates", server: node1, client: node2},
+		{name: "server certificate of another node", server: node3, client: node2, err: `dialed node 1 but its certificate belongs to node "3"`},
+		{name: "server certificate of another CA", server: other, client: node2, err: "failed to verify certificate of node 1"},
+		{name: "client certificate of another node", server: node1, client: node3, err: `request claims to come from node 2 but the certificate belongs to node "3"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &voteHandler{}
+			addr := serveTLS(t, tt.server, handler)
+
+			transport := &HTTPTransport{tls: tt.client}
+			client, err := transport.Dial("1", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var reply RequestVoteReply
+			err = client.RequestVote(RequestVoteArgs{Term: 4, CandidateID: "2"}, &reply)
+
+			if tt.err == "" {
+				if err != nil || !reply.VoteGranted || handler.calls.Load() != 1 {
+					t.Fatalf("RequestVote = %+v, %v after %d calls, want the vote granted", reply, err, handler.calls.Load())
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("RequestVote returned %v, want an error containing %q", err, tt.err)
+			}
+			if calls := handler.calls.Load(); calls != 0 {
+				t.Fatalf("a rejected RPC reached the node %d times", calls)
+			}
+		})
+	}
+}
+
+// TestCheckPeer checks the identity an RPC server requires of a request
+func TestCheckPeer(t *testing.T) {
+	ca := newTestCA(t)
+	cert := func(id string) []*x509.Certificate {
+		parsed, err := x509.ParseCertificate(ca.issue(id).cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []*x509.Certificate{parsed}
+	}
+
+	tests := []struct {
+		name    string
+		state   *tls.ConnectionState
+		claimed string
+		ok      bool
+	}{
+		{name: "plain HTTP", state: nil, claimed: "2", ok: true},
+		{name: "no certificate", state: &tls.ConnectionState{}, claimed: "2"},
+		{name: "same node", state: &tls.ConnectionState{PeerCertificates: cert("2")}, claimed: "2", ok: true},
+		{name: "other node", state: &tls.ConnectionState{PeerCertificates: cert("3")}, claimed: "2"},
+		{name: "multi-character ID", state: &tls.ConnectionState{PeerCertificates: cert("bar-east")}, claimed: "bar-east", ok: true},
+		{name: "ID prefix", state: &tls.ConnectionState{PeerCertificates: cert("bar-east")}, claimed: "bar"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPeer(&http.Request{TLS: tt.state}, tt.claimed)
+			if (err == nil) != tt.ok {
+				t.Fatalf("checkPeer(%q) = %v, want ok %v", tt.claimed, err, tt.ok)
+			}
+		})
+	}
+}
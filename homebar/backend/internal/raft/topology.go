@@ -0,0 +1,174 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Cluster topology.
+//
+// Every node serves three endpoints: Raft RPCs, the business HTTP API and
+// the cluster coordinator. A Topology names them for any node ID. Whatever
+// it leaves out is derived from the node's Raft address following the
+// default port layout, the API on the Raft port + 920 and the coordinator
+// on the Raft port + 10, so node 1 on 8081 serves its API on 9001 and its
+// coordinator on 8091.
+//
+// The Raft address of a member in the cluster configuration takes
+// precedence over the topology, since it is what the members agreed on;
+// the topology supplies it for members the configuration has no address for.
+
+const (
+	apiPortOffset         = 920
+	coordinatorPortOffset = 10
+)
+
+// NodeAddresses are the base URLs a node serves on
+type NodeAddresses struct {
+	Raft        string `json:"raft"`                  // Raft RPC endpoint, such as http://10.0.0.1:8081/raft
+	API         string `json:"api,omitempty"`         // Business HTTP API, such as http://10.0.0.1:9001
+	Coordinator string `json:"coordinator,omitempty"` // Cluster coordinator, such as http://10.0.0.1:8091
+}
+
+// Topology maps node IDs to their addresses. The zero value and nil know no
+// node, and derive every address from the Raft address.
+type Topology struct {
+	Nodes map[string]NodeAddresses `json:"nodes"`
+}
+
+// ParseTopology decodes a topology from its JSON form:
+//
+//	{"nodes": {"bar-a": {"raft": "http://10.0.0.1:8081/raft", "api": "http://10.0.0.1:9001", "coordinator": "http://10.0.0.1:8091"}}}
+func ParseTopology(data []byte) (*Topology, error) {
+	var t Topology
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t); err != nil {
+		return nil, fmt.Errorf("failed to decode topology: %w", err)
+	}
+
+	for id, addrs := range t.Nodes {
+		if id == "" {
+			return nil, errors.New("topology has a node with an empty ID")
+		}
+		for name, addr := range map[string]string{"raft": addrs.Raft, "api": addrs.API, "coordinator": addrs.Coordinator} {
+			if addr == "" {
+				continue
+			}
+			if u, err := url.Parse(addr); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("topology: %s address %q of node %s is not an http(s) URL", name, addr, id)
+			}
+		}
+	}
+	return &t, nil
+}
+
+// TopologyFromEnv reads the topology from the file named by
+// RAFT_TOPOLOGY_FILE, or from the JSON in RAFT_TOPOLOGY. It returns an
+// empty topology if neither is set.
+func TopologyFromEnv() (*Topology, error) {
+	file, inline := os.Getenv("RAFT_TOPOLOGY_FILE"), os.Getenv("RAFT_TOPOLOGY")
+	switch {
+	case file != "" && inline != "":
+		return nil, errors.New("set either RAFT_TOPOLOGY_FILE or RAFT_TOPOLOGY, not both")
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read topology: %w", err)
+		}
+		return ParseTopology(data)
+	case inline != "":
+		return ParseTopology([]byte(inline))
+	}
+	return &Topology{}, nil
+}
+
+// IDs returns the IDs of the nodes in the topology in sorted order
+func (t *Topology) IDs() []string {
+	if t == nil {
+		return nil
+	}
+	ids := make([]string, 0, len(t.Nodes))
+	for id := range t.Nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Addresses returns the addresses of a node. raftAddr is its Raft address
+// in the cluster configuration, if any. Addresses that cannot be worked
+// out are left empty.
+func (t *Topology) Addresses(id, raftAddr string) NodeAddresses {
+	addrs := t.node(id)
+	if raftAddr != "" {
+		addrs.Raft = raftAddr
+	}
+	if addrs.Raft == "" {
+		addrs.Raft = defaultRaftAddr(id)
+	}
+
+	if addrs.API == "" {
+		addrs.API = deriveAddr(addrs.Raft, apiPortOffset)
+	}
+	if addrs.Coordinator == "" {
+		addrs.Coordinator = deriveAddr(addrs.Raft, coordinatorPortOffset)
+	}
+	return addrs
+}
+
+// node returns the addresses the topology lists for a node, without
+// deriving any
+func (t *Topology) node(id string) NodeAddresses {
+	if t == nil {
+		return NodeAddresses{}
+	}
+	return t.Nodes[id]
+}
+
+// defaultRaftAddr returns the Raft address a node with a single digit ID
+// uses when nothing configures one, port 808<ID> on localhost
+func defaultRaftAddr(id string) string {
+	if len(id) != 1 || id[0] < '0' || id[0] > '9' {
+		return ""
+	}
+	return fmt.Sprintf("http://localhost:808%s/raft", id)
+}
+
+// deriveAddr returns the base URL on the host of a Raft address, offset
+// ports above it. It returns "" for addresses that are not URLs with a
+// port, such as those of a MemoryNetwork.
+func deriveAddr(raftAddr string, offset int) string {
+	u, err := url.Parse(raftAddr)
+	if err != nil || u.Hostname() == "" {
+		return ""
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		return ""
+	}
+	return "http://" + net.JoinHostPort(u.Hostname(), strconv.Itoa(port+offset))
+}
+
+// ListenAddr returns the address to listen on for serving a base URL,
+// every interface on its port
+func ListenAddr(addr string) (string, error) {
+	if addr == "" {
+		return "", errors.New("no address configured")
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	if u.Port() == "" {
+		return "", fmt.Errorf("address %q has no port", addr)
+	}
+	return ":" + u.Port(), nil
+}
@@ -0,0 +1,147 @@
+package raft
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestParseTopology checks that node addresses must be http(s) URLs
+func TestParseTopology(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		ids  []string
+		err  string
+	}{
+		{
+			name: "multi-character IDs",
+			json: `{"nodes": {"bar-east": {"raft": "https://10.0.0.1:8081/raft"}, "bar-west-2": {"raft": "http://bar-west-2:7000/raft", "api": "http://bar-west-2:80"}}}`,
+			ids:  []string{"bar-east", "bar-west-2"},
+		},
+		{name: "empty", json: `{}`, ids: []string{}},
+		{name: "empty ID", json: `{"nodes": {"": {"raft": "http://10.0.0.1:8081/raft"}}}`, err: "empty ID"},
+		{name: "unknown field", json: `{"nodes": {"a": {"rpc": "http://10.0.0.1:8081/raft"}}}`, err: "failed to decode topology"},
+		{name: "not JSON", json: `nodes: a`, err: "failed to decode topology"},
+		{name: "no scheme", json: `{"nodes": {"a": {"raft": "10.0.0.1:8081"}}}`, err: `raft address "10.0.0.1:8081" of node a`},
+		{name: "other scheme", json: `{"nodes": {"a": {"api": "ftp://10.0.0.1:9001"}}}`, err: `api address "ftp://10.0.0.1:9001" of node a`},
+		{name: "no host", json: `{"nodes": {"a": {"coordinator": "http:///status"}}}`, err: `coordinator address "http:///status" of node a`},
+		{name: "bad URL", json: `{"nodes": {"a": {"raft": "http://[::1/raft"}}}`, err: `raft address "http://[::1/raft" of node a`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topology, err := ParseTopology([]byte(tt.json))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("ParseTopology = %+v, %v, want an error containing %q", topology, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := topology.IDs(); !reflect.DeepEqual(got, tt.ids) {
+				t.Fatalf("IDs = %q, want %q", got, tt.ids)
+			}
+		})
+	}
+}
+
+// TestTopologyAddresses checks which addresses are taken from the topology,
+// which from the cluster configuration and which are derived
+func TestTopologyAddresses(t *testing.T) {
+	topology, err := ParseTopology([]byte(`{"nodes": {
+		"bar-east": {"raft": "http://10.0.0.1:7000/raft", "api": "https://east.example.com", "coordinator": "http://10.0.0.1:7500"},
+		"bar-west": {"raft": "http://10.0.0.2:8081/raft"},
+		"2": {"api": "http://10.0.0.3:80"}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		topology *Topology
+		id       string
+		raftAddr string // From the cluster configuration
+		want     NodeAddresses
+	}{
+		{
+			name: "explicit", topology: topology, id: "bar-east",
+			want: NodeAddresses{Raft: "http://10.0.0.1:7000/raft", API: "https://east.example.com", Coordinator: "http://10.0.0.1:7500"},
+		},
+		{
+			name: "derived", topology: topology, id: "bar-west",
+			want: NodeAddresses{Raft: "http://10.0.0.2:8081/raft", API: "http://10.0.0.2:9001", Coordinator: "http://10.0.0.2:8091"},
+		},
+		{
+			name: "configured Raft address", topology: topology, id: "bar-west", raftAddr: "http://10.0.0.9:6000/raft",
+			want: NodeAddresses{Raft: "http://10.0.0.9:6000/raft", API: "http://10.0.0.9:6920", Coordinator: "http://10.0.0.9:6010"},
+		},
+		{
+			name: "configured Raft address keeps explicit ones", topology: topology, id: "bar-east", raftAddr: "http://10.0.0.9:6000/raft",
+			want: NodeAddresses{Raft: "http://10.0.0.9:6000/raft", API: "https://east.example.com", Coordinator: "http://10.0.0.1:7500"},
+		},
+		{
+			name: "default Raft address", topology: topology, id: "2",
+			want: NodeAddresses{Raft: "http://localhost:8082/raft", API: "http://10.0.0.3:80", Coordinator: "http://localhost:8092"},
+		},
+		{
+			name: "no topology", topology: nil, id: "3",
+			want: NodeAddresses{Raft: "http://localhost:8083/raft", API: "http://localhost:9003", Coordinator: "http://localhost:8093"},
+		},
+		{
+			name: "unknown multi-character ID", topology: topology, id: "bar-north",
+			want: NodeAddresses{},
+		},
+		{
+			name: "IPv6", topology: nil, id: "bar-v6", raftAddr: "http://[fd00::1]:8081/raft",
+			want: NodeAddresses{Raft: "http://[fd00::1]:8081/raft", API: "http://[fd00::1]:9001", Coordinator: "http://[fd00::1]:8091"},
+		},
+		{
+			name: "not a URL", topology: nil, id: "1", raftAddr: "apply-1",
+			want: NodeAddresses{Raft: "apply-1"},
+		},
+		{
+			name: "no port", topology: nil, id: "1", raftAddr: "http://bar-1/raft",
+			want: NodeAddresses{Raft: "http://bar-1/raft"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.topology.Addresses(tt.id, tt.raftAddr); got != tt.want {
+				t.Fatalf("Addresses(%q, %q) = %+v, want %+v", tt.id, tt.raftAddr, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestListenAddr checks the address a base URL is served on
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+		err  string
+	}{
+		{addr: "http://10.0.0.1:9001", want: ":9001"},
+		{addr: "https://[fd00::1]:8091/status", want: ":8091"},
+		{addr: "", err: "no address configured"},
+		{addr: "http://bar-1/raft", err: "has no port"},
+		{addr: "http://[::1/raft", err: "invalid address"},
+	}
+
+	for _, tt := range tests {
+		got, err := ListenAddr(tt.addr)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("ListenAddr(%q) = %q, %v, want an error containing %q", tt.addr, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Fatalf("ListenAddr(%q) = %q, %v, want %q", tt.addr, got, err, tt.want)
+		}
+	}
+}
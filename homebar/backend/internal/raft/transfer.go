@@ -0,0 +1,182 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Leadership transfer hands leadership to a chosen follower without waiting
+// for an election timeout (Raft thesis, section 3.10). The leader stops
+// accepting new commands, replicates its log to the target and then sends it
+// TimeoutNow, which makes the target start an election right away. The target
+// wins because its log is as up-to-date as the leader's.
+
+var (
+	// ErrLeadershipTransfer is returned for new commands while leadership is being handed over
+	ErrLeadershipTransfer = errors.New("leadership transfer in progress")
+	// ErrTransferTimeout is returned when the target did not take over in time
+	ErrTransferTimeout = errors.New("leadership transfer timed out")
+)
+
+// leadershipTransfer tracks the transfer in progress on a leader
+type leadershipTransfer struct {
+	target         string
+	term           uint64
+	timeoutNowSent bool
+	timer          Timer
+	done           chan error
+}
+
+// TransferLeadership hands leadership over to targetID and blocks until
+// another node has taken over or the transfer was abandoned. An empty
+// targetID picks the member whose log is most up to date.
+func (n *RaftNode) TransferLeadership(targetID string) error {
+	n.mu.Lock()
+	done, err := n.startLeadershipTransfer(targetID)
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return <-done
+}
+
+// startLeadershipTransfer begins a transfer and returns the channel that
+// receives its outcome
+func (n *RaftNode) startLeadershipTransfer(targetID string) (<-chan error, error) {
+	if n.state != Leader {
+		return nil, ErrNotLeader
+	}
+	if n.transfer != nil {
+		return nil, ErrLeadershipTransfer
+	}
+
+	if targetID == "" {
+		targetID = n.pickTransferTarget()
+		if targetID == "" {
+			return nil, fmt.Errorf("no other member to transfer leadership to")
+		}
+	}
+	if targetID == n.id {
+		return nil, fmt.Errorf("node %s is already the leader", targetID)
+	}
+	peer, ok := n.peers[targetID]
+	if !ok || !n.config.Has(targetID) {
+		return nil, fmt.Errorf("node %s is not a member", targetID)
+	}
+
+	t := &leadershipTransfer{
+		target: targetID,
+		term:   n.currentTerm,
+		done:   make(chan error, 1),
+	}
+	t.timer = n.clock.AfterFunc(LeadershipTransferTimeout, func() { n.transferTimeout(t) })
+	n.transfer = t
+
+	n.logger.Info().Msgf("🤝 Node %s transferring leadership to %s in term %d", n.id, targetID, n.currentTerm)
+
+	// Bring the target up to date; the TimeoutNow follows once it has caught up
+	if !n.maybeSendTimeoutNow(targetID) {
+		n.replicateTo(peer, true)
+	}
+
+	return t.done, nil
+}
+
+// pickTransferTarget returns the voting peer with the longest matching log
+func (n *RaftNode) pickTransferTarget() string {
+	best := ""
+	for id := range n.config.Members {
+		if id == n.id {
+			continue
+		}
+		if best == "" || n.matchIndex[id] > n.matchIndex[best] ||
+			(n.matchIndex[id] == n.matchIndex[best] && id < best) {
+			best = id
+		}
+	}
+	return best
+}
+
+// maybeSendTimeoutNow sends TimeoutNow once the transfer target has every
+// entry in the leader's log. It reports whether the RPC was sent.
+func (n *RaftNode) maybeSendTimeoutNow(peerID string) bool {
+	t := n.transfer
+	if t == nil || t.target != peerID || t.timeoutNowSent || n.matchIndex[peerID] < n.lastLogIndex() {
+		return false
+	}
+	peer, ok := n.peers[peerID]
+	if !ok {
+		return false
+	}
+
+	t.timeoutNowSent = true
+	args := TimeoutNowArgs{Term: n.currentTerm, LeaderID: n.id}
+	n.spawn(func() {
+		var reply TimeoutNowReply
+		err := peer.client.TimeoutNow(args, &reply)
+
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		if err != nil {
+			n.logger.Info().Msgf("⚠️  Node %s TimeoutNow to %s failed: %v", n.id, peerID, err)
+			// Try again after the next successful AppendEntries
+			if n.transfer == t {
+				t.timeoutNowSent = false
+			}
+			return
+		}
+		if reply.Term > n.currentTerm {
+			n.becomeFollower(reply.Term)
+		}
+	})
+	return true
+}
+
+// transferTimeout abandons a transfer that did not complete in time so the
+// leader accepts commands again
+func (n *RaftNode) transferTimeout(t *leadershipTransfer) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.transfer != t {
+		return
+	}
+	n.logger.Info().Msgf("⌛ Node %s leadership transfer to %s timed out", n.id, t.target)
+	n.finishTransfer(ErrTransferTimeout)
+}
+
+// finishTransfer reports the outcome of the transfer in progress, if any
+func (n *RaftNode) finishTransfer(err error) {
+	t := n.transfer
+	if t == nil {
+		return
+	}
+	n.transfer = nil
+	t.timer.Stop()
+	t.done <- err
+}
+
+// TimeoutNow handles a TimeoutNow RPC: the leader asks this node to start an
+// election immediately, skipping the pre-vote
+func (n *RaftNode) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	reply.Term = n.currentTerm
+	if args.Term < n.currentTerm {
+		return nil
+	}
+	if args.Term > n.currentTerm {
+		n.becomeFollower(args.Term)
+		reply.Term = n.currentTerm
+	}
+
+	if n.stopped || n.state == Leader || !n.config.Has(n.id) {
+		return nil
+	}
+
+	n.logger.Info().Msgf("⏩ Node %s received TimeoutNow from %s", n.id, args.LeaderID)
+	n.startElection(true)
+	return nil
+}
@@ -0,0 +1,36 @@
+package raft
+
+import "errors"
+
+// ErrPeerUnreachable is returned by a transport when the peer is not listening
+var ErrPeerUnreachable = errors.New("peer unreachable")
+
+// RPCHandler is the receiving side of the Raft RPCs. RaftNode implements it.
+type RPCHandler interface {
+	RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error
+	AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error
+	InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error
+	TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error
+}
+
+// RPCClient sends Raft RPCs to a single peer. Calls must time out on their
+// own, the node never cancels them.
+type RPCClient interface {
+	RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error
+	AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error
+	InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error
+	TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) error
+}
+
+// Transport carries Raft RPCs between nodes. The default is JSON-RPC over
+// HTTP (HTTPTransport); MemoryTransport connects nodes inside one process.
+type Transport interface {
+	// Dial returns a client for the peer with the given ID and address
+	Dial(peerID string, addr string) (RPCClient, error)
+
+	// Serve starts delivering incoming RPCs to handler
+	Serve(handler RPCHandler) error
+
+	// Close stops serving incoming RPCs
+	Close() error
+}
@@ -24,32 +24,56 @@ const (
 	HeartbeatInterval   = 50 * time.Millisecond
 	RPCTimeout          = 100 * time.Millisecond
 	MaxAppendEntries    = 100 // Maximum number of entries to send in a single AppendEntries RPC
+	MaxInflightAppends  = 8   // AppendEntries carrying entries that may be outstanding per peer
 	MaxLogEntriesBuffer = 1000
+
+	// Applying
+	MaxApplyBatch   = 100  // Committed entries copied out of the log at a time for the state machine
+	MaxApplyBacklog = 1000 // Entries accepted by the leader but not yet applied before new commands are refused
+
+	// Snapshotting
+	SnapshotThreshold  = 1000            // Number of applied entries kept in the log before it is compacted
+	SnapshotRPCTimeout = 5 * time.Second // InstallSnapshot carries the whole state machine, so allow it longer
+
+	// Leadership transfer
+	LeadershipTransferTimeout = 2 * MaxElectionTimeout // A transfer that has not completed by then is abandoned
+
+	// Lease reads; the margin below MinElectionTimeout allows for clock drift
+	LeaseDuration = MinElectionTimeout * 9 / 10
+)
+
+// EntryType distinguishes client commands from entries used by Raft itself
+type EntryType uint8
+
+const (
+	// EntryNormal entries carry a client command for the state machine
+	EntryNormal EntryType = iota
+	// EntryNoop entries are appended by a new leader to commit entries from earlier terms
+	EntryNoop
+	// EntryConfiguration entries carry a new cluster Configuration
+	EntryConfiguration
 )
 
 // LogEntry represents a single entry in the Raft log
 type LogEntry struct {
 	Index   uint64      // Position in the log
 	Term    uint64      // Term when entry was received by leader
+	Type    EntryType   `json:",omitempty"` // Kind of entry, normal commands when omitted
 	Command interface{} // Command to be applied to the state machine
 }
 
-// OrderCommand represents a command to modify order and inventory state
-type OrderCommand struct {
-	Type           string                 // Type of command (e.g., "create_order", "update_inventory")
-	OrderID        uint                   // ID of the order (if applicable)
-	CustomerID     uint                   // Customer ID
-	MerchantID     uint                   // Merchant ID
-	OrderItems     []OrderItemCommand     // Items in the order
-	AdditionalData map[string]interface{} // Additional command-specific data
+// Configuration is the set of voting members of the cluster, together
+// with the learners that replicate the log without voting
+type Configuration struct {
+	Members  map[string]string `json:"members"`            // Node ID -> Raft RPC address
+	Learners map[string]string `json:"learners,omitempty"` // Node ID -> Raft RPC address of non-voting members
 }
 
-// OrderItemCommand represents an item in an order command
-type OrderItemCommand struct {
-	ProductID uint    `json:"product_id"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
-}
+// Roles of a node in the cluster configuration
+const (
+	RoleVoter   = "voter"
+	RoleLearner = "learner"
+)
 
 // RequestVoteArgs represents the arguments for a RequestVote RPC
 type RequestVoteArgs struct {
@@ -57,6 +81,9 @@ type RequestVoteArgs struct {
 	CandidateID  string // Candidate requesting vote
 	LastLogIndex uint64 // Index of candidate's last log entry
 	LastLogTerm  uint64 // Term of candidate's last log entry
+	PreVote      bool   `json:",omitempty"` // Asks whether the vote would be granted, without changing any state
+
+	LeadershipTransfer bool `json:",omitempty"` // Election started by TimeoutNow, voters must not ignore it
 }
 
 // RequestVoteReply represents the result of a RequestVote RPC
@@ -82,3 +109,40 @@ type AppendEntriesReply struct {
 	ConflictTerm  uint64 // Term of the conflicting entry
 	ConflictIndex uint64 // First index of the conflicting term
 }
+
+// Snapshot represents a compacted prefix of the log together with the state
+// machine data that results from applying it
+type Snapshot struct {
+	LastIncludedIndex uint64 // Index of the last entry replaced by the snapshot
+	LastIncludedTerm  uint64 // Term of the last entry replaced by the snapshot
+	Data              []byte // Serialized state machine produced by StateMachine.Snapshot
+
+	Configuration *Configuration `json:",omitempty"` // Cluster membership as of LastIncludedIndex
+}
+
+// InstallSnapshotArgs represents the arguments for an InstallSnapshot RPC
+type InstallSnapshotArgs struct {
+	Term              uint64 // Leader's term
+	LeaderID          string // So follower can redirect clients
+	LastIncludedIndex uint64 // The snapshot replaces all entries up through and including this index
+	LastIncludedTerm  uint64 // Term of lastIncludedIndex
+	Data              []byte // Raw snapshot data
+
+	Configuration *Configuration // Cluster membership as of lastIncludedIndex
+}
+
+// InstallSnapshotReply represents the result of an InstallSnapshot RPC
+type InstallSnapshotReply struct {
+	Term uint64 // Current term, for leader to update itself
+}
+
+// TimeoutNowArgs represents the arguments for a TimeoutNow RPC
+type TimeoutNowArgs struct {
+	Term     uint64 // Leader's term
+	LeaderID string // Leader handing over leadership
+}
+
+// TimeoutNowReply represents the result of a TimeoutNow RPC
+type TimeoutNowReply struct {
+	Term uint64 // Current term, for leader to update itself
+}
@@ -0,0 +1,720 @@
+package raft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Write-ahead log storage.
+//
+// The log lives in append-only segment files named after the index of their
+// first entry. Every entry is one record
+//
+//	length uint32 | crc32c(payload) uint32 | payload
+//
+// whose payload is index uint64 | term uint64 | type uint8 | command JSON,
+// all little endian. AppendLog writes a batch of records and fsyncs the
+// segment before returning. A crash can leave the last record of the last
+// segment half written; opening the log cuts such a torn tail off. A bad
+// record anywhere else means the log is corrupt and opening it fails. Tools
+// inspecting a stopped node open the log read-only, which reports either
+// instead and leaves the files as they are.
+//
+// State, configuration, snapshot and the compaction point are small files
+// holding a single record. They are replaced by writing and syncing a
+// temporary file and renaming it over the old one.
+
+// WALSegmentSize is the size at which a new segment file is started
+const WALSegmentSize = 64 << 20
+
+const (
+	walRecordHeaderSize = 8  // Length and checksum
+	walEntryHeaderSize  = 17 // Index, term and type
+	walSegmentExt       = ".seg"
+)
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrWALCorrupt is returned when a record before the tail of the log fails its checksum
+var ErrWALCorrupt = errors.New("write-ahead log is corrupt")
+
+// WALStorage implements the Storage interface with a segmented write-ahead log
+type WALStorage struct {
+	mu          sync.Mutex
+	dir         string
+	segmentSize int64
+	segments    []*walSegment // Ordered by first index; records are appended to the last
+	file        *os.File      // Open handle on the last segment
+	trimmed     uint64        // Entries up to here were discarded by TruncatePrefix
+	err         error         // Set after a failed write, the files are in an unknown state
+	readOnly    bool          // Opened for inspection, damage is reported instead of repaired
+	damage      []string      // Damage found by a read-only open and left in place
+}
+
+// walSegment is one segment file and the position of each record in it
+type walSegment struct {
+	path    string
+	first   uint64  // Index of the first entry
+	offsets []int64 // Offset of each entry's record
+	size    int64
+}
+
+// NewWALStorage opens the write-ahead log of a node, cutting off a torn tail
+// left by a crash
+func NewWALStorage(nodeID string, dir string) (Storage, error) {
+	if dir == "" {
+		dir = "raft-data"
+	}
+	return openWAL(filepath.Join(dir, fmt.Sprintf("node-%s", nodeID), "wal"), WALSegmentSize)
+}
+
+// openWAL opens the write-ahead log in dir with the given segment size
+func openWAL(dir string, segmentSize int64) (*WALStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	w := &WALStorage{dir: dir, segmentSize: segmentSize}
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// openWALReadOnly opens the write-ahead log in dir without changing any
+// file. A torn tail or bad record is recorded as damage and the log ends
+// before it; every write fails.
+func openWALReadOnly(dir string) (*WALStorage, error) {
+	if info, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("failed to open write-ahead log: %w", err)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	w := &WALStorage{dir: dir, segmentSize: WALSegmentSize, readOnly: true,
+		err: errors.New("write-ahead log is opened read-only")}
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Damage returns what a read-only open found wrong with the log and left
+// in place, such as a torn tail a writable open would cut off
+func (w *WALStorage) Damage() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.damage...)
+}
+
+// load reads the compaction point and scans the segments
+func (w *WALStorage) load() error {
+	payload, err := readRecordFile(w.path("trim.rec"))
+	if err != nil {
+		return fmt.Errorf("failed to read compaction point: %w", err)
+	}
+	if payload != nil {
+		if len(payload) != 8 {
+			return fmt.Errorf("invalid compaction point: %w", ErrWALCorrupt)
+		}
+		w.trimmed = binary.LittleEndian.Uint64(payload)
+	}
+	return w.recover()
+}
+
+// recover scans every segment, rebuilds the record offsets and cuts off a
+// torn tail in the last segment. Opened read-only it cuts nothing: the
+// first bad record is recorded as damage and the log ends before it.
+func (w *WALStorage) recover() error {
+	names, err := filepath.Glob(filepath.Join(w.dir, "*"+walSegmentExt))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), walSegmentExt), 10, 64)
+		if err != nil {
+			return fmt.Errorf("unexpected segment file %s", name)
+		}
+		w.segments = append(w.segments, &walSegment{path: name, first: first})
+	}
+	sort.Slice(w.segments, func(i, j int) bool { return w.segments[i].first < w.segments[j].first })
+
+	for i, seg := range w.segments {
+		last := i == len(w.segments)-1
+		if i > 0 {
+			prev := w.segments[i-1]
+			if seg.first != prev.first+uint64(len(prev.offsets)) {
+				err := fmt.Errorf("segment %s does not follow the previous one: %w", seg.path, ErrWALCorrupt)
+				if !w.readOnly {
+					return err
+				}
+				w.damage = append(w.damage, err.Error())
+				w.segments = w.segments[:i]
+				break
+			}
+		}
+
+		data, err := os.ReadFile(seg.path)
+		if err != nil {
+			return fmt.Errorf("failed to read segment: %w", err)
+		}
+		var off int64
+		var bad error
+		for off < int64(len(data)) {
+			payload, n, ok := decodeWALRecord(data[off:])
+			if ok && len(payload) >= walEntryHeaderSize {
+				index := binary.LittleEndian.Uint64(payload)
+				if index != seg.first+uint64(len(seg.offsets)) {
+					bad = fmt.Errorf("entry %d out of place in %s: %w", index, seg.path, ErrWALCorrupt)
+					break
+				}
+				seg.offsets = append(seg.offsets, off)
+				off += n
+				continue
+			}
+
+			if !last {
+				bad = fmt.Errorf("bad record at offset %d of %s: %w", off, seg.path, ErrWALCorrupt)
+				break
+			}
+			if w.readOnly {
+				w.damage = append(w.damage, fmt.Sprintf("torn tail of %d bytes at offset %d of %s", len(data)-int(off), off, seg.path))
+				break
+			}
+			log.Warn().Str("segment", seg.path).Int64("offset", off).Int("bytes", len(data)-int(off)).
+				Msg("Cutting torn tail off write-ahead log")
+			if err := truncateSync(seg.path, off); err != nil {
+				return fmt.Errorf("failed to cut torn tail: %w", err)
+			}
+			break
+		}
+		seg.size = off
+
+		if bad != nil {
+			if !w.readOnly {
+				return bad
+			}
+			w.damage = append(w.damage, bad.Error())
+			w.segments = w.segments[:i+1]
+			break
+		}
+	}
+
+	if w.readOnly {
+		return nil
+	}
+	if len(w.segments) > 0 {
+		f, err := os.OpenFile(w.segments[len(w.segments)-1].path, os.O_RDWR, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open segment: %w", err)
+		}
+		w.file = f
+	}
+	return nil
+}
+
+func (w *WALStorage) path(name string) string {
+	return filepath.Join(w.dir, name)
+}
+
+// nextIndex returns the index the next appended entry must have, or 0 if
+// the log is empty and any index may start it
+func (w *WALStorage) nextIndex() uint64 {
+	if len(w.segments) == 0 {
+		return 0
+	}
+	last := w.segments[len(w.segments)-1]
+	return last.first + uint64(len(last.offsets))
+}
+
+// fail records a write error; later calls return it instead of touching files
+// whose contents are no longer known
+func (w *WALStorage) fail(err error) error {
+	if w.err == nil {
+		w.err = err
+	}
+	return err
+}
+
+// SaveState persists the current term, votedFor, and lastApplied
+func (w *WALStorage) SaveState(term uint64, votedFor string, lastApplied uint64) error {
+	data, err := json.Marshal(persistentState{CurrentTerm: term, VotedFor: votedFor, LastApplied: lastApplied})
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	return writeRecordFile(w.path("state.rec"), data)
+}
+
+// LoadState loads the saved term, votedFor, and lastApplied
+func (w *WALStorage) LoadState() (uint64, string, uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	data, err := readRecordFile(w.path("state.rec"))
+	if err != nil || data == nil {
+		return 0, "", 0, err
+	}
+	var state persistentState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, "", 0, fmt.Errorf("failed to unmarshal state: %w", err)
+	}
+	return state.CurrentTerm, state.VotedFor, state.LastApplied, nil
+}
+
+// AppendLog writes the entries and syncs them to disk. Stored entries at or
+// after the index of the first one are discarded first.
+func (w *WALStorage) AppendLog(entries []LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+
+	first := entries[0].Index
+	if first <= w.trimmed {
+		// The log is being rewritten below the compaction point, as after a
+		// snapshot replaced a conflicting log. Move the point down first so
+		// the new entries are not hidden.
+		if err := w.setTrimmed(first - 1); err != nil {
+			return err
+		}
+	}
+	if next := w.nextIndex(); next != 0 && first < next {
+		if err := w.truncateSuffix(first); err != nil {
+			return err
+		}
+	}
+	if next := w.nextIndex(); next != 0 && first != next {
+		return fmt.Errorf("entry %d does not follow the last stored entry %d", first, next-1)
+	}
+	if len(w.segments) == 0 {
+		if err := w.createSegment(first); err != nil {
+			return err
+		}
+	}
+
+	var buf []byte
+	for i, entry := range entries {
+		if entry.Index != first+uint64(i) {
+			return fmt.Errorf("entry %d does not follow entry %d", entry.Index, first+uint64(i)-1)
+		}
+		record, err := encodeWALEntry(entry)
+		if err != nil {
+			return err
+		}
+
+		seg := w.segments[len(w.segments)-1]
+		if seg.size+int64(len(buf)) > 0 && seg.size+int64(len(buf)+len(record)) > w.segmentSize {
+			// Finish the full segment before starting the next one
+			if err := w.write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+			if err := w.createSegment(entry.Index); err != nil {
+				return err
+			}
+			seg = w.segments[len(w.segments)-1]
+		}
+
+		seg.offsets = append(seg.offsets, seg.size+int64(len(buf)))
+		buf = append(buf, record...)
+	}
+	return w.write(buf)
+}
+
+// write appends buf to the last segment and syncs it
+func (w *WALStorage) write(buf []byte) error {
+	seg := w.segments[len(w.segments)-1]
+	if _, err := w.file.WriteAt(buf, seg.size); err != nil {
+		return w.fail(fmt.Errorf("failed to write segment: %w", err))
+	}
+	if err := w.file.Sync(); err != nil {
+		return w.fail(fmt.Errorf("failed to sync segment: %w", err))
+	}
+	seg.size += int64(len(buf))
+	return nil
+}
+
+// createSegment starts a new segment whose first entry has the given index
+func (w *WALStorage) createSegment(first uint64) error {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return w.fail(fmt.Errorf("failed to close segment: %w", err))
+		}
+		w.file = nil
+	}
+
+	path := w.path(fmt.Sprintf("%020d%s", first, walSegmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return w.fail(fmt.Errorf("failed to create segment: %w", err))
+	}
+	w.file = f
+	w.segments = append(w.segments, &walSegment{path: path, first: first})
+	if err := syncDir(w.dir); err != nil {
+		return w.fail(err)
+	}
+	return nil
+}
+
+// LoadLog loads all log entries after the compaction point
+func (w *WALStorage) LoadLog() ([]LogEntry, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var entries []LogEntry
+	for _, seg := range w.segments {
+		if len(seg.offsets) == 0 || seg.first+uint64(len(seg.offsets)) <= w.trimmed+1 {
+			continue
+		}
+		data, err := os.ReadFile(seg.path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read segment: %w", err)
+		}
+		for i, off := range seg.offsets {
+			if seg.first+uint64(i) <= w.trimmed {
+				continue
+			}
+			payload, _, ok := decodeWALRecord(data[off:])
+			if !ok {
+				return nil, fmt.Errorf("bad record at offset %d of %s: %w", off, seg.path, ErrWALCorrupt)
+			}
+			entry, err := decodeWALEntry(payload)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// SaveSnapshot persists the latest snapshot, replacing any older one
+func (w *WALStorage) SaveSnapshot(snapshot Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	return writeRecordFile(w.path("snapshot.rec"), data)
+}
+
+// LoadSnapshot loads the latest snapshot, or nil if none has been taken
+func (w *WALStorage) LoadSnapshot() (*Snapshot, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	data, err := readRecordFile(w.path("snapshot.rec"))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal snapshot: %w", err)
+	}
+	return &snapshot, nil
+}
+
+// TruncatePrefix discards all log entries up to and including index. The
+// compaction point is recorded first; segments holding nothing after it are
+// then removed.
+func (w *WALStorage) TruncatePrefix(index uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if index <= w.trimmed {
+		return nil
+	}
+
+	if err := w.setTrimmed(index); err != nil {
+		return err
+	}
+
+	for len(w.segments) > 0 {
+		seg := w.segments[0]
+		if len(w.segments) > 1 {
+			if w.segments[1].first > index+1 {
+				break
+			}
+		} else if seg.first+uint64(len(seg.offsets)) > index+1 {
+			break
+		}
+		if err := w.removeSegment(0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setTrimmed records the compaction point
+func (w *WALStorage) setTrimmed(index uint64) error {
+	payload := make([]byte, 8)
+	binary.LittleEndian.PutUint64(payload, index)
+	if err := writeRecordFile(w.path("trim.rec"), payload); err != nil {
+		return err
+	}
+	w.trimmed = index
+	return nil
+}
+
+// TruncateSuffix discards all log entries from index onwards
+func (w *WALStorage) TruncateSuffix(index uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	return w.truncateSuffix(index)
+}
+
+func (w *WALStorage) truncateSuffix(index uint64) error {
+	for len(w.segments) > 0 {
+		last := len(w.segments) - 1
+		seg := w.segments[last]
+		if index <= seg.first {
+			if err := w.removeSegment(last); err != nil {
+				return err
+			}
+			continue
+		}
+
+		pos := index - seg.first
+		if pos < uint64(len(seg.offsets)) {
+			if err := w.file.Truncate(seg.offsets[pos]); err != nil {
+				return w.fail(fmt.Errorf("failed to truncate segment: %w", err))
+			}
+			if err := w.file.Sync(); err != nil {
+				return w.fail(fmt.Errorf("failed to sync segment: %w", err))
+			}
+			seg.size = seg.offsets[pos]
+			seg.offsets = seg.offsets[:pos]
+		}
+		return nil
+	}
+	return nil
+}
+
+// removeSegment deletes a whole segment file, reopening the new last segment
+// when the last one goes
+func (w *WALStorage) removeSegment(i int) error {
+	seg := w.segments[i]
+	last := i == len(w.segments)-1
+	if last && w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return w.fail(fmt.Errorf("failed to close segment: %w", err))
+		}
+		w.file = nil
+	}
+	if err := os.Remove(seg.path); err != nil {
+		return w.fail(fmt.Errorf("failed to remove segment: %w", err))
+	}
+	w.segments = append(w.segments[:i], w.segments[i+1:]...)
+	if err := syncDir(w.dir); err != nil {
+		return w.fail(err)
+	}
+
+	if last && len(w.segments) > 0 {
+		f, err := os.OpenFile(w.segments[len(w.segments)-1].path, os.O_RDWR, 0644)
+		if err != nil {
+			return w.fail(fmt.Errorf("failed to open segment: %w", err))
+		}
+		w.file = f
+	}
+	return nil
+}
+
+// SaveConfiguration persists the membership at the start of the log
+func (w *WALStorage) SaveConfiguration(config Configuration) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to marshal configuration: %w", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	return writeRecordFile(w.path("config.rec"), data)
+}
+
+// LoadConfiguration loads the membership at the start of the log, or nil if none was saved
+func (w *WALStorage) LoadConfiguration() (*Configuration, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	data, err := readRecordFile(w.path("config.rec"))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var config Configuration
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal configuration: %w", err)
+	}
+	return &config, nil
+}
+
+// Close releases the open segment. Later writes fail.
+func (w *WALStorage) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var err error
+	if w.file != nil {
+		err = w.file.Close()
+		w.file = nil
+	}
+	if w.err == nil {
+		w.err = errors.New("write-ahead log is closed")
+	}
+	return err
+}
+
+// encodeWALEntry encodes a log entry as a record
+func encodeWALEntry(entry LogEntry) ([]byte, error) {
+	command, err := json.Marshal(entry.Command)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal command of entry %d: %w", entry.Index, err)
+	}
+
+	payload := make([]byte, walEntryHeaderSize, walEntryHeaderSize+len(command))
+	binary.LittleEndian.PutUint64(payload[0:], entry.Index)
+	binary.LittleEndian.PutUint64(payload[8:], entry.Term)
+	payload[16] = byte(entry.Type)
+	payload = append(payload, command...)
+	return encodeWALRecord(payload), nil
+}
+
+// decodeWALEntry decodes the payload of an entry record
+func decodeWALEntry(payload []byte) (LogEntry, error) {
+	entry := LogEntry{
+		Index: binary.LittleEndian.Uint64(payload[0:]),
+		Term:  binary.LittleEndian.Uint64(payload[8:]),
+		Type:  EntryType(payload[16]),
+	}
+	if err := json.Unmarshal(payload[walEntryHeaderSize:], &entry.Command); err != nil {
+		return LogEntry{}, fmt.Errorf("failed to unmarshal command of entry %d: %w", entry.Index, err)
+	}
+	return entry, nil
+}
+
+// encodeWALRecord frames a payload with its length and checksum
+func encodeWALRecord(payload []byte) []byte {
+	record := make([]byte, walRecordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.Checksum(payload, walCRCTable))
+	copy(record[walRecordHeaderSize:], payload)
+	return record
+}
+
+// decodeWALRecord returns the payload of the record at the start of data and
+// the record's length, or false if it is incomplete or fails its checksum
+func decodeWALRecord(data []byte) ([]byte, int64, bool) {
+	if len(data) < walRecordHeaderSize {
+		return nil, 0, false
+	}
+	length := int64(binary.LittleEndian.Uint32(data[0:]))
+	if int64(len(data)-walRecordHeaderSize) < length {
+		return nil, 0, false
+	}
+	payload := data[walRecordHeaderSize : walRecordHeaderSize+length]
+	if crc32.Checksum(payload, walCRCTable) != binary.LittleEndian.Uint32(data[4:]) {
+		return nil, 0, false
+	}
+	return payload, walRecordHeaderSize + length, true
+}
+
+// writeRecordFile atomically replaces path with a file holding one record
+func writeRecordFile(path string, payload []byte) error {
+	tmpFile := path + ".tmp"
+	f, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Base(path), err)
+	}
+	if _, err := f.Write(encodeWALRecord(payload)); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync %s: %w", filepath.Base(path), err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// readRecordFile returns the payload of a file written by writeRecordFile,
+// or nil if it does not exist
+func readRecordFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	payload, n, ok := decodeWALRecord(data)
+	if !ok || n != int64(len(data)) {
+		return nil, fmt.Errorf("bad record in %s: %w", filepath.Base(path), ErrWALCorrupt)
+	}
+	return payload, nil
+}
+
+// truncateSync cuts a file to size and syncs it
+func truncateSync(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// syncDir makes renames, creations and removals in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
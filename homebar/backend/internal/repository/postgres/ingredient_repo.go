@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/kexincchen/homebar/internal/domain"
@@ -51,6 +52,29 @@ func (r *IngredientRepository) Create(ctx context.Context, ingredient *domain.In
 	return ingredient, nil
 }
 
+// Insert adds an ingredient whose ID and timestamps are already set, in tx
+// if it is not nil
+func (r *IngredientRepository) Insert(ctx context.Context, tx *sql.Tx, ingredient *domain.Ingredient) error {
+	query := `
+		INSERT INTO ingredients (id, merchant_id, name, quantity, unit, low_stock_threshold, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+
+	_, err := r.conn(tx).ExecContext(
+		ctx,
+		query,
+		ingredient.ID,
+		ingredient.MerchantID,
+		ingredient.Name,
+		ingredient.Quantity,
+		ingredient.Unit,
+		ingredient.LowStockThreshold,
+		ingredient.CreatedAt,
+		ingredient.UpdatedAt,
+	)
+	return err
+}
+
 // GetByID retrieves an ingredient by its ID
 func (r *IngredientRepository) GetByID(ctx context.Context, id int64) (*domain.Ingredient, error) {
 	query := `
@@ -123,17 +147,20 @@ func (r *IngredientRepository) GetByMerchant(ctx context.Context, merchantID int
 	return ingredients, nil
 }
 
-// Update updates an existing ingredient
-func (r *IngredientRepository) Update(ctx context.Context, ingredient *domain.Ingredient) error {
+// Update updates an existing ingredient, in tx if it is not nil. A preset
+// UpdatedAt is kept.
+func (r *IngredientRepository) Update(ctx context.Context, tx *sql.Tx, ingredient *domain.Ingredient) error {
 	query := `
 		UPDATE ingredients
 		SET name = $1, quantity = $2, unit = $3, low_stock_threshold = $4, updated_at = $5
 		WHERE id = $6
 	`
 
-	ingredient.UpdatedAt = time.Now()
+	if ingredient.UpdatedAt.IsZero() {
+		ingredient.UpdatedAt = time.Now()
+	}
 
-	_, err := r.db.ExecContext(
+	_, err := r.conn(tx).ExecContext(
 		ctx,
 		query,
 		ingredient.Name,
@@ -147,10 +174,10 @@ func (r *IngredientRepository) Update(ctx context.Context, ingredient *domain.In
 	return err
 }
 
-// Delete removes an ingredient
-func (r *IngredientRepository) Delete(ctx context.Context, id int64) error {
+// Delete removes an ingredient, in tx if it is not nil
+func (r *IngredientRepository) Delete(ctx context.Context, tx *sql.Tx, id int64) error {
 	query := `DELETE FROM ingredients WHERE id = $1`
-	_, err := r.db.ExecContext(ctx, query, id)
+	_, err := r.conn(tx).ExecContext(ctx, query, id)
 	return err
 }
 
@@ -235,7 +262,7 @@ func (r *IngredientRepository) CheckProductsAvailability(ctx context.Context, pr
 
 // LockInventoryForOrder attempts to lock inventory for an order
 // Returns false if there's not enough inventory
-func (r *IngredientRepository) LockInventoryForOrder(ctx context.Context, orderItems []*domain.OrderItem) (bool, error) {	
+func (r *IngredientRepository) LockInventoryForOrder(ctx context.Context, orderItems []*domain.OrderItem) (bool, error) {
 	// Start a transaction
 	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
@@ -243,42 +270,65 @@ func (r *IngredientRepository) LockInventoryForOrder(ctx context.Context, orderI
 	}
 	defer tx.Rollback()
 
-	// Map to store required ingredients and their quantities
-	requiredIngredients := make(map[int64]float64)
-
 	// First pass: collect all required ingredients for all products
-	for _, item := range orderItems {
-		// Get the product ingredients
-		query := `
-			SELECT ingredient_id, quantity
-			FROM product_ingredients
-			WHERE product_id = $1
-		`
-		rows, err := tx.QueryContext(ctx, query, item.ProductID)
-		if err != nil {
-			return false, err
-		}
-
-		for rows.Next() {
-			var ingredientID int64
-			var quantity float64
-			if err := rows.Scan(&ingredientID, &quantity); err != nil {
-				rows.Close()
-				return false, err
-			}
-			
-			// Multiply by the order item quantity and add to our requirements
-			requiredIngredients[ingredientID] += quantity * float64(item.Quantity)
-		}
-		rows.Close()
-		
-		if err = rows.Err(); err != nil {
-			return false, err
-		}
+	required, err := requiredIngredients(ctx, tx, orderItems)
+	if err != nil {
+		return false, err
 	}
 
 	// Second pass: check and update each ingredient with locking
-	for ingredientID, requiredQty := range requiredIngredients {
+	ok, err := r.TakeStock(ctx, tx, required, time.Now())
+	if err != nil || !ok {
+		return false, err
+	}
+
+	// Everything is good, commit the transaction
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RestoreInventoryForOrder restores ingredients that were previously locked for an order
+func (r *IngredientRepository) RestoreInventoryForOrder(ctx context.Context, orderID uint) error {
+	// Start a transaction
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	reserved, err := reservedForOrder(ctx, tx, orderID)
+	if err != nil {
+		return err
+	}
+
+	// Restore each ingredient
+	if err := r.ReturnStock(ctx, tx, reserved, time.Now()); err != nil {
+		return err
+	}
+
+	// Commit the transaction
+	return tx.Commit()
+}
+
+// RequiredForItems returns the ingredients the order items take out of stock
+// according to the product recipes, ordered by ingredient ID
+func (r *IngredientRepository) RequiredForItems(ctx context.Context, orderItems []*domain.OrderItem) ([]domain.IngredientAmount, error) {
+	return requiredIngredients(ctx, r.db, orderItems)
+}
+
+// ReservedForOrder returns the ingredients an existing order took out of
+// stock according to the product recipes, ordered by ingredient ID
+func (r *IngredientRepository) ReservedForOrder(ctx context.Context, orderID uint) ([]domain.IngredientAmount, error) {
+	return reservedForOrder(ctx, r.db, orderID)
+}
+
+// TakeStock locks the ingredients and subtracts the amounts in the given
+// order. Returns false without changing anything if one of them runs short.
+func (r *IngredientRepository) TakeStock(ctx context.Context, tx *sql.Tx, amounts []domain.IngredientAmount, at time.Time) (bool, error) {
+	for _, amount := range amounts {
 		// Lock the row for update
 		var currentQty float64
 		query := `
@@ -287,54 +337,77 @@ func (r *IngredientRepository) LockInventoryForOrder(ctx context.Context, orderI
 			WHERE id = $1
 			FOR UPDATE
 		`
-		err := tx.QueryRowContext(ctx, query, ingredientID).Scan(&currentQty)
+		err := tx.QueryRowContext(ctx, query, amount.IngredientID).Scan(&currentQty)
 		if err != nil {
 			return false, err
 		}
 
 		// Check if there's enough
-		if currentQty < requiredQty {
+		if currentQty < amount.Quantity {
 			return false, nil // Not enough inventory
 		}
 
 		// Update the inventory
 		_, err = tx.ExecContext(
 			ctx,
-			`UPDATE ingredients SET quantity = quantity - $1, updated_at = NOW() WHERE id = $2`,
-			requiredQty,
-			ingredientID,
+			`UPDATE ingredients SET quantity = quantity - $1, updated_at = $2 WHERE id = $3`,
+			amount.Quantity,
+			at,
+			amount.IngredientID,
 		)
 		if err != nil {
 			return false, err
 		}
 	}
+	return true, nil
+}
 
-	// Everything is good, commit the transaction
-	if err := tx.Commit(); err != nil {
-		return false, err
+// ReturnStock adds the amounts back to the ingredients in the given order
+func (r *IngredientRepository) ReturnStock(ctx context.Context, tx *sql.Tx, amounts []domain.IngredientAmount, at time.Time) error {
+	for _, amount := range amounts {
+		_, err := tx.ExecContext(
+			ctx,
+			`UPDATE ingredients SET quantity = quantity + $1, updated_at = $2 WHERE id = $3`,
+			amount.Quantity,
+			at,
+			amount.IngredientID,
+		)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return true, nil
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
 }
 
-// RestoreInventoryForOrder restores ingredients that were previously locked for an order
-func (r *IngredientRepository) RestoreInventoryForOrder(ctx context.Context, orderID uint) error {
-	// Start a transaction
-	tx, err := r.db.BeginTx(ctx, nil)
-	if err != nil {
-		return err
+// execer is implemented by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// conn returns tx, or the database if tx is nil
+func (r *IngredientRepository) conn(tx *sql.Tx) execer {
+	if tx != nil {
+		return tx
 	}
-	defer tx.Rollback()
+	return r.db
+}
 
+// reservedForOrder reads the items of an order and returns the ingredients they require
+func reservedForOrder(ctx context.Context, q queryer, orderID uint) ([]domain.IngredientAmount, error) {
 	// First get the order items
 	query := `
 		SELECT product_id, quantity
 		FROM order_items
 		WHERE order_id = $1
 	`
-	rows, err := tx.QueryContext(ctx, query, orderID)
+	rows, err := q.QueryContext(ctx, query, orderID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer rows.Close()
 
@@ -342,19 +415,24 @@ func (r *IngredientRepository) RestoreInventoryForOrder(ctx context.Context, ord
 	for rows.Next() {
 		var item domain.OrderItem
 		if err := rows.Scan(&item.ProductID, &item.Quantity); err != nil {
-			return err
+			return nil, err
 		}
 		orderItems = append(orderItems, &item)
 	}
 
 	if err = rows.Err(); err != nil {
-		return err
+		return nil, err
 	}
 
-	// Map to store ingredients to be restored
-	ingredientsToRestore := make(map[int64]float64)
+	return requiredIngredients(ctx, q, orderItems)
+}
+
+// requiredIngredients sums the recipe amounts of every item. The result is
+// sorted by ingredient ID so rows are always locked and updated in the same order.
+func requiredIngredients(ctx context.Context, q queryer, orderItems []*domain.OrderItem) ([]domain.IngredientAmount, error) {
+	// Map to store required ingredients and their quantities
+	requiredIngredients := make(map[int64]float64)
 
-	// Collect all ingredients used in this order
 	for _, item := range orderItems {
 		// Get the product ingredients
 		query := `
@@ -362,47 +440,35 @@ func (r *IngredientRepository) RestoreInventoryForOrder(ctx context.Context, ord
 			FROM product_ingredients
 			WHERE product_id = $1
 		`
-		pRows, err := tx.QueryContext(ctx, query, item.ProductID)
+		rows, err := q.QueryContext(ctx, query, item.ProductID)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		for pRows.Next() {
+		for rows.Next() {
 			var ingredientID int64
 			var quantity float64
-			if err := pRows.Scan(&ingredientID, &quantity); err != nil {
-				pRows.Close()
-				return err
+			if err := rows.Scan(&ingredientID, &quantity); err != nil {
+				rows.Close()
+				return nil, err
 			}
-			
-			// Multiply by the order item quantity and add to our restoration map
-			fmt.Println("ingredientID: ", ingredientID)
-			fmt.Println("quantity: ", quantity)
-			fmt.Println("item.Quantity: ", item.Quantity)
-			ingredientsToRestore[ingredientID] += quantity * float64(item.Quantity)
-		}
-		pRows.Close()
-		
-		if err = pRows.Err(); err != nil {
-			return err
+
+			// Multiply by the order item quantity and add to our requirements
+			requiredIngredients[ingredientID] += quantity * float64(item.Quantity)
 		}
-	}
+		rows.Close()
 
-	// Restore each ingredient
-	for ingredientID, restoreQty := range ingredientsToRestore {
-		_, err = tx.ExecContext(
-			ctx,
-			`UPDATE ingredients SET quantity = quantity + $1, updated_at = NOW() WHERE id = $2`,
-			restoreQty,
-			ingredientID,
-		)
-		if err != nil {
-			return err
+		if err = rows.Err(); err != nil {
+			return nil, err
 		}
 	}
 
-	// Commit the transaction
-	return tx.Commit()
+	amounts := make([]domain.IngredientAmount, 0, len(requiredIngredients))
+	for ingredientID, quantity := range requiredIngredients {
+		amounts = append(amounts, domain.IngredientAmount{IngredientID: ingredientID, Quantity: quantity})
+	}
+	sort.Slice(amounts, func(i, j int) bool { return amounts[i].IngredientID < amounts[j].IngredientID })
+	return amounts, nil
 }
 
 // Helper to get a single ingredient with FOR UPDATE lock
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/kexincchen/homebar/internal/domain"
 )
@@ -47,6 +48,28 @@ func (r *OrderRepo) Create(ctx context.Context, o *domain.Order, items []domain.
 	return tx.Commit()
 }
 
+// Insert stores an order and its items with the IDs already set on them
+func (r *OrderRepo) Insert(ctx context.Context, tx *sql.Tx, o *domain.Order, items []domain.OrderItem) error {
+	const qOrder = `INSERT INTO orders
+	  (id, customer_id, merchant_id, total_amount, status, notes, created_at, updated_at)
+	  VALUES ($1,$2,$3,$4,$5,$6,$7,$8)`
+	if _, err := tx.ExecContext(ctx, qOrder,
+		o.ID, o.CustomerID, o.MerchantID, o.TotalAmount, o.Status, o.Notes,
+		o.CreatedAt, o.UpdatedAt,
+	); err != nil {
+		return err
+	}
+	const qItem = `INSERT INTO order_items
+	  (id, order_id, product_id, quantity, price)
+	  VALUES ($1,$2,$3,$4,$5)`
+	for _, it := range items {
+		if _, err := tx.ExecContext(ctx, qItem, it.ID, o.ID, it.ProductID, it.Quantity, it.Price); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // -------  Query helpers  -------
 func scanOrder(row *sql.Row) (*domain.Order, error) {
 	var o domain.Order
@@ -89,6 +112,14 @@ func (r *OrderRepo) GetByID(ctx context.Context, id uint) (*domain.Order, []doma
 	return o, list, nil
 }
 
+// GetForUpdate reads an order in tx and locks it until tx ends
+func (r *OrderRepo) GetForUpdate(ctx context.Context, tx *sql.Tx, id uint) (*domain.Order, error) {
+	row := tx.QueryRowContext(ctx,
+		`SELECT id, customer_id, merchant_id, total_amount, status, notes,
+		        created_at, updated_at FROM orders WHERE id=$1 FOR UPDATE`, id)
+	return scanOrder(row)
+}
+
 func (r *OrderRepo) GetByCustomer(ctx context.Context, cid uint) ([]*domain.Order, error) {
 	return r.list(ctx, `WHERE customer_id=$1`, cid)
 }
@@ -122,32 +153,32 @@ func (r *OrderRepo) list(ctx context.Context, where string, arg interface{}) ([]
 }
 
 // UpdateStatus updates the status of an order
-func (r *OrderRepo) UpdateStatus(ctx context.Context, tx *sql.Tx, id uint, status domain.OrderStatus) error {
-	query := `UPDATE orders SET status = $1, updated_at = NOW() WHERE id = $2`
+func (r *OrderRepo) UpdateStatus(ctx context.Context, tx *sql.Tx, id uint, status domain.OrderStatus, updatedAt time.Time) error {
+	query := `UPDATE orders SET status = $1, updated_at = $2 WHERE id = $3`
 
 	var err error
 	if tx != nil {
-		_, err = tx.ExecContext(ctx, query, status, id)
+		_, err = tx.ExecContext(ctx, query, status, updatedAt, id)
 	} else {
-		_, err = r.db.ExecContext(ctx, query, status, id)
+		_, err = r.db.ExecContext(ctx, query, status, updatedAt, id)
 	}
 
 	return err
 }
 
-// Update updates an order
+// Update updates the status, notes and updated_at of an order
 func (r *OrderRepo) Update(ctx context.Context, tx *sql.Tx, order *domain.Order) error {
 	query := `
 		UPDATE orders 
-		SET status = $1, notes = $2, updated_at = NOW()
-		WHERE id = $3
+		SET status = $1, notes = $2, updated_at = $3
+		WHERE id = $4
 	`
 
 	var err error
 	if tx != nil {
-		_, err = tx.ExecContext(ctx, query, order.Status, order.Notes, order.ID)
+		_, err = tx.ExecContext(ctx, query, order.Status, order.Notes, order.UpdatedAt, order.ID)
 	} else {
-		_, err = r.db.ExecContext(ctx, query, order.Status, order.Notes, order.ID)
+		_, err = r.db.ExecContext(ctx, query, order.Status, order.Notes, order.UpdatedAt, order.ID)
 	}
 
 	return err
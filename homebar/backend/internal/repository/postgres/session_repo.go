@@ -0,0 +1,80 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/kexincchen/homebar/internal/domain"
+)
+
+// SessionRepository stores the client sessions of the replicated state
+// machine. Like the other replicated tables it is only written while
+// applying log entries, in the transaction that applies the entry.
+type SessionRepository struct {
+	db *sql.DB
+}
+
+// NewSessionRepository creates a new client session repository
+func NewSessionRepository(db *sql.DB) *SessionRepository {
+	return &SessionRepository{db: db}
+}
+
+// Get returns the session of a client as seen by tx, or nil if it has none
+func (r *SessionRepository) Get(ctx context.Context, tx *sql.Tx, clientID string) (*domain.ClientSession, error) {
+	var (
+		session domain.ClientSession
+		result  []byte
+		errText sql.NullString
+	)
+	err := tx.QueryRowContext(ctx, `
+		SELECT client_id, last_seq, result, error, last_active
+		FROM client_sessions
+		WHERE client_id = $1
+	`, clientID).Scan(&session.ClientID, &session.Sequence, &result, &errText, &session.LastActive)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	session.Result = result
+	session.Error = errText.String
+	return &session, nil
+}
+
+// Save records the latest request of a client and its outcome in tx
+func (r *SessionRepository) Save(ctx context.Context, tx *sql.Tx, session *domain.ClientSession) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO client_sessions (client_id, last_seq, result, error, last_active)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (client_id) DO UPDATE
+		SET last_seq = EXCLUDED.last_seq, result = EXCLUDED.result,
+		    error = EXCLUDED.error, last_active = EXCLUDED.last_active
+	`, session.ClientID, session.Sequence, nullJSON(session.Result), nullString(session.Error), session.LastActive)
+	return err
+}
+
+// ExpireBefore deletes in tx the sessions last active before t and returns
+// how many
+func (r *SessionRepository) ExpireBefore(ctx context.Context, tx *sql.Tx, t time.Time) (int64, error) {
+	res, err := tx.ExecContext(ctx, `DELETE FROM client_sessions WHERE last_active < $1`, t)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// nullJSON stores an empty JSON document as NULL
+func nullJSON(data []byte) interface{} {
+	if len(data) == 0 {
+		return nil
+	}
+	return string(data)
+}
+
+// nullString stores an empty string as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -0,0 +1,296 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/kexincchen/homebar/internal/domain"
+	"github.com/lib/pq"
+)
+
+// StateSnapshot is a point-in-time copy of the tables replicated through Raft
+type StateSnapshot struct {
+	Ingredients []*domain.Ingredient `json:"ingredients"`
+	Orders      []*domain.Order      `json:"orders"`
+	OrderItems  []domain.OrderItem   `json:"order_items"`
+
+	ClientSessions []*domain.ClientSession `json:"client_sessions,omitempty"`
+}
+
+// replicatedTables are the tables whose rows are created through Raft commands
+var replicatedTables = []string{"ingredients", "orders", "order_items"}
+
+// SnapshotRepository exports and restores the replicated tables as a whole
+type SnapshotRepository struct {
+	db *sql.DB
+}
+
+// NewSnapshotRepository creates a new snapshot repository
+func NewSnapshotRepository(db *sql.DB) *SnapshotRepository {
+	return &SnapshotRepository{db: db}
+}
+
+// Export reads all replicated tables in a single consistent transaction
+func (r *SnapshotRepository) Export(ctx context.Context) (*StateSnapshot, error) {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	snap := &StateSnapshot{}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, merchant_id, name, quantity, unit, low_stock_threshold, created_at, updated_at
+		FROM ingredients
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var ingredient domain.Ingredient
+		if err := rows.Scan(
+			&ingredient.ID,
+			&ingredient.MerchantID,
+			&ingredient.Name,
+			&ingredient.Quantity,
+			&ingredient.Unit,
+			&ingredient.LowStockThreshold,
+			&ingredient.CreatedAt,
+			&ingredient.UpdatedAt,
+		); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		snap.Ingredients = append(snap.Ingredients, &ingredient)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT id, customer_id, merchant_id, total_amount, status, notes, created_at, updated_at
+		FROM orders
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var o domain.Order
+		if err := rows.Scan(&o.ID, &o.CustomerID, &o.MerchantID, &o.TotalAmount,
+			&o.Status, &o.Notes, &o.CreatedAt, &o.UpdatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		snap.Orders = append(snap.Orders, &o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT id, order_id, product_id, quantity, price
+		FROM order_items
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var it domain.OrderItem
+		if err := rows.Scan(&it.ID, &it.OrderID, &it.ProductID, &it.Quantity, &it.Price); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		snap.OrderItems = append(snap.OrderItems, it)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT client_id, last_seq, result, error, last_active
+		FROM client_sessions
+		ORDER BY client_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var (
+			session domain.ClientSession
+			result  []byte
+			errText sql.NullString
+		)
+		if err := rows.Scan(&session.ClientID, &session.Sequence, &result, &errText, &session.LastActive); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		session.Result = result
+		session.Error = errText.String
+		snap.ClientSessions = append(snap.ClientSessions, &session)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return snap, tx.Commit()
+}
+
+// Restore makes the replicated tables match the snapshot exactly, keeping
+// the original row IDs so later log entries refer to the right rows, and
+// records index as the last applied log entry
+func (r *SnapshotRepository) Restore(ctx context.Context, snap *StateSnapshot, index uint64) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ingredientIDs := make([]int64, len(snap.Ingredients))
+	for i, ingredient := range snap.Ingredients {
+		ingredientIDs[i] = ingredient.ID
+	}
+	orderIDs := make([]int64, len(snap.Orders))
+	for i, o := range snap.Orders {
+		orderIDs[i] = int64(o.ID)
+	}
+
+	// Items are rewritten wholesale; orders and ingredients are upserted so
+	// rows referenced from non-replicated tables survive
+	if _, err := tx.ExecContext(ctx, `DELETE FROM order_items`); err != nil {
+		return fmt.Errorf("failed to clear order items: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM orders WHERE id <> ALL($1)`, pq.Array(orderIDs)); err != nil {
+		return fmt.Errorf("failed to delete orders: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM ingredients WHERE id <> ALL($1)`, pq.Array(ingredientIDs)); err != nil {
+		return fmt.Errorf("failed to delete ingredients: %w", err)
+	}
+
+	for _, ingredient := range snap.Ingredients {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO ingredients (id, merchant_id, name, quantity, unit, low_stock_threshold, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (id) DO UPDATE
+			SET merchant_id = EXCLUDED.merchant_id, name = EXCLUDED.name, quantity = EXCLUDED.quantity,
+			    unit = EXCLUDED.unit, low_stock_threshold = EXCLUDED.low_stock_threshold,
+			    created_at = EXCLUDED.created_at, updated_at = EXCLUDED.updated_at
+		`,
+			ingredient.ID,
+			ingredient.MerchantID,
+			ingredient.Name,
+			ingredient.Quantity,
+			ingredient.Unit,
+			ingredient.LowStockThreshold,
+			ingredient.CreatedAt,
+			ingredient.UpdatedAt,
+		); err != nil {
+			return fmt.Errorf("failed to restore ingredient %d: %w", ingredient.ID, err)
+		}
+	}
+
+	for _, o := range snap.Orders {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO orders (id, customer_id, merchant_id, total_amount, status, notes, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (id) DO UPDATE
+			SET customer_id = EXCLUDED.customer_id, merchant_id = EXCLUDED.merchant_id,
+			    total_amount = EXCLUDED.total_amount, status = EXCLUDED.status, notes = EXCLUDED.notes,
+			    created_at = EXCLUDED.created_at, updated_at = EXCLUDED.updated_at
+		`,
+			o.ID, o.CustomerID, o.MerchantID, o.TotalAmount, o.Status, o.Notes,
+			o.CreatedAt, o.UpdatedAt,
+		); err != nil {
+			return fmt.Errorf("failed to restore order %d: %w", o.ID, err)
+		}
+	}
+
+	for _, it := range snap.OrderItems {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO order_items (id, order_id, product_id, quantity, price)
+			VALUES ($1, $2, $3, $4, $5)
+		`, it.ID, it.OrderID, it.ProductID, it.Quantity, it.Price); err != nil {
+			return fmt.Errorf("failed to restore order item %d: %w", it.ID, err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM client_sessions`); err != nil {
+		return fmt.Errorf("failed to clear client sessions: %w", err)
+	}
+	for _, session := range snap.ClientSessions {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO client_sessions (client_id, last_seq, result, error, last_active)
+			VALUES ($1, $2, $3, $4, $5)
+		`, session.ClientID, session.Sequence, nullJSON(session.Result), nullString(session.Error), session.LastActive); err != nil {
+			return fmt.Errorf("failed to restore session of client %s: %w", session.ClientID, err)
+		}
+	}
+
+	// Keep the serial sequences ahead of the restored IDs
+	for _, table := range replicatedTables {
+		q := fmt.Sprintf(`SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %s`, table, table)
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("failed to reset %s sequence: %w", table, err)
+		}
+	}
+
+	if err := r.SetAppliedIndex(ctx, tx, index); err != nil {
+		return fmt.Errorf("failed to record applied index: %w", err)
+	}
+	return tx.Commit()
+}
+
+// AppliedIndex returns the index of the last log entry applied to the
+// replicated tables, or 0 if none has been
+func (r *SnapshotRepository) AppliedIndex(ctx context.Context) (uint64, error) {
+	var index uint64
+	err := r.db.QueryRowContext(ctx, `SELECT applied_index FROM raft_applied`).Scan(&index)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return index, err
+}
+
+// SetAppliedIndex records in tx that the log entries up to index are
+// applied. Written in the transaction that applies the entry, it can never
+// disagree with the replicated tables.
+func (r *SnapshotRepository) SetAppliedIndex(ctx context.Context, tx *sql.Tx, index uint64) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO raft_applied (id, applied_index)
+		VALUES (TRUE, $1)
+		ON CONFLICT (id) DO UPDATE SET applied_index = EXCLUDED.applied_index
+	`, index)
+	return err
+}
+
+// GetDB returns the underlying database connection
+func (r *SnapshotRepository) GetDB() *sql.DB {
+	return r.db
+}
+
+// MaxID returns the highest row ID of a replicated table, or 0 if it is empty
+func (r *SnapshotRepository) MaxID(ctx context.Context, table string) (int64, error) {
+	known := false
+	for _, t := range replicatedTables {
+		known = known || t == table
+	}
+	if !known {
+		return 0, fmt.Errorf("%s is not a replicated table", table)
+	}
+
+	var id int64
+	q := fmt.Sprintf(`SELECT COALESCE(MAX(id), 0) FROM %s`, table)
+	if err := r.db.QueryRowContext(ctx, q).Scan(&id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
@@ -3,6 +3,7 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"github.com/kexincchen/homebar/internal/repository/postgres"
 
@@ -48,10 +49,12 @@ type ProductRepository interface {
 
 type OrderRepository interface {
 	Create(ctx context.Context, order *domain.Order, items []domain.OrderItem) error
+	Insert(ctx context.Context, tx *sql.Tx, order *domain.Order, items []domain.OrderItem) error
 	GetByID(ctx context.Context, id uint) (*domain.Order, []domain.OrderItem, error)
+	GetForUpdate(ctx context.Context, tx *sql.Tx, id uint) (*domain.Order, error)
 	GetByCustomer(ctx context.Context, customerID uint) ([]*domain.Order, error)
 	GetByMerchant(ctx context.Context, merchantID uint) ([]*domain.Order, error)
-	UpdateStatus(ctx context.Context, tx *sql.Tx, id uint, st domain.OrderStatus) error
+	UpdateStatus(ctx context.Context, tx *sql.Tx, id uint, st domain.OrderStatus, updatedAt time.Time) error
 	Update(ctx context.Context, tx *sql.Tx, order *domain.Order) error
 	GetDB() *sql.DB
 	Delete(ctx context.Context, tx *sql.Tx, id uint) error
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Applying an entry fails in one of two ways. The command itself can be
+// rejected, for instance an order for more than is in stock. Every node
+// rejects it alike, so the entry counts as applied and the rejection is the
+// result of the proposal. Or the database can fail, for instance when the
+// connection drops. Other nodes may well apply the entry, so this node must
+// retry it instead of moving on.
+
+const (
+	applyRetryMin = 100 * time.Millisecond // First wait before applying a failed entry again
+	applyRetryMax = 5 * time.Second        // Longest wait between attempts
+)
+
+// notAppliedError is returned when a log entry could not be applied at all,
+// as opposed to a command the state machine rejected
+type notAppliedError struct {
+	err error
+}
+
+func (e *notAppliedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *notAppliedError) Unwrap() error {
+	return e.err
+}
+
+// notApplied marks err as having kept an entry from being applied
+func notApplied(err error) error {
+	return &notAppliedError{err: err}
+}
+
+// isInfrastructureError reports whether err comes from the database or the
+// connection to it rather than from the command, so that applying the same
+// command again may succeed
+func isInfrastructureError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, sql.ErrTxDone) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Data exceptions and integrity violations follow from the command
+		// and the replicated tables, which are the same on every node.
+		// Anything else, such as a serialization failure, a full disk or a
+		// missing table, is particular to this node.
+		switch pqErr.Code.Class() {
+		case "22", "23":
+			return false
+		}
+		return true
+	}
+	return false
+}
@@ -5,7 +5,9 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"time"
 
+	"github.com/kexincchen/homebar/internal/command"
 	"github.com/kexincchen/homebar/internal/domain"
 	"github.com/kexincchen/homebar/internal/raft"
 	"github.com/kexincchen/homebar/internal/repository/postgres"
@@ -35,6 +37,12 @@ func (s *IngredientService) CreateIngredient(ctx context.Context, ingredient *do
 	return s.ingredientRepo.Create(ctx, ingredient)
 }
 
+// InsertIngredient adds an ingredient whose ID and timestamps are already
+// set as part of tx
+func (s *IngredientService) InsertIngredient(ctx context.Context, tx *sql.Tx, ingredient *domain.Ingredient) error {
+	return s.ingredientRepo.Insert(ctx, tx, ingredient)
+}
+
 func (s *IngredientService) GetIngredientByID(ctx context.Context, id int64) (*domain.Ingredient, error) {
 	fmt.Println("Getting ingredient by ID: ", id)
 	return s.ingredientRepo.GetByID(ctx, id)
@@ -45,12 +53,23 @@ func (s *IngredientService) GetIngredientsByMerchant(ctx context.Context, mercha
 }
 
 func (s *IngredientService) UpdateIngredient(ctx context.Context, ingredient *domain.Ingredient) error {
-	return s.ingredientRepo.Update(ctx, ingredient)
+	return s.ingredientRepo.Update(ctx, nil, ingredient)
+}
+
+// EditIngredient updates an ingredient whose UpdatedAt is already set as
+// part of tx
+func (s *IngredientService) EditIngredient(ctx context.Context, tx *sql.Tx, ingredient *domain.Ingredient) error {
+	return s.ingredientRepo.Update(ctx, tx, ingredient)
 }
 
 func (s *IngredientService) DeleteIngredient(ctx context.Context, id int64) error {
 	fmt.Println("Deleting ingredient: ", id)
-	return s.ingredientRepo.Delete(ctx, id)
+	return s.ingredientRepo.Delete(ctx, nil, id)
+}
+
+// RemoveIngredient deletes an ingredient as part of tx
+func (s *IngredientService) RemoveIngredient(ctx context.Context, tx *sql.Tx, id int64) error {
+	return s.ingredientRepo.Delete(ctx, tx, id)
 }
 
 func (s *IngredientService) GetInventorySummary(ctx context.Context, merchantID int64) (map[string]interface{}, error) {
@@ -61,6 +80,30 @@ func (s *IngredientService) HasSufficientInventoryForOrder(ctx context.Context,
 	return s.ingredientRepo.LockInventoryForOrder(ctx, orderItems)
 }
 
+// RequiredForItems returns the ingredients the order items take out of stock
+func (s *IngredientService) RequiredForItems(ctx context.Context, items []domain.OrderItem) ([]domain.IngredientAmount, error) {
+	ptrs := make([]*domain.OrderItem, len(items))
+	for i := range items {
+		ptrs[i] = &items[i]
+	}
+	return s.ingredientRepo.RequiredForItems(ctx, ptrs)
+}
+
+// ReservedForOrder returns the ingredients an existing order took out of stock
+func (s *IngredientService) ReservedForOrder(ctx context.Context, orderID uint) ([]domain.IngredientAmount, error) {
+	return s.ingredientRepo.ReservedForOrder(ctx, orderID)
+}
+
+// TakeStock subtracts the amounts within tx, or returns false if there is not enough
+func (s *IngredientService) TakeStock(ctx context.Context, tx *sql.Tx, amounts []domain.IngredientAmount, at time.Time) (bool, error) {
+	return s.ingredientRepo.TakeStock(ctx, tx, amounts, at)
+}
+
+// ReturnStock adds the amounts back within tx
+func (s *IngredientService) ReturnStock(ctx context.Context, tx *sql.Tx, amounts []domain.IngredientAmount, at time.Time) error {
+	return s.ingredientRepo.ReturnStock(ctx, tx, amounts, at)
+}
+
 // CheckProductAvailability determines if a product is available based on its ingredients
 func (s *IngredientService) CheckProductAvailability(ctx context.Context, productID uint) (bool, error) {
 	// Get all ingredients required for this product
@@ -113,23 +156,23 @@ func (s *IngredientService) HasSufficientInventoryForOrderWithRaft(
 		return hasInventory, err
 	}
 
-	// Convert orderItemsData to []raft.OrderItemCommand
-	orderItemsData := make([]raft.OrderItemCommand, len(orderItems))
+	// Convert orderItemsData to []command.OrderItem
+	orderItemsData := make([]command.OrderItem, len(orderItems))
 	for i, item := range orderItems {
-		orderItemsData[i] = raft.OrderItemCommand{
+		orderItemsData[i] = command.OrderItem{
 			ProductID: uint(item.ProductID),
 			Quantity:  int(item.Quantity),
 			Price:     float64(item.Price),
 		}
 	}
 
-	cmd := raft.OrderCommand{
-		Type:       "reserve_inventory",
-		OrderItems: orderItemsData,
+	env, err := command.Encode(&command.ReserveInventory{Items: orderItemsData})
+	if err != nil {
+		return false, err
 	}
 
 	// Submit to Raft to achieve consensus
-	_, err = raftNode.Submit(cmd)
+	_, err = raftNode.Submit(env)
 	if err != nil {
 		return false, fmt.Errorf("failed to achieve consensus on inventory reservation: %w", err)
 	}
@@ -141,11 +184,11 @@ func (s *IngredientService) HasSufficientInventoryForOrderWithRaft(
 // ReserveInventoryCommand processes a command to reserve inventory
 func (s *IngredientService) ReserveInventoryCommand(
 	ctx context.Context,
-	cmd raft.OrderCommand,
+	cmd *command.ReserveInventory,
 ) error {
 	// Convert order items from the command
 	var orderItems []*domain.OrderItem
-	itemsData, err := json.Marshal(cmd.OrderItems)
+	itemsData, err := json.Marshal(cmd.Items)
 	if err != nil {
 		return fmt.Errorf("failed to marshal order items: %w", err)
 	}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"database/sql"
 	"time"
 
 	"errors"
@@ -35,25 +36,9 @@ func (s *OrderService) CreateOrder(
 	notes string,
 ) (*domain.Order, error) {
 
-	var (
-		total  float64
-		models []domain.OrderItem
-	)
-	for _, it := range items {
-		price := it.Price
-		if price == 0 {
-			p, err := s.productRepo.GetByID(ctx, it.ProductID)
-			if err != nil {
-				return nil, err
-			}
-			price = p.Price
-		}
-		total += price * float64(it.Quantity)
-		models = append(models, domain.OrderItem{
-			ProductID: it.ProductID,
-			Quantity:  it.Quantity,
-			Price:     price,
-		})
+	models, total, err := s.ResolveItems(ctx, items)
+	if err != nil {
+		return nil, err
 	}
 
 	now := time.Now()
@@ -92,6 +77,66 @@ func (s *OrderService) CreateOrder(
 	return order, nil
 }
 
+// ResolveItems fills in the catalogue price of items that do not carry one
+// and returns the order items with the order total
+func (s *OrderService) ResolveItems(ctx context.Context, items []SimpleItem) ([]domain.OrderItem, float64, error) {
+	var (
+		total  float64
+		models []domain.OrderItem
+	)
+	for _, it := range items {
+		price := it.Price
+		if price == 0 {
+			p, err := s.productRepo.GetByID(ctx, it.ProductID)
+			if err != nil {
+				return nil, 0, err
+			}
+			price = p.Price
+		}
+		total += price * float64(it.Quantity)
+		models = append(models, domain.OrderItem{
+			ProductID: it.ProductID,
+			Quantity:  it.Quantity,
+			Price:     price,
+		})
+	}
+	return models, total, nil
+}
+
+// PlaceOrder stores an order whose IDs, prices and timestamps are already set
+// and takes its ingredients out of stock, all as part of tx
+func (s *OrderService) PlaceOrder(
+	ctx context.Context,
+	tx *sql.Tx,
+	order *domain.Order,
+	items []domain.OrderItem,
+	ingredients []domain.IngredientAmount,
+) error {
+	hasInventory, err := s.ingredientService.TakeStock(ctx, tx, ingredients, order.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if !hasInventory {
+		return errors.New("insufficient ingredients inventory for this order")
+	}
+
+	return s.orderRepo.Insert(ctx, tx, order, items)
+}
+
+// inTx runs fn in a new transaction, which is committed if fn succeeds
+func (s *OrderService) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.orderRepo.GetDB().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (s *OrderService) GetByID(ctx context.Context, id uint) (*domain.Order, []domain.OrderItem, error) {
 	return s.orderRepo.GetByID(ctx, id)
 }
@@ -105,8 +150,30 @@ func (s *OrderService) ListByMerchant(ctx context.Context, mid uint) ([]*domain.
 }
 
 func (s *OrderService) UpdateStatus(ctx context.Context, id uint, status domain.OrderStatus) error {
+	var restock []domain.IngredientAmount
+	if status == domain.OrderStatusCancelled {
+		var err error
+		if restock, err = s.ingredientService.ReservedForOrder(ctx, id); err != nil {
+			return err
+		}
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return s.SetStatus(ctx, tx, id, status, restock, time.Now())
+	})
+}
+
+// SetStatus moves an order to a new status at the given time as part of tx.
+// Cancelling a pending order returns restock to the inventory.
+func (s *OrderService) SetStatus(
+	ctx context.Context,
+	tx *sql.Tx,
+	id uint,
+	status domain.OrderStatus,
+	restock []domain.IngredientAmount,
+	at time.Time,
+) error {
 	// First get the current order status
-	order, _, err := s.orderRepo.GetByID(ctx, id)
+	order, err := s.orderRepo.GetForUpdate(ctx, tx, id)
 	if err != nil {
 		return err
 	}
@@ -116,15 +183,8 @@ func (s *OrderService) UpdateStatus(ctx context.Context, id uint, status domain.
 		return errors.New("invalid status transition")
 	}
 
-	// Start transaction
-	tx, err := s.orderRepo.GetDB().BeginTx(ctx, nil)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-
 	// Update the order status
-	err = s.orderRepo.UpdateStatus(ctx, tx, id, status)
+	err = s.orderRepo.UpdateStatus(ctx, tx, id, status, at)
 	if err != nil {
 		return err
 	}
@@ -132,14 +192,13 @@ func (s *OrderService) UpdateStatus(ctx context.Context, id uint, status domain.
 	// Handle inventory based on status change - ONLY for status changes to cancelled
 	if status == domain.OrderStatusCancelled && order.Status == domain.OrderStatusPending {
 		// For cancelled orders, restore the inventory
-		err = s.ingredientService.CancelOrderInventory(ctx, id)
+		err = s.ingredientService.ReturnStock(ctx, tx, restock, at)
 		if err != nil {
 			return err
 		}
 	}
 
-	// Commit the transaction
-	return tx.Commit()
+	return nil
 }
 
 // isValidStatusTransition checks if a status transition is valid
@@ -158,18 +217,19 @@ func isValidStatusTransition(current, new domain.OrderStatus) bool {
 
 // UpdateOrder updates an order's details
 func (s *OrderService) UpdateOrder(ctx context.Context, id uint, status string, notes string) error {
-	// Get the existing order
-	order, _, err := s.orderRepo.GetByID(ctx, id)
-	if err != nil {
-		return err
-	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return s.EditOrder(ctx, tx, id, status, notes, time.Now())
+	})
+}
 
-	// Start transaction
-	tx, err := s.orderRepo.GetDB().BeginTx(ctx, nil)
+// EditOrder updates an order's details as part of tx, recording the given
+// update time
+func (s *OrderService) EditOrder(ctx context.Context, tx *sql.Tx, id uint, status string, notes string, at time.Time) error {
+	// Get the existing order
+	order, err := s.orderRepo.GetForUpdate(ctx, tx, id)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
 
 	// Track if we need to update the order
 	needsUpdate := false
@@ -203,8 +263,9 @@ func (s *OrderService) UpdateOrder(ctx context.Context, id uint, status string,
 
 	// Update the order in the database
 	if statusChanged {
-		err = s.orderRepo.UpdateStatus(ctx, tx, id, newStatus)
+		err = s.orderRepo.UpdateStatus(ctx, tx, id, newStatus, at)
 	} else if notesChanged {
+		order.UpdatedAt = at
 		err = s.orderRepo.Update(ctx, tx, order)
 	}
 
@@ -215,8 +276,7 @@ func (s *OrderService) UpdateOrder(ctx context.Context, id uint, status string,
 	// Handle inventory ONLY in UpdateStatus method
 	// Remove inventory handling from here to avoid duplication
 
-	// Commit the transaction
-	return tx.Commit()
+	return nil
 }
 
 func (s *OrderService) CheckProductsAvailability(ctx context.Context, productIDs []uint) (map[uint]bool, error) {
@@ -225,32 +285,31 @@ func (s *OrderService) CheckProductsAvailability(ctx context.Context, productIDs
 
 // DeleteOrder deletes an order by ID
 func (s *OrderService) DeleteOrder(ctx context.Context, id uint) error {
+	restock, err := s.ingredientService.ReservedForOrder(ctx, id)
+	if err != nil {
+		return err
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return s.RemoveOrder(ctx, tx, id, restock, time.Now())
+	})
+}
+
+// RemoveOrder deletes an order as part of tx. A pending order is cancelled
+// first, so restock is returned to the inventory.
+func (s *OrderService) RemoveOrder(ctx context.Context, tx *sql.Tx, id uint, restock []domain.IngredientAmount, at time.Time) error {
 	// First get the order to check its status
-	order, _, err := s.orderRepo.GetByID(ctx, id)
+	order, err := s.orderRepo.GetForUpdate(ctx, tx, id)
 	if err != nil {
 		return err
 	}
 
 	// Only completed or cancelled orders can be deleted directly
 	if order.Status == domain.OrderStatusPending {
-		// Cancel the order
-		err = s.UpdateStatus(ctx, id, domain.OrderStatusCancelled)
-		if err != nil {
+		if err := s.ingredientService.ReturnStock(ctx, tx, restock, at); err != nil {
 			return err
 		}
 	}
 
-	// Start transaction
-	tx, err := s.orderRepo.GetDB().BeginTx(ctx, nil)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-
 	// Delete the order
-	if err := s.orderRepo.Delete(ctx, tx, id); err != nil {
-		return err
-	}
-
-	return tx.Commit()
+	return s.orderRepo.Delete(ctx, tx, id)
 }
@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,27 +13,48 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"github.com/kexincchen/homebar/internal/command"
 	"github.com/kexincchen/homebar/internal/domain"
 	"github.com/kexincchen/homebar/internal/raft"
+	"github.com/kexincchen/homebar/internal/repository/postgres"
 )
 
 // RaftService wraps OrderService to provide distributed consensus
 type RaftService struct {
-	orderService        *OrderService
-	ingredientService   *IngredientService
-	raftNode            *raft.RaftNode
-	applyCh             chan raft.LogEntry
-	nodeID              string
-	isLeader            bool
-	orderResultMap      map[uint64]*domain.Order
-	ingredientResultMap map[uint64]*domain.Ingredient
-	resultMapLock       sync.Mutex
+	orderService      *OrderService
+	ingredientService *IngredientService
+	snapshotRepo      *postgres.SnapshotRepository
+	sessionRepo       *postgres.SessionRepository
+	raftNode          *raft.RaftNode
+	applyCh           chan raft.LogEntry
+	nodeID            string
+	isLeader          bool
+
+	// applyMu serializes applying entries with snapshotting and restoring
+	applyMu      sync.Mutex
+	appliedIndex uint64
+
+	// Reads wait for the applied index to reach their read index
+	applied         appliedWaiter
+	readConsistency ReadConsistency // Used when the context does not ask for one
+
+	// Next row ID to hand out per replicated table while this node leads
+	idMu   sync.Mutex
+	nextID map[string]int64
+}
+
+// raftSnapshot is the state machine snapshot handed to the Raft node
+type raftSnapshot struct {
+	AppliedIndex uint64                  `json:"applied_index"`
+	State        *postgres.StateSnapshot `json:"state"`
 }
 
 // NewRaftService creates a new Raft-enabled order service
 func NewRaftService(
 	orderService *OrderService,
 	ingredientService *IngredientService,
+	snapshotRepo *postgres.SnapshotRepository,
+	sessionRepo *postgres.SessionRepository,
 	nodeID string,
 	peerIDs []string,
 	peerAddrs map[string]string,
@@ -49,28 +71,37 @@ func NewRaftService(
 	applyCh := make(chan raft.LogEntry, raft.MaxLogEntriesBuffer)
 
 	service := &RaftService{
-		orderService:        orderService,
-		ingredientService:   ingredientService,
-		applyCh:             applyCh,
-		nodeID:              nodeID,
-		isLeader:            false,
-		orderResultMap:      make(map[uint64]*domain.Order),
-		ingredientResultMap: make(map[uint64]*domain.Ingredient),
+		orderService:      orderService,
+		ingredientService: ingredientService,
+		snapshotRepo:      snapshotRepo,
+		sessionRepo:       sessionRepo,
+		applyCh:           applyCh,
+		nodeID:            nodeID,
+		isLeader:          false,
+		readConsistency:   ReadLinearizable,
+		nextID:            make(map[string]int64),
+	}
+
+	if v := os.Getenv("RAFT_READ_CONSISTENCY"); v != "" {
+		if c, err := ParseReadConsistency(v); err == nil {
+			service.readConsistency = c
+		} else {
+			raftLogger.Warn().Str("value", v).Msg("Ignoring invalid RAFT_READ_CONSISTENCY")
+		}
 	}
 
-	// Create the Raft node
+	// Create the Raft node. Entries are applied from applyCh, each in a
+	// transaction of its own.
 	raftNode := raft.NewRaftNode(
 		nodeID,
 		peerIDs,
 		peerAddrs,
 		applyCh,
-		func(cmd interface{}) error {
-			_, _, err := service.applyCommand(cmd)
-			return err
-		},
+		nil,
 	)
 
 	service.raftNode = raftNode
+	raftNode.SetStateMachine(service)
 
 	// Start processing applied commands
 	go service.processAppliedCommands()
@@ -80,8 +111,16 @@ func NewRaftService(
 
 // Start initializes and starts the Raft node
 func (s *RaftService) Start(ctx context.Context) error {
-	// Start the cleanup goroutine
-	go s.cleanupResults()
+	// Reads and the apply lag start from the entries the database already
+	// holds rather than from nothing
+	index, err := s.snapshotRepo.AppliedIndex(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read applied index: %w", err)
+	}
+	s.applyMu.Lock()
+	s.appliedIndex = index
+	s.applied.set(index)
+	s.applyMu.Unlock()
 
 	// Start the Raft node
 	return s.raftNode.Start(ctx)
@@ -94,203 +133,162 @@ func (s *RaftService) CreateOrder(
 	items []SimpleItem,
 	notes string,
 ) (*domain.Order, error) {
+	// Resolve prices and stock here so every node applies the same order
+	models, total, err := s.orderService.ResolveItems(ctx, items)
+	if err != nil {
+		return nil, err
+	}
+	ingredients, err := s.ingredientService.RequiredForItems(ctx, models)
+	if err != nil {
+		return nil, err
+	}
+
+	orderID, err := s.nextIDs(ctx, "orders", 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate order ID: %w", err)
+	}
+	itemID, err := s.nextIDs(ctx, "order_items", len(models))
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate order item IDs: %w", err)
+	}
+
 	// Prepare the order command
-	// Convert the map slice to the expected type
-	raftItems := make([]raft.OrderItemCommand, len(items))
-	for i, item := range items {
-		raftItems[i] = raft.OrderItemCommand{
+	orderItems := make([]command.OrderItem, len(models))
+	for i, item := range models {
+		orderItems[i] = command.OrderItem{
+			ID:        uint(itemID) + uint(i),
 			ProductID: item.ProductID,
 			Quantity:  item.Quantity,
 			Price:     item.Price,
 		}
 	}
 
-	cmd := raft.OrderCommand{
-		Type:       "create_order",
-		CustomerID: customerID,
-		MerchantID: merchantID,
-		OrderItems: raftItems,
-		AdditionalData: map[string]interface{}{
-			"notes": notes,
-		},
+	cmd := &command.CreateOrder{
+		OrderID:     uint(orderID),
+		CustomerID:  customerID,
+		MerchantID:  merchantID,
+		Items:       orderItems,
+		TotalAmount: total,
+		Notes:       notes,
+		Ingredients: ingredients,
+		CreatedAt:   time.Now().UTC(),
 	}
-	// Submit the command to Raft
-	index, err := s.raftNode.Submit(cmd)
+	// Submit the command to Raft and wait until it has been applied
+	result, err := s.propose(ctx, cmd)
 	if err != nil {
-		return nil, fmt.Errorf("failed to submit order to Raft: %w", err)
+		return nil, fmt.Errorf("failed to create order: %w", err)
 	}
 
-	// Wait for the command to be applied
-	timeout := time.After(5 * time.Second)
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
+	log.Info().
+		Uint("customer_id", customerID).
+		Uint("merchant_id", merchantID).
+		Int("item_count", len(items)).
+		Msg("Order created successfully")
 
-	for {
-		select {
-		case <-ticker.C:
-			// Log performance metrics
-			log.Info().
-				Uint("customer_id", customerID).
-				Uint("merchant_id", merchantID).
-				Int("item_count", len(items)).
-				Msg("Order created successfully")
-
-			// Check if the command has been applied
-			s.updateLastApplied(index)
-			s.resultMapLock.Lock()
-			order, exists := s.orderResultMap[index]
-			if exists {
-				// Delete the result from the cache to avoid memory leaks
-				delete(s.orderResultMap, index)
-				s.resultMapLock.Unlock()
-				return order, nil
-			}
-			s.resultMapLock.Unlock()
-
-		case <-timeout:
-			return nil, errors.New("timeout waiting for order creation")
-
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		}
+	order, ok := result.(*domain.Order)
+	if !ok {
+		return nil, errors.New("order creation returned no order")
 	}
+	return order, nil
 }
 
-// applyCommand applies a Raft command to the state machine
-func (s *RaftService) applyCommand(cmdInterface interface{}) (*domain.Order, *domain.Ingredient, error) {
-	var createdOrder *domain.Order = nil
-	var createdIngredient *domain.Ingredient = nil
-
-	// Convert the interface to an OrderCommand
-	cmdBytes, err := json.Marshal(cmdInterface)
+// propose wraps a command in its envelope, proposes it to Raft and waits
+// until this node has applied it, returning the result of applying it
+func (s *RaftService) propose(ctx context.Context, cmd command.Command) (interface{}, error) {
+	env, err := command.Encode(cmd)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to marshal command: %w", err)
+		return nil, err
 	}
-
-	var cmd raft.OrderCommand
-	if err := json.Unmarshal(cmdBytes, &cmd); err != nil {
-		return nil, nil, fmt.Errorf("failed to unmarshal command: %w", err)
+	env.Session = clientSessionFrom(ctx, time.Now().UTC())
+	future, err := s.raftNode.Propose(env)
+	if err != nil {
+		return nil, err
 	}
 
-	if s.nodeID != s.raftNode.LeaderID() {
-		log.Printf("[Follower-%s] skip %s (already done by leader %s)",
-			s.nodeID, cmd.Type, s.raftNode.LeaderID())
-		return nil, nil, nil
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	result, err := future.Wait(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("timeout waiting for index %d to be applied: %w", future.Index(), err)
 	}
+	return result, err
+}
 
-	ctx := context.Background()
+// applyCommand applies a Raft command to the state machine as part of tx
+func (s *RaftService) applyCommand(ctx context.Context, tx *sql.Tx, cmdInterface interface{}) (*domain.Order, *domain.Ingredient, error) {
+	var createdOrder *domain.Order = nil
+	var createdIngredient *domain.Ingredient = nil
 
-	switch cmd.Type {
-	case "create_order":
-		// Convert from OrderItemCommand to SimpleItem directly
-		items := make([]SimpleItem, len(cmd.OrderItems))
-		for i, item := range cmd.OrderItems {
-			items[i] = SimpleItem{
-				ProductID: item.ProductID,
-				Quantity:  item.Quantity,
-				Price:     item.Price,
-			}
-		}
+	decoded, err := command.Decode(cmdInterface)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		notes := ""
-		if notesVal, ok := cmd.AdditionalData["notes"]; ok {
-			if notesStr, ok := notesVal.(string); ok {
-				notes = notesStr
-			}
-		}
+	// Every node applies every command to its own database
+	if err := s.completeLegacy(ctx, decoded); err != nil {
+		return nil, nil, fmt.Errorf("failed to complete %s command: %w", decoded.CommandType(), err)
+	}
 
-		// Call the underlying service to create the order
-		order, err := s.orderService.CreateOrder(ctx, cmd.CustomerID, cmd.MerchantID, items, notes)
-		if err != nil {
+	switch cmd := decoded.(type) {
+	case *command.CreateOrder:
+		order, items := cmd.Order()
+		if err := s.orderService.PlaceOrder(ctx, tx, order, items, cmd.Ingredients); err != nil {
 			return nil, nil, fmt.Errorf("failed to create order: %w", err)
 		}
 
-		// Store the order ID in the command for reference
-		cmd.OrderID = order.ID
 		createdOrder = order
 
-	case "update_order_status":
-		// Get the status from additional data
-		statusStr, ok := cmd.AdditionalData["status"].(string)
-		if !ok {
-			return nil, nil, fmt.Errorf("invalid status in update_order_status command")
-		}
-
-		// Convert string to OrderStatus
-		status := domain.OrderStatus(statusStr)
-
-		// Call the underlying service to update the order status
-		if err := s.orderService.UpdateStatus(ctx, cmd.OrderID, status); err != nil {
+	case *command.UpdateOrderStatus:
+		if err := s.orderService.SetStatus(ctx, tx, cmd.OrderID, cmd.Status, cmd.Restock, cmd.UpdatedAt); err != nil {
 			return nil, nil, fmt.Errorf("failed to update order status: %w", err)
 		}
 
 		// For status updates, we don't need to return the order
 		return nil, nil, nil
 
-	case "update_order":
-		// Handle the update_order command too
-		statusStr, _ := cmd.AdditionalData["status"].(string)
-		notesStr, _ := cmd.AdditionalData["notes"].(string)
-
-		if err := s.orderService.UpdateOrder(ctx, cmd.OrderID, statusStr, notesStr); err != nil {
+	case *command.UpdateOrder:
+		if err := s.orderService.EditOrder(ctx, tx, cmd.OrderID, cmd.Status, cmd.Notes, cmd.UpdatedAt); err != nil {
 			return nil, nil, fmt.Errorf("failed to update order: %w", err)
 		}
 
 		return nil, nil, nil
 
-	case "create_ingredient":
-		// Extract ingredient data from command
-		var ingredient domain.Ingredient
-		ingredientData, err := json.Marshal(cmd.AdditionalData)
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to marshal ingredient data: %w", err)
+	case *command.DeleteOrder:
+		if err := s.orderService.RemoveOrder(ctx, tx, cmd.OrderID, cmd.Restock, cmd.DeletedAt); err != nil {
+			return nil, nil, fmt.Errorf("failed to delete order: %w", err)
 		}
 
-		if err := json.Unmarshal(ingredientData, &ingredient); err != nil {
-			return nil, nil, fmt.Errorf("failed to unmarshal ingredient data: %w", err)
-		}
+		return nil, nil, nil
 
-		// Call the underlying service to create the ingredient
-		result, err := s.ingredientService.CreateIngredient(ctx, &ingredient)
-		if err != nil {
+	case *command.CreateIngredient:
+		ingredient := cmd.Ingredient(cmd.ID)
+		ingredient.CreatedAt = cmd.CreatedAt
+		ingredient.UpdatedAt = cmd.CreatedAt
+		if err := s.ingredientService.InsertIngredient(ctx, tx, ingredient); err != nil {
 			return nil, nil, fmt.Errorf("failed to create ingredient: %w", err)
 		}
 
-		createdIngredient = result
+		createdIngredient = ingredient
 
-	case "update_ingredient":
-		// Extract ingredient data from command
-		var ingredient domain.Ingredient
-		ingredientData, err := json.Marshal(cmd.AdditionalData)
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to marshal ingredient data: %w", err)
-		}
-
-		if err := json.Unmarshal(ingredientData, &ingredient); err != nil {
-			return nil, nil, fmt.Errorf("failed to unmarshal ingredient data: %w", err)
-		}
-
-		// Call the underlying service to update the ingredient
-		if err := s.ingredientService.UpdateIngredient(ctx, &ingredient); err != nil {
+	case *command.UpdateIngredient:
+		ingredient := cmd.Ingredient(cmd.ID)
+		ingredient.UpdatedAt = cmd.UpdatedAt
+		if err := s.ingredientService.EditIngredient(ctx, tx, ingredient); err != nil {
 			return nil, nil, fmt.Errorf("failed to update ingredient: %w", err)
 		}
 
-	case "delete_ingredient":
-		// Get the ingredient ID
-		idFloat, ok := cmd.AdditionalData["id"].(float64)
-		if !ok {
-			return nil, nil, fmt.Errorf("invalid ingredient ID in delete_ingredient command")
-		}
-
-		id := int64(idFloat)
-
+	case *command.DeleteIngredient:
 		// Call the underlying service to delete the ingredient
-		if err := s.ingredientService.DeleteIngredient(ctx, id); err != nil {
+		if err := s.ingredientService.RemoveIngredient(ctx, tx, cmd.ID); err != nil {
 			return nil, nil, fmt.Errorf("failed to delete ingredient: %w", err)
 		}
 
+	case *command.ReserveInventory:
+		// Orders take their stock when they are created; a reservation
+		// on its own applies as nothing
+
 	default:
-		return nil, nil, fmt.Errorf("unknown command type: %s", cmd.Type)
+		return nil, nil, fmt.Errorf("unsupported command type: %s", decoded.CommandType())
 	}
 
 	return createdOrder, createdIngredient, nil
@@ -302,156 +300,225 @@ func (s *RaftService) processAppliedCommands() {
 		// Log that we received a command for auditing
 		log.Printf("Applied command at index %d, term %d", entry.Index, entry.Term)
 
-		// Apply the command directly and store the result
-		order, ingredient, err := s.applyCommand(entry.Command)
+		s.applyCommitted(entry)
+	}
+}
+
+// applyCommitted applies an entry, retrying for as long as the database
+// fails, and reports the outcome to the Raft node. The applied index only
+// moves past an entry once the database holds it, so this node never skips
+// an entry the other nodes apply.
+func (s *RaftService) applyCommitted(entry raft.LogEntry) {
+	backoff := applyRetryMin
+	for {
+		s.applyMu.Lock()
+		if entry.Index <= s.appliedIndex {
+			// Already covered by a restored snapshot
+			s.applyMu.Unlock()
+			return
+		}
+
+		result, err := s.applyLogEntry(entry)
+		var failed *notAppliedError
+		if errors.As(err, &failed) {
+			s.applyMu.Unlock()
+			log.Error().Err(err).Uint64("index", entry.Index).Dur("retry_in", backoff).
+				Msg("Failed to apply entry, retrying")
+			time.Sleep(backoff)
+			backoff = min(2*backoff, applyRetryMax)
+			continue
+		}
+		s.appliedIndex = entry.Index
+		s.applied.set(entry.Index)
+		s.applyMu.Unlock()
+
 		if err != nil {
 			log.Printf("Error applying command: %v", err)
-			continue
 		}
 
-		s.resultMapLock.Lock()
+		// Hand the created row to the caller waiting on the proposal, and let
+		// the node compact its log once enough entries are applied
+		s.raftNode.NotifyAppliedResult(entry.Index, result, err)
+		return
+	}
+}
 
-		// If it's an order creation command and the order was created successfully
-		if order != nil {
-			s.orderResultMap[entry.Index] = order
-		}
+// applyLogEntry applies a log entry and records its index in the same
+// transaction, so the database tells exactly which entries it holds and a
+// restarted node resumes right after them. It returns a notAppliedError if
+// the entry could not be applied and must be tried again; any other error
+// is the command's own, and the entry is applied all the same.
+func (s *RaftService) applyLogEntry(entry raft.LogEntry) (interface{}, error) {
+	ctx := context.Background()
+	tx, err := s.snapshotRepo.GetDB().BeginTx(ctx, nil)
+	if err != nil {
+		return nil, notApplied(fmt.Errorf("failed to begin transaction: %w", err))
+	}
+	defer tx.Rollback()
 
-		// If it's an ingredient creation command and was successful
-		if ingredient != nil {
-			s.ingredientResultMap[entry.Index] = ingredient
+	// No-op and membership entries are handled by the Raft node itself
+	var (
+		result   interface{}
+		applyErr error
+	)
+	if entry.Type == raft.EntryNormal {
+		result, applyErr = s.applyEntry(ctx, tx, entry.Command)
+		var failed *notAppliedError
+		if errors.As(applyErr, &failed) {
+			return nil, applyErr
 		}
+	}
 
-		s.resultMapLock.Unlock()
+	if err := s.snapshotRepo.SetAppliedIndex(ctx, tx, entry.Index); err != nil {
+		return nil, notApplied(fmt.Errorf("failed to record applied index: %w", err))
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, notApplied(fmt.Errorf("failed to commit entry %d: %w", entry.Index, err))
 	}
+	return result, applyErr
 }
 
-func (s *RaftService) UpdateOrder(ctx context.Context, id uint, status string, notes string) error {
-	// For status changes that affect inventory, use Raft
-	if status == string(domain.OrderStatusCancelled) {
-		cmd := raft.OrderCommand{
-			Type:    "update_order",
-			OrderID: id,
-			AdditionalData: map[string]interface{}{
-				"status": status,
-				"notes":  notes,
-			},
-		}
+// AppliedIndex returns the index of the last entry applied to the database
+func (s *RaftService) AppliedIndex() (uint64, error) {
+	return s.snapshotRepo.AppliedIndex(context.Background())
+}
 
-		_, err := s.raftNode.Submit(cmd)
-		return err
+// Snapshot serializes the replicated tables for log compaction
+func (s *RaftService) Snapshot() ([]byte, error) {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+
+	state, err := s.snapshotRepo.Export(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to export state: %w", err)
 	}
 
-	return s.orderService.UpdateOrder(ctx, id, status, notes)
+	return json.Marshal(raftSnapshot{
+		AppliedIndex: s.appliedIndex,
+		State:        state,
+	})
 }
 
-func (s *RaftService) UpdateStatus(ctx context.Context, id uint, st domain.OrderStatus) error {
-	// For status changes that affect inventory (like cancellations), use Raft
-	// Otherwise, go directly to the underlying service
-	if st == domain.OrderStatusCancelled || st == domain.OrderStatusCompleted {
-		cmd := raft.OrderCommand{
-			Type:    "update_order_status",
-			OrderID: id,
-			AdditionalData: map[string]interface{}{
-				"status": string(st),
-			},
-		}
+// RestoreSnapshot replaces the replicated tables with a snapshot received
+// from the leader or read back from storage
+func (s *RaftService) RestoreSnapshot(index uint64, data []byte) error {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+
+	// The node only asks for a restore when the database is behind the
+	// snapshot or, after raftctl imported one, must be rebuilt from it
+	var snap raftSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("failed to unmarshal snapshot: %w", err)
+	}
 
-		_, err := s.raftNode.Submit(cmd)
-		return err
+	if snap.State == nil {
+		return errors.New("snapshot holds no state")
+	}
+	if err := s.snapshotRepo.Restore(context.Background(), snap.State, index); err != nil {
+		return fmt.Errorf("failed to restore state: %w", err)
 	}
 
-	return s.orderService.UpdateStatus(ctx, id, st)
+	s.appliedIndex = index
+	s.applied.set(index)
+	return nil
 }
 
-// DeleteOrder deletes an order with Raft consensus
-func (s *RaftService) DeleteOrder(ctx context.Context, id uint) error {
-	// Get the order first to check its status
+func (s *RaftService) UpdateOrder(ctx context.Context, id uint, status string, notes string) error {
+	cmd := &command.UpdateOrder{
+		OrderID:   id,
+		Status:    status,
+		Notes:     notes,
+		UpdatedAt: time.Now().UTC(),
+	}
+
+	_, err := s.propose(ctx, cmd)
+	return err
+}
+
+func (s *RaftService) UpdateStatus(ctx context.Context, id uint, st domain.OrderStatus) error {
+	// Reject invalid transitions before they reach the log
 	order, _, err := s.orderService.GetByID(ctx, id)
 	if err != nil {
 		return err
 	}
+	if !isValidStatusTransition(order.Status, st) {
+		return errors.New("invalid status transition")
+	}
 
-	// If order is pending, we need to cancel it first (which will use Raft)
-	if order.Status == domain.OrderStatusPending {
+	cmd := &command.UpdateOrderStatus{
+		OrderID:   id,
+		Status:    st,
+		UpdatedAt: time.Now().UTC(),
+	}
 
-		if err := s.UpdateStatus(ctx, id, domain.OrderStatusCancelled); err != nil {
-			return fmt.Errorf("failed to cancel order before deletion: %w", err)
+	// Cancelling returns the order's ingredients to stock
+	if st == domain.OrderStatusCancelled {
+		if cmd.Restock, err = s.ingredientService.ReservedForOrder(ctx, id); err != nil {
+			return err
 		}
+	}
 
+	_, err = s.propose(ctx, cmd)
+	return err
+}
+
+// DeleteOrder deletes an order with Raft consensus
+func (s *RaftService) DeleteOrder(ctx context.Context, id uint) error {
+	// A pending order is cancelled as part of the deletion, returning its
+	// ingredients to stock
+	restock, err := s.ingredientService.ReservedForOrder(ctx, id)
+	if err != nil {
+		return err
 	}
 
-	// No need to delete order with Raft, just use the underlying service
-	return s.orderService.DeleteOrder(ctx, id)
+	cmd := &command.DeleteOrder{
+		OrderID:   id,
+		Restock:   restock,
+		DeletedAt: time.Now().UTC(),
+	}
 
+	if _, err := s.propose(ctx, cmd); err != nil {
+		return fmt.Errorf("failed to delete order: %w", err)
+	}
+	return nil
 }
 
 // CreateIngredient creates a new ingredient with Raft consensus
 func (s *RaftService) CreateIngredient(ctx context.Context, ingredient *domain.Ingredient) (*domain.Ingredient, error) {
-	// Convert ingredient to a map for the command
-	ingredientData, err := json.Marshal(ingredient)
+	id, err := s.nextIDs(ctx, "ingredients", 1)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal ingredient: %w", err)
-	}
-
-	var ingredientMap map[string]interface{}
-	if err := json.Unmarshal(ingredientData, &ingredientMap); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal ingredient: %w", err)
+		return nil, fmt.Errorf("failed to allocate ingredient ID: %w", err)
 	}
 
 	// Prepare the ingredient command
-	cmd := raft.OrderCommand{
-		Type:           "create_ingredient",
-		AdditionalData: ingredientMap,
+	cmd := &command.CreateIngredient{
+		ID:               id,
+		IngredientFields: command.NewIngredientFields(ingredient),
+		CreatedAt:        time.Now().UTC(),
 	}
 
-	// Submit the command to Raft
-	index, err := s.raftNode.Submit(cmd)
+	// Submit the command to Raft and wait until it has been applied
+	result, err := s.propose(ctx, cmd)
 	if err != nil {
-		return nil, fmt.Errorf("failed to submit ingredient creation to Raft: %w", err)
+		return nil, fmt.Errorf("failed to create ingredient: %w", err)
 	}
-
-	// Wait for the command to be applied
-	timeout := time.After(5 * time.Second)
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			s.updateLastApplied(index)
-			s.resultMapLock.Lock()
-			result, exists := s.ingredientResultMap[index]
-			if exists {
-				delete(s.ingredientResultMap, index)
-				s.resultMapLock.Unlock()
-				return result, nil
-			}
-			s.resultMapLock.Unlock()
-		case <-timeout:
-			return nil, errors.New("timeout waiting for ingredient creation")
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		}
+	created, ok := result.(*domain.Ingredient)
+	if !ok {
+		return nil, errors.New("ingredient creation returned no ingredient")
 	}
+	return created, nil
 }
 
 // DeleteIngredient deletes an ingredient with Raft consensus
 func (s *RaftService) DeleteIngredient(ctx context.Context, id int64) error {
 	// Prepare the ingredient command
-	cmd := raft.OrderCommand{
-		Type: "delete_ingredient",
-		AdditionalData: map[string]interface{}{
-			"id": id,
-		},
-	}
+	cmd := &command.DeleteIngredient{ID: id}
 
-	// Submit the command to Raft
-	_, err := s.raftNode.Submit(cmd)
-	if err != nil {
-		return fmt.Errorf("failed to submit ingredient deletion to Raft: %w", err)
+	// Submit the command to Raft and wait until it has been applied
+	if _, err := s.propose(ctx, cmd); err != nil {
+		return fmt.Errorf("failed to delete ingredient: %w", err)
 	}
-
-	// For deletions, we don't need to wait for a result
 	return nil
 }
 
@@ -460,94 +527,114 @@ func (s *RaftService) GetRaftNode() *raft.RaftNode {
 	return s.raftNode
 }
 
-func (s *RaftService) updateLastApplied(index uint64) {
-	s.raftNode.UpdateLastApplied(index)
-}
-
-// CleanupResults cleans up the result map
-func (s *RaftService) cleanupResults() {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		s.resultMapLock.Lock()
-		// Clean up based on time or maximum number
-		// Here we simplify the cleanup, in actual use, it should be more refined
-		if len(s.orderResultMap) > 1000 {
-			s.orderResultMap = make(map[uint64]*domain.Order)
-		}
-		if len(s.ingredientResultMap) > 1000 {
-			s.ingredientResultMap = make(map[uint64]*domain.Ingredient)
-		}
-		s.resultMapLock.Unlock()
-	}
-}
-
 // UpdateIngredient updates an ingredient with Raft consensus
 func (s *RaftService) UpdateIngredient(ctx context.Context, ingredient *domain.Ingredient) error {
-	// Convert ingredient to a map for the command
-	ingredientData, err := json.Marshal(ingredient)
-	if err != nil {
-		return fmt.Errorf("failed to marshal ingredient: %w", err)
+	// Prepare the ingredient command
+	cmd := &command.UpdateIngredient{
+		ID:               ingredient.ID,
+		IngredientFields: command.NewIngredientFields(ingredient),
+		UpdatedAt:        time.Now().UTC(),
 	}
 
-	var ingredientMap map[string]interface{}
-	if err := json.Unmarshal(ingredientData, &ingredientMap); err != nil {
-		return fmt.Errorf("failed to unmarshal ingredient: %w", err)
+	// Submit the command to Raft and wait until it has been applied
+	if _, err := s.propose(ctx, cmd); err != nil {
+		return fmt.Errorf("failed to update ingredient: %w", err)
 	}
+	return nil
+}
 
-	// Prepare the ingredient command
-	cmd := raft.OrderCommand{
-		Type:           "update_ingredient",
-		AdditionalData: ingredientMap,
+// readBarrier blocks until the local database reflects every write committed
+// before the read, as far as the consistency requested in ctx demands
+func (s *RaftService) readBarrier(ctx context.Context) error {
+	consistency := readConsistencyFrom(ctx, s.readConsistency)
+	if consistency == ReadStale {
+		return nil
 	}
+	return s.waitForReadIndex(ctx, consistency == ReadLease)
+}
 
-	// Submit the command to Raft
-	_, err = s.raftNode.Submit(cmd)
+// waitForReadIndex obtains a read index from the leader, using its lease if
+// allowed, and waits until the local state machine has applied it
+func (s *RaftService) waitForReadIndex(ctx context.Context, lease bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var (
+		index uint64
+		err   error
+	)
+	if lease {
+		index, err = s.raftNode.LeaseReadIndex(ctx)
+	} else {
+		index, err = s.raftNode.ReadIndex(ctx)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to submit ingredient update to Raft: %w", err)
+		return fmt.Errorf("failed to confirm read index: %w", err)
 	}
 
-	// For updates, we don't need to wait for a result
+	if err := s.applied.wait(ctx, index); err != nil {
+		return fmt.Errorf("timeout waiting for index %d to be applied: %w", index, err)
+	}
 	return nil
 }
 
 func (s *RaftService) GetByID(ctx context.Context, id uint) (*domain.Order, []domain.OrderItem, error) {
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, nil, err
+	}
 	return s.orderService.GetByID(ctx, id)
 }
 
 func (s *RaftService) ListByCustomer(ctx context.Context, cid uint) ([]*domain.Order, error) {
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
 	return s.orderService.ListByCustomer(ctx, cid)
 }
 
 func (s *RaftService) ListByMerchant(ctx context.Context, mid uint) ([]*domain.Order, error) {
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
 	return s.orderService.ListByMerchant(ctx, mid)
 }
 
 func (s *RaftService) CheckProductsAvailability(ctx context.Context, productIDs []uint) (map[uint]bool, error) {
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
 	return s.orderService.CheckProductsAvailability(ctx, productIDs)
 }
 
 // CheckProductAvailability checks if a product is available
 func (s *RaftService) CheckProductAvailability(ctx context.Context, productID uint) (bool, error) {
+	if err := s.readBarrier(ctx); err != nil {
+		return false, err
+	}
 	return s.ingredientService.CheckProductAvailability(ctx, productID)
 }
 
 // GetIngredientByID retrieves an ingredient by its ID
 func (s *RaftService) GetIngredientByID(ctx context.Context, id int64) (*domain.Ingredient, error) {
-	// This is a read operation, so we can delegate directly
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
 	return s.ingredientService.GetIngredientByID(ctx, id)
 }
 
 // GetIngredientsByMerchant retrieves all ingredients for a merchant
 func (s *RaftService) GetIngredientsByMerchant(ctx context.Context, merchantID int64) ([]*domain.Ingredient, error) {
-	// This is a read operation, so we can delegate directly
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
 	return s.ingredientService.GetIngredientsByMerchant(ctx, merchantID)
 }
 
 // GetInventorySummary retrieves inventory summary for a merchant
 func (s *RaftService) GetInventorySummary(ctx context.Context, merchantID int64) (map[string]interface{}, error) {
-	// This is a read operation, so we can delegate directly
+	if err := s.readBarrier(ctx); err != nil {
+		return nil, err
+	}
 	return s.ingredientService.GetInventorySummary(ctx, merchantID)
 }
 
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ReadConsistency selects how fresh the data returned by a RaftService read must be
+type ReadConsistency string
+
+const (
+	// ReadLinearizable confirms leadership with a heartbeat round (ReadIndex)
+	// and waits for the local state machine to catch up before reading
+	ReadLinearizable ReadConsistency = "linearizable"
+	// ReadLease skips the heartbeat round while the leader holds a lease
+	ReadLease ReadConsistency = "lease"
+	// ReadStale reads the local database without any check
+	ReadStale ReadConsistency = "stale"
+)
+
+// ParseReadConsistency converts a consistency name into a ReadConsistency
+func ParseReadConsistency(s string) (ReadConsistency, error) {
+	switch c := ReadConsistency(s); c {
+	case ReadLinearizable, ReadLease, ReadStale:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown read consistency %q", s)
+	}
+}
+
+type readConsistencyKey struct{}
+
+// WithReadConsistency returns a context asking RaftService reads for the given consistency
+func WithReadConsistency(ctx context.Context, c ReadConsistency) context.Context {
+	return context.WithValue(ctx, readConsistencyKey{}, c)
+}
+
+// readConsistencyFrom returns the consistency requested in ctx, or def if none
+func readConsistencyFrom(ctx context.Context, def ReadConsistency) ReadConsistency {
+	if c, ok := ctx.Value(readConsistencyKey{}).(ReadConsistency); ok {
+		return c
+	}
+	return def
+}
+
+// appliedWaiter lets reads wait until the state machine has applied an index
+type appliedWaiter struct {
+	mu      sync.Mutex
+	index   uint64
+	advance chan struct{} // Closed and replaced whenever index moves forward
+}
+
+// set records that every entry up to index has been applied
+func (w *appliedWaiter) set(index uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if index <= w.index {
+		return
+	}
+	w.index = index
+	if w.advance != nil {
+		close(w.advance)
+		w.advance = nil
+	}
+}
+
+// current returns the index applied so far
+func (w *appliedWaiter) current() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.index
+}
+
+// wait blocks until index has been applied or ctx ends
+func (w *appliedWaiter) wait(ctx context.Context, index uint64) error {
+	for {
+		w.mu.Lock()
+		if w.index >= index {
+			w.mu.Unlock()
+			return nil
+		}
+		if w.advance == nil {
+			w.advance = make(chan struct{})
+		}
+		advance := w.advance
+		w.mu.Unlock()
+
+		select {
+		case <-advance:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ApplyLag returns how many entries the leader has committed that this node
+// has not applied yet. It reports false when the node is out of touch with
+// the leader and cannot tell.
+func (s *RaftService) ApplyLag() (uint64, bool) {
+	commit, ok := s.raftNode.LeaderCommit()
+	if !ok {
+		return 0, false
+	}
+	if applied := s.applied.current(); applied < commit {
+		return commit - applied, true
+	}
+	return 0, true
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kexincchen/homebar/internal/command"
+	"github.com/kexincchen/homebar/internal/domain"
+)
+
+// Every node applies the log to its own database, so applying a command must
+// not depend on anything but the command and the replicated tables. The
+// leader resolves the other inputs before proposing: it allocates row IDs,
+// takes the time, looks up catalogue prices and works out from the recipes
+// how much stock an order takes or returns.
+
+// nextIDs reserves n consecutive row IDs of a replicated table for a command
+// this node is about to propose, and returns the first
+func (s *RaftService) nextIDs(ctx context.Context, table string, n int) (int64, error) {
+	// Once the local state machine has caught up with a read index it has
+	// applied every entry of earlier terms, so the only IDs that may be in
+	// flight are the ones this node handed out itself
+	if err := s.waitForReadIndex(ctx, true); err != nil {
+		return 0, err
+	}
+
+	maxID, err := s.snapshotRepo.MaxID(ctx, table)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read highest %s ID: %w", table, err)
+	}
+
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+
+	first := maxID + 1
+	if next := s.nextID[table]; next > first {
+		first = next
+	}
+	s.nextID[table] = first + int64(n)
+	return first, nil
+}
+
+// completeLegacy fills in the inputs that commands written before version 2
+// do not carry. IDs come from the replicated tables and are deterministic;
+// prices and recipes come from the local catalogue, so those entries only
+// apply identically on nodes whose catalogues match. Timestamps stay zero.
+func (s *RaftService) completeLegacy(ctx context.Context, decoded command.Command) error {
+	switch cmd := decoded.(type) {
+	case *command.CreateOrder:
+		if cmd.OrderID != 0 {
+			return nil
+		}
+		items := make([]SimpleItem, len(cmd.Items))
+		for i, item := range cmd.Items {
+			items[i] = SimpleItem{ProductID: item.ProductID, Quantity: item.Quantity, Price: item.Price}
+		}
+		models, total, err := s.orderService.ResolveItems(ctx, items)
+		if err != nil {
+			return err
+		}
+		if cmd.Ingredients, err = s.ingredientService.RequiredForItems(ctx, models); err != nil {
+			return err
+		}
+
+		orderID, err := s.snapshotRepo.MaxID(ctx, "orders")
+		if err != nil {
+			return err
+		}
+		itemID, err := s.snapshotRepo.MaxID(ctx, "order_items")
+		if err != nil {
+			return err
+		}
+		cmd.OrderID = uint(orderID + 1)
+		cmd.TotalAmount = total
+		for i := range cmd.Items {
+			cmd.Items[i].ID = uint(itemID) + uint(i) + 1
+			cmd.Items[i].Price = models[i].Price
+		}
+
+	case *command.UpdateOrderStatus:
+		if cmd.Status != domain.OrderStatusCancelled || cmd.Restock != nil {
+			return nil
+		}
+		restock, err := s.ingredientService.ReservedForOrder(ctx, cmd.OrderID)
+		if err != nil {
+			return err
+		}
+		cmd.Restock = restock
+
+	case *command.CreateIngredient:
+		if cmd.ID != 0 {
+			return nil
+		}
+		maxID, err := s.snapshotRepo.MaxID(ctx, "ingredients")
+		if err != nil {
+			return err
+		}
+		cmd.ID = maxID + 1
+	}
+	return nil
+}
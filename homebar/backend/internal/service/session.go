@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/kexincchen/homebar/internal/command"
+	"github.com/kexincchen/homebar/internal/domain"
+)
+
+// Client sessions make writes exactly-once (Raft thesis, section 6.3). A
+// client numbers its requests and sends the same number when it retries one.
+// The state machine remembers the latest sequence number applied for every
+// client together with its result, so a retry that reaches the log a second
+// time returns the recorded result instead of being applied again.
+
+// ClientSessionTTL is how long a session is kept after the client's last
+// request. A retry arriving later is applied as a new request.
+const ClientSessionTTL = 24 * time.Hour
+
+// ErrStaleSequence is returned for a request older than the client's latest
+// applied one, whose result is no longer kept
+var ErrStaleSequence = errors.New("request was superseded by a later request of the same client")
+
+type clientSessionKey struct{}
+
+type clientSession struct {
+	clientID string
+	sequence uint64
+}
+
+// WithClientSession returns a context whose RaftService writes are applied at
+// most once for the given client and sequence number
+func WithClientSession(ctx context.Context, clientID string, sequence uint64) context.Context {
+	return context.WithValue(ctx, clientSessionKey{}, clientSession{clientID: clientID, sequence: sequence})
+}
+
+// clientSessionFrom returns the session of the request in ctx, or nil if it has none
+func clientSessionFrom(ctx context.Context, at time.Time) *command.Session {
+	cs, ok := ctx.Value(clientSessionKey{}).(clientSession)
+	if !ok {
+		return nil
+	}
+	return &command.Session{ClientID: cs.clientID, Sequence: cs.sequence, At: at}
+}
+
+// applyEntry applies the command of a log entry as part of tx, once per
+// client request when it carries a session, and returns the row it created
+// if any. The session is checked and updated in tx as well, so a crash can
+// never leave the command applied without the session recording it.
+func (s *RaftService) applyEntry(ctx context.Context, tx *sql.Tx, cmd interface{}) (interface{}, error) {
+	session := command.SessionOf(cmd)
+	if session == nil {
+		return s.applyResult(ctx, tx, cmd)
+	}
+
+	if _, err := s.sessionRepo.ExpireBefore(ctx, tx, session.At.Add(-ClientSessionTTL)); err != nil {
+		return nil, notApplied(fmt.Errorf("failed to expire client sessions: %w", err))
+	}
+
+	prev, err := s.sessionRepo.Get(ctx, tx, session.ClientID)
+	if err != nil {
+		return nil, notApplied(fmt.Errorf("failed to load session of client %s: %w", session.ClientID, err))
+	}
+	if prev != nil && session.Sequence <= prev.Sequence {
+		if session.Sequence < prev.Sequence {
+			return nil, ErrStaleSequence
+		}
+		log.Info().Str("client_id", session.ClientID).Uint64("seq", session.Sequence).
+			Msg("Skipping duplicate request, returning recorded result")
+		return sessionResult(command.TypeOf(cmd), prev)
+	}
+
+	result, applyErr := s.applyResult(ctx, tx, cmd)
+	var failed *notAppliedError
+	if errors.As(applyErr, &failed) {
+		return nil, applyErr
+	}
+
+	record := &domain.ClientSession{
+		ClientID:   session.ClientID,
+		Sequence:   session.Sequence,
+		LastActive: session.At,
+	}
+	if applyErr != nil {
+		record.Error = applyErr.Error()
+	} else if result != nil {
+		if record.Result, err = json.Marshal(result); err != nil {
+			return nil, notApplied(fmt.Errorf("failed to marshal result: %w", err))
+		}
+	}
+	if err := s.sessionRepo.Save(ctx, tx, record); err != nil {
+		return nil, notApplied(fmt.Errorf("failed to record session of client %s: %w", session.ClientID, err))
+	}
+	return result, applyErr
+}
+
+// applyResult applies a command and returns the row it created, if any. A
+// command that the state machine rejects is rolled back without aborting
+// tx, so that the entry is still recorded as applied.
+func (s *RaftService) applyResult(ctx context.Context, tx *sql.Tx, cmd interface{}) (interface{}, error) {
+	if _, err := tx.ExecContext(ctx, `SAVEPOINT apply_command`); err != nil {
+		return nil, notApplied(fmt.Errorf("failed to create savepoint: %w", err))
+	}
+	order, ingredient, err := s.applyCommand(ctx, tx, cmd)
+	if err != nil {
+		if isInfrastructureError(err) {
+			return nil, notApplied(err)
+		}
+		if _, rollbackErr := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT apply_command`); rollbackErr != nil {
+			return nil, notApplied(fmt.Errorf("failed to roll back command: %w", rollbackErr))
+		}
+		return nil, err
+	}
+
+	switch {
+	case order != nil:
+		return order, nil
+	case ingredient != nil:
+		return ingredient, nil
+	}
+	return nil, nil
+}
+
+// sessionResult rebuilds the outcome recorded for a client's request
+func sessionResult(typ string, session *domain.ClientSession) (interface{}, error) {
+	if session.Error != "" {
+		return nil, errors.New(session.Error)
+	}
+	if len(session.Result) == 0 {
+		return nil, nil
+	}
+
+	var result interface{}
+	switch typ {
+	case command.TypeCreateOrder:
+		result = &domain.Order{}
+	case command.TypeCreateIngredient:
+		result = &domain.Ingredient{}
+	default:
+		return nil, nil
+	}
+	if err := json.Unmarshal(session.Result, result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal recorded result: %w", err)
+	}
+	return result, nil
+}